@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/complyue/different-hpc/pkg/agent"
+	"github.com/complyue/hbi/pkg/errors"
+	"github.com/golang/glog"
+)
+
+const (
+	requestTimeout  = 10 * time.Second
+	hostKeyAttempts = 15
+)
+
+var (
+	ccAddr   string
+	macAddr  string
+	interval time.Duration
+
+	hostKeyFile string
+	hostKeyOnly bool
+
+	client = &http.Client{Timeout: requestTimeout}
+)
+
+func post(ccURL *url.URL, path string, payload interface{}) (*agent.Reply, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Post(ccURL.String()+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("%s from [%s]", resp.Status, path)
+	}
+	var reply agent.Reply
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return nil, err
+	}
+	if len(reply.Err) > 0 {
+		return nil, errors.New(reply.Err)
+	}
+	return &reply, nil
+}
+
+// fetch the host key of this node with the token from its boot cmdline, and
+// install it to keyFile. retried only on failures to reach the control
+// center, as a rejected request has consumed the token.
+func fetchHostKey(ccURL *url.URL, mac, keyFile string) error {
+	token := agent.CmdlineArg(agent.HostKeyTokenArg)
+	if len(token) <= 0 {
+		return errors.Errorf("no %s in boot cmdline", agent.HostKeyTokenArg)
+	}
+	if "https" != ccURL.Scheme {
+		glog.Warningf("Fetching host key over plain [%s], it can be sniffed on the network.", ccURL.Scheme)
+	}
+	body, err := json.Marshal(map[string]string{"Token": token})
+	if err != nil {
+		return err
+	}
+	var resp *http.Response
+	for attempt := 1; ; attempt++ {
+		resp, err = client.Post(ccURL.String()+"/hostkey/v1/"+mac, "application/json", bytes.NewReader(body))
+		if err == nil || attempt >= hostKeyAttempts {
+			break
+		}
+		glog.Warningf("Error reaching [%s] for host key, retrying: %v", ccURL, err)
+		time.Sleep(2 * time.Second)
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("%s fetching host key", resp.Status)
+	}
+	var hk agent.HostKey
+	if err := json.NewDecoder(resp.Body).Decode(&hk); err != nil {
+		return err
+	}
+	if len(hk.Err) > 0 {
+		return errors.New(hk.Err)
+	}
+	if err := agent.InstallHostKey(keyFile, &hk); err != nil {
+		return err
+	}
+	glog.Infof("Installed host key [%s].", keyFile)
+	return nil
+}
+
+// register with the control center on start, then heartbeat to it, forever
+func main() {
+	var err error
+	defer func() {
+		if e := recover(); e != nil {
+			err = errors.RichError(e)
+		}
+		if err != nil {
+			glog.Error(errors.RichError(err))
+		}
+	}()
+
+	flag.Parse()
+
+	ccURL, err := url.Parse(strings.TrimSuffix(ccAddr, "/"))
+	if err != nil {
+		return
+	}
+	mac := macAddr
+	if len(mac) <= 0 {
+		hostPort := ccURL.Host
+		if len(ccURL.Port()) <= 0 {
+			if "https" == ccURL.Scheme {
+				hostPort = net.JoinHostPort(ccURL.Hostname(), "443")
+			} else {
+				hostPort = net.JoinHostPort(ccURL.Hostname(), "80")
+			}
+		}
+		if mac, err = agent.MacRoutingTo(hostPort); err != nil {
+			err = errors.Wrapf(err, "can not determine mac, specify with -mac")
+			return
+		}
+	}
+
+	if len(hostKeyFile) > 0 {
+		if err := fetchHostKey(ccURL, mac, hostKeyFile); err != nil {
+			glog.Errorf("Error fetching host key: %+v", err)
+		}
+	}
+	if hostKeyOnly {
+		return
+	}
+
+	glog.Infof("Agent of mac=[%s] reporting to [%s] ...", mac, ccURL)
+
+	hbInterval := agent.DefaultInterval
+	if interval > 0 {
+		hbInterval = interval
+	}
+	adoptInterval := func(reply *agent.Reply) {
+		if interval <= 0 && reply.Interval > 0 && reply.Interval != hbInterval {
+			glog.Infof("Heartbeat interval changed to %v.", reply.Interval)
+			hbInterval = reply.Interval
+		}
+	}
+
+	registered := false
+	for ; ; time.Sleep(hbInterval) {
+		if !registered {
+			reply, err := post(ccURL, "/agent/v1/register", agent.CollectInventory(mac))
+			if err != nil {
+				glog.Errorf("Error registering with [%s]: %+v", ccURL, err)
+				continue
+			}
+			glog.Infof("Registered with [%s].", ccURL)
+			registered = true
+			adoptInterval(reply)
+		}
+
+		reply, err := post(ccURL, "/agent/v1/heartbeat", agent.CollectHeartbeat(mac))
+		if err != nil {
+			glog.Errorf("Error sending heartbeat to [%s]: %+v", ccURL, err)
+			continue
+		}
+		if reply.Reregister {
+			glog.Warningf("Control center asks to register again.")
+			registered = false
+		}
+		adoptInterval(reply)
+	}
+}
+
+func init() {
+	// change glog default destination to stderr
+	if glog.V(0) { // should always be true, mention glog so it defines its flags before we change them
+		if err := flag.CommandLine.Set("logtostderr", "true"); nil != err {
+			log.Printf("Failed changing glog default desitination, err: %s", err)
+		}
+	}
+	flag.StringVar(&ccAddr, "cc", "http://192.168.11.10:6767", "Base url of the control center.")
+	flag.StringVar(&macAddr, "mac", "", "MAC to report as, defaults to that of the interface routing to the control center.")
+	flag.StringVar(&agent.ProcDir, "proc", agent.ProcDir, "Where procfs is mounted.")
+	flag.StringVar(&agent.SysDir, "sys", agent.SysDir, "Where sysfs is mounted.")
+	flag.DurationVar(&interval, "interval", 0, "Heartbeat interval, defaults to what the control center tells.")
+	flag.StringVar(&hostKeyFile, "hostkey", "", "Fetch the host key of this node on start and install it here, e.g. /etc/ssh/ssh_host_ed25519_key.")
+	flag.BoolVar(&hostKeyOnly, "hostkeyOnly", false, "Exit after fetching the host key, to run before sshd starts.")
+}
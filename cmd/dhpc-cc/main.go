@@ -2,18 +2,22 @@ package main
 
 import (
 	"flag"
-	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"time"
 
+	"github.com/complyue/different-hpc/pkg/audit"
+	"github.com/complyue/different-hpc/pkg/auth"
 	"github.com/complyue/different-hpc/pkg/bknd"
+	"github.com/complyue/different-hpc/pkg/ccm"
+	"github.com/complyue/different-hpc/pkg/cloudinit"
+	"github.com/complyue/different-hpc/pkg/power"
+	"github.com/complyue/different-hpc/pkg/remote"
 	"github.com/complyue/hbi/pkg/errors"
 	"github.com/golang/glog"
 	"github.com/gorilla/mux"
-	yaml "gopkg.in/yaml.v2"
 )
 
 func main() {
@@ -29,19 +33,51 @@ func main() {
 
 	flag.Parse()
 
-	type WebCfg struct {
-		HTTP, HTTPS string
-	}
-	var webCfg WebCfg
-	webRawYaml, err := ioutil.ReadFile("etc/web.yaml")
-	if err != nil {
+	if err = bknd.LoadWebCfg(); err != nil {
 		cwd, _ := os.Getwd()
-		panic(errors.Wrapf(err, "Can NOT read etc/web.yaml`, [%s] may not be the right directory ?\n", cwd))
+		panic(errors.Wrapf(err, "Can NOT load etc/web.yaml`, [%s] may not be the right directory ?\n", cwd))
 	}
-	err = yaml.Unmarshal(webRawYaml, &webCfg)
+	webCfg := bknd.GetWebCfg()
+
+	st, err := ccm.OpenStore(storeSpec)
 	if err != nil {
 		return
 	}
+	defer st.Close()
+	ccm.UseStore(st)
+	glog.Infof("Using store [%s] for compute node configs and states.", st.Spec())
+
+	authCfg := auth.GetAuthCfg()
+	if !authCfg.Enabled {
+		glog.Warningf("Authentication disabled by [%s], web ui and api open to anyone reaching them.", auth.AuthCfgFile)
+	}
+
+	// a broken audit log is reported, but doesn't stop serving
+	if v, err := audit.Verify(); err != nil {
+		glog.Errorf("Error verifying audit log [%s]: %+v", audit.GetAuditCfg().File, err)
+	} else if !v.OK {
+		glog.Errorf("Audit log [%s] broken at line %d: %s", audit.GetAuditCfg().File, v.BrokenLine, v.Problem)
+	} else {
+		glog.Infof("Audit log [%s] verified, %d entries.", audit.GetAuditCfg().File, v.Entries)
+	}
+
+	ccm.RegisterCfgReloader("etc/web.yaml", bknd.LoadWebCfg)
+	ccm.RegisterCfgReloader(auth.AuthCfgFile, auth.ReloadAuthCfg)
+	ccm.RegisterCfgReloader(authCfg.UsersFile, auth.ReloadUsers)
+	ccm.RegisterCfgReloader(power.PowerCfgFile, power.ReloadPowerCfg)
+	ccm.RegisterCfgReloader(power.BMCSecretsFile, power.ReloadBMCSecrets)
+	ccm.RegisterCfgReloader(remote.RemoteCfgFile, remote.ReloadRemoteCfg)
+	ccm.RegisterCfgReloader(cloudinit.CloudInitCfgFile, cloudinit.ReloadCloudInitCfg)
+	ccm.RegisterCfgReloader(audit.AuditCfgFile, audit.ReloadAuditCfg)
+	if err = ccm.WatchCfgFiles(); err != nil {
+		return
+	}
+	// start loading compute node configs in background, serving meanwhile,
+	// then checking aliveness of the nodes
+	go func() {
+		ccm.PreloadComputeNodeCfgs()
+		ccm.StartPulse()
+	}()
 
 	router := mux.NewRouter()
 
@@ -54,7 +90,7 @@ func main() {
 	bknd.DefinePageRoutes(router)
 
 	srv := &http.Server{
-		Handler:      router,
+		Handler:      bknd.Authenticate(router),
 		Addr:         webCfg.HTTP,
 		WriteTimeout: 30 * time.Second,
 		ReadTimeout:  30 * time.Second,
@@ -90,6 +126,8 @@ func (ln tcpKeepAliveListener) Accept() (net.Conn, error) {
 	return tc, nil
 }
 
+var storeSpec string
+
 func init() {
 	// change glog default destination to stderr
 	if glog.V(0) { // should always be true, mention glog so it defines its flags before we change them
@@ -98,4 +136,6 @@ func init() {
 		}
 	}
 	flag.BoolVar(&bknd.DevMode, "dev", false, "Run in development mode.")
+	flag.StringVar(&storeSpec, "store", "yaml:etc/cnodes",
+		"Store of compute node configs and states, yaml:<cfg dir>[,<state dir>[,sharded]] or bolt:<db file>")
 }
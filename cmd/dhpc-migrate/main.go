@@ -0,0 +1,123 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/complyue/different-hpc/pkg/ccm"
+	"github.com/complyue/hbi/pkg/errors"
+	"github.com/golang/glog"
+)
+
+// copy compute node configs and states from one store to another
+func main() {
+	var err error
+	defer func() {
+		if e := recover(); e != nil {
+			err = errors.RichError(e)
+		}
+		if err != nil {
+			glog.Error(errors.RichError(err))
+		}
+	}()
+
+	var fromSpec, toSpec string
+	flag.StringVar(&fromSpec, "from", "yaml:etc/cnodes", "Store to migrate from.")
+	flag.StringVar(&toSpec, "to", "bolt:var/dhpc.db", "Store to migrate to.")
+	flag.Parse()
+
+	from, err := ccm.OpenStore(fromSpec)
+	if err != nil {
+		return
+	}
+	defer from.Close()
+	to, err := ccm.OpenStore(toSpec)
+	if err != nil {
+		return
+	}
+	defer to.Close()
+
+	cfgs, err := from.LoadCfgs()
+	if err != nil {
+		return
+	}
+	for _, cfg := range cfgs {
+		if _, err = to.SaveCfg(cfg.Mac, []byte(cfg.RawYaml)); err != nil {
+			err = errors.Wrapf(err, "failed migrating config of mac=[%s]", cfg.Mac)
+			return
+		}
+	}
+	glog.Infof("%d compute node configs migrated.", len(cfgs))
+
+	acs, err := from.ListArchived()
+	if err != nil {
+		return
+	}
+	for _, ac := range acs {
+		var full *ccm.ArchivedCfg
+		if full, err = from.LoadArchived(ac.ID); err != nil {
+			return
+		}
+		if full == nil {
+			continue // purged meanwhile
+		}
+		if err = to.PutArchived(*full); err != nil {
+			err = errors.Wrapf(err, "failed migrating archived config [%s]", ac.ID)
+			return
+		}
+	}
+	glog.Infof("%d archived configs migrated.", len(acs))
+
+	states, err := from.LoadAliveness()
+	if err != nil {
+		return
+	}
+	if err = to.SaveAliveness(states); err != nil {
+		return
+	}
+	glog.Infof("%d aliveness states migrated.", len(states))
+
+	evts, err := from.ListHistory("", 0)
+	if err != nil {
+		return
+	}
+	for _, evt := range evts {
+		if err = to.AppendHistory(evt); err != nil {
+			return
+		}
+	}
+	glog.Infof("%d history events migrated.", len(evts))
+
+	invs, err := from.LoadInventories()
+	if err != nil {
+		return
+	}
+	for _, inv := range invs {
+		if err = to.SaveInventory(inv); err != nil {
+			return
+		}
+	}
+	glog.Infof("%d node inventories migrated.", len(invs))
+
+	snaps, err := from.LoadBootSnapshots()
+	if err != nil {
+		return
+	}
+	for _, snap := range snaps {
+		if err = to.SaveBootSnapshot(snap); err != nil {
+			return
+		}
+	}
+	glog.Infof("%d boot snapshots migrated.", len(snaps))
+
+	glog.Infof("Migrated from [%s] to [%s].", from.Spec(), to.Spec())
+}
+
+func init() {
+	// change glog default destination to stderr
+	if glog.V(0) { // should always be true, mention glog so it defines its flags before we change them
+		if err := flag.CommandLine.Set("logtostderr", "true"); nil != err {
+			log.Printf("Failed changing glog default desitination, err: %s", err)
+		}
+	}
+}
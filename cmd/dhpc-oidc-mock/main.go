@@ -0,0 +1,275 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"html/template"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const keyID = "mock"
+
+// a minimal openid connect provider, logging in whoever asks as whatever
+// user and groups they fill in, for testing sso without a real provider
+func main() {
+	var addr, clientID, clientSecret, user, groups string
+	flag.StringVar(&addr, "http", "localhost:5556", "Address to serve plain http on, the issuer is http://<addr>.")
+	flag.StringVar(&clientID, "client", "dhpc-cc", "Client id of the relying party.")
+	flag.StringVar(&clientSecret, "secret", "secret", "Client secret of the relying party.")
+	flag.StringVar(&user, "user", "alice", "User name prefilled on the login form.")
+	flag.StringVar(&groups, "groups", "hpc-admins", "Comma separated groups prefilled on the login form.")
+	flag.Parse()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	op := &mockProvider{
+		issuer: "http://" + addr, clientID: clientID, clientSecret: clientSecret,
+		user: user, groups: groups, key: key,
+		codes: make(map[string]*authCode),
+	}
+
+	http.HandleFunc("/.well-known/openid-configuration", op.discovery)
+	http.HandleFunc("/keys", op.keys)
+	http.HandleFunc("/auth", op.auth)
+	http.HandleFunc("/token", op.token)
+
+	glog.Infof("Mock oidc provider serving on %s", op.issuer)
+	if err := http.ListenAndServe(addr, nil); err != nil {
+		glog.Fatal(err)
+	}
+}
+
+type authCode struct {
+	user        string
+	groups      []string
+	nonce       string
+	redirectURI string
+	challenge   string
+	expires     time.Time
+}
+
+type mockProvider struct {
+	issuer, clientID, clientSecret string
+	user, groups                   string
+	key                            *rsa.PrivateKey
+
+	mutex sync.Mutex
+	codes map[string]*authCode
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func (op *mockProvider) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                op.issuer,
+		"authorization_endpoint":                op.issuer + "/auth",
+		"token_endpoint":                        op.issuer + "/token",
+		"jwks_uri":                              op.issuer + "/keys",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"scopes_supported":                      []string{"openid", "profile", "email", "groups"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (op *mockProvider) keys(w http.ResponseWriter, r *http.Request) {
+	pub := op.key.PublicKey
+	writeJson(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA", "use": "sig", "alg": "RS256", "kid": keyID,
+			"n": b64(pub.N.Bytes()),
+			"e": b64(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+var loginForm = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html><body>
+<h3>Mock OIDC Provider</h3>
+<form method="post">
+  {{range $k, $v := .Params}}<input type="hidden" name="{{$k}}" value="{{index $v 0}}" />
+  {{end}}
+  <label>User <input name="user" value="{{.User}}" /></label>
+  <label>Groups <input name="groups" value="{{.Groups}}" /></label>
+  <button type="submit">Log in</button>
+</form>
+</body></html>
+`))
+
+// a login form on GET, an authorization code issued on POST of it
+func (op *mockProvider) auth(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.Form.Get("client_id") != op.clientID {
+		http.Error(w, "unknown client_id", http.StatusBadRequest)
+		return
+	}
+	redirectURI, err := url.Parse(r.Form.Get("redirect_uri"))
+	if err != nil || !redirectURI.IsAbs() {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	if "code" != r.Form.Get("response_type") {
+		http.Error(w, "only response_type=code supported", http.StatusBadRequest)
+		return
+	}
+
+	if "POST" != r.Method {
+		params := url.Values{}
+		for _, k := range []string{"client_id", "redirect_uri", "response_type", "scope",
+			"state", "nonce", "code_challenge", "code_challenge_method"} {
+			if v := r.Form.Get(k); len(v) > 0 {
+				params.Set(k, v)
+			}
+		}
+		loginForm.Execute(w, map[string]interface{}{
+			"Params": params, "User": op.user, "Groups": op.groups,
+		})
+		return
+	}
+
+	if m := r.Form.Get("code_challenge_method"); len(m) > 0 && "S256" != m {
+		http.Error(w, "only S256 code challenge supported", http.StatusBadRequest)
+		return
+	}
+	var groups []string
+	for _, g := range strings.Split(r.Form.Get("groups"), ",") {
+		if g = strings.TrimSpace(g); len(g) > 0 {
+			groups = append(groups, g)
+		}
+	}
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	code := hex.EncodeToString(buf)
+
+	op.mutex.Lock()
+	op.codes[code] = &authCode{
+		user: r.Form.Get("user"), groups: groups, nonce: r.Form.Get("nonce"),
+		redirectURI: redirectURI.String(), challenge: r.Form.Get("code_challenge"),
+		expires: time.Now().Add(time.Minute),
+	}
+	op.mutex.Unlock()
+
+	q := redirectURI.Query()
+	q.Set("code", code)
+	if state := r.Form.Get("state"); len(state) > 0 {
+		q.Set("state", state)
+	}
+	redirectURI.RawQuery = q.Encode()
+	glog.Infof("Code issued for user [%s] groups %v.", r.Form.Get("user"), groups)
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+func (op *mockProvider) signJwt(claims map[string]interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": keyID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signing := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signing))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, op.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signing + "." + b64(sig), nil
+}
+
+// exchange an authorization code for an id token
+func (op *mockProvider) token(w http.ResponseWriter, r *http.Request) {
+	tokenErr := func(e string) {
+		writeJson(w, http.StatusBadRequest, map[string]string{"error": e})
+	}
+	if err := r.ParseForm(); err != nil {
+		tokenErr("invalid_request")
+		return
+	}
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if id != op.clientID || subtle.ConstantTimeCompare([]byte(secret), []byte(op.clientSecret)) != 1 {
+		writeJson(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	if "authorization_code" != r.PostForm.Get("grant_type") {
+		tokenErr("unsupported_grant_type")
+		return
+	}
+
+	code := r.PostForm.Get("code")
+	op.mutex.Lock()
+	ac := op.codes[code]
+	delete(op.codes, code)
+	op.mutex.Unlock()
+
+	if ac == nil || time.Now().After(ac.expires) || ac.redirectURI != r.PostForm.Get("redirect_uri") {
+		tokenErr("invalid_grant")
+		return
+	}
+	if len(ac.challenge) > 0 {
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if b64(sum[:]) != ac.challenge {
+			tokenErr("invalid_grant")
+			return
+		}
+	}
+
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":                op.issuer,
+		"sub":                ac.user,
+		"aud":                op.clientID,
+		"iat":                now.Unix(),
+		"exp":                now.Add(time.Hour).Unix(),
+		"preferred_username": ac.user,
+		"groups":             ac.groups,
+	}
+	if len(ac.nonce) > 0 {
+		claims["nonce"] = ac.nonce
+	}
+	idToken, err := op.signJwt(claims)
+	if err != nil {
+		glog.Errorf("Error signing id token: %v", err)
+		tokenErr("server_error")
+		return
+	}
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	writeJson(w, http.StatusOK, map[string]interface{}{
+		"access_token": hex.EncodeToString(buf),
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
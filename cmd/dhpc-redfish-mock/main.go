@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// a minimal Redfish BMC with a single system, for testing power control
+// without real hardware
+func main() {
+	var addr, user, password string
+	flag.StringVar(&addr, "http", "localhost:8443", "Address to serve plain http on.")
+	flag.StringVar(&user, "user", "admin", "Basic auth user, empty to disable auth.")
+	flag.StringVar(&password, "password", "admin", "Basic auth password.")
+	flag.Parse()
+
+	sys := &mockSystem{PowerState: "Off", BootOverride: "Disabled", BootTarget: "None"}
+
+	authed := func(h http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if len(user) > 0 {
+				u, p, ok := r.BasicAuth()
+				if !ok || u != user || p != password {
+					http.Error(w, "unauthorized", http.StatusUnauthorized)
+					return
+				}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			h(w, r)
+		}
+	}
+
+	http.HandleFunc("/redfish/v1/Systems", authed(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"Members": []map[string]string{
+				{"@odata.id": "/redfish/v1/Systems/1"},
+			},
+			"Members@odata.count": 1,
+		})
+	}))
+	http.HandleFunc("/redfish/v1/Systems/1", authed(sys.serve))
+	http.HandleFunc("/redfish/v1/Systems/1/Actions/ComputerSystem.Reset", authed(sys.reset))
+
+	glog.Infof("Mock redfish BMC serving on http://%s", addr)
+	if err := http.ListenAndServe(addr, nil); err != nil {
+		glog.Fatal(err)
+	}
+}
+
+type mockSystem struct {
+	mutex sync.Mutex
+
+	PowerState   string
+	BootOverride string
+	BootTarget   string
+}
+
+func (sys *mockSystem) render() map[string]interface{} {
+	return map[string]interface{}{
+		"@odata.id":  "/redfish/v1/Systems/1",
+		"Id":         "1",
+		"PowerState": sys.PowerState,
+		"Boot": map[string]string{
+			"BootSourceOverrideEnabled": sys.BootOverride,
+			"BootSourceOverrideTarget":  sys.BootTarget,
+		},
+	}
+}
+
+func (sys *mockSystem) serve(w http.ResponseWriter, r *http.Request) {
+	sys.mutex.Lock()
+	defer sys.mutex.Unlock()
+
+	switch r.Method {
+	case "GET":
+	case "PATCH":
+		req := struct {
+			Boot *struct {
+				BootSourceOverrideEnabled string
+				BootSourceOverrideTarget  string
+			}
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Boot != nil {
+			if len(req.Boot.BootSourceOverrideEnabled) > 0 {
+				sys.BootOverride = req.Boot.BootSourceOverrideEnabled
+			}
+			if len(req.Boot.BootSourceOverrideTarget) > 0 {
+				sys.BootTarget = req.Boot.BootSourceOverrideTarget
+			}
+			glog.Infof("Boot override set to %s/%s", sys.BootOverride, sys.BootTarget)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	json.NewEncoder(w).Encode(sys.render())
+}
+
+func (sys *mockSystem) reset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	req := struct {
+		ResetType string
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sys.mutex.Lock()
+	defer sys.mutex.Unlock()
+
+	switch req.ResetType {
+	case "On", "ForceOn":
+		sys.PowerState = "On"
+	case "ForceOff", "GracefulShutdown":
+		sys.PowerState = "Off"
+	case "ForceRestart", "GracefulRestart", "PowerCycle":
+		sys.PowerState = "On"
+	default:
+		http.Error(w, "unsupported ResetType "+req.ResetType, http.StatusBadRequest)
+		return
+	}
+	if "On" == sys.PowerState && "Once" == sys.BootOverride {
+		// consumed by this boot
+		glog.Infof("Booting from %s once", sys.BootTarget)
+		sys.BootOverride, sys.BootTarget = "Disabled", "None"
+	}
+	glog.Infof("%s, power is now %s", req.ResetType, sys.PowerState)
+	w.WriteHeader(http.StatusNoContent)
+}
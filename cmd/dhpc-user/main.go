@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/complyue/different-hpc/pkg/auth"
+	"github.com/complyue/hbi/pkg/errors"
+	"github.com/golang/glog"
+)
+
+const usage = `Maintain local users of the control center, run from where dhpc-cc runs.
+
+  dhpc-user passwd <user>          set password, read from stdin, adding the user if new
+  dhpc-user del <user>             remove a user
+  dhpc-user token <user> <name>    add an api token, printed only this once
+  dhpc-user revoke <user> <name>   revoke an api token
+  dhpc-user list                   list users and names of their tokens
+`
+
+var usersFile string
+
+func readPassword() (string, error) {
+	if fi, err := os.Stdin.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		fmt.Fprint(os.Stderr, "Password (echoed): ")
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && len(line) <= 0 {
+		return "", errors.Wrapf(err, "no password from stdin")
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func main() {
+	var err error
+	defer func() {
+		if e := recover(); e != nil {
+			err = errors.RichError(e)
+		}
+		if err != nil {
+			glog.Error(errors.RichError(err))
+			os.Exit(1)
+		}
+	}()
+
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+	if len(args) <= 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if len(usersFile) <= 0 {
+		usersFile = auth.GetAuthCfg().UsersFile
+	}
+
+	us, err := auth.LoadUsersFile(usersFile)
+	if err != nil {
+		return
+	}
+
+	argsFor := func(n int) {
+		if len(args) != n+1 {
+			flag.Usage()
+			os.Exit(2)
+		}
+	}
+	switch args[0] {
+	case "passwd":
+		argsFor(1)
+		var password string
+		if password, err = readPassword(); err != nil {
+			return
+		}
+		if err = us.SetPassword(args[1], password); err != nil {
+			return
+		}
+	case "del":
+		argsFor(1)
+		if us[args[1]] == nil {
+			err = errors.Errorf("no user [%s]", args[1])
+			return
+		}
+		delete(us, args[1])
+	case "token":
+		argsFor(2)
+		var token string
+		if token, err = us.AddToken(args[1], args[2]); err != nil {
+			return
+		}
+		fmt.Println(token)
+	case "revoke":
+		argsFor(2)
+		if err = us.RevokeToken(args[1], args[2]); err != nil {
+			return
+		}
+	case "list":
+		argsFor(0)
+		names := make([]string, 0, len(us))
+		for name := range us {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			tokens := make([]string, 0, len(us[name].Tokens))
+			for tn := range us[name].Tokens {
+				tokens = append(tokens, tn)
+			}
+			sort.Strings(tokens)
+			fmt.Printf("%s\t%s\n", name, strings.Join(tokens, " "))
+		}
+		return
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	err = us.Save(usersFile)
+}
+
+func init() {
+	// change glog default destination to stderr
+	if glog.V(0) { // should always be true, mention glog so it defines its flags before we change them
+		if err := flag.CommandLine.Set("logtostderr", "true"); nil != err {
+			log.Printf("Failed changing glog default desitination, err: %s", err)
+		}
+	}
+	flag.StringVar(&usersFile, "file", "", "Users file, defaults to usersFile in etc/auth.yaml.")
+}
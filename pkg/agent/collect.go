@@ -0,0 +1,206 @@
+package agent
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/complyue/hbi/pkg/errors"
+)
+
+// procfs and sysfs can be mounted elsewhere, e.g. for an agent in container
+var (
+	ProcDir = "/proc"
+	SysDir  = "/sys"
+)
+
+func readTrimmed(fileName string) string {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// values of /proc/meminfo in bytes
+func memInfo() map[string]uint64 {
+	f, err := os.Open(filepath.Join(ProcDir, "meminfo"))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	mi := make(map[string]uint64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		if len(fields) > 2 && "kB" == fields[2] {
+			v *= 1024
+		}
+		mi[strings.TrimSuffix(fields[0], ":")] = v
+	}
+	return mi
+}
+
+func cpuInfo() (model string, cores int) {
+	f, err := os.Open(filepath.Join(ProcDir, "cpuinfo"))
+	if err != nil {
+		return "", 0
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch strings.TrimSpace(kv[0]) {
+		case "processor":
+			cores++
+		case "model name", "Model", "cpu model":
+			if len(model) <= 0 {
+				model = strings.TrimSpace(kv[1])
+			}
+		}
+	}
+	return model, cores
+}
+
+func disks() []Disk {
+	dirs, err := ioutil.ReadDir(filepath.Join(SysDir, "block"))
+	if err != nil {
+		return nil
+	}
+	var ds []Disk
+	for _, fi := range dirs {
+		name := fi.Name()
+		if strings.HasPrefix(name, "loop") || strings.HasPrefix(name, "ram") {
+			continue
+		}
+		dir := filepath.Join(SysDir, "block", name)
+		// sizes are always in 512 bytes sectors
+		sectors, _ := strconv.ParseUint(readTrimmed(filepath.Join(dir, "size")), 10, 64)
+		if sectors <= 0 {
+			continue
+		}
+		ds = append(ds, Disk{
+			Name:       name,
+			Model:      readTrimmed(filepath.Join(dir, "device", "model")),
+			Size:       sectors * 512,
+			Rotational: "1" == readTrimmed(filepath.Join(dir, "queue", "rotational")),
+		})
+	}
+	return ds
+}
+
+func nics() []NIC {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var ns []NIC
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 || len(iface.HardwareAddr) <= 0 {
+			continue
+		}
+		nic := NIC{Name: iface.Name, Mac: iface.HardwareAddr.String()}
+		dir := filepath.Join(SysDir, "class", "net", iface.Name)
+		if driver, err := os.Readlink(filepath.Join(dir, "device", "driver")); err == nil {
+			nic.Driver = filepath.Base(driver)
+		}
+		vendor := readTrimmed(filepath.Join(dir, "device", "vendor"))
+		device := readTrimmed(filepath.Join(dir, "device", "device"))
+		if len(vendor) > 0 && len(device) > 0 {
+			nic.PciID = strings.TrimPrefix(vendor, "0x") + ":" + strings.TrimPrefix(device, "0x")
+		}
+		// negative when link is down
+		if speed, err := strconv.Atoi(readTrimmed(filepath.Join(dir, "speed"))); err == nil && speed > 0 {
+			nic.Speed = speed
+		}
+		if addrs, err := iface.Addrs(); err == nil {
+			for _, addr := range addrs {
+				nic.Addrs = append(nic.Addrs, addr.String())
+			}
+		}
+		ns = append(ns, nic)
+	}
+	return ns
+}
+
+// collect inventory of this node, to be reported as of mac
+func CollectInventory(mac string) *Inventory {
+	hostname, _ := os.Hostname()
+	inv := &Inventory{
+		Mac:          mac,
+		Hostname:     hostname,
+		Kernel:       readTrimmed(filepath.Join(ProcDir, "sys", "kernel", "osrelease")),
+		Cmdline:      readTrimmed(filepath.Join(ProcDir, "cmdline")),
+		Disks:        disks(),
+		NICs:         nics(),
+		AgentVersion: Version,
+		Time:         time.Now(),
+	}
+	inv.CPUModel, inv.CPUCores = cpuInfo()
+	inv.MemTotal = memInfo()["MemTotal"]
+	return inv
+}
+
+// collect current load, memory and uptime of this node
+func CollectHeartbeat(mac string) *Heartbeat {
+	hb := &Heartbeat{Mac: mac, Time: time.Now()}
+	if loads := strings.Fields(readTrimmed(filepath.Join(ProcDir, "loadavg"))); len(loads) >= 3 {
+		hb.Load1, _ = strconv.ParseFloat(loads[0], 64)
+		hb.Load5, _ = strconv.ParseFloat(loads[1], 64)
+		hb.Load15, _ = strconv.ParseFloat(loads[2], 64)
+	}
+	if uptime := strings.Fields(readTrimmed(filepath.Join(ProcDir, "uptime"))); len(uptime) >= 1 {
+		hb.Uptime, _ = strconv.ParseFloat(uptime[0], 64)
+	}
+	mi := memInfo()
+	hb.MemTotal, hb.MemAvailable = mi["MemTotal"], mi["MemAvailable"]
+	return hb
+}
+
+// mac of the interface routing to the specified host:port
+func MacRoutingTo(addr string) (string, error) {
+	// no packet is sent by connecting udp
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return "", err
+	}
+	localIP := conn.LocalAddr().(*net.UDPAddr).IP
+	conn.Close()
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if ipn, ok := a.(*net.IPNet); ok && ipn.IP.Equal(localIP) {
+				if len(iface.HardwareAddr) <= 0 {
+					return "", errors.Errorf("no hardware address of [%s]", iface.Name)
+				}
+				return iface.HardwareAddr.String(), nil
+			}
+		}
+	}
+	return "", errors.Errorf("no interface found with ip [%s]", localIP)
+}
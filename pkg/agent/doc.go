@@ -0,0 +1,2 @@
+// the agent running on compute nodes, reporting to the control center
+package agent
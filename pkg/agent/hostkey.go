@@ -0,0 +1,62 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/complyue/hbi/pkg/errors"
+)
+
+// boot cmdline arg carrying the one-time token to fetch the host key with
+const HostKeyTokenArg = "dhpc_hostkey_token"
+
+// reply of the control center to a host key request
+type HostKey struct {
+	PrivateKey string
+	PublicKey  string
+
+	Err string `json:"err,omitempty"`
+}
+
+// value of an arg in the boot cmdline of this node, empty if not present
+func CmdlineArg(name string) string {
+	for _, arg := range strings.Fields(readTrimmed(filepath.Join(ProcDir, "cmdline"))) {
+		if strings.HasPrefix(arg, name+"=") {
+			return arg[len(name)+1:]
+		}
+	}
+	return ""
+}
+
+// write the host key to keyFile and keyFile.pub, as sshd expects them
+func InstallHostKey(keyFile string, hk *HostKey) error {
+	if len(hk.PrivateKey) <= 0 || len(hk.PublicKey) <= 0 {
+		return errors.New("empty host key")
+	}
+	if err := os.MkdirAll(filepath.Dir(keyFile), 0755); err != nil {
+		return err
+	}
+	// write aside then rename, sshd never sees a partial key
+	for _, f := range []struct {
+		path string
+		data string
+		perm os.FileMode
+	}{
+		{keyFile, hk.PrivateKey, 0600},
+		{keyFile + ".pub", hk.PublicKey, 0644},
+	} {
+		tmp := f.path + ".tmp"
+		if err := ioutil.WriteFile(tmp, []byte(f.data), f.perm); err != nil {
+			return err
+		}
+		if err := os.Chmod(tmp, f.perm); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, f.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
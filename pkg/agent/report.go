@@ -0,0 +1,112 @@
+package agent
+
+import (
+	"fmt"
+	"time"
+)
+
+const Version = "0.1"
+
+// heartbeat interval unless told otherwise by the control center
+const DefaultInterval = 30 * time.Second
+
+// a block device of a compute node
+type Disk struct {
+	Name  string
+	Model string
+	// in bytes
+	Size       uint64
+	Rotational bool
+}
+
+// a network interface of a compute node
+type NIC struct {
+	Name string
+	Mac  string
+	// kernel driver and pci vendor:device id of the device, if on pci
+	Driver, PciID string
+	// link speed in Mbps, 0 if unknown
+	Speed int
+	Addrs []string
+}
+
+// hardware and software inventory of a compute node, reported by its agent
+// on registration
+type Inventory struct {
+	Mac      string
+	Hostname string
+
+	CPUModel string
+	CPUCores int
+	// in bytes
+	MemTotal uint64
+	Disks    []Disk
+	NICs     []NIC
+
+	Kernel string
+	// kernel cmdline the node booted with
+	Cmdline string
+
+	AgentVersion string
+	Time         time.Time
+}
+
+// periodic report from the agent of a compute node
+type Heartbeat struct {
+	Mac string
+
+	Load1, Load5, Load15 float64
+	// in bytes
+	MemTotal, MemAvailable uint64
+	// seconds since boot
+	Uptime float64
+
+	Time time.Time
+}
+
+func (hb *Heartbeat) MemUsedPercent() float64 {
+	if hb.MemTotal <= 0 {
+		return 0
+	}
+	return 100 * float64(hb.MemTotal-hb.MemAvailable) / float64(hb.MemTotal)
+}
+
+func (hb *Heartbeat) UptimeStr() string {
+	d := time.Duration(hb.Uptime) * time.Second
+	if d >= 24*time.Hour {
+		return fmt.Sprintf("%dd%dh", d/(24*time.Hour), (d%(24*time.Hour))/time.Hour)
+	}
+	return d.Round(time.Minute).String()
+}
+
+// reply from the control center to registrations and heartbeats
+type Reply struct {
+	// interval for heartbeats to be sent
+	Interval time.Duration
+	// the control center has no inventory of this node, register again
+	Reregister bool
+
+	Err string `json:"err,omitempty"`
+}
+
+// size in bytes as human readable, in binary units
+func HumanSize(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func (inv *Inventory) MemStr() string {
+	return HumanSize(inv.MemTotal)
+}
+
+func (d *Disk) SizeStr() string {
+	return HumanSize(d.Size)
+}
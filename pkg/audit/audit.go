@@ -0,0 +1,395 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// actor of actions taken by the control center on its own, e.g. enrolling a
+// node booting for the first time
+const SystemActor = "system"
+
+// actors of actions taken by the control center automatically, remediation of
+// dead nodes, and reboots of nodes in rollouts
+const (
+	RemedyActor  = "dhpc-cc:remedy"
+	RolloutActor = "dhpc-cc:rollout"
+)
+
+// an action taken via the control center
+type Entry struct {
+	// 1 for the first entry, increasing by 1 without gaps
+	Seq  uint64
+	Time time.Time
+	// user taking the action
+	Actor string
+	// source ip of the request
+	Source string `json:",omitempty"`
+	// save/bulk-save/archive/reassign/restore/purge/enroll/ip-reuse/power/
+	// wake/rollout/faulty/exec/term/gui/login/login-failed/logout etc.
+	Action string
+	// target node
+	Mac    string `json:",omitempty"`
+	IP     string `json:",omitempty"`
+	Detail string `json:",omitempty"`
+	// hashes of the node config before/after the action, as its etag
+	Before string `json:",omitempty"`
+	After  string `json:",omitempty"`
+
+	// hash of the previous entry, empty for the first one
+	Prev string
+	// hash of this entry, over all the fields above with this one empty
+	Hash string
+}
+
+func hashOf(e Entry) string {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		panic(err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+var (
+	// the file the chain tail below is of
+	chainFile string
+	lastSeq   uint64
+	lastHash  string
+
+	auditMutex sync.Mutex
+)
+
+// call fn with each line of the first size bytes of the audit log, with the
+// entry parsed from it or the error parsing it, until fn returns false. lines
+// are only appended whole, so auditMutex needn't be locked to scan up to a
+// size taken with it locked.
+func scan(file string, size int64, fn func(lineNo int, line []byte, e *Entry, err error) bool) error {
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(io.LimitReader(f, size))
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Bytes()
+		var e Entry
+		if err := json.Unmarshal(line, &e); err != nil {
+			if !fn(lineNo, line, nil, err) {
+				return nil
+			}
+			continue
+		}
+		if !fn(lineNo, line, &e, nil) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+// cut off a partial line at the end of the audit log file, left by a crash in
+// the middle of appending, so the next entry starts on a line of its own.
+// auditMutex must be locked.
+func _cutPartialLine(file string) error {
+	f, err := os.OpenFile(file, os.O_RDWR, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	// end of the last complete line, searched backwards
+	size, end := fi.Size(), fi.Size()
+	buf := make([]byte, 4096)
+	for end > 0 {
+		n := int64(len(buf))
+		if n > end {
+			n = end
+		}
+		if _, err := f.ReadAt(buf[:n], end-n); err != nil {
+			return err
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			end = end - n + int64(i) + 1
+			break
+		}
+		end -= n
+	}
+	if end >= size {
+		return nil
+	}
+	glog.Warningf("Cutting off partial line of %d bytes at the end of audit log [%s].", size-end, file)
+	return f.Truncate(end)
+}
+
+// find the tail of the chain in the audit log file, auditMutex must be locked
+func _loadTail(file string) error {
+	if err := _cutPartialLine(file); err != nil {
+		return err
+	}
+	var seq uint64
+	var hash string
+	if err := scan(file, math.MaxInt64, func(lineNo int, line []byte, e *Entry, err error) bool {
+		if err != nil {
+			glog.Warningf("Bad audit entry at line %d of [%s]: %v", lineNo, file, err)
+			return true
+		}
+		seq, hash = e.Seq, e.Hash
+		return true
+	}); err != nil {
+		return err
+	}
+	chainFile, lastSeq, lastHash = file, seq, hash
+	return nil
+}
+
+func record(e *Entry) error {
+	cfg, err := getAuditCfg()
+	if err != nil {
+		glog.Errorf("Error loading audit cfg, auditing to [%s]: %+v", defaultAuditFile, err)
+		cfg = &AuditCfg{File: defaultAuditFile, SyncWrites: true}
+	}
+
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+
+	if chainFile != cfg.File {
+		if err := _loadTail(cfg.File); err != nil {
+			return err
+		}
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	e.Seq, e.Prev = lastSeq+1, lastHash
+	e.Hash = hashOf(*e)
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(cfg.File), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(cfg.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if cfg.SyncWrites {
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+
+	lastSeq, lastHash = e.Seq, e.Hash
+	return nil
+}
+
+// size of the audit log file as entries so far appended, for readers to scan
+// up to without holding auditMutex
+func sizeToScan(file string) (int64, error) {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+
+	if chainFile != file {
+		// with any partial line cut off
+		if err := _loadTail(file); err != nil {
+			return 0, err
+		}
+	}
+	fi, err := os.Stat(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// append an entry to the audit log, with its time (if zero), sequence and
+// hashes filled, failure is logged but otherwise ignored
+func Record(e Entry) {
+	// callers in background goroutines may have no recovery
+	defer func() {
+		if err := recover(); err != nil {
+			glog.Errorf("Error auditing %s by [%s] on mac=[%s]: %+v", e.Action, e.Actor, e.Mac, err)
+		}
+	}()
+	if err := record(&e); err != nil {
+		glog.Errorf("Error auditing %s by [%s] on mac=[%s]: %+v", e.Action, e.Actor, e.Mac, err)
+	}
+}
+
+// criteria to select audit entries, empty fields match anything
+type Filter struct {
+	Mac    string
+	Actor  string
+	Action string
+	Since  time.Time
+	Until  time.Time
+
+	// further check of entries, e.g. whether the reader can view the node
+	Allow func(e *Entry) bool
+}
+
+func (f *Filter) empty() bool {
+	return len(f.Mac) <= 0 && len(f.Actor) <= 0 && len(f.Action) <= 0 &&
+		f.Since.IsZero() && f.Until.IsZero() && f.Allow == nil
+}
+
+func (f *Filter) match(e *Entry) bool {
+	if len(f.Mac) > 0 && f.Mac != e.Mac {
+		return false
+	}
+	if len(f.Actor) > 0 && f.Actor != e.Actor {
+		return false
+	}
+	if len(f.Action) > 0 && f.Action != e.Action {
+		return false
+	}
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !e.Time.Before(f.Until) {
+		return false
+	}
+	if f.Allow != nil && !f.Allow(e) {
+		return false
+	}
+	return true
+}
+
+// entries matching the filter, oldest first, only the most recent ones if
+// limit > 0
+func Query(f Filter, limit int) ([]Entry, error) {
+	file := GetAuditCfg().File
+	size, err := sizeToScan(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	if err := scan(file, size, func(lineNo int, line []byte, e *Entry, err error) bool {
+		if e != nil && f.match(e) {
+			entries = append(entries, *e)
+		}
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	if limit > 0 && len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	return entries, nil
+}
+
+// write entries matching the filter to w as json lines, exactly as stored so
+// they can be verified elsewhere. with an empty filter the whole file is
+// written, including lines not parsed as entries.
+func Export(w io.Writer, f Filter) error {
+	file := GetAuditCfg().File
+	size, err := sizeToScan(file)
+	if err != nil {
+		return err
+	}
+
+	all := f.empty()
+	var werr error
+	if err := scan(file, size, func(lineNo int, line []byte, e *Entry, err error) bool {
+		if all || (e != nil && f.match(e)) {
+			if _, werr = w.Write(append(line, '\n')); werr != nil {
+				return false
+			}
+		}
+		return true
+	}); err != nil {
+		return err
+	}
+	return werr
+}
+
+// result of verifying the hash chain of the audit log
+type Verification struct {
+	// entries verified good
+	Entries int
+	OK      bool
+	// line number of the first entry failing verification, 0 if none
+	BrokenLine int    `json:",omitempty"`
+	Problem    string `json:",omitempty"`
+	// sequence and hash of the last entry, note them elsewhere to detect
+	// entries cut off from the end later, which the chain itself can't tell
+	HeadSeq uint64
+	Head    string
+}
+
+// verify the hash chain of the audit log, from the first entry to the last
+func Verify() (*Verification, error) {
+	file := GetAuditCfg().File
+	size, err := sizeToScan(file)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &Verification{OK: true}
+	broken := func(lineNo int, problem string) {
+		v.OK, v.BrokenLine, v.Problem = false, lineNo, problem
+	}
+	if err := scan(file, size, func(lineNo int, line []byte, e *Entry, err error) bool {
+		if err != nil {
+			broken(lineNo, "not an audit entry: "+err.Error())
+			return false
+		}
+		if e.Seq != v.HeadSeq+1 {
+			broken(lineNo, fmt.Sprintf("seq %d follows %d", e.Seq, v.HeadSeq))
+			return false
+		}
+		if e.Prev != v.Head {
+			broken(lineNo, "previous hash mismatch")
+			return false
+		}
+		if hash := hashOf(*e); hash != e.Hash {
+			broken(lineNo, "entry hash mismatch")
+			return false
+		}
+		if canonical, _ := json.Marshal(e); !bytes.Equal(canonical, line) {
+			broken(lineNo, "entry not in canonical form")
+			return false
+		}
+		v.Entries++
+		v.HeadSeq, v.Head = e.Seq, e.Hash
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
@@ -0,0 +1,79 @@
+package audit
+
+import (
+	"io/ioutil"
+	"sync"
+
+	"github.com/complyue/hbi/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+const AuditCfgFile = "etc/audit.yaml"
+
+type AuditCfg struct {
+	// append-only file of hash-chained entries, one json per line
+	File string `yaml:"file"`
+
+	// fsync the file after each entry appended
+	SyncWrites bool `yaml:"syncWrites"`
+}
+
+var (
+	auditCfg      *AuditCfg
+	auditCfgMutex sync.Mutex
+)
+
+func loadAuditCfg() (*AuditCfg, error) {
+	cfgRawYaml, err := ioutil.ReadFile(AuditCfgFile)
+	if err != nil {
+		return nil, err
+	}
+	var cfgYaml AuditCfg
+	if err = yaml.Unmarshal(cfgRawYaml, &cfgYaml); err != nil {
+		return nil, err
+	}
+	if len(cfgYaml.File) <= 0 {
+		return nil, errors.Errorf("no file in [%s]", AuditCfgFile)
+	}
+	return &cfgYaml, nil
+}
+
+// entries are appended to this file if the audit cfg can not be loaded, so
+// actions are audited still
+const defaultAuditFile = "var/audit.jsonl"
+
+func getAuditCfg() (*AuditCfg, error) {
+	auditCfgMutex.Lock()
+	defer auditCfgMutex.Unlock()
+
+	if nil == auditCfg {
+		cfg, err := loadAuditCfg()
+		if err != nil {
+			return nil, err
+		}
+		auditCfg = cfg
+	}
+	return auditCfg, nil
+}
+
+func GetAuditCfg() *AuditCfg {
+	cfg, err := getAuditCfg()
+	if err != nil {
+		panic(err)
+	}
+	return cfg
+}
+
+// reload audit cfg from file, the last good one is kept on error
+func ReloadAuditCfg() error {
+	cfg, err := loadAuditCfg()
+	if err != nil {
+		return err
+	}
+
+	auditCfgMutex.Lock()
+	defer auditCfgMutex.Unlock()
+
+	auditCfg = cfg
+	return nil
+}
@@ -0,0 +1,2 @@
+// tamper-evident audit log of actions taken via the control center
+package audit
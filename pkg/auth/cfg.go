@@ -0,0 +1,166 @@
+package auth
+
+import (
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/complyue/hbi/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+const AuthCfgFile = "etc/auth.yaml"
+
+type AuthCfg struct {
+	// require authentication for the web ui and api
+	Enabled bool `yaml:"enabled"`
+
+	// local users with bcrypt hashed passwords and api tokens
+	UsersFile string `yaml:"usersFile"`
+
+	// how long a login session lasts
+	SessionTTL time.Duration `yaml:"sessionTTL"`
+	// set the Secure flag on session cookies, for serving behind https
+	SecureCookie bool `yaml:"secureCookie"`
+
+	// source addresses pixiecore requests boot specs from, ips or cidrs
+	PixieSources []string `yaml:"pixieSources"`
+	// source addresses of reverse proxies trusted to tell the user of a
+	// request, by X-Forwarded-User/X-Remote-User header or basic auth,
+	// ips or cidrs
+	ProxySources []string `yaml:"proxySources"`
+
+	// role of users not in roles
+	DefaultRole string `yaml:"defaultRole"`
+	// roles of users on all nodes, by user name
+	Roles map[string]string `yaml:"roles"`
+	// roles of users on nodes of a group, by group then user name, in
+	// addition to roles above
+	GroupRoles map[string]map[string]string `yaml:"groupRoles"`
+
+	pixieNets   []*net.IPNet
+	proxyNets   []*net.IPNet
+	defaultRole Role
+	roles       map[string]Role
+	groupRoles  map[string]map[string]Role
+}
+
+var (
+	authCfg      *AuthCfg
+	authCfgMutex sync.Mutex
+)
+
+// parse ips or cidrs into networks
+func parseNets(addrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(addrs))
+	for _, addr := range addrs {
+		if !strings.Contains(addr, "/") {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return nil, errors.Errorf("invalid ip [%s]", addr)
+			}
+			if ip.To4() != nil {
+				addr += "/32"
+			} else {
+				addr += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(addr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func loadAuthCfg() (*AuthCfg, error) {
+	cfgRawYaml, err := ioutil.ReadFile(AuthCfgFile)
+	if err != nil {
+		return nil, err
+	}
+	var cfgYaml AuthCfg
+	if err = yaml.Unmarshal(cfgRawYaml, &cfgYaml); err != nil {
+		return nil, err
+	}
+	if len(cfgYaml.UsersFile) <= 0 {
+		return nil, errors.Errorf("no usersFile in [%s]", AuthCfgFile)
+	}
+	if cfgYaml.SessionTTL <= 0 {
+		return nil, errors.Errorf("invalid sessionTTL=%v in [%s]", cfgYaml.SessionTTL, AuthCfgFile)
+	}
+	if cfgYaml.pixieNets, err = parseNets(cfgYaml.PixieSources); err != nil {
+		return nil, errors.Wrapf(err, "invalid pixieSources in [%s]", AuthCfgFile)
+	}
+	if cfgYaml.proxyNets, err = parseNets(cfgYaml.ProxySources); err != nil {
+		return nil, errors.Wrapf(err, "invalid proxySources in [%s]", AuthCfgFile)
+	}
+	if len(cfgYaml.DefaultRole) > 0 {
+		if cfgYaml.defaultRole, err = ParseRole(cfgYaml.DefaultRole); err != nil {
+			return nil, errors.Wrapf(err, "invalid defaultRole in [%s]", AuthCfgFile)
+		}
+	}
+	if cfgYaml.roles, err = parseRoles(cfgYaml.Roles); err != nil {
+		return nil, errors.Wrapf(err, "invalid roles in [%s]", AuthCfgFile)
+	}
+	cfgYaml.groupRoles = make(map[string]map[string]Role, len(cfgYaml.GroupRoles))
+	for group, roles := range cfgYaml.GroupRoles {
+		if cfgYaml.groupRoles[group], err = parseRoles(roles); err != nil {
+			return nil, errors.Wrapf(err, "invalid groupRoles of [%s] in [%s]", group, AuthCfgFile)
+		}
+	}
+	return &cfgYaml, nil
+}
+
+func GetAuthCfg() *AuthCfg {
+	authCfgMutex.Lock()
+	defer authCfgMutex.Unlock()
+
+	if nil == authCfg {
+		cfg, err := loadAuthCfg()
+		if err != nil {
+			panic(err)
+		}
+		authCfg = cfg
+	}
+	return authCfg
+}
+
+// reload auth cfg from file, the last good one is kept on error
+func ReloadAuthCfg() error {
+	cfg, err := loadAuthCfg()
+	if err != nil {
+		return err
+	}
+
+	authCfgMutex.Lock()
+	defer authCfgMutex.Unlock()
+
+	authCfg = cfg
+	return nil
+}
+
+func inNets(ip string, nets []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// whether pixiecore is trusted to request boot specs from the ip
+func (cfg *AuthCfg) IsPixieSource(ip string) bool {
+	return inNets(ip, cfg.pixieNets)
+}
+
+// whether a reverse proxy at the ip is trusted to tell the user of requests
+func (cfg *AuthCfg) IsProxySource(ip string) bool {
+	return inNets(ip, cfg.proxyNets)
+}
@@ -0,0 +1,2 @@
+// authentication of web users and api clients of the control center
+package auth
@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"crypto/tls"
+	"strings"
+
+	"github.com/complyue/hbi/pkg/errors"
+	"github.com/go-ldap/ldap/v3"
+)
+
+func (pc *ProviderCfg) ldapDial() (*ldap.Conn, error) {
+	tlsCfg := &tls.Config{InsecureSkipVerify: pc.InsecureSkipVerify}
+	conn, err := ldap.DialURL(pc.URL, ldap.DialWithTLSConfig(tlsCfg))
+	if err != nil {
+		return nil, err
+	}
+	if pc.StartTLS {
+		if err = conn.StartTLS(tlsCfg); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (pc *ProviderCfg) ldapServiceBind(conn *ldap.Conn) error {
+	if len(pc.BindDN) <= 0 {
+		// search anonymously
+		return nil
+	}
+	return conn.Bind(pc.BindDN, pc.BindPassword)
+}
+
+// authenticate a user by binding to the ldap server with the password, and
+// find groups of the user
+func (pc *ProviderCfg) LdapLogin(user, password string) (*Principal, error) {
+	if "ldap" != pc.Type {
+		return nil, errors.Errorf("[%s] is not an ldap provider", pc.Name)
+	}
+	// an empty password makes an unauthenticated bind, which succeeds
+	if len(user) <= 0 || len(password) <= 0 {
+		return nil, errors.New("empty user or password")
+	}
+
+	conn, err := pc.ldapDial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var userDN string
+	if len(pc.UserDN) > 0 {
+		userDN = strings.Replace(pc.UserDN, "{user}", ldap.EscapeDN(user), -1)
+	} else {
+		if err = pc.ldapServiceBind(conn); err != nil {
+			return nil, errors.Wrapf(err, "service bind to [%s] failed", pc.URL)
+		}
+		sr, err := conn.Search(ldap.NewSearchRequest(pc.UserBase,
+			ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+			strings.Replace(pc.UserFilter, "{user}", ldap.EscapeFilter(user), -1),
+			[]string{"dn"}, nil))
+		if err != nil {
+			return nil, errors.Wrapf(err, "searching user [%s]", user)
+		}
+		if len(sr.Entries) != 1 {
+			return nil, errors.Errorf("%d entries found for user [%s]", len(sr.Entries), user)
+		}
+		userDN = sr.Entries[0].DN
+	}
+
+	if err = conn.Bind(userDN, password); err != nil {
+		return nil, errors.Wrapf(err, "bind as [%s] failed", userDN)
+	}
+
+	var groups []string
+	if len(pc.GroupBase) > 0 {
+		if err = pc.ldapServiceBind(conn); err != nil {
+			return nil, errors.Wrapf(err, "service bind to [%s] failed", pc.URL)
+		}
+		filter := strings.NewReplacer(
+			"{dn}", ldap.EscapeFilter(userDN),
+			"{user}", ldap.EscapeFilter(user),
+		).Replace(pc.GroupFilter)
+		sr, err := conn.Search(ldap.NewSearchRequest(pc.GroupBase,
+			ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+			filter, []string{pc.GroupAttr}, nil))
+		if err != nil {
+			return nil, errors.Wrapf(err, "searching groups of [%s]", user)
+		}
+		for _, e := range sr.Entries {
+			if g := e.GetAttributeValue(pc.GroupAttr); len(g) > 0 {
+				groups = append(groups, g)
+			}
+		}
+	}
+	return pc.principal(user, groups), nil
+}
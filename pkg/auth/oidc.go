@@ -0,0 +1,166 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/complyue/hbi/pkg/errors"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// how long a user can take at the oidc provider to log in
+const oidcLoginTimeout = 10 * time.Minute
+
+type oidcClient struct {
+	// config the client is made of, remade when changed
+	cfgKey string
+
+	verifier *oidc.IDTokenVerifier
+	oauth2   oauth2.Config
+}
+
+type oidcPending struct {
+	provider string
+	nonce    string
+	verifier string
+	next     string
+	expires  time.Time
+}
+
+var (
+	oidcClients  = make(map[string]*oidcClient)
+	oidcPendings = make(map[string]*oidcPending)
+	oidcMutex    sync.Mutex
+)
+
+// the client to an oidc provider, discovered on first use
+func (pc *ProviderCfg) oidcClient(ctx context.Context) (*oidcClient, error) {
+	if "oidc" != pc.Type {
+		return nil, errors.Errorf("[%s] is not an oidc provider", pc.Name)
+	}
+	cfgKey := fmt.Sprintf("%s|%s|%s|%s|%v", pc.Issuer, pc.ClientID, pc.ClientSecret, pc.RedirectURL, pc.Scopes)
+
+	oidcMutex.Lock()
+	oc := oidcClients[pc.Name]
+	oidcMutex.Unlock()
+	if oc != nil && oc.cfgKey == cfgKey {
+		return oc, nil
+	}
+
+	provider, err := oidc.NewProvider(ctx, pc.Issuer)
+	if err != nil {
+		return nil, errors.Wrapf(err, "discovering oidc provider [%s]", pc.Issuer)
+	}
+	oc = &oidcClient{
+		cfgKey:   cfgKey,
+		verifier: provider.Verifier(&oidc.Config{ClientID: pc.ClientID}),
+		oauth2: oauth2.Config{
+			ClientID:     pc.ClientID,
+			ClientSecret: pc.ClientSecret,
+			Endpoint:     provider.Endpoint(),
+			RedirectURL:  pc.RedirectURL,
+			Scopes:       pc.Scopes,
+		},
+	}
+
+	oidcMutex.Lock()
+	defer oidcMutex.Unlock()
+
+	oidcClients[pc.Name] = oc
+	return oc, nil
+}
+
+// begin logging in with an oidc provider, the user is to be redirected to
+// the url returned, and the state kept in a cookie to be checked on callback
+func (pc *ProviderCfg) BeginOidcLogin(ctx context.Context, next string) (authURL, state string, err error) {
+	oc, err := pc.oidcClient(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	if state, err = randomHex(16); err != nil {
+		return "", "", err
+	}
+	nonce, err := randomHex(16)
+	if err != nil {
+		return "", "", err
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	oidcMutex.Lock()
+	defer oidcMutex.Unlock()
+
+	now := time.Now()
+	for s, p := range oidcPendings {
+		if now.After(p.expires) {
+			delete(oidcPendings, s)
+		}
+	}
+	oidcPendings[state] = &oidcPending{
+		provider: pc.Name, nonce: nonce, verifier: verifier, next: next,
+		expires: now.Add(oidcLoginTimeout),
+	}
+	return oc.oauth2.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)), state, nil
+}
+
+func claimStrings(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return strings.FieldsFunc(v, func(r rune) bool {
+			return r == ',' || r == ' '
+		})
+	case []interface{}:
+		strs := make([]string, 0, len(v))
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				strs = append(strs, s)
+			}
+		}
+		return strs
+	}
+	return nil
+}
+
+// finish logging in with an oidc provider, on callback with the state and
+// authorization code, the local path to go after login is returned along
+func (pc *ProviderCfg) FinishOidcLogin(ctx context.Context, state, code string) (*Principal, string, error) {
+	oidcMutex.Lock()
+	pending := oidcPendings[state]
+	delete(oidcPendings, state)
+	oidcMutex.Unlock()
+
+	if pending == nil || pending.provider != pc.Name || time.Now().After(pending.expires) {
+		return nil, "", errors.New("unknown or expired login state")
+	}
+	oc, err := pc.oidcClient(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	token, err := oc.oauth2.Exchange(ctx, code, oauth2.VerifierOption(pending.verifier))
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "exchanging authorization code")
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, "", errors.New("no id_token from provider")
+	}
+	idToken, err := oc.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "invalid id_token")
+	}
+	if idToken.Nonce != pending.nonce {
+		return nil, "", errors.New("nonce mismatch")
+	}
+	var claims map[string]interface{}
+	if err = idToken.Claims(&claims); err != nil {
+		return nil, "", err
+	}
+	user, _ := claims[pc.UserClaim].(string)
+	if len(user) <= 0 {
+		return nil, "", errors.Errorf("no [%s] claim in id_token", pc.UserClaim)
+	}
+	return pc.principal(user, claimStrings(claims[pc.GroupsClaim])), pending.next, nil
+}
@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"strings"
+
+	"github.com/complyue/hbi/pkg/errors"
+)
+
+// an external identity provider users log in with, besides local users
+type ProviderCfg struct {
+	// shown on the login page, and in callback urls of oidc
+	Name string `yaml:"name"`
+	// ldap or oidc
+	Type string `yaml:"type"`
+
+	// role granted to members of directory groups, on all nodes
+	RoleOfGroup map[string]string `yaml:"roleOfGroup"`
+
+	// ldap server, like ldap://host:389 or ldaps://host:636
+	URL                string `yaml:"url"`
+	StartTLS           bool   `yaml:"startTLS"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify"`
+	// bind as the user by this dn with {user} in it, or find the user's dn
+	// with userFilter under userBase, binding as bindDN to search if set
+	UserDN       string `yaml:"userDN"`
+	BindDN       string `yaml:"bindDN"`
+	BindPassword string `yaml:"bindPassword"`
+	UserBase     string `yaml:"userBase"`
+	UserFilter   string `yaml:"userFilter"`
+	// groups of the user, by groupFilter with {dn} and {user} in it under
+	// groupBase, named by groupAttr
+	GroupBase   string `yaml:"groupBase"`
+	GroupFilter string `yaml:"groupFilter"`
+	GroupAttr   string `yaml:"groupAttr"`
+
+	// oidc provider, discovered from <issuer>/.well-known/openid-configuration
+	Issuer       string   `yaml:"issuer"`
+	ClientID     string   `yaml:"clientID"`
+	ClientSecret string   `yaml:"clientSecret"`
+	RedirectURL  string   `yaml:"redirectURL"`
+	Scopes       []string `yaml:"scopes"`
+	// id token claims of the user name and groups
+	UserClaim   string `yaml:"userClaim"`
+	GroupsClaim string `yaml:"groupsClaim"`
+
+	roleOfGroup map[string]Role
+}
+
+// a user authenticated by an identity provider
+type Principal struct {
+	// <provider>:<user> with a provider, so roles by user name in auth.yaml
+	// never apply to a namesake of another provider or a local user
+	User     string
+	Provider string
+	// directory groups of the user
+	Groups []string
+	// role granted by groups
+	Role Role
+}
+
+// validate a provider config and fill in defaults
+func (pc *ProviderCfg) Prepare() error {
+	if len(pc.Name) <= 0 {
+		return errors.New("provider without name")
+	}
+	if strings.ContainsAny(pc.Name, ":/") {
+		return errors.Errorf("invalid provider name [%s]", pc.Name)
+	}
+	var err error
+	if pc.roleOfGroup, err = parseRoles(pc.RoleOfGroup); err != nil {
+		return errors.Wrapf(err, "invalid roleOfGroup of provider [%s]", pc.Name)
+	}
+	switch pc.Type {
+	case "ldap":
+		if len(pc.URL) <= 0 {
+			return errors.Errorf("no url of ldap provider [%s]", pc.Name)
+		}
+		if len(pc.UserDN) <= 0 && len(pc.UserBase) <= 0 {
+			return errors.Errorf("neither userDN nor userBase of ldap provider [%s]", pc.Name)
+		}
+		if len(pc.UserFilter) <= 0 {
+			pc.UserFilter = "(uid={user})"
+		}
+		if len(pc.GroupBase) > 0 && len(pc.GroupFilter) <= 0 {
+			pc.GroupFilter = "(|(member={dn})(uniqueMember={dn})(memberUid={user}))"
+		}
+		if len(pc.GroupAttr) <= 0 {
+			pc.GroupAttr = "cn"
+		}
+	case "oidc":
+		if len(pc.Issuer) <= 0 || len(pc.ClientID) <= 0 || len(pc.RedirectURL) <= 0 {
+			return errors.Errorf("issuer, clientID and redirectURL required of oidc provider [%s]", pc.Name)
+		}
+		if len(pc.Scopes) <= 0 {
+			pc.Scopes = []string{"openid", "profile", "email"}
+		}
+		if len(pc.UserClaim) <= 0 {
+			// unique and stable per provider, unlike names users may pick
+			pc.UserClaim = "sub"
+		}
+		if len(pc.GroupsClaim) <= 0 {
+			pc.GroupsClaim = "groups"
+		}
+	default:
+		return errors.Errorf("unknown type [%s] of provider [%s]", pc.Type, pc.Name)
+	}
+	return nil
+}
+
+func (pc *ProviderCfg) principal(user string, groups []string) *Principal {
+	p := &Principal{User: pc.Name + ":" + user, Provider: pc.Name, Groups: groups}
+	for _, g := range groups {
+		if r := pc.roleOfGroup[g]; r > p.Role {
+			p.Role = r
+		}
+	}
+	return p
+}
@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"github.com/complyue/hbi/pkg/errors"
+)
+
+// what a user can do to nodes, each role can do what lower ones can
+type Role int
+
+const (
+	NoRole Role = iota
+	// view configs and states of nodes
+	Viewer
+	// power nodes, run commands and open terminals on them
+	Operator
+	// edit configs of nodes
+	Admin
+)
+
+var roleNames = map[Role]string{
+	NoRole:   "none",
+	Viewer:   "viewer",
+	Operator: "operator",
+	Admin:    "admin",
+}
+
+func (role Role) String() string {
+	if name, ok := roleNames[role]; ok {
+		return name
+	}
+	return "invalid"
+}
+
+func ParseRole(name string) (Role, error) {
+	for role, n := range roleNames {
+		if n == name {
+			return role, nil
+		}
+	}
+	return NoRole, errors.Errorf("invalid role [%s]", name)
+}
+
+func parseRoles(roles map[string]string) (map[string]Role, error) {
+	parsed := make(map[string]Role, len(roles))
+	for user, name := range roles {
+		role, err := ParseRole(name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "for [%s]", user)
+		}
+		parsed[user] = role
+	}
+	return parsed, nil
+}
+
+// role of a user on all nodes
+func (cfg *AuthCfg) RoleOf(user string) Role {
+	role := cfg.defaultRole
+	if r := cfg.roles[user]; r > role {
+		role = r
+	}
+	return role
+}
+
+// role of a user on nodes in the groups
+func (cfg *AuthCfg) RoleOn(user string, groups []string) Role {
+	role := cfg.RoleOf(user)
+	for _, g := range groups {
+		if r := cfg.groupRoles[g][user]; r > role {
+			role = r
+		}
+	}
+	return role
+}
+
+// highest role of a user on any nodes
+func (cfg *AuthCfg) MaxRoleOf(user string) Role {
+	role := cfg.RoleOf(user)
+	for _, roles := range cfg.groupRoles {
+		if r := roles[user]; r > role {
+			role = r
+		}
+	}
+	return role
+}
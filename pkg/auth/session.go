@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// a login session of a web user
+type Session struct {
+	User string
+	// identity provider the user logged in with, empty for local users
+	Provider string
+	// role granted by the provider, on all nodes
+	Grant Role
+	// to be presented with mutating requests, as X-CSRF-Token header or
+	// csrf form field
+	CSRFToken string
+	Expires   time.Time
+}
+
+var (
+	sessions      = make(map[string]*Session)
+	sessionsMutex sync.Mutex
+)
+
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// start a session for a user, the session id is returned along
+func NewSession(p Principal) (string, *Session, error) {
+	id, err := randomHex(32)
+	if err != nil {
+		return "", nil, err
+	}
+	csrf, err := randomHex(16)
+	if err != nil {
+		return "", nil, err
+	}
+	sess := &Session{
+		User: p.User, Provider: p.Provider, Grant: p.Role,
+		CSRFToken: csrf, Expires: time.Now().Add(GetAuthCfg().SessionTTL),
+	}
+
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	now := time.Now()
+	for sid, s := range sessions {
+		if now.After(s.Expires) {
+			delete(sessions, sid)
+		}
+	}
+	sessions[id] = sess
+	return id, sess, nil
+}
+
+// an unexpired session by id, nil if none
+func GetSession(id string) *Session {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	sess := sessions[id]
+	if sess == nil {
+		return nil
+	}
+	if time.Now().After(sess.Expires) {
+		delete(sessions, id)
+		return nil
+	}
+	return sess
+}
+
+// end a session
+func EndSession(id string) {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	delete(sessions, id)
+}
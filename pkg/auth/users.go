@@ -0,0 +1,221 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/complyue/hbi/pkg/errors"
+	"github.com/golang/glog"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+// prefix of api tokens, telling them apart from other bearer credentials
+const tokenPrefix = "dhpc_"
+
+var validUserName = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.@-]*$`)
+
+// an api token of a user, only its hash is kept
+type TokenEntry struct {
+	// sha256 of the token, in hex
+	Hash    string    `yaml:"hash"`
+	Created time.Time `yaml:"created"`
+}
+
+// a local user
+type UserEntry struct {
+	// bcrypt hash of the password, the user can not log in if empty
+	Password string `yaml:"password"`
+	// api tokens by name
+	Tokens map[string]*TokenEntry `yaml:"tokens,omitempty"`
+}
+
+// local users by name, as kept in the users file
+type Users map[string]*UserEntry
+
+var (
+	users      Users
+	tokenUsers map[string]string
+	usersMutex sync.Mutex
+
+	// compared against for unknown users, so they take as long to refuse
+	dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+)
+
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// read local users from file, none if the file doesn't exist
+func LoadUsersFile(fileName string) (Users, error) {
+	rawYaml, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return Users{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	us := Users{}
+	if err = yaml.Unmarshal(rawYaml, &us); err != nil {
+		return nil, errors.Wrapf(err, "invalid users file [%s]", fileName)
+	}
+	for name, u := range us {
+		if u == nil {
+			us[name] = &UserEntry{}
+		}
+	}
+	return us, nil
+}
+
+// write local users to file, replacing it at once
+func (us Users) Save(fileName string) error {
+	out, err := yaml.Marshal(us)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(fileName), 0700); err != nil {
+		return err
+	}
+	tmpFile := fileName + ".tmp"
+	if err = ioutil.WriteFile(tmpFile, out, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, fileName)
+}
+
+// set password of a user, the user is added if not existing
+func (us Users) SetPassword(user, password string) error {
+	if !validUserName.MatchString(user) {
+		return errors.Errorf("invalid user name [%s]", user)
+	}
+	if len(password) <= 0 {
+		return errors.New("empty password")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	u := us[user]
+	if u == nil {
+		u = &UserEntry{}
+		us[user] = u
+	}
+	u.Password = string(hash)
+	return nil
+}
+
+// add an api token to a user, the token is returned, and can not be
+// recovered afterwards
+func (us Users) AddToken(user, name string) (string, error) {
+	u := us[user]
+	if u == nil {
+		return "", errors.Errorf("no user [%s]", user)
+	}
+	if len(name) <= 0 {
+		return "", errors.New("no token name")
+	}
+	if _, ok := u.Tokens[name]; ok {
+		return "", errors.Errorf("user [%s] already has token [%s]", user, name)
+	}
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := tokenPrefix + hex.EncodeToString(buf)
+	if u.Tokens == nil {
+		u.Tokens = make(map[string]*TokenEntry)
+	}
+	u.Tokens[name] = &TokenEntry{Hash: tokenHash(token), Created: time.Now()}
+	return token, nil
+}
+
+// revoke an api token of a user
+func (us Users) RevokeToken(user, name string) error {
+	u := us[user]
+	if u == nil {
+		return errors.Errorf("no user [%s]", user)
+	}
+	if _, ok := u.Tokens[name]; !ok {
+		return errors.Errorf("user [%s] has no token [%s]", user, name)
+	}
+	delete(u.Tokens, name)
+	return nil
+}
+
+func useUsers(us Users) {
+	tus := make(map[string]string)
+	for name, u := range us {
+		for _, t := range u.Tokens {
+			tus[t.Hash] = name
+		}
+	}
+	users, tokenUsers = us, tus
+}
+
+func lockUsers() {
+	usersMutex.Lock()
+	if users != nil {
+		return
+	}
+	usersFile := GetAuthCfg().UsersFile
+	us, err := LoadUsersFile(usersFile)
+	if err != nil {
+		glog.Errorf("Error loading users: %+v", err)
+		us = Users{}
+	}
+	if len(us) <= 0 {
+		glog.Warningf("No user in [%s], add one with dhpc-user.", usersFile)
+	}
+	useUsers(us)
+}
+
+// reload local users from file, the last good ones are kept on error
+func ReloadUsers() error {
+	us, err := LoadUsersFile(GetAuthCfg().UsersFile)
+	if err != nil {
+		return err
+	}
+
+	usersMutex.Lock()
+	defer usersMutex.Unlock()
+
+	useUsers(us)
+	return nil
+}
+
+// whether the password is right for the user
+func CheckPassword(user, password string) bool {
+	lockUsers()
+	u := users[user]
+	usersMutex.Unlock()
+
+	if u == nil || len(u.Password) <= 0 {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password)) == nil
+}
+
+// user an api token belongs to, empty if no one
+func UserOfToken(token string) string {
+	lockUsers()
+	defer usersMutex.Unlock()
+
+	return tokenUsers[tokenHash(token)]
+}
+
+// whether a user exists, sessions of removed users are no longer valid
+func HasUser(user string) bool {
+	lockUsers()
+	defer usersMutex.Unlock()
+
+	return users[user] != nil
+}
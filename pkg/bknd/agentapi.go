@@ -0,0 +1,112 @@
+package bknd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/complyue/different-hpc/pkg/agent"
+	"github.com/complyue/different-hpc/pkg/ccm"
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+)
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func agentRegister(w http.ResponseWriter, r *http.Request) {
+	var inv agent.Inventory
+	jsonDecoder := json.NewDecoder(r.Body)
+	jsonDecoder.Decode(&inv)
+
+	jsonResult := make(map[string]interface{}, 5)
+	func() {
+		defer func() {
+			if e := recover(); e != nil {
+				glog.Errorf("Error registering agent of mac=[%s]:\n+%v", inv.Mac, e)
+				jsonResult["err"] = fmt.Sprintf("Unexpected error: %+v", e)
+			}
+		}()
+
+		if err := ccm.RegisterAgent(inv, remoteIP(r)); err != nil {
+			glog.Warningf("Agent registration rejected: %+v", err)
+			jsonResult["err"] = err.Error()
+			return
+		}
+		jsonResult["interval"] = ccm.GetPulseCfg().AgentInterval
+	}()
+	if err := json.NewEncoder(w).Encode(jsonResult); err != nil {
+		panic(err)
+	}
+}
+
+func agentHeartbeat(w http.ResponseWriter, r *http.Request) {
+	var hb agent.Heartbeat
+	jsonDecoder := json.NewDecoder(r.Body)
+	jsonDecoder.Decode(&hb)
+
+	jsonResult := make(map[string]interface{}, 5)
+	func() {
+		defer func() {
+			if e := recover(); e != nil {
+				glog.Errorf("Error accepting heartbeat of mac=[%s]:\n+%v", hb.Mac, e)
+				jsonResult["err"] = fmt.Sprintf("Unexpected error: %+v", e)
+			}
+		}()
+
+		reregister, err := ccm.AgentHeartbeat(hb, remoteIP(r))
+		if err != nil {
+			glog.Warningf("Agent heartbeat rejected: %+v", err)
+			jsonResult["err"] = err.Error()
+			return
+		}
+		jsonResult["interval"] = ccm.GetPulseCfg().AgentInterval
+		jsonResult["reregister"] = reregister
+	}()
+	if err := json.NewEncoder(w).Encode(jsonResult); err != nil {
+		panic(err)
+	}
+}
+
+func cnodeListAgents(w http.ResponseWriter, r *http.Request) {
+	jsonResult := make(map[string]interface{}, 5)
+	var agents []ccm.AgentState
+	for _, as := range ccm.ListAgentStates() {
+		if canViewNode(r, as.Mac) {
+			agents = append(agents, as)
+		}
+	}
+	jsonResult["agents"] = agents
+	if err := json.NewEncoder(w).Encode(jsonResult); err != nil {
+		panic(err)
+	}
+}
+
+func cnodeViewAgent(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	jsonResult := make(map[string]interface{}, 5)
+	func() {
+		mac, err := ccm.NormalizeMac(vars["mac"])
+		if err != nil {
+			jsonResult["err"] = err.Error()
+			return
+		}
+		as := ccm.GetAgentState(mac)
+		if as == nil {
+			jsonResult["err"] = fmt.Sprintf("No agent reported for mac=[%s]", mac)
+			return
+		}
+		jsonResult["agent"] = as
+		jsonResult["beating"] = as.Beating()
+	}()
+	if err := json.NewEncoder(w).Encode(jsonResult); err != nil {
+		panic(err)
+	}
+}
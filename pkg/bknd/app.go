@@ -1,17 +1,26 @@
 package bknd
 
 import (
+	"fmt"
 	"net/http"
 
+	"github.com/complyue/different-hpc/pkg/auth"
 	"github.com/complyue/different-hpc/pkg/ccm"
 
 	"github.com/flosch/pongo2"
+	"github.com/golang/glog"
 	"github.com/gorilla/mux"
 )
 
 func DefinePageRoutes(router *mux.Router) {
 
-	router.Handle("/", &Pongo2Page{
+	router.HandleFunc("/login", webLoginPage).Methods("GET")
+	router.HandleFunc("/login", webLogin).Methods("POST")
+	router.HandleFunc("/logout", webLogout).Methods("POST")
+	router.HandleFunc("/login/oidc/{provider}", webOidcLogin).Methods("GET")
+	router.HandleFunc("/login/oidc/{provider}/callback", webOidcCallback).Methods("GET")
+
+	router.Handle("/", requireRole(auth.Viewer, (&Pongo2Page{
 		TmplFile: "web/templates/index.html",
 		UpdateCtx: func(ctx pongo2.Context, r *http.Request) {
 			ctx["title"] = "Different HPC Control Center"
@@ -20,8 +29,54 @@ func DefinePageRoutes(router *mux.Router) {
 			ctx["sshUser"] = pulseCfg.SshUser
 
 			ccm.GetComputeNodeCfgs()
-			ctx["cnips"] = ccm.ListCaredIPs()
+			var cnips []ccm.IpAliveness
+			for _, cnip := range ccm.ListCaredIPs() {
+				var cfgs []*ccm.ComputeNodeCfg
+				for _, cfg := range cnip.Cfgs {
+					if canViewNode(r, cfg.Mac) {
+						cfgs = append(cfgs, cfg)
+					}
+				}
+				if len(cfgs) > 0 {
+					cnip.Cfgs = cfgs
+					cnips = append(cnips, cnip)
+				}
+			}
+			ctx["cnips"] = cnips
+
+			ctx["reloadErrs"] = ccm.ListCfgReloadErrors()
+			ctx["conflicts"] = viewableConflicts(r)
+			ctx["remedies"] = viewableRemedies(r)
+			ctx["agentOf"] = ccm.GetAgentState
+			ctx["driftOf"] = ccm.GetDriftState
+
+			if archived, err := viewableArchivedCfgs(r); err != nil {
+				glog.Errorf("Error listing archived configs: %+v", err)
+			} else {
+				ctx["archived"] = archived
+			}
+		},
+	}).ServeHTTP))
+
+	router.Handle("/term/{mac}", requireRole(auth.Operator, (&Pongo2Page{
+		TmplFile: "web/templates/term.html",
+		UpdateCtx: func(ctx pongo2.Context, r *http.Request) {
+			ctx["title"] = "Terminal"
+			mac, err := ccm.NormalizeMac(ctx["mac"].(string))
+			if err != nil {
+				ctx["err"] = err.Error()
+				return
+			}
+			ctx["mac"] = mac
+			cfg := ccm.GetComputeNodeCfg(mac)
+			if cfg == nil {
+				ctx["err"] = "No config for mac=[" + mac + "]"
+				return
+			}
+			cfgd := cfg.Inflate()
+			ctx["title"] = fmt.Sprintf("%v - Terminal", cfgd["hostname"])
+			ctx["cfgd"] = cfgd
 		},
-	})
+	}).ServeHTTP))
 
 }
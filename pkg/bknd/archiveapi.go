@@ -0,0 +1,217 @@
+package bknd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/complyue/different-hpc/pkg/audit"
+	"github.com/complyue/different-hpc/pkg/auth"
+	"github.com/complyue/different-hpc/pkg/ccm"
+	"github.com/golang/glog"
+)
+
+func cnodeListArchived(w http.ResponseWriter, r *http.Request) {
+	jsonResult := make(map[string]interface{}, 5)
+	func() {
+		defer func() {
+			if e := recover(); e != nil {
+				glog.Errorf("Error listing archived configs:\n+%v", e)
+				jsonResult["err"] = fmt.Sprintf("Unexpected error: %+v", e)
+			}
+		}()
+
+		acs, err := viewableArchivedCfgs(r)
+		if err != nil {
+			jsonResult["err"] = fmt.Sprintf("Failed listing archived configs: %+v", err)
+			return
+		}
+		jsonResult["archived"] = acs
+	}()
+	if err := json.NewEncoder(w).Encode(jsonResult); err != nil {
+		panic(err)
+	}
+}
+
+// archived configs of nodes the web user can view, those without a valid mac
+// only to viewers of all nodes
+func viewableArchivedCfgs(r *http.Request) ([]ccm.ArchivedCfg, error) {
+	acs, err := ccm.ListArchivedCfgs()
+	if err != nil {
+		return nil, err
+	}
+	viewable := make([]ccm.ArchivedCfg, 0, len(acs))
+	for _, ac := range acs {
+		if canViewNode(r, ac.Mac) {
+			viewable = append(viewable, ac)
+		}
+	}
+	return viewable, nil
+}
+
+// check the web user can view an archived config, both by the node now and
+// as it was configured
+func authorizeArchived(r *http.Request, ac *ccm.ArchivedCfg) error {
+	if err := authorizeNodes(r, auth.Viewer, ac.Mac); err != nil {
+		return err
+	}
+	return authorizeRawCfg(r, auth.Viewer, ac.RawYaml)
+}
+
+// an archived config, diffed against the active config of the same node, or
+// another archived config specified by ?against=<id>
+func cnodeViewArchived(w http.ResponseWriter, r *http.Request) {
+	id, against := r.URL.Query().Get("id"), r.URL.Query().Get("against")
+
+	jsonResult := make(map[string]interface{}, 5)
+	func() {
+		defer func() {
+			if e := recover(); e != nil {
+				glog.Errorf("Error viewing archived config [%s]:\n+%v", id, e)
+				jsonResult["err"] = fmt.Sprintf("Unexpected error: %+v", e)
+			}
+		}()
+
+		ac, err := ccm.LoadArchivedCfg(id)
+		if err != nil {
+			jsonResult["err"] = fmt.Sprintf("Failed loading archived config: %+v", err)
+			return
+		}
+		if ac == nil {
+			jsonResult["err"] = fmt.Sprintf("No archived config [%s]", id)
+			return
+		}
+		if err := authorizeArchived(r, ac); err != nil {
+			jsonResult["err"] = err.Error()
+			return
+		}
+		jsonResult["archived"] = ac
+
+		var base string
+		if len(against) > 0 {
+			other, err := ccm.LoadArchivedCfg(against)
+			if err != nil {
+				jsonResult["err"] = fmt.Sprintf("Failed loading archived config: %+v", err)
+				return
+			}
+			if other == nil {
+				jsonResult["err"] = fmt.Sprintf("No archived config [%s]", against)
+				return
+			}
+			if err := authorizeArchived(r, other); err != nil {
+				delete(jsonResult, "archived")
+				jsonResult["err"] = err.Error()
+				return
+			}
+			base = other.RawYaml
+			jsonResult["against"] = against
+		} else if len(ac.Mac) > 0 {
+			if cfg := ccm.GetComputeNodeCfg(ac.Mac); cfg != nil {
+				base = cfg.RawYaml
+				jsonResult["against"] = cfg.FileName
+			}
+		}
+		if len(base) > 0 {
+			jsonResult["diff"] = ccm.DiffLines(base, ac.RawYaml)
+		}
+	}()
+	if err := json.NewEncoder(w).Encode(jsonResult); err != nil {
+		panic(err)
+	}
+}
+
+func cnodeRestoreArchived(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		ID string
+		// fixed content to restore, the archived content if empty
+		RawYaml string
+	}{}
+	jsonDecoder := json.NewDecoder(r.Body)
+	jsonDecoder.Decode(&req)
+
+	jsonResult := make(map[string]interface{}, 5)
+	func() {
+		defer func() {
+			if e := recover(); e != nil {
+				glog.Errorf("Error restoring archived config [%s]:\n+%v", req.ID, e)
+				jsonResult["err"] = fmt.Sprintf("Unexpected error: %+v", e)
+			}
+		}()
+
+		// checked as the config would be restored
+		restoring := req.RawYaml
+		if len(restoring) <= 0 {
+			if ac, err := ccm.LoadArchivedCfg(req.ID); err == nil && ac != nil {
+				restoring = ac.RawYaml
+			}
+		}
+		if err := authorizeRawCfg(r, auth.Admin, restoring); err != nil {
+			jsonResult["err"] = err.Error()
+			return
+		}
+
+		var rawYaml []byte
+		if len(req.RawYaml) > 0 {
+			rawYaml = []byte(req.RawYaml)
+		}
+		cfg, err := ccm.RestoreArchivedCfg(req.ID, rawYaml)
+		if err != nil {
+			jsonResult["err"] = fmt.Sprintf("Failed restoring: %+v", err)
+			return
+		}
+		glog.Infof("Archived config [%s] restored as [%s].", req.ID, cfg.FileName)
+		ip, _ := cfg.Inflate()["ip"].(string)
+		auditAction(r, audit.Entry{Action: "restore", Mac: cfg.Mac, IP: ip,
+			Detail: "archived " + req.ID + " restored as " + cfg.FileName, After: cfg.ETag})
+		jsonResult["mac"] = cfg.Mac
+		jsonResult["etag"] = cfg.ETag
+	}()
+	if err := json.NewEncoder(w).Encode(jsonResult); err != nil {
+		panic(err)
+	}
+}
+
+func cnodePurgeArchived(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		IDs []string
+	}{}
+	jsonDecoder := json.NewDecoder(r.Body)
+	jsonDecoder.Decode(&req)
+
+	jsonResult := make(map[string]interface{}, 5)
+	func() {
+		defer func() {
+			if e := recover(); e != nil {
+				glog.Errorf("Error purging archived configs:\n+%v", e)
+				jsonResult["err"] = fmt.Sprintf("Unexpected error: %+v", e)
+			}
+		}()
+
+		// archived configs are out of any group
+		if webRoleOn(r, nil) < auth.Admin {
+			jsonResult["err"] = "admin role on all nodes required to purge"
+			return
+		}
+
+		purged := 0
+		for _, id := range req.IDs {
+			ac, err := ccm.LoadArchivedCfg(id)
+			if err == nil {
+				err = ccm.PurgeArchivedCfg(id)
+			}
+			if err != nil {
+				jsonResult["err"] = fmt.Sprintf("Failed purging [%s]: %+v", id, err)
+				break
+			}
+			if ac != nil {
+				auditAction(r, audit.Entry{Action: "purge", Mac: ac.Mac,
+					Detail: "archived " + id + " purged", Before: ccm.CfgETag([]byte(ac.RawYaml))})
+			}
+			purged++
+		}
+		jsonResult["purged"] = purged
+	}()
+	if err := json.NewEncoder(w).Encode(jsonResult); err != nil {
+		panic(err)
+	}
+}
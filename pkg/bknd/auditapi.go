@@ -0,0 +1,149 @@
+package bknd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/complyue/different-hpc/pkg/audit"
+	"github.com/complyue/different-hpc/pkg/auth"
+	"github.com/complyue/different-hpc/pkg/ccm"
+	"github.com/complyue/hbi/pkg/errors"
+	"github.com/golang/glog"
+)
+
+// record an action taken by the web user of a request in the audit log
+func auditAction(r *http.Request, e audit.Entry) {
+	e.Actor, e.Source = webUser(r), remoteIP(r)
+	audit.Record(e)
+}
+
+// whether the web user is admin on all nodes, to read the whole audit log,
+// others only read entries of nodes they are admin on
+func isGlobalAdmin(r *http.Request) bool {
+	return webRoleOn(r, nil) >= auth.Admin
+}
+
+// audit filter from query params mac, actor, action, since and until, with
+// times in RFC3339, and only entries of nodes the web user is admin on unless
+// admin on all nodes
+func auditFilterOf(r *http.Request) (audit.Filter, error) {
+	q := r.URL.Query()
+	f := audit.Filter{Actor: q.Get("actor"), Action: q.Get("action")}
+	if !isGlobalAdmin(r) {
+		administered := make(map[string]bool)
+		f.Allow = func(e *audit.Entry) bool {
+			ok, checked := administered[e.Mac]
+			if !checked {
+				ok = authorizeNodes(r, auth.Admin, e.Mac) == nil
+				administered[e.Mac] = ok
+			}
+			return ok
+		}
+	}
+	if mac := q.Get("mac"); len(mac) > 0 {
+		normMac, err := ccm.NormalizeMac(mac)
+		if err != nil {
+			return f, errors.Errorf("invalid mac [%s]: %v", mac, err)
+		}
+		f.Mac = normMac
+	}
+	for _, tp := range []struct {
+		name string
+		t    *time.Time
+	}{{"since", &f.Since}, {"until", &f.Until}} {
+		if s := q.Get(tp.name); len(s) > 0 {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				return f, errors.Errorf("invalid %s [%s]: %v", tp.name, s, err)
+			}
+			*tp.t = t
+		}
+	}
+	return f, nil
+}
+
+func auditListEntries(w http.ResponseWriter, r *http.Request) {
+	jsonResult := make(map[string]interface{}, 5)
+	func() {
+		defer func() {
+			if e := recover(); e != nil {
+				glog.Errorf("Error listing audit entries:\n+%v", e)
+				jsonResult["err"] = fmt.Sprintf("Unexpected error: %+v", e)
+			}
+		}()
+
+		f, err := auditFilterOf(r)
+		if err != nil {
+			jsonResult["err"] = err.Error()
+			return
+		}
+		limit := 200
+		if s := r.URL.Query().Get("limit"); len(s) > 0 {
+			if limit, err = strconv.Atoi(s); err != nil {
+				jsonResult["err"] = fmt.Sprintf("Invalid limit [%s]", s)
+				return
+			}
+		}
+		entries, err := audit.Query(f, limit)
+		if err != nil {
+			jsonResult["err"] = fmt.Sprintf("Failed reading audit log: %+v", err)
+			return
+		}
+		// most recent first
+		for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+			entries[i], entries[j] = entries[j], entries[i]
+		}
+		jsonResult["entries"] = entries
+	}()
+	if err := json.NewEncoder(w).Encode(jsonResult); err != nil {
+		panic(err)
+	}
+}
+
+// audit entries as json lines, exactly as stored
+func auditExport(w http.ResponseWriter, r *http.Request) {
+	f, err := auditFilterOf(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(
+		`attachment; filename="dhpc-audit-%s.jsonl"`, time.Now().Format("20060102-150405")))
+	if err := audit.Export(w, f); err != nil {
+		// headers are likely sent already
+		glog.Errorf("Error exporting audit log: %+v", err)
+	}
+}
+
+func auditVerify(w http.ResponseWriter, r *http.Request) {
+	jsonResult := make(map[string]interface{}, 5)
+	func() {
+		defer func() {
+			if e := recover(); e != nil {
+				glog.Errorf("Error verifying audit log:\n+%v", e)
+				jsonResult["err"] = fmt.Sprintf("Unexpected error: %+v", e)
+			}
+		}()
+
+		if !isGlobalAdmin(r) {
+			jsonResult["err"] = fmt.Sprintf("%s role required on all nodes", auth.Admin)
+			return
+		}
+		v, err := audit.Verify()
+		if err != nil {
+			jsonResult["err"] = fmt.Sprintf("Failed reading audit log: %+v", err)
+			return
+		}
+		if !v.OK {
+			glog.Warningf("Audit log broken at line %d: %s", v.BrokenLine, v.Problem)
+		}
+		jsonResult["verification"] = v
+	}()
+	if err := json.NewEncoder(w).Encode(jsonResult); err != nil {
+		panic(err)
+	}
+}
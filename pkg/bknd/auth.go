@@ -0,0 +1,300 @@
+package bknd
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/complyue/different-hpc/pkg/audit"
+	"github.com/complyue/different-hpc/pkg/auth"
+	"github.com/flosch/pongo2"
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+)
+
+const (
+	sessionCookie = "dhpc_session"
+	// state of an oidc login in progress, bound to the browser
+	oidcStateCookie = "dhpc_oidc_state"
+)
+
+type ctxKey int
+
+const webIdentityKey ctxKey = iota
+
+// who a request is authenticated as
+type webIdentity struct {
+	User string
+	// role granted by the identity provider, on all nodes
+	Grant auth.Role
+	// nil if authenticated by api token
+	Session *auth.Session
+}
+
+func identityOf(r *http.Request) *webIdentity {
+	id, _ := r.Context().Value(webIdentityKey).(*webIdentity)
+	return id
+}
+
+// paths served without authentication, nodes talk to these and are
+// authenticated by tokens or source ips there
+func isPublicPath(path string) bool {
+	switch path {
+	case "/login", "/ssh/v1/known_hosts":
+		return true
+	}
+	for _, prefix := range []string{"/static/", "/login/oidc/", "/agent/v1/", "/cloudinit/v1/", "/hostkey/v1/"} {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func authenticate(r *http.Request) *webIdentity {
+	if authz := r.Header.Get("Authorization"); strings.HasPrefix(authz, "Bearer ") {
+		if user := auth.UserOfToken(strings.TrimSpace(authz[len("Bearer "):])); len(user) > 0 {
+			return &webIdentity{User: user}
+		}
+		return nil
+	}
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil
+	}
+	sess := auth.GetSession(c.Value)
+	if sess == nil {
+		return nil
+	}
+	if len(sess.Provider) > 0 {
+		// sessions of a provider end with it removed
+		if GetWebCfg().Provider(sess.Provider) == nil {
+			return nil
+		}
+	} else if !auth.HasUser(sess.User) {
+		return nil
+	}
+	return &webIdentity{User: sess.User, Grant: sess.Grant, Session: sess}
+}
+
+func checkCSRF(r *http.Request, sess *auth.Session) bool {
+	token := r.Header.Get("X-CSRF-Token")
+	if len(token) <= 0 {
+		token = r.PostFormValue("csrf")
+	}
+	return len(token) > 0 && subtle.ConstantTimeCompare([]byte(token), []byte(sess.CSRFToken)) == 1
+}
+
+// require authentication for all but public paths, with a login session or
+// an api token as bearer. mutating requests of sessions have to present the
+// csrf token of the session. pixiecore is trusted by source address.
+func Authenticate(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := auth.GetAuthCfg()
+		if !cfg.Enabled {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/pixie/v1/boot/") {
+			if !cfg.IsPixieSource(remoteIP(r)) {
+				glog.Warningf("Boot request from untrusted source [%s] refused.", r.RemoteAddr)
+				http.Error(w, "untrusted source", http.StatusForbidden)
+				return
+			}
+			h.ServeHTTP(w, r)
+			return
+		}
+		if isPublicPath(r.URL.Path) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		id := authenticate(r)
+		if id == nil {
+			if "GET" == r.Method && strings.Contains(r.Header.Get("Accept"), "text/html") {
+				http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+				return
+			}
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+		switch r.Method {
+		case "GET", "HEAD", "OPTIONS":
+		default:
+			if id.Session != nil && !checkCSRF(r, id.Session) {
+				glog.Warningf("Request to [%s] of [%s] from [%s] without valid csrf token refused.",
+					r.URL.Path, id.User, r.RemoteAddr)
+				http.Error(w, "invalid csrf token", http.StatusForbidden)
+				return
+			}
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), webIdentityKey, id)))
+	})
+}
+
+// a local path to go after login, never off site
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+var loginPage = &Pongo2Page{
+	TmplFile: "web/templates/login.html",
+	UpdateCtx: func(ctx pongo2.Context, r *http.Request) {
+		ctx["title"] = "Log in - Different HPC Control Center"
+		ctx["next"] = safeNext(r.FormValue("next"))
+		switch r.FormValue("failed") {
+		case "1":
+			ctx["err"] = "Wrong user or password."
+		case "oidc":
+			ctx["err"] = "Login with the identity provider failed."
+		}
+		var oidcNames []string
+		for _, pc := range GetWebCfg().ProvidersOf("oidc") {
+			oidcNames = append(oidcNames, pc.Name)
+		}
+		ctx["oidcProviders"] = oidcNames
+	},
+}
+
+func webLoginPage(w http.ResponseWriter, r *http.Request) {
+	if !auth.GetAuthCfg().Enabled {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	loginPage.ServeHTTP(w, r)
+}
+
+// start a login session, and go to next
+func startSession(w http.ResponseWriter, r *http.Request, p *auth.Principal, next string) {
+	id, sess, err := auth.NewSession(*p)
+	if err != nil {
+		panic(err)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     "/",
+		Expires:  sess.Expires,
+		HttpOnly: true,
+		Secure:   auth.GetAuthCfg().SecureCookie,
+		SameSite: http.SameSiteLaxMode,
+	})
+	detail := "local user"
+	if len(p.Provider) > 0 {
+		glog.Infof("[%s] logged in via [%s] from [%s], groups %v granting %s.",
+			p.User, p.Provider, r.RemoteAddr, p.Groups, p.Role)
+		detail = fmt.Sprintf("via %s, groups %v granting %s", p.Provider, p.Groups, p.Role)
+	} else {
+		glog.Infof("[%s] logged in from [%s].", p.User, r.RemoteAddr)
+	}
+	audit.Record(audit.Entry{Actor: p.User, Source: remoteIP(r), Action: "login", Detail: detail})
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+// log in as a local user, or by ldap providers in order
+func webLogin(w http.ResponseWriter, r *http.Request) {
+	user, password := r.PostFormValue("user"), r.PostFormValue("password")
+	next := safeNext(r.PostFormValue("next"))
+	if auth.CheckPassword(user, password) {
+		startSession(w, r, &auth.Principal{User: user}, next)
+		return
+	}
+	for _, pc := range GetWebCfg().ProvidersOf("ldap") {
+		p, err := pc.LdapLogin(user, password)
+		if err != nil {
+			glog.Warningf("Ldap login of [%s] via [%s] failed: %v", user, pc.Name, err)
+			continue
+		}
+		startSession(w, r, p, next)
+		return
+	}
+	glog.Warningf("Failed login of [%s] from [%s].", user, r.RemoteAddr)
+	audit.Record(audit.Entry{Actor: user, Source: remoteIP(r), Action: "login-failed"})
+	// slow down password guessing
+	time.Sleep(time.Second)
+	http.Redirect(w, r, "/login?failed=1&next="+url.QueryEscape(next), http.StatusSeeOther)
+}
+
+// redirect to an oidc provider to log in
+func webOidcLogin(w http.ResponseWriter, r *http.Request) {
+	pc := GetWebCfg().Provider(mux.Vars(r)["provider"])
+	if pc == nil || "oidc" != pc.Type {
+		http.NotFound(w, r)
+		return
+	}
+	authURL, state, err := pc.BeginOidcLogin(r.Context(), safeNext(r.FormValue("next")))
+	if err != nil {
+		glog.Errorf("Error starting login via [%s]: %+v", pc.Name, err)
+		http.Redirect(w, r, "/login?failed=oidc", http.StatusSeeOther)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/login/oidc/",
+		MaxAge:   int((10 * time.Minute).Seconds()),
+		HttpOnly: true,
+		Secure:   auth.GetAuthCfg().SecureCookie,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// an oidc provider redirects back here after the user logged in
+func webOidcCallback(w http.ResponseWriter, r *http.Request) {
+	pc := GetWebCfg().Provider(mux.Vars(r)["provider"])
+	if pc == nil || "oidc" != pc.Type {
+		http.NotFound(w, r)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/login/oidc/", MaxAge: -1})
+
+	q := r.URL.Query()
+	if e := q.Get("error"); len(e) > 0 {
+		glog.Warningf("Login via [%s] from [%s] failed: %s %s", pc.Name, r.RemoteAddr, e, q.Get("error_description"))
+		http.Redirect(w, r, "/login?failed=oidc", http.StatusSeeOther)
+		return
+	}
+	state := q.Get("state")
+	c, err := r.Cookie(oidcStateCookie)
+	if err != nil || len(state) <= 0 || subtle.ConstantTimeCompare([]byte(c.Value), []byte(state)) != 1 {
+		glog.Warningf("Login via [%s] from [%s] with mismatching state refused.", pc.Name, r.RemoteAddr)
+		http.Redirect(w, r, "/login?failed=oidc", http.StatusSeeOther)
+		return
+	}
+	p, next, err := pc.FinishOidcLogin(r.Context(), state, q.Get("code"))
+	if err != nil {
+		glog.Warningf("Login via [%s] from [%s] failed: %+v", pc.Name, r.RemoteAddr, err)
+		auditAction(r, audit.Entry{Action: "login-failed", Detail: "via " + pc.Name + ": " + err.Error()})
+		http.Redirect(w, r, "/login?failed=oidc", http.StatusSeeOther)
+		return
+	}
+	startSession(w, r, p, next)
+}
+
+func webLogout(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		auth.EndSession(c.Value)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   auth.GetAuthCfg().SecureCookie,
+		SameSite: http.SameSiteLaxMode,
+	})
+	if id := identityOf(r); id != nil {
+		glog.Infof("[%s] logged out.", id.User)
+		auditAction(r, audit.Entry{Action: "logout"})
+	}
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
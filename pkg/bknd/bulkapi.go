@@ -0,0 +1,114 @@
+package bknd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/complyue/different-hpc/pkg/audit"
+	"github.com/complyue/different-hpc/pkg/auth"
+	"github.com/complyue/different-hpc/pkg/ccm"
+	"github.com/golang/glog"
+)
+
+type bulkPatchReq struct {
+	Selection ccm.NodeSelection
+	Ops       []ccm.CfgPatchOp
+	// etags of configs previewed, keyed by mac, for apply
+	ETags map[string]string
+}
+
+// admin role is required on nodes patched, before and after the patch
+func authorizePatch(r *http.Request, previews []ccm.CfgPatchPreview) error {
+	for _, pv := range previews {
+		if err := authorizeNodes(r, auth.Admin, pv.Mac); err != nil {
+			return err
+		}
+		if len(pv.After) > 0 {
+			if err := authorizeRawCfg(r, auth.Admin, pv.After); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func cnodeBulkPreview(w http.ResponseWriter, r *http.Request) {
+	var req bulkPatchReq
+	jsonDecoder := json.NewDecoder(r.Body)
+	jsonDecoder.Decode(&req)
+
+	jsonResult := make(map[string]interface{}, 5)
+	func() {
+		defer func() {
+			if e := recover(); e != nil {
+				glog.Errorf("Error previewing bulk config patch:\n+%v", e)
+				jsonResult["err"] = fmt.Sprintf("Unexpected error: %+v", e)
+			}
+		}()
+
+		previews, err := ccm.PreviewCfgPatch(req.Selection, req.Ops)
+		if err != nil {
+			jsonResult["err"] = fmt.Sprintf("Failed previewing patch: %+v", err)
+			return
+		}
+		if err := authorizePatch(r, previews); err != nil {
+			jsonResult["err"] = err.Error()
+			return
+		}
+		jsonResult["previews"] = previews
+	}()
+	if err := json.NewEncoder(w).Encode(jsonResult); err != nil {
+		panic(err)
+	}
+}
+
+func cnodeBulkApply(w http.ResponseWriter, r *http.Request) {
+	var req bulkPatchReq
+	jsonDecoder := json.NewDecoder(r.Body)
+	jsonDecoder.Decode(&req)
+
+	jsonResult := make(map[string]interface{}, 5)
+	func() {
+		defer func() {
+			if e := recover(); e != nil {
+				glog.Errorf("Error applying bulk config patch:\n+%v", e)
+				jsonResult["err"] = fmt.Sprintf("Unexpected error: %+v", e)
+			}
+		}()
+
+		previews, err := ccm.PreviewCfgPatch(req.Selection, req.Ops)
+		if err != nil {
+			jsonResult["err"] = fmt.Sprintf("Failed previewing patch: %+v", err)
+			return
+		}
+		if err := authorizePatch(r, previews); err != nil {
+			jsonResult["err"] = err.Error()
+			return
+		}
+
+		results, err := ccm.ApplyCfgPatch(req.Selection, req.Ops, req.ETags)
+		if err != nil {
+			if cce, ok := err.(*ccm.CfgChangedError); ok {
+				jsonResult["err"] = fmt.Sprintf("%s since previewed, please preview again.", cce.Error())
+				return
+			}
+			glog.Errorf("Error applying bulk config patch:\n%+v", err)
+			jsonResult["err"] = fmt.Sprintf("Failed applying patch: %+v", err)
+			return
+		}
+		glog.Infof("Bulk config patch applied to %d nodes.", len(results))
+		for _, pv := range results {
+			if len(pv.RawDiff) <= 0 {
+				continue // not changed
+			}
+			auditAction(r, audit.Entry{Action: "bulk-save", Mac: pv.Mac, IP: pv.IP,
+				Detail: fmt.Sprintf("bulk patch of %d nodes", len(results)),
+				Before: pv.ETag, After: ccm.CfgETag([]byte(pv.After))})
+		}
+		jsonResult["results"] = results
+	}()
+	if err := json.NewEncoder(w).Encode(jsonResult); err != nil {
+		panic(err)
+	}
+}
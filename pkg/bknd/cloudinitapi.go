@@ -0,0 +1,77 @@
+package bknd
+
+import (
+	"net/http"
+	"os"
+
+	"github.com/complyue/different-hpc/pkg/ccm"
+	"github.com/complyue/different-hpc/pkg/cloudinit"
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+)
+
+func serveCloudInitData(w http.ResponseWriter, r *http.Request, cfg *ccm.ComputeNodeCfg, file string) {
+	data, err := cloudinit.Render(cfg, file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+			return
+		}
+		glog.Errorf("Error rendering cloud-init %s for mac=[%s]: %+v", file, cfg.Mac, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(data)
+
+	if "user-data" == file {
+		ip, _ := cfg.Inflate()["ip"].(string)
+		ccm.RecordHistory(cfg.Mac, ip, "cloudinit", "user-data served to "+remoteIP(r))
+	}
+}
+
+// NoCloud data for the compute node identified by token in url
+func cloudInitByToken(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !cloudinit.DataFiles[vars["file"]] {
+		http.NotFound(w, r)
+		return
+	}
+	mac, err := cloudinit.MacOfToken(vars["token"])
+	if err != nil {
+		glog.Warningf("Cloud-init request from [%s] refused: %v", remoteIP(r), err)
+		http.Error(w, "invalid token", http.StatusForbidden)
+		return
+	}
+	cfg := ccm.GetComputeNodeCfg(mac)
+	if cfg == nil {
+		http.Error(w, "no config for mac=["+mac+"]", http.StatusNotFound)
+		return
+	}
+	serveCloudInitData(w, r, cfg, vars["file"])
+}
+
+// NoCloud data for the compute node identified by source ip
+func cloudInitBySourceIP(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !cloudinit.DataFiles[vars["file"]] {
+		http.NotFound(w, r)
+		return
+	}
+	if !cloudinit.GetCloudInitCfg().BySourceIP {
+		http.Error(w, "identifying nodes by source ip disabled", http.StatusForbidden)
+		return
+	}
+	ip := remoteIP(r)
+	cfg, err := ccm.GetComputeNodeCfgByIP(ip)
+	if err != nil {
+		glog.Warningf("Cloud-init request from [%s] refused: %v", ip, err)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if cfg == nil {
+		http.Error(w, "no config for ip=["+ip+"]", http.StatusNotFound)
+		return
+	}
+	serveCloudInitData(w, r, cfg, vars["file"])
+}
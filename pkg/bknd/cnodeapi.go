@@ -3,18 +3,21 @@ package bknd
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 
+	"github.com/complyue/different-hpc/pkg/audit"
+	"github.com/complyue/different-hpc/pkg/auth"
 	"github.com/complyue/different-hpc/pkg/ccm"
 	"github.com/golang/glog"
 )
 
 func cnodeSaveCfg(w http.ResponseWriter, r *http.Request) {
 	req := struct {
-		FileName  string
+		Mac       string
 		AfterEdit string
-		PreEdit   string
+		// the config the edit is based on, and its etag
+		PreEdit string
+		ETag    string
 	}{}
 	jsonDecoder := json.NewDecoder(r.Body)
 	jsonDecoder.Decode(&req)
@@ -23,36 +26,88 @@ func cnodeSaveCfg(w http.ResponseWriter, r *http.Request) {
 	func() {
 		defer func() {
 			if e := recover(); e != nil {
-				glog.Errorf("Error saving compute node config file [%s]:\n+%v", req.FileName, e)
+				glog.Errorf("Error saving compute node config of mac=[%s]:\n+%v", req.Mac, e)
 				jsonResult["err"] = fmt.Sprintf("Unexpected error: %+v", e)
 			}
 		}()
 
-		oldCfg, err := ccm.LoadComputeNodeCfg(req.FileName, "")
+		mac, err := ccm.NormalizeMac(req.Mac)
 		if err != nil {
-			panic(err)
+			jsonResult["err"] = fmt.Sprintf("Invalid mac [%s]: %+v", req.Mac, err)
+			return
 		}
-		if oldCfg == nil {
-			// file disappeared
-			glog.Warningf("Config file [%s] disappeared.", req.FileName)
-		} else {
-			if len(req.PreEdit) > 0 && req.PreEdit != oldCfg.RawYaml {
-				jsonResult["err"] = fmt.Sprintf("Config file has changed!")
+
+		if err := authorizeNodes(r, auth.Admin, mac); err != nil {
+			jsonResult["err"] = err.Error()
+			return
+		}
+		if err := authorizeRawCfg(r, auth.Admin, req.AfterEdit); err != nil {
+			jsonResult["err"] = err.Error()
+			return
+		}
+
+		// etag of the config actually overwritten
+		before := req.ETag
+		cfg, err := ccm.SaveComputeNodeCfg(mac, ([]byte)(req.AfterEdit), req.ETag)
+		if cce, ok := err.(*ccm.CfgChangedError); ok && cce.Current != nil && len(req.PreEdit) > 0 {
+			// changed by others since edit started, try merge both edits, with
+			// the base verified to be what the etag was taken from
+			if ccm.CfgETag(([]byte)(req.PreEdit)) != req.ETag {
+				glog.Warningf("Edit base of config of mac=[%s] mismatches etag [%s].", mac, req.ETag)
+				jsonResult["err"] = fmt.Sprintf("Config has changed, and the edit base does not match its etag to merge!")
+				jsonResult["etag"] = cce.Current.ETag
+				return
+			}
+			merged, conflicts, mergeErr := ccm.MergeCfgYaml(req.PreEdit, cce.Current.RawYaml, req.AfterEdit)
+			if mergeErr != nil {
+				jsonResult["err"] = fmt.Sprintf("Config has changed, and can not be merged: %+v", mergeErr)
+				return
+			}
+			if len(conflicts) > 0 {
+				glog.Warningf("Concurrent edits to config of mac=[%s] conflict on %d keys.", mac, len(conflicts))
+				jsonResult["err"] = fmt.Sprintf("Config has changed, with conflicting edits!")
+				jsonResult["conflict"] = map[string]interface{}{
+					"keys":    conflicts,
+					"current": cce.Current.RawYaml,
+					"mine":    req.AfterEdit,
+					"merged":  merged,
+					"etag":    cce.Current.ETag,
+				}
 				return
 			}
-			ccm.ForgetCfg(oldCfg)
+			glog.Infof("Concurrent edits to config of mac=[%s] merged.", mac)
+			jsonResult["merged"] = true
+			before = cce.Current.ETag
+			cfg, err = ccm.SaveComputeNodeCfg(mac, ([]byte)(merged), cce.Current.ETag)
 		}
-
-		if err := ioutil.WriteFile(req.FileName, ([]byte)(req.AfterEdit), 0644); err != nil {
-			glog.Errorf("Error saving compute node config file [%s]:\n%+v", req.FileName, err)
-			jsonResult["err"] = fmt.Sprintf("Failed saving config file: %+v", err)
+		if err != nil {
+			if cce, ok := err.(*ccm.CfgChangedError); ok {
+				glog.Warningf("Not saving stale config of mac=[%s].", mac)
+				jsonResult["err"] = fmt.Sprintf("Config has changed!")
+				if cce.Current != nil {
+					jsonResult["etag"] = cce.Current.ETag
+				}
+				return
+			}
+			if cce, ok := err.(*ccm.CfgConflictError); ok {
+				glog.Warningf("Not saving config of mac=[%s]: %s", mac, cce.Error())
+				jsonResult["err"] = fmt.Sprintf("Config would clash with others: %s", cce.Error())
+				jsonResult["conflicts"] = cce.Conflicts
+				return
+			}
+			glog.Errorf("Error saving compute node config of mac=[%s]:\n%+v", mac, err)
+			jsonResult["err"] = fmt.Sprintf("Failed saving config: %+v", err)
+			return
 		}
-
-		if cfg, err := ccm.ReloadComputeNodeCfg(req.FileName); err != nil {
-			panic(err)
-		} else {
-			ccm.CareIpAliveness(cfg.Inflate()["ip"].(string), false, cfg)
+		ip, _ := cfg.Inflate()["ip"].(string)
+		detail := cfg.FileName
+		if merged, _ := jsonResult["merged"].(bool); merged {
+			detail += " (merged with concurrent edits)"
 		}
+		auditAction(r, audit.Entry{Action: "save", Mac: mac, IP: ip, Detail: detail,
+			Before: before, After: cfg.ETag})
+		jsonResult["etag"] = cfg.ETag
+		jsonResult["rawYaml"] = cfg.RawYaml
 	}()
 	if err := json.NewEncoder(w).Encode(jsonResult); err != nil {
 		panic(err)
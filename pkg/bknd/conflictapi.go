@@ -0,0 +1,140 @@
+package bknd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/complyue/different-hpc/pkg/audit"
+	"github.com/complyue/different-hpc/pkg/auth"
+	"github.com/complyue/different-hpc/pkg/ccm"
+	"github.com/golang/glog"
+)
+
+func cnodeListConflicts(w http.ResponseWriter, r *http.Request) {
+	jsonResult := make(map[string]interface{}, 5)
+	func() {
+		defer func() {
+			if e := recover(); e != nil {
+				glog.Errorf("Error listing config conflicts:\n+%v", e)
+				jsonResult["err"] = fmt.Sprintf("Unexpected error: %+v", e)
+			}
+		}()
+
+		jsonResult["conflicts"] = viewableConflicts(r)
+	}()
+	if err := json.NewEncoder(w).Encode(jsonResult); err != nil {
+		panic(err)
+	}
+}
+
+// config conflicts with only holders the web user can view
+func viewableConflicts(r *http.Request) []ccm.CfgConflict {
+	var conflicts []ccm.CfgConflict
+	for _, c := range ccm.ListCfgConflicts() {
+		var holders []ccm.CfgHolder
+		for _, h := range c.Holders {
+			if canViewNode(r, h.Mac) {
+				holders = append(holders, h)
+			}
+		}
+		if len(holders) > 0 {
+			c.Holders = holders
+			conflicts = append(conflicts, c)
+		}
+	}
+	return conflicts
+}
+
+func cnodeArchiveConflicting(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Mac      string
+		FileName string
+	}{}
+	jsonDecoder := json.NewDecoder(r.Body)
+	jsonDecoder.Decode(&req)
+
+	jsonResult := make(map[string]interface{}, 5)
+	func() {
+		defer func() {
+			if e := recover(); e != nil {
+				glog.Errorf("Error archiving conflicting config [%s]:\n+%v", req.FileName, e)
+				jsonResult["err"] = fmt.Sprintf("Unexpected error: %+v", e)
+			}
+		}()
+
+		mac, err := ccm.NormalizeMac(req.Mac)
+		if err != nil {
+			jsonResult["err"] = fmt.Sprintf("Invalid mac [%s]: %+v", req.Mac, err)
+			return
+		}
+
+		if err := authorizeNodes(r, auth.Admin, mac); err != nil {
+			jsonResult["err"] = err.Error()
+			return
+		}
+		var before, ip string
+		if cfg := ccm.GetComputeNodeCfg(mac); cfg != nil && cfg.FileName == req.FileName {
+			before = cfg.ETag
+			ip, _ = cfg.Inflate()["ip"].(string)
+		}
+		if err = ccm.ArchiveConflictingCfg(mac, req.FileName); err != nil {
+			jsonResult["err"] = fmt.Sprintf("Failed archiving: %+v", err)
+			return
+		}
+		glog.Infof("Conflicting config [%s] of mac=[%s] archived.", req.FileName, mac)
+		auditAction(r, audit.Entry{Action: "archive", Mac: mac, IP: ip,
+			Detail: req.FileName + " archived as conflicting", Before: before})
+		jsonResult["archived"] = true
+	}()
+	if err := json.NewEncoder(w).Encode(jsonResult); err != nil {
+		panic(err)
+	}
+}
+
+func cnodeReassignIP(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Mac string
+	}{}
+	jsonDecoder := json.NewDecoder(r.Body)
+	jsonDecoder.Decode(&req)
+
+	jsonResult := make(map[string]interface{}, 5)
+	func() {
+		defer func() {
+			if e := recover(); e != nil {
+				glog.Errorf("Error reassigning ip to mac=[%s]:\n+%v", req.Mac, e)
+				jsonResult["err"] = fmt.Sprintf("Unexpected error: %+v", e)
+			}
+		}()
+
+		mac, err := ccm.NormalizeMac(req.Mac)
+		if err != nil {
+			jsonResult["err"] = fmt.Sprintf("Invalid mac [%s]: %+v", req.Mac, err)
+			return
+		}
+
+		if err := authorizeNodes(r, auth.Admin, mac); err != nil {
+			jsonResult["err"] = err.Error()
+			return
+		}
+		var before, oldIP string
+		if cfg := ccm.GetComputeNodeCfg(mac); cfg != nil {
+			before = cfg.ETag
+			oldIP, _ = cfg.Inflate()["ip"].(string)
+		}
+		cfg, err := ccm.ReassignComputeNodeIP(mac)
+		if err != nil {
+			jsonResult["err"] = fmt.Sprintf("Failed reassigning ip: %+v", err)
+			return
+		}
+		ip, _ := cfg.Inflate()["ip"].(string)
+		auditAction(r, audit.Entry{Action: "reassign", Mac: cfg.Mac, IP: ip,
+			Detail: "ip was " + oldIP, Before: before, After: cfg.ETag})
+		jsonResult["etag"] = cfg.ETag
+		jsonResult["rawYaml"] = cfg.RawYaml
+	}()
+	if err := json.NewEncoder(w).Encode(jsonResult); err != nil {
+		panic(err)
+	}
+}
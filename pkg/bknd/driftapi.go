@@ -0,0 +1,22 @@
+package bknd
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/complyue/different-hpc/pkg/ccm"
+)
+
+func cnodeListDrift(w http.ResponseWriter, r *http.Request) {
+	jsonResult := make(map[string]interface{}, 5)
+	var nodes []ccm.DriftState
+	for _, ds := range ccm.ListDriftStates("" != r.URL.Query().Get("all")) {
+		if canViewNode(r, ds.Mac) {
+			nodes = append(nodes, ds)
+		}
+	}
+	jsonResult["nodes"] = nodes
+	if err := json.NewEncoder(w).Encode(jsonResult); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,169 @@
+package bknd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/complyue/different-hpc/pkg/audit"
+	"github.com/complyue/different-hpc/pkg/auth"
+	"github.com/complyue/different-hpc/pkg/ccm"
+	"github.com/complyue/different-hpc/pkg/remote"
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+)
+
+func cnodeStartExec(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Selection ccm.NodeSelection
+		Command   string
+		Timeout   string
+	}{}
+	jsonDecoder := json.NewDecoder(r.Body)
+	jsonDecoder.Decode(&req)
+
+	jsonResult := make(map[string]interface{}, 5)
+	func() {
+		defer func() {
+			if e := recover(); e != nil {
+				glog.Errorf("Error starting command run:\n+%v", e)
+				jsonResult["err"] = fmt.Sprintf("Unexpected error: %+v", e)
+			}
+		}()
+
+		if err := authorizeSelection(r, auth.Operator, req.Selection); err != nil {
+			jsonResult["err"] = err.Error()
+			return
+		}
+		run, err := remote.StartExec(req.Selection, req.Command, req.Timeout)
+		if err != nil {
+			jsonResult["err"] = fmt.Sprintf("Failed starting command run: %+v", err)
+			return
+		}
+		glog.Infof("Command run #%d started on %d nodes: %s", run.ID, len(run.Nodes), run.Command)
+		for _, n := range run.Nodes {
+			auditAction(r, audit.Entry{Action: "exec", Mac: n.Mac, IP: n.IP,
+				Detail: fmt.Sprintf("#%d %s", run.ID, run.Command)})
+		}
+		jsonResult["run"] = run
+	}()
+	if err := json.NewEncoder(w).Encode(jsonResult); err != nil {
+		panic(err)
+	}
+}
+
+func cnodeListExecRuns(w http.ResponseWriter, r *http.Request) {
+	jsonResult := make(map[string]interface{}, 5)
+	func() {
+		defer func() {
+			if e := recover(); e != nil {
+				glog.Errorf("Error listing command runs:\n+%v", e)
+				jsonResult["err"] = fmt.Sprintf("Unexpected error: %+v", e)
+			}
+		}()
+
+		runs, err := remote.ListExecRuns()
+		if err != nil {
+			jsonResult["err"] = fmt.Sprintf("Failed listing command runs: %+v", err)
+			return
+		}
+		var viewable []remote.ExecRunSummary
+		for _, run := range runs {
+			for _, mac := range run.Macs {
+				if canViewNode(r, mac) {
+					viewable = append(viewable, run)
+					break
+				}
+			}
+		}
+		jsonResult["runs"] = viewable
+		if pubKey, err := remote.PublicKey(); err != nil {
+			jsonResult["err"] = fmt.Sprintf("Failed loading control center key: %+v", err)
+		} else {
+			jsonResult["pubKey"] = pubKey
+		}
+	}()
+	if err := json.NewEncoder(w).Encode(jsonResult); err != nil {
+		panic(err)
+	}
+}
+
+func cnodeViewExecRun(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	jsonResult := make(map[string]interface{}, 5)
+	func() {
+		defer func() {
+			if e := recover(); e != nil {
+				glog.Errorf("Error viewing command run #%s:\n+%v", vars["id"], e)
+				jsonResult["err"] = fmt.Sprintf("Unexpected error: %+v", e)
+			}
+		}()
+
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			jsonResult["err"] = err.Error()
+			return
+		}
+		run, err := remote.GetExecRun(id)
+		if err != nil {
+			jsonResult["err"] = fmt.Sprintf("Failed loading command run: %+v", err)
+			return
+		}
+		var nodes []remote.ExecNode
+		for _, n := range run.Nodes {
+			if canViewNode(r, n.Mac) {
+				nodes = append(nodes, n)
+			}
+		}
+		if len(nodes) <= 0 && len(run.Nodes) > 0 {
+			jsonResult["err"] = fmt.Sprintf("%s role required on nodes of command run #%d", auth.Viewer, id)
+			return
+		}
+		run.Nodes = nodes
+		jsonResult["run"] = run
+		jsonResult["groups"] = remote.GroupOutputs(run.Nodes)
+	}()
+	if err := json.NewEncoder(w).Encode(jsonResult); err != nil {
+		panic(err)
+	}
+}
+
+// output events of a command run since ?since=, waits a while if none yet
+func cnodeExecEvents(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	jsonResult := make(map[string]interface{}, 5)
+	func() {
+		defer func() {
+			if e := recover(); e != nil {
+				glog.Errorf("Error watching command run #%s:\n+%v", vars["id"], e)
+				jsonResult["err"] = fmt.Sprintf("Unexpected error: %+v", e)
+			}
+		}()
+
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			jsonResult["err"] = err.Error()
+			return
+		}
+		since, _ := strconv.Atoi(r.URL.Query().Get("since"))
+		events, done := remote.ExecEvents(id, since)
+		viewable := make([]remote.ExecEvent, 0, len(events))
+		for _, ev := range events {
+			if canViewNode(r, ev.Mac) {
+				viewable = append(viewable, ev)
+			}
+		}
+		jsonResult["events"] = viewable
+		// to follow on from, past events of nodes not viewable
+		if len(events) > 0 {
+			jsonResult["next"] = events[len(events)-1].Seq + 1
+		}
+		jsonResult["done"] = done
+	}()
+	if err := json.NewEncoder(w).Encode(jsonResult); err != nil {
+		panic(err)
+	}
+}
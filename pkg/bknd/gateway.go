@@ -1,15 +1,65 @@
 package bknd
 
 import (
+	"github.com/complyue/different-hpc/pkg/auth"
 	"github.com/gorilla/mux"
 )
 
 func DefineApiRoutes(router *mux.Router) {
 
 	// http route to pixiecore API
-	router.HandleFunc("/pixie/v1/boot/{mac}", pixieApi)
+	router.HandleFunc("/pixie/v1/boot/{mac}", pixieApi).Methods("GET")
+	router.HandleFunc("/pixie/v1/preview/{mac}", requireRole(auth.Viewer, pixiePreview)).Methods("GET")
+
+	// http route to node agent API
+	router.HandleFunc("/agent/v1/register", agentRegister).Methods("POST")
+	router.HandleFunc("/agent/v1/heartbeat", agentHeartbeat).Methods("POST")
+
+	// http route to cloud-init NoCloud data source
+	router.HandleFunc("/cloudinit/v1/t/{token}/{file}", cloudInitByToken).Methods("GET")
+	router.HandleFunc("/cloudinit/v1/{file}", cloudInitBySourceIP).Methods("GET")
+
+	// http route to ssh host keys of nodes
+	router.HandleFunc("/hostkey/v1/{mac}", hostKeyFetch).Methods("POST")
+	router.HandleFunc("/ssh/v1/known_hosts", sshKnownHosts).Methods("GET")
 
 	// http route to compute node API
-	router.HandleFunc("/cnode/v1/save", cnodeSaveCfg)
+	router.HandleFunc("/cnode/v1/save", requireRole(auth.Admin, cnodeSaveCfg)).Methods("POST")
+	router.HandleFunc("/cnode/v1/bulk/preview", requireRole(auth.Admin, cnodeBulkPreview)).Methods("POST")
+	router.HandleFunc("/cnode/v1/bulk/apply", requireRole(auth.Admin, cnodeBulkApply)).Methods("POST")
+	router.HandleFunc("/cnode/v1/conflicts", requireRole(auth.Viewer, cnodeListConflicts)).Methods("GET")
+	router.HandleFunc("/cnode/v1/conflicts/archive", requireRole(auth.Admin, cnodeArchiveConflicting)).Methods("POST")
+	router.HandleFunc("/cnode/v1/conflicts/reassign-ip", requireRole(auth.Admin, cnodeReassignIP)).Methods("POST")
+	router.HandleFunc("/cnode/v1/archived", requireRole(auth.Viewer, cnodeListArchived)).Methods("GET")
+	router.HandleFunc("/cnode/v1/archived/view", requireRole(auth.Viewer, cnodeViewArchived)).Methods("GET")
+	router.HandleFunc("/cnode/v1/archived/restore", requireRole(auth.Admin, cnodeRestoreArchived)).Methods("POST")
+	router.HandleFunc("/cnode/v1/archived/purge", requireRole(auth.Admin, cnodePurgeArchived)).Methods("POST")
+	router.HandleFunc("/cnode/v1/power/{mac}", requireRole(auth.Viewer, cnodePowerStatus)).Methods("GET")
+	router.HandleFunc("/cnode/v1/power/{mac}", requireRole(auth.Operator, cnodePowerAction)).Methods("POST")
+	router.HandleFunc("/cnode/v1/wake", requireRole(auth.Viewer, cnodeListWakeJobs)).Methods("GET")
+	router.HandleFunc("/cnode/v1/wake", requireRole(auth.Operator, cnodeWake)).Methods("POST")
+	router.HandleFunc("/cnode/v1/remedies", requireRole(auth.Viewer, cnodeListRemedies)).Methods("GET")
+	router.HandleFunc("/cnode/v1/rollout", requireRole(auth.Viewer, cnodeListRollouts)).Methods("GET")
+	router.HandleFunc("/cnode/v1/rollout", requireRole(auth.Operator, cnodeStartRollout)).Methods("POST")
+	router.HandleFunc("/cnode/v1/rollout/control", requireRole(auth.Operator, cnodeControlRollout)).Methods("POST")
+	router.HandleFunc("/cnode/v1/exec", requireRole(auth.Viewer, cnodeListExecRuns)).Methods("GET")
+	router.HandleFunc("/cnode/v1/exec", requireRole(auth.Operator, cnodeStartExec)).Methods("POST")
+	router.HandleFunc("/cnode/v1/exec/{id}", requireRole(auth.Viewer, cnodeViewExecRun)).Methods("GET")
+	router.HandleFunc("/cnode/v1/exec/{id}/events", requireRole(auth.Viewer, cnodeExecEvents)).Methods("GET")
+	router.HandleFunc("/cnode/v1/agents", requireRole(auth.Viewer, cnodeListAgents)).Methods("GET")
+	router.HandleFunc("/cnode/v1/agent/{mac}", requireRole(auth.Viewer, cnodeViewAgent)).Methods("GET")
+	router.HandleFunc("/cnode/v1/drift", requireRole(auth.Viewer, cnodeListDrift)).Methods("GET")
+	router.HandleFunc("/cnode/v1/inventory", requireRole(auth.Viewer, cnodeSearchInventory)).Methods("GET")
+	router.HandleFunc("/cnode/v1/inventory/alerts", requireRole(auth.Viewer, cnodeListInventoryAlerts)).Methods("GET")
+	router.HandleFunc("/cnode/v1/inventory/alerts/ack", requireRole(auth.Operator, cnodeAckInventoryAlerts)).Methods("POST")
+	router.HandleFunc("/cnode/v1/inventory/{mac}", requireRole(auth.Operator, cnodePutInventory)).Methods("POST")
+	router.HandleFunc("/term/v1/ws/{mac}", requireRole(auth.Operator, termWebsocket)).Methods("GET")
+	router.HandleFunc("/gui/v1/vnc/{mac}", requireRole(auth.Operator, guiVncWebsocket)).Methods("GET")
+	router.PathPrefix("/gui/{mac}").HandlerFunc(requireRole(auth.Operator, guiProxy))
+
+	// http route to audit log API
+	router.HandleFunc("/audit/v1/entries", requireRole(auth.Admin, auditListEntries)).Methods("GET")
+	router.HandleFunc("/audit/v1/export", requireRole(auth.Admin, auditExport)).Methods("GET")
+	router.HandleFunc("/audit/v1/verify", requireRole(auth.Admin, auditVerify)).Methods("GET")
 
 }
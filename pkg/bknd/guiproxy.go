@@ -0,0 +1,242 @@
+package bknd
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/complyue/different-hpc/pkg/audit"
+	"github.com/complyue/different-hpc/pkg/ccm"
+	"github.com/complyue/hbi/pkg/errors"
+	"github.com/flosch/pongo2"
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	defaultVncPort = "5900"
+	vncDialTimeout = 10 * time.Second
+
+	// GUIs of nodes are not to be trusted with the origin of dhpc-cc, they
+	// run sandboxed in an opaque origin, where scripts can't reach the pages
+	// or session of dhpc-cc
+	guiSandboxPolicy = "sandbox allow-scripts allow-forms allow-popups allow-modals allow-downloads"
+)
+
+var (
+	// GUIs of nodes mostly come with self signed certs, on the private
+	// cluster network
+	guiTransport = &http.Transport{
+		Proxy:               nil,
+		TLSClientConfig:     &tls.Config{InsecureSkipVerify: true},
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+	}
+
+	// noVNC speaks binary subprotocol, default origin check rejects cross
+	// site websocket requests
+	vncUpgrader = websocket.Upgrader{
+		ReadBufferSize:  16384,
+		WriteBufferSize: 16384,
+		Subprotocols:    []string{"binary"},
+	}
+
+	vncPage = &Pongo2Page{
+		TmplFile: "web/templates/vnc.html",
+		UpdateCtx: func(ctx pongo2.Context, r *http.Request) {
+			cfg := ccm.GetComputeNodeCfg(ctx["mac"].(string))
+			if cfg == nil {
+				ctx["err"] = fmt.Sprintf("No config for mac=[%s]", ctx["mac"])
+				return
+			}
+			guiType := cfg.GuiType
+			if len(guiType) <= 0 {
+				guiType = "VNC"
+			}
+			cfgd := cfg.Inflate()
+			ctx["title"] = fmt.Sprintf("%v - %s", cfgd["hostname"], guiType)
+			ctx["cfgd"] = cfgd
+		},
+	}
+)
+
+// a node's config, and where its GUI is from the inflated guiHref of it
+func nodeGuiTarget(macStr string) (*ccm.ComputeNodeCfg, *url.URL, error) {
+	mac, err := ccm.NormalizeMac(macStr)
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg := ccm.GetComputeNodeCfg(mac)
+	if cfg == nil {
+		return nil, nil, errors.Errorf("no config for mac=[%s]", mac)
+	}
+	cfgd, err := cfg.InflateE()
+	if err != nil {
+		return nil, nil, err
+	}
+	href, _ := cfgd["guiHref"].(string)
+	if len(href) <= 0 {
+		return nil, nil, errors.Errorf("no guiHref configured for mac=[%s]", mac)
+	}
+	target, err := url.Parse(href)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "bad guiHref of mac=[%s]", mac)
+	}
+	switch target.Scheme {
+	case "vnc":
+		if len(target.Port()) <= 0 {
+			target.Host = net.JoinHostPort(target.Hostname(), defaultVncPort)
+		}
+	case "http", "https":
+	default:
+		return nil, nil, errors.Errorf("unsupported guiHref [%s] of mac=[%s]", href, mac)
+	}
+	return cfg, target, nil
+}
+
+// websocket to the VNC server of a node, for noVNC in browser
+func guiVncWebsocket(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	cfg, target, err := nodeGuiTarget(vars["mac"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if "vnc" != target.Scheme {
+		http.Error(w, "not a vnc gui", http.StatusBadRequest)
+		return
+	}
+	user := webUser(r)
+
+	ws, err := vncUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		glog.Errorf("Error upgrading vnc websocket of mac=[%s]: %v", cfg.Mac, err)
+		return
+	}
+	defer ws.Close()
+
+	conn, err := net.DialTimeout("tcp", target.Host, vncDialTimeout)
+	if err != nil {
+		glog.Errorf("Error connecting vnc [%s] of mac=[%s]: %v", target.Host, cfg.Mac, err)
+		ws.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseInternalServerErr, err.Error()),
+			time.Now().Add(time.Second))
+		return
+	}
+	defer conn.Close()
+
+	ip, _ := cfg.Inflate()["ip"].(string)
+	started := time.Now()
+	glog.Infof("VNC to mac=[%s] [%s] opened for [%s].", cfg.Mac, target.Host, user)
+	ccm.RecordHistory(cfg.Mac, ip, "gui", "vnc opened for "+user)
+	auditAction(r, audit.Entry{Action: "gui", Mac: cfg.Mac, IP: ip, Detail: "vnc opened"})
+	defer func() {
+		elapsed := time.Since(started).Round(time.Second)
+		glog.Infof("VNC to mac=[%s] [%s] closed for [%s] after %v.", cfg.Mac, target.Host, user, elapsed)
+		ccm.RecordHistory(cfg.Mac, ip, "gui", fmt.Sprintf("vnc closed for %s after %v", user, elapsed))
+		auditAction(r, audit.Entry{Action: "gui", Mac: cfg.Mac, IP: ip,
+			Detail: fmt.Sprintf("vnc closed after %v", elapsed)})
+	}()
+
+	// vnc server to browser
+	go func() {
+		defer ws.Close()
+		buf := make([]byte, 16384)
+		for {
+			n, err := conn.Read(buf)
+			if n > 0 {
+				if err := ws.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	// browser to vnc server
+	for {
+		_, rd, err := ws.NextReader()
+		if err != nil {
+			return
+		}
+		if _, err := io.Copy(conn, rd); err != nil {
+			return
+		}
+	}
+}
+
+// the GUI of a node under /gui/{mac}/, a noVNC page for vnc, or reverse
+// proxied for http(s)
+func guiProxy(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	cfg, target, err := nodeGuiTarget(vars["mac"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	prefix := "/gui/" + vars["mac"]
+	if r.URL.Path == prefix {
+		http.Redirect(w, r, prefix+"/", http.StatusFound)
+		return
+	}
+
+	if "vnc" == target.Scheme {
+		if r.URL.Path != prefix+"/" {
+			http.NotFound(w, r)
+			return
+		}
+		vars["mac"] = cfg.Mac
+		vncPage.ServeHTTP(w, r)
+		return
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = target.Scheme
+			req.URL.Host = target.Host
+			req.URL.Path = strings.TrimSuffix(target.Path, "/") + "/" +
+				strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, prefix), "/")
+			req.URL.RawPath = ""
+			req.Host = target.Host
+			// the node is not to trust identities asserted to dhpc-cc
+			req.Header.Del("X-Forwarded-User")
+			req.Header.Del("X-Remote-User")
+			req.Header.Del("Authorization")
+			req.Header.Del("Cookie")
+			req.Header.Del("X-CSRF-Token")
+		},
+		Transport: guiTransport,
+		ModifyResponse: func(resp *http.Response) error {
+			// cookies are not passed to nodes, nor is a node to clobber
+			// the session cookie of dhpc-cc
+			resp.Header.Del("Set-Cookie")
+			// in addition to policies of the node's own, if any
+			resp.Header.Add("Content-Security-Policy", guiSandboxPolicy)
+			// keep redirects within the proxy
+			if loc := resp.Header.Get("Location"); len(loc) > 0 {
+				if locURL, err := url.Parse(loc); err == nil &&
+					(len(locURL.Host) <= 0 || locURL.Host == target.Host) {
+					p := strings.TrimPrefix(locURL.Path, strings.TrimSuffix(target.Path, "/"))
+					locURL.Scheme, locURL.Host = "", ""
+					locURL.Path = prefix + "/" + strings.TrimPrefix(p, "/")
+					resp.Header.Set("Location", locURL.String())
+				}
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			glog.Errorf("Error proxying gui of mac=[%s] to [%s]: %v", cfg.Mac, target.Host, err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		},
+	}
+	proxy.ServeHTTP(w, r)
+}
@@ -0,0 +1,68 @@
+package bknd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/complyue/different-hpc/pkg/ccm"
+	"github.com/complyue/different-hpc/pkg/remote"
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+)
+
+// a booting node fetches its ssh host key, with the one-time token from its
+// boot cmdline
+func hostKeyFetch(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var req struct {
+		Token string
+	}
+	jsonDecoder := json.NewDecoder(r.Body)
+	jsonDecoder.Decode(&req)
+
+	jsonResult := make(map[string]interface{}, 5)
+	func() {
+		defer func() {
+			if e := recover(); e != nil {
+				glog.Errorf("Error serving host key:\n+%v", e)
+				jsonResult["err"] = fmt.Sprintf("Unexpected error: %+v", e)
+			}
+		}()
+
+		mac, err := ccm.NormalizeMac(vars["mac"])
+		if err != nil {
+			jsonResult["err"] = err.Error()
+			return
+		}
+		hk, err := remote.TakeHostKey(mac, req.Token, remoteIP(r))
+		if err != nil {
+			glog.Warningf("Host key request from [%s] refused: %v", remoteIP(r), err)
+			jsonResult["err"] = err.Error()
+			return
+		}
+		jsonResult["privateKey"] = hk.PrivateKey
+		jsonResult["publicKey"] = hk.PublicKey
+
+		ip := ""
+		if cfg := ccm.GetComputeNodeCfg(mac); cfg != nil {
+			ip, _ = cfg.Inflate()["ip"].(string)
+		}
+		ccm.RecordHistory(mac, ip, "hostkey", "host key delivered to "+remoteIP(r))
+	}()
+	if err := json.NewEncoder(w).Encode(jsonResult); err != nil {
+		panic(err)
+	}
+}
+
+// ssh_known_hosts covering all nodes with host keys generated
+func sshKnownHosts(w http.ResponseWriter, r *http.Request) {
+	out, err := remote.KnownHosts()
+	if err != nil {
+		glog.Errorf("Error listing known hosts: %+v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(out)
+}
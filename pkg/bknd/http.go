@@ -3,6 +3,7 @@ package bknd
 import (
 	"net/http"
 
+	"github.com/complyue/different-hpc/pkg/auth"
 	"github.com/flosch/pongo2"
 	"github.com/gorilla/mux"
 )
@@ -27,6 +28,19 @@ func (page *Pongo2Page) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			ctx[k] = v
 		}
 	}
+	if id := identityOf(r); id != nil && id.Session != nil {
+		ctx["webUser"] = id.User
+		ctx["csrfToken"] = id.Session.CSRFToken
+	}
+	// whether the web user has the role on the node of mac, or on any nodes
+	ctx["canOn"] = func(roleName, mac string) bool {
+		role, err := auth.ParseRole(roleName)
+		return err == nil && authorizeNodes(r, role, mac) == nil
+	}
+	ctx["canAny"] = func(roleName string) bool {
+		role, err := auth.ParseRole(roleName)
+		return err == nil && webMaxRole(r) >= role
+	}
 	if page.UpdateCtx != nil {
 		page.UpdateCtx(ctx, r)
 	}
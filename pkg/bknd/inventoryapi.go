@@ -0,0 +1,112 @@
+package bknd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/complyue/different-hpc/pkg/agent"
+	"github.com/complyue/different-hpc/pkg/auth"
+	"github.com/complyue/different-hpc/pkg/ccm"
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+)
+
+func cnodeSearchInventory(w http.ResponseWriter, r *http.Request) {
+	jsonResult := make(map[string]interface{}, 5)
+	func() {
+		defer func() {
+			if e := recover(); e != nil {
+				glog.Errorf("Error searching inventory:\n+%v", e)
+				jsonResult["err"] = fmt.Sprintf("Unexpected error: %+v", e)
+			}
+		}()
+
+		records, err := ccm.SearchInventory(r.URL.Query().Get("q"))
+		if err != nil {
+			jsonResult["err"] = err.Error()
+			return
+		}
+		var nodes []ccm.InventoryRecord
+		for _, rec := range records {
+			if canViewNode(r, rec.Mac) {
+				nodes = append(nodes, rec)
+			}
+		}
+		jsonResult["nodes"] = nodes
+	}()
+	if err := json.NewEncoder(w).Encode(jsonResult); err != nil {
+		panic(err)
+	}
+}
+
+func cnodePutInventory(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var inv agent.Inventory
+	jsonDecoder := json.NewDecoder(r.Body)
+	decodeErr := jsonDecoder.Decode(&inv)
+
+	jsonResult := make(map[string]interface{}, 5)
+	func() {
+		defer func() {
+			if e := recover(); e != nil {
+				glog.Errorf("Error putting inventory of mac=[%s]:\n+%v", vars["mac"], e)
+				jsonResult["err"] = fmt.Sprintf("Unexpected error: %+v", e)
+			}
+		}()
+
+		if decodeErr != nil {
+			jsonResult["err"] = fmt.Sprintf("Invalid inventory: %v", decodeErr)
+			return
+		}
+		changes, err := ccm.PutInventory(vars["mac"], inv)
+		if err != nil {
+			jsonResult["err"] = err.Error()
+			return
+		}
+		glog.Infof("Inventory of mac=[%s] posted by [%s].", vars["mac"], webUser(r))
+		jsonResult["changes"] = changes
+	}()
+	if err := json.NewEncoder(w).Encode(jsonResult); err != nil {
+		panic(err)
+	}
+}
+
+func cnodeListInventoryAlerts(w http.ResponseWriter, r *http.Request) {
+	jsonResult := make(map[string]interface{}, 5)
+	var alerts []ccm.InventoryAlert
+	for _, alert := range ccm.ListInventoryAlerts("" != r.URL.Query().Get("all")) {
+		if canViewNode(r, alert.Mac) {
+			alerts = append(alerts, alert)
+		}
+	}
+	jsonResult["alerts"] = alerts
+	if err := json.NewEncoder(w).Encode(jsonResult); err != nil {
+		panic(err)
+	}
+}
+
+func cnodeAckInventoryAlerts(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Mac string
+	}{}
+	jsonDecoder := json.NewDecoder(r.Body)
+	jsonDecoder.Decode(&req)
+
+	jsonResult := make(map[string]interface{}, 5)
+	func() {
+		if err := authorizeNodes(r, auth.Operator, req.Mac); err != nil {
+			jsonResult["err"] = err.Error()
+			return
+		}
+		n, err := ccm.AckInventoryAlerts(req.Mac, webUser(r))
+		if err != nil {
+			jsonResult["err"] = err.Error()
+			return
+		}
+		jsonResult["acked"] = n
+	}()
+	if err := json.NewEncoder(w).Encode(jsonResult); err != nil {
+		panic(err)
+	}
+}
@@ -2,49 +2,115 @@ package bknd
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"strings"
 
+	"github.com/complyue/different-hpc/pkg/agent"
 	"github.com/complyue/different-hpc/pkg/ccm"
-	"github.com/complyue/hbi/pkg/errors"
+	"github.com/complyue/different-hpc/pkg/remote"
+	"github.com/golang/glog"
 	"github.com/gorilla/mux"
 )
 
+// render the response to pixiecore from a compute node's boot spec
+func pixieBootResult(spec *ccm.BootSpec) map[string]interface{} {
+	jsonResult := make(map[string]interface{}, 5)
+	jsonResult["kernel"] = spec.Kernel
+	jsonResult["initrd"] = spec.Initrd
+	jsonResult["cmdline"] = spec.Cmdline
+	return jsonResult
+}
+
 func pixieApi(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	mac := vars["mac"]
+	mac, err := ccm.NormalizeMac(vars["mac"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	cnCfg, err := ccm.PrepareComputeNodeCfg(mac)
+	if cce, ok := err.(*ccm.CfgConflictError); ok {
+		glog.Errorf("Refused to boot mac=[%s]: %s", mac, cce.Error())
+		http.Error(w, cce.Error(), http.StatusConflict)
+		return
+	}
 	if err != nil {
 		panic(err)
 	}
 
-	jsonResult := make(map[string]interface{}, 5)
-
-	cfgData := cnCfg.Inflate()
-	switch kernel := cfgData["kernel"].(type) {
-	case string:
-		jsonResult["kernel"] = kernel
-	default:
-		panic(errors.Errorf("Invalid kernel of type %T - %#v", kernel, kernel))
+	spec, err := ccm.CfgBootSpec(cnCfg)
+	if err != nil {
+		panic(err)
 	}
-	switch initrd := cfgData["initrd"].(type) {
-	case []string:
-		jsonResult["initrd"] = initrd
-	case string:
-		jsonResult["initrd"] = []string{initrd}
-	default:
-		panic(errors.Errorf("Invalid initrd of type %T - %#v", initrd, initrd))
+
+	// the one-time host key token is not part of the boot config, so kept
+	// out of the boot snapshot
+	served := *spec
+	if token, err := remote.IssueHostKeyToken(cnCfg.Mac); err != nil {
+		glog.Errorf("Error issuing host key token for mac=[%s]: %+v", cnCfg.Mac, err)
+	} else if len(token) > 0 {
+		served.Cmdline = strings.TrimSpace(served.Cmdline) + " " + agent.HostKeyTokenArg + "=" + token
 	}
-	switch cmdline := cfgData["cmdline"].(type) {
-	case []string:
-		jsonResult["cmdline"] = strings.Join(cmdline, " ")
-	case string:
-		jsonResult["cmdline"] = cmdline
-	default:
-		panic(errors.Errorf("Invalid cmdline of type %T - %#v", cmdline, cmdline))
+
+	if err := json.NewEncoder(w).Encode(pixieBootResult(&served)); err != nil {
+		panic(err)
 	}
 
+	ip, _ := cnCfg.Inflate()["ip"].(string)
+	ccm.RecordHistory(cnCfg.Mac, ip, "boot", r.RemoteAddr)
+	ccm.RecordBootSnapshot(cnCfg, spec)
+}
+
+// what pixieApi would respond for a mac, without side effects, unknown ips
+// in range are pinged only with query ?probe=1
+func pixiePreview(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	probe := r.URL.Query().Get("probe") == "1"
+
+	jsonResult := make(map[string]interface{}, 8)
+	func() {
+		defer func() {
+			if e := recover(); e != nil {
+				glog.Errorf("Error previewing boot response:\n+%v", e)
+				jsonResult["err"] = fmt.Sprintf("Unexpected error: %+v", e)
+			}
+		}()
+
+		mac, err := ccm.NormalizeMac(vars["mac"])
+		if err != nil {
+			jsonResult["err"] = err.Error()
+			return
+		}
+		jsonResult["mac"] = mac
+
+		pv, err := ccm.PreviewBootCfg(mac, probe)
+		if err != nil {
+			jsonResult["err"] = fmt.Sprintf("Failed preparing config: %+v", err)
+			return
+		}
+		jsonResult["new"] = pv.New
+		if len(pv.Conflicts) > 0 {
+			jsonResult["conflicts"] = pv.Conflicts
+			jsonResult["err"] = "Boot would be refused, " + (&ccm.CfgConflictError{Conflicts: pv.Conflicts}).Error()
+		}
+		jsonResult["reclaimFrom"] = pv.ReclaimFrom
+		jsonResult["rawYaml"] = pv.Cfg.RawYaml
+		if cfgd, err := pv.Cfg.InflateE(); err == nil {
+			jsonResult["ip"], _ = cfgd["ip"].(string)
+		}
+
+		spec, err := ccm.CfgBootSpec(pv.Cfg)
+		if err != nil {
+			jsonResult["err"] = err.Error()
+			return
+		}
+		if len(pv.Conflicts) > 0 {
+			return
+		}
+		jsonResult["boot"] = pixieBootResult(spec)
+	}()
 	if err := json.NewEncoder(w).Encode(jsonResult); err != nil {
 		panic(err)
 	}
@@ -0,0 +1,276 @@
+package bknd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/complyue/different-hpc/pkg/audit"
+	"github.com/complyue/different-hpc/pkg/auth"
+	"github.com/complyue/different-hpc/pkg/ccm"
+	"github.com/complyue/different-hpc/pkg/power"
+	"github.com/complyue/hbi/pkg/errors"
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+)
+
+func nodePowerController(macStr string) (*ccm.ComputeNodeCfg, power.Controller, error) {
+	mac, err := ccm.NormalizeMac(macStr)
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg := ccm.GetComputeNodeCfg(mac)
+	if cfg == nil {
+		return nil, nil, errors.Errorf("no config for mac=[%s]", mac)
+	}
+	ctrl, err := power.NodeController(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cfg, ctrl, nil
+}
+
+func cnodePowerStatus(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	jsonResult := make(map[string]interface{}, 5)
+	func() {
+		defer func() {
+			if e := recover(); e != nil {
+				glog.Errorf("Error querying power status of mac=[%s]:\n+%v", vars["mac"], e)
+				jsonResult["err"] = fmt.Sprintf("Unexpected error: %+v", e)
+			}
+		}()
+
+		_, ctrl, err := nodePowerController(vars["mac"])
+		if err != nil {
+			jsonResult["err"] = err.Error()
+			return
+		}
+		state, err := ctrl.Status()
+		if err != nil {
+			jsonResult["err"] = fmt.Sprintf("Failed querying power status: %+v", err)
+			return
+		}
+		jsonResult["power"] = state
+	}()
+	if err := json.NewEncoder(w).Encode(jsonResult); err != nil {
+		panic(err)
+	}
+}
+
+func cnodePowerAction(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	req := struct {
+		Action string
+	}{}
+	jsonDecoder := json.NewDecoder(r.Body)
+	jsonDecoder.Decode(&req)
+
+	jsonResult := make(map[string]interface{}, 5)
+	func() {
+		defer func() {
+			if e := recover(); e != nil {
+				glog.Errorf("Error doing power %s to mac=[%s]:\n+%v", req.Action, vars["mac"], e)
+				jsonResult["err"] = fmt.Sprintf("Unexpected error: %+v", e)
+			}
+		}()
+
+		cfg, ctrl, err := nodePowerController(vars["mac"])
+		if err != nil {
+			jsonResult["err"] = err.Error()
+			return
+		}
+		ip, _ := cfg.Inflate()["ip"].(string)
+		held := power.HoldForPower(cfg.Mac, ip, req.Action)
+		err = ctrl.Do(req.Action)
+		held(err == nil)
+		if err != nil {
+			ccm.RecordHistory(cfg.Mac, ip, "power", fmt.Sprintf("%s failed: %v", req.Action, err))
+			auditAction(r, audit.Entry{Action: "power", Mac: cfg.Mac, IP: ip,
+				Detail: fmt.Sprintf("%s failed: %v", req.Action, err)})
+			jsonResult["err"] = fmt.Sprintf("Failed power %s: %+v", req.Action, err)
+			return
+		}
+		glog.Infof("Power %s done to mac=[%s] ip=[%s].", req.Action, cfg.Mac, ip)
+		ccm.RecordHistory(cfg.Mac, ip, "power", req.Action)
+		auditAction(r, audit.Entry{Action: "power", Mac: cfg.Mac, IP: ip, Detail: req.Action})
+		jsonResult["done"] = req.Action
+	}()
+	if err := json.NewEncoder(w).Encode(jsonResult); err != nil {
+		panic(err)
+	}
+}
+
+func cnodeWake(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Selection ccm.NodeSelection
+	}{}
+	jsonDecoder := json.NewDecoder(r.Body)
+	jsonDecoder.Decode(&req)
+
+	jsonResult := make(map[string]interface{}, 5)
+	func() {
+		defer func() {
+			if e := recover(); e != nil {
+				glog.Errorf("Error waking nodes:\n+%v", e)
+				jsonResult["err"] = fmt.Sprintf("Unexpected error: %+v", e)
+			}
+		}()
+
+		if err := authorizeSelection(r, auth.Operator, req.Selection); err != nil {
+			jsonResult["err"] = err.Error()
+			return
+		}
+		job, err := power.StartWake(req.Selection)
+		if err != nil {
+			jsonResult["err"] = fmt.Sprintf("Failed waking nodes: %+v", err)
+			return
+		}
+		glog.Infof("Wake job #%d started for %d nodes.", job.ID, len(job.Nodes))
+		for _, n := range job.Nodes {
+			auditAction(r, audit.Entry{Action: "wake", Mac: n.Mac, IP: n.IP,
+				Detail: fmt.Sprintf("wake job #%d", job.ID)})
+		}
+		jsonResult["job"] = job
+	}()
+	if err := json.NewEncoder(w).Encode(jsonResult); err != nil {
+		panic(err)
+	}
+}
+
+func cnodeListWakeJobs(w http.ResponseWriter, r *http.Request) {
+	jsonResult := make(map[string]interface{}, 5)
+	var jobs []power.WakeJob
+	for _, job := range power.ListWakeJobs() {
+		var nodes []power.WakeNode
+		for _, n := range job.Nodes {
+			if canViewNode(r, n.Mac) {
+				nodes = append(nodes, n)
+			}
+		}
+		if len(nodes) > 0 {
+			job.Nodes = nodes
+			jobs = append(jobs, job)
+		}
+	}
+	jsonResult["jobs"] = jobs
+	if err := json.NewEncoder(w).Encode(jsonResult); err != nil {
+		panic(err)
+	}
+}
+
+func cnodeListRemedies(w http.ResponseWriter, r *http.Request) {
+	jsonResult := make(map[string]interface{}, 5)
+	jsonResult["remedies"] = viewableRemedies(r)
+	if err := json.NewEncoder(w).Encode(jsonResult); err != nil {
+		panic(err)
+	}
+}
+
+func viewableRemedies(r *http.Request) []power.Remedy {
+	var remedies []power.Remedy
+	for _, rm := range power.ListRemedies() {
+		if canViewNode(r, rm.Mac) {
+			remedies = append(remedies, rm)
+		}
+	}
+	return remedies
+}
+
+func cnodeStartRollout(w http.ResponseWriter, r *http.Request) {
+	var spec power.RolloutSpec
+	jsonDecoder := json.NewDecoder(r.Body)
+	jsonDecoder.Decode(&spec)
+
+	jsonResult := make(map[string]interface{}, 5)
+	func() {
+		defer func() {
+			if e := recover(); e != nil {
+				glog.Errorf("Error starting rollout:\n+%v", e)
+				jsonResult["err"] = fmt.Sprintf("Unexpected error: %+v", e)
+			}
+		}()
+
+		if err := authorizeSelection(r, auth.Operator, spec.Selection); err != nil {
+			jsonResult["err"] = err.Error()
+			return
+		}
+		ro, err := power.StartRollout(spec)
+		if err != nil {
+			jsonResult["err"] = fmt.Sprintf("Failed starting rollout: %+v", err)
+			return
+		}
+		glog.Infof("Rollout #%d started for %d nodes in %d waves.", ro.ID, len(ro.Nodes), ro.Waves)
+		for _, n := range ro.Nodes {
+			auditAction(r, audit.Entry{Action: "rollout", Mac: n.Mac, IP: n.IP,
+				Detail: fmt.Sprintf("rollout #%d started, wave %d", ro.ID, n.Wave)})
+		}
+		jsonResult["rollout"] = ro
+	}()
+	if err := json.NewEncoder(w).Encode(jsonResult); err != nil {
+		panic(err)
+	}
+}
+
+func cnodeControlRollout(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		ID  int
+		Act string
+	}{}
+	jsonDecoder := json.NewDecoder(r.Body)
+	jsonDecoder.Decode(&req)
+
+	jsonResult := make(map[string]interface{}, 5)
+	func() {
+		defer func() {
+			if e := recover(); e != nil {
+				glog.Errorf("Error controlling rollout #%d:\n+%v", req.ID, e)
+				jsonResult["err"] = fmt.Sprintf("Unexpected error: %+v", e)
+			}
+		}()
+
+		for _, ro := range power.ListRollouts() {
+			if ro.ID != req.ID {
+				continue
+			}
+			for _, n := range ro.Nodes {
+				if err := authorizeNodes(r, auth.Operator, n.Mac); err != nil {
+					jsonResult["err"] = err.Error()
+					return
+				}
+			}
+		}
+		ro, err := power.ControlRollout(req.ID, req.Act)
+		if err != nil {
+			jsonResult["err"] = fmt.Sprintf("Failed to %s rollout: %+v", req.Act, err)
+			return
+		}
+		auditAction(r, audit.Entry{Action: "rollout", Detail: fmt.Sprintf("rollout #%d %s", ro.ID, req.Act)})
+		jsonResult["rollout"] = ro
+	}()
+	if err := json.NewEncoder(w).Encode(jsonResult); err != nil {
+		panic(err)
+	}
+}
+
+func cnodeListRollouts(w http.ResponseWriter, r *http.Request) {
+	jsonResult := make(map[string]interface{}, 5)
+	var rollouts []power.Rollout
+	for _, ro := range power.ListRollouts() {
+		var nodes []power.RolloutNode
+		for _, n := range ro.Nodes {
+			if canViewNode(r, n.Mac) {
+				nodes = append(nodes, n)
+			}
+		}
+		if len(nodes) > 0 {
+			ro.Nodes = nodes
+			rollouts = append(rollouts, ro)
+		}
+	}
+	jsonResult["rollouts"] = rollouts
+	if err := json.NewEncoder(w).Encode(jsonResult); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,123 @@
+package bknd
+
+import (
+	"net/http"
+
+	"github.com/complyue/different-hpc/pkg/auth"
+	"github.com/complyue/different-hpc/pkg/ccm"
+	"github.com/complyue/hbi/pkg/errors"
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+)
+
+// role of the web user of a request on nodes in the groups, everyone is
+// admin with authentication disabled
+func webRoleOn(r *http.Request, groups []string) auth.Role {
+	cfg := auth.GetAuthCfg()
+	if !cfg.Enabled {
+		return auth.Admin
+	}
+	id := identityOf(r)
+	if id == nil {
+		return auth.NoRole
+	}
+	if role := cfg.RoleOn(id.User, groups); role > id.Grant {
+		return role
+	}
+	return id.Grant
+}
+
+// highest role of the web user of a request on any nodes
+func webMaxRole(r *http.Request) auth.Role {
+	cfg := auth.GetAuthCfg()
+	if !cfg.Enabled {
+		return auth.Admin
+	}
+	id := identityOf(r)
+	if id == nil {
+		return auth.NoRole
+	}
+	if role := cfg.MaxRoleOf(id.User); role > id.Grant {
+		return role
+	}
+	return id.Grant
+}
+
+func cfgGroups(cfg *ccm.ComputeNodeCfg) []string {
+	if cfg == nil {
+		return nil
+	}
+	cfgd, err := cfg.InflateE()
+	if err != nil {
+		return nil
+	}
+	return ccm.CfgGroups(cfgd)
+}
+
+// check the web user has the role on nodes of the macs, unknown nodes are
+// checked against the role on all nodes
+func authorizeNodes(r *http.Request, role auth.Role, macs ...string) error {
+	for _, mac := range macs {
+		if normMac, err := ccm.NormalizeMac(mac); err == nil {
+			mac = normMac
+		}
+		if webRoleOn(r, cfgGroups(ccm.GetComputeNodeCfg(mac))) < role {
+			return errors.Errorf("%s role required on mac=[%s]", role, mac)
+		}
+	}
+	return nil
+}
+
+// whether the web user can view the node of the mac, for lists and views not
+// bound to a node by the route to show only nodes within reach
+func canViewNode(r *http.Request, mac string) bool {
+	return authorizeNodes(r, auth.Viewer, mac) == nil
+}
+
+// check the web user has the role on a node as it would be configured by
+// the raw yaml, so nodes can't be moved into groups out of reach
+func authorizeRawCfg(r *http.Request, role auth.Role, rawYaml string) error {
+	cfg, err := ccm.ParseComputeNodeCfg([]byte(rawYaml))
+	if err != nil {
+		// invalid configs are refused otherwise
+		return nil
+	}
+	if webRoleOn(r, cfgGroups(cfg)) < role {
+		return errors.Errorf("%s role required on mac=[%s] as configured", role, cfg.Mac)
+	}
+	return nil
+}
+
+// check the web user has the role on all nodes selected
+func authorizeSelection(r *http.Request, role auth.Role, sel ccm.NodeSelection) error {
+	cfgs, err := ccm.SelectComputeNodeCfgs(sel)
+	if err != nil {
+		// invalid selections are refused otherwise
+		return nil
+	}
+	for _, cfg := range cfgs {
+		if webRoleOn(r, cfgGroups(cfg)) < role {
+			return errors.Errorf("%s role required on mac=[%s]", role, cfg.Mac)
+		}
+	}
+	return nil
+}
+
+// require the role for a route, on the node of {mac} in the path if any, or
+// on any nodes otherwise, for the handler to check further on nodes it acts
+func requireRole(role auth.Role, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		if mac, ok := mux.Vars(r)["mac"]; ok {
+			err = authorizeNodes(r, role, mac)
+		} else if webMaxRole(r) < role {
+			err = errors.Errorf("%s role required", role)
+		}
+		if err != nil {
+			glog.Warningf("Request to [%s] of [%s] refused: %v", r.URL.Path, webUser(r), err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
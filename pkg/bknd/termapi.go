@@ -0,0 +1,131 @@
+package bknd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/complyue/different-hpc/pkg/audit"
+	"github.com/complyue/different-hpc/pkg/ccm"
+	"github.com/complyue/different-hpc/pkg/remote"
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// default origin check rejects cross site websocket requests
+var termUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+}
+
+// control message from the browser terminal, sent as websocket text
+// messages, while keystrokes are sent as binary messages
+type termCtrl struct {
+	Type       string
+	Cols, Rows int
+}
+
+// websocket to an ssh shell session on a node
+func termWebsocket(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	mac, err := ccm.NormalizeMac(vars["mac"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cfg := ccm.GetComputeNodeCfg(mac)
+	if cfg == nil {
+		http.Error(w, fmt.Sprintf("no config for mac=[%s]", mac), http.StatusNotFound)
+		return
+	}
+	user := webUser(r)
+
+	ws, err := termUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// error response has been sent by the upgrader
+		glog.Errorf("Error upgrading terminal websocket of mac=[%s]: %v", mac, err)
+		return
+	}
+	defer ws.Close()
+
+	sshUser := ""
+	if remote.GetRemoteCfg().TermAsWebUser {
+		sshUser = user
+	}
+	cols, err := strconv.Atoi(r.URL.Query().Get("cols"))
+	if err != nil || cols <= 0 {
+		cols = 80
+	}
+	rows, err := strconv.Atoi(r.URL.Query().Get("rows"))
+	if err != nil || rows <= 0 {
+		rows = 24
+	}
+	term, err := remote.OpenTerm(cfg, sshUser, cols, rows)
+	if err != nil {
+		glog.Errorf("Error opening terminal to mac=[%s] for [%s]: %+v", mac, user, err)
+		ws.WriteMessage(websocket.BinaryMessage, []byte(fmt.Sprintf("\r\nFailed connecting: %v\r\n", err)))
+		return
+	}
+	defer term.Close()
+
+	ip, _ := cfg.Inflate()["ip"].(string)
+	started := time.Now()
+	glog.Infof("Terminal to mac=[%s] ip=[%s] opened for [%s].", mac, ip, user)
+	ccm.RecordHistory(mac, ip, "term", "opened for "+user)
+	auditAction(r, audit.Entry{Action: "term", Mac: mac, IP: ip, Detail: "opened as " + sshUser})
+	defer func() {
+		elapsed := time.Since(started).Round(time.Second)
+		glog.Infof("Terminal to mac=[%s] ip=[%s] closed for [%s] after %v.", mac, ip, user, elapsed)
+		ccm.RecordHistory(mac, ip, "term", fmt.Sprintf("closed for %s after %v", user, elapsed))
+		auditAction(r, audit.Entry{Action: "term", Mac: mac, IP: ip,
+			Detail: fmt.Sprintf("closed after %v", elapsed)})
+	}()
+
+	// shell output to browser
+	go func() {
+		defer ws.Close()
+		buf := make([]byte, 8192)
+		for {
+			n, err := term.Read(buf)
+			if n > 0 {
+				if err := ws.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
+					return
+				}
+			}
+			if err != nil {
+				ws.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseNormalClosure, "session ended"),
+					time.Now().Add(time.Second))
+				return
+			}
+		}
+	}()
+
+	// browser input to shell
+	for {
+		msgType, data, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		switch msgType {
+		case websocket.BinaryMessage:
+			if _, err := term.Write(data); err != nil {
+				return
+			}
+		case websocket.TextMessage:
+			var ctrl termCtrl
+			if err := json.Unmarshal(data, &ctrl); err != nil {
+				glog.Warningf("Bad terminal control message: %v", err)
+				continue
+			}
+			if "resize" == ctrl.Type && ctrl.Cols > 0 && ctrl.Rows > 0 {
+				if err := term.Resize(ctrl.Cols, ctrl.Rows); err != nil {
+					glog.Warningf("Error resizing terminal of mac=[%s]: %v", mac, err)
+				}
+			}
+		}
+	}
+}
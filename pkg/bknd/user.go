@@ -0,0 +1,30 @@
+package bknd
+
+import (
+	"net/http"
+
+	"github.com/complyue/different-hpc/pkg/auth"
+)
+
+// identity of the web user of a request, as authenticated by the control
+// center, or by a trusted reverse proxy in front if authentication is
+// disabled here, or the remote address if unknown
+func webUser(r *http.Request) string {
+	if id := identityOf(r); id != nil {
+		return id.User
+	}
+	ip := remoteIP(r)
+	if !auth.GetAuthCfg().IsProxySource(ip) {
+		// anyone can send these
+		return "anonymous@" + ip
+	}
+	for _, header := range []string{"X-Forwarded-User", "X-Remote-User"} {
+		if user := r.Header.Get(header); len(user) > 0 {
+			return user
+		}
+	}
+	if user, _, ok := r.BasicAuth(); ok && len(user) > 0 {
+		return user
+	}
+	return "anonymous@" + ip
+}
@@ -0,0 +1,97 @@
+package bknd
+
+import (
+	"io/ioutil"
+	"net"
+	"sync"
+
+	"github.com/complyue/different-hpc/pkg/auth"
+	"github.com/complyue/hbi/pkg/errors"
+	"github.com/golang/glog"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const webCfgFile = "etc/web.yaml"
+
+type WebCfg struct {
+	HTTP, HTTPS string
+
+	// identity providers users can log in with, besides local users
+	Providers []*auth.ProviderCfg `yaml:"providers"`
+}
+
+var (
+	webCfg      *WebCfg
+	webCfgMutex sync.Mutex
+)
+
+func loadWebCfg() (*WebCfg, error) {
+	webRawYaml, err := ioutil.ReadFile(webCfgFile)
+	if err != nil {
+		return nil, err
+	}
+	var cfg WebCfg
+	if err = yaml.Unmarshal(webRawYaml, &cfg); err != nil {
+		return nil, err
+	}
+	if _, _, err = net.SplitHostPort(cfg.HTTP); err != nil {
+		return nil, errors.Wrapf(err, "invalid http address [%s] in [%s]", cfg.HTTP, webCfgFile)
+	}
+	names := make(map[string]bool, len(cfg.Providers))
+	for _, pc := range cfg.Providers {
+		if err = pc.Prepare(); err != nil {
+			return nil, errors.Wrapf(err, "in [%s]", webCfgFile)
+		}
+		if names[pc.Name] {
+			return nil, errors.Errorf("duplicate provider [%s] in [%s]", pc.Name, webCfgFile)
+		}
+		names[pc.Name] = true
+	}
+	return &cfg, nil
+}
+
+// load web cfg from file, the last good one is kept on error
+func LoadWebCfg() error {
+	cfg, err := loadWebCfg()
+	if err != nil {
+		return err
+	}
+
+	webCfgMutex.Lock()
+	defer webCfgMutex.Unlock()
+
+	if webCfg != nil && webCfg.HTTP != cfg.HTTP {
+		glog.Warningf("Web serving address changed from [%s] to [%s], restart to take effect.",
+			webCfg.HTTP, cfg.HTTP)
+	}
+	webCfg = cfg
+	return nil
+}
+
+func GetWebCfg() *WebCfg {
+	webCfgMutex.Lock()
+	defer webCfgMutex.Unlock()
+
+	return webCfg
+}
+
+// identity provider by name, nil if not configured
+func (cfg *WebCfg) Provider(name string) *auth.ProviderCfg {
+	for _, pc := range cfg.Providers {
+		if pc.Name == name {
+			return pc
+		}
+	}
+	return nil
+}
+
+// identity providers of a type
+func (cfg *WebCfg) ProvidersOf(typ string) []*auth.ProviderCfg {
+	var pcs []*auth.ProviderCfg
+	for _, pc := range cfg.Providers {
+		if pc.Type == typ {
+			pcs = append(pcs, pc)
+		}
+	}
+	return pcs
+}
@@ -0,0 +1,156 @@
+package ccm
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/complyue/different-hpc/pkg/agent"
+	"github.com/complyue/hbi/pkg/errors"
+	"github.com/golang/glog"
+)
+
+// what is known from the agent on a compute node
+type AgentState struct {
+	Mac string
+
+	Inventory *agent.Inventory
+	Heartbeat *agent.Heartbeat
+	// ip the last heartbeat came from
+	SourceIP string
+}
+
+var (
+	agentStates      map[string]*AgentState
+	agentStatesMutex sync.Mutex
+)
+
+// lock agent states, with inventories restored from store on first access
+func lockAgentStates() {
+	agentStatesMutex.Lock()
+	if agentStates != nil {
+		return
+	}
+	agentStates = make(map[string]*AgentState)
+	invs, err := getStore().LoadInventories()
+	if err != nil {
+		glog.Errorf("Error restoring node inventories: %+v", err)
+		return
+	}
+	for i := range invs {
+		inv := invs[i]
+		agentStates[inv.Mac] = &AgentState{Mac: inv.Mac, Inventory: &inv}
+	}
+}
+
+// check a report from an agent, return the normalized mac and the ip
+// configured for it
+func checkAgentReport(mac, srcIP string) (string, string, error) {
+	normMac, err := NormalizeMac(mac)
+	if err != nil {
+		return "", "", err
+	}
+	cfg := GetComputeNodeCfg(normMac)
+	if cfg == nil {
+		return "", "", errors.Errorf("no config for mac=[%s]", normMac)
+	}
+	ip, err := inflatedIP(cfg)
+	if err != nil {
+		return "", "", err
+	}
+	if GetPulseCfg().AgentCheckSource && srcIP != ip {
+		return "", "", errors.Errorf("report of mac=[%s] from [%s] instead of its ip [%s]", normMac, srcIP, ip)
+	}
+	return normMac, ip, nil
+}
+
+// accept the inventory from the agent of a compute node on its registration
+func RegisterAgent(inv agent.Inventory, srcIP string) error {
+	mac, ip, err := checkAgentReport(inv.Mac, srcIP)
+	if err != nil {
+		return err
+	}
+	// clocks of nodes are not trusted
+	inv.Time = time.Now()
+	if _, err := acceptInventory(mac, ip, &inv); err != nil {
+		return err
+	}
+
+	NoteIpAlive(ip)
+	glog.Infof("Agent of mac=[%s] registered from [%s].", mac, srcIP)
+	RecordHistory(mac, ip, "agent", fmt.Sprintf(
+		"registered, agent %s, kernel %s, %d cores, %d disks",
+		inv.AgentVersion, inv.Kernel, inv.CPUCores, len(inv.Disks),
+	))
+	return nil
+}
+
+// accept a heartbeat from the agent of a compute node, reregister is true if
+// there's no inventory of the node
+func AgentHeartbeat(hb agent.Heartbeat, srcIP string) (reregister bool, err error) {
+	mac, ip, err := checkAgentReport(hb.Mac, srcIP)
+	if err != nil {
+		return false, err
+	}
+	// clocks of nodes are not trusted
+	hb.Mac, hb.Time = mac, time.Now()
+
+	func() {
+		lockAgentStates()
+		defer agentStatesMutex.Unlock()
+
+		as, ok := agentStates[mac]
+		if !ok {
+			as = &AgentState{Mac: mac}
+			agentStates[mac] = as
+		}
+		as.Heartbeat, as.SourceIP = &hb, srcIP
+		reregister = as.Inventory == nil
+	}()
+
+	NoteIpAlive(ip)
+	glog.V(1).Infof("Heartbeat from agent of mac=[%s].", mac)
+	return reregister, nil
+}
+
+// what is known from the agent on a compute node, nil if nothing
+func GetAgentState(mac string) *AgentState {
+	lockAgentStates()
+	defer agentStatesMutex.Unlock()
+
+	as, ok := agentStates[mac]
+	if !ok {
+		return nil
+	}
+	asCopy := *as
+	return &asCopy
+}
+
+// states of all agents, sorted by mac
+func ListAgentStates() []AgentState {
+	lockAgentStates()
+	defer agentStatesMutex.Unlock()
+
+	states := make([]AgentState, 0, len(agentStates))
+	for _, as := range agentStates {
+		states = append(states, *as)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Mac < states[j].Mac
+	})
+	return states
+}
+
+// whether the last heartbeat of an agent is recent enough, by the configured
+// interval with a few misses tolerated
+func (as *AgentState) Beating() bool {
+	if as.Heartbeat == nil {
+		return false
+	}
+	interval := GetPulseCfg().AgentInterval
+	if interval <= 0 {
+		interval = agent.DefaultInterval
+	}
+	return time.Since(as.Heartbeat.Time) < 3*interval
+}
@@ -0,0 +1,122 @@
+package ccm
+
+import (
+	"time"
+
+	"github.com/complyue/hbi/pkg/errors"
+	"github.com/golang/glog"
+)
+
+// interval to purge archived configs beyond retention
+const archivePurgeInterval = time.Hour
+
+// archived compute node configs, oldest first
+func ListArchivedCfgs() ([]ArchivedCfg, error) {
+	return getStore().ListArchived()
+}
+
+// an archived compute node config with its raw yaml, nil if not found
+func LoadArchivedCfg(id string) (*ArchivedCfg, error) {
+	return getStore().LoadArchived(id)
+}
+
+// put an archived config back into service, optionally with rawYaml fixed.
+// the node must have no active config, its ip and hostname must not clash
+// with other configs, and its ip must not be alive for some unknown reason.
+func RestoreArchivedCfg(id string, rawYaml []byte) (*ComputeNodeCfg, error) {
+	lockComputeNodeCfgs()
+	defer mutexComputeNodeCfgs.Unlock()
+
+	st := getStore()
+	ac, err := st.LoadArchived(id)
+	if err != nil {
+		return nil, err
+	}
+	if ac == nil {
+		return nil, errors.Errorf("no archived config [%s]", id)
+	}
+	if rawYaml == nil {
+		rawYaml = []byte(ac.RawYaml)
+	}
+	cfg, err := ParseComputeNodeCfg(rawYaml)
+	if err != nil {
+		return nil, err
+	}
+	ip, err := inflatedIP(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := _getComputeNodeCfgs()[cfg.Mac]; ok {
+		return nil, errors.Errorf("mac=[%s] already has an active config", cfg.Mac)
+	}
+	if err := _checkCfgConflicts(cfg); err != nil {
+		return nil, err
+	}
+	alivenessMutext.Lock()
+	knownState, caring := aliveness[ip]
+	alivenessMutext.Unlock()
+	if caring && knownState.AssumeAlive {
+		return nil, errors.Errorf("ip=[%s] is alive", ip)
+	}
+
+	if cfg, err = st.RestoreArchived(id, rawYaml); err != nil {
+		return nil, err
+	}
+	knownComputeNodeCfgs[cfg.Mac] = cfg
+	CareIpAliveness(ip, false, cfg)
+	RecordHistory(cfg.Mac, ip, "restored", id)
+	return cfg, nil
+}
+
+// delete an archived config permanently
+func PurgeArchivedCfg(id string) error {
+	ac, err := getStore().LoadArchived(id)
+	if err != nil {
+		return err
+	}
+	if ac == nil {
+		return nil
+	}
+	if err := getStore().PurgeArchived(id); err != nil {
+		return err
+	}
+	if len(ac.Mac) > 0 {
+		RecordHistory(ac.Mac, "", "purged", id)
+	}
+	return nil
+}
+
+// purge archived configs older than archiveRetention in pulse config
+func purgeExpiredArchives() error {
+	retention := GetPulseCfg().ArchiveRetention
+	if retention <= 0 {
+		return nil // kept forever
+	}
+	acs, err := ListArchivedCfgs()
+	if err != nil {
+		return err
+	}
+	expiry := time.Now().Add(-retention)
+	for _, ac := range acs {
+		if !ac.Time.Before(expiry) {
+			break // sorted by time
+		}
+		glog.Infof("Purging %s config [%s] archived at %v ...", ac.Reason, ac.ID, ac.Time)
+		if err := PurgeArchivedCfg(ac.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// purge expired archives periodically, forever
+func startArchivePurge() {
+	go func() {
+		for range time.Tick(archivePurgeInterval) {
+			if err := purgeExpiredArchives(); err != nil {
+				glog.Errorf("Error purging expired archives: %+v", err)
+			}
+		}
+	}()
+}
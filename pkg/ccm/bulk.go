@@ -0,0 +1,377 @@
+package ccm
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/complyue/hbi/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// selection of compute nodes, all criteria specified must match
+type NodeSelection struct {
+	// explicitly selected nodes
+	Macs []string
+	// regular expression matched against hostname, ip or mac
+	Filter string
+	// value of the group key in node config
+	Group string
+	// only nodes pending reboot or drifted
+	Stale bool
+}
+
+// groups a compute node belongs to, from the inflated group key, either a
+// string with comma/space separated names, or a sequence of names
+func CfgGroups(cfgd map[string]interface{}) []string {
+	switch g := cfgd["group"].(type) {
+	case string:
+		return strings.FieldsFunc(g, func(r rune) bool {
+			return r == ',' || r == ' '
+		})
+	case []string:
+		return g
+	}
+	return nil
+}
+
+func _selectComputeNodeCfgs(sel NodeSelection) ([]*ComputeNodeCfg, error) {
+	if len(sel.Macs) <= 0 && len(sel.Filter) <= 0 && len(sel.Group) <= 0 && !sel.Stale {
+		return nil, errors.New("no node selected")
+	}
+	var macs map[string]bool
+	if len(sel.Macs) > 0 {
+		macs = make(map[string]bool, len(sel.Macs))
+		for _, mac := range sel.Macs {
+			normMac, err := NormalizeMac(mac)
+			if err != nil {
+				return nil, err
+			}
+			macs[normMac] = true
+		}
+	}
+	var filter *regexp.Regexp
+	if len(sel.Filter) > 0 {
+		var err error
+		if filter, err = regexp.Compile(sel.Filter); err != nil {
+			return nil, err
+		}
+	}
+
+	var cfgs []*ComputeNodeCfg
+	for mac, cfg := range _getComputeNodeCfgs() {
+		if macs != nil && !macs[mac] {
+			continue
+		}
+		if filter != nil || len(sel.Group) > 0 {
+			cfgd, err := cfg.InflateE()
+			if err != nil {
+				continue
+			}
+			if filter != nil {
+				host, _ := cfgd["hostname"].(string)
+				ip, _ := cfgd["ip"].(string)
+				if !filter.MatchString(host) && !filter.MatchString(ip) && !filter.MatchString(mac) {
+					continue
+				}
+			}
+			if len(sel.Group) > 0 {
+				inGroup := false
+				for _, g := range CfgGroups(cfgd) {
+					if g == sel.Group {
+						inGroup = true
+						break
+					}
+				}
+				if !inGroup {
+					continue
+				}
+			}
+		}
+		if sel.Stale {
+			if ds := cfgDrift(cfg); !ds.PendingReboot && !ds.Drifted {
+				continue
+			}
+		}
+		cfgs = append(cfgs, cfg)
+	}
+	sort.Slice(cfgs, func(i, j int) bool {
+		return cfgs[i].Mac < cfgs[j].Mac
+	})
+	return cfgs, nil
+}
+
+// configs of selected compute nodes, sorted by mac
+func SelectComputeNodeCfgs(sel NodeSelection) ([]*ComputeNodeCfg, error) {
+	lockComputeNodeCfgs()
+	defer mutexComputeNodeCfgs.Unlock()
+
+	return _selectComputeNodeCfgs(sel)
+}
+
+// a structured change to compute node configs
+type CfgPatchOp struct {
+	// set/unset/append/replace
+	Op  string
+	Key string
+	// yaml text of the value to set, or the element to append to a sequence
+	Value string
+	// regular expression and replacement for replace, applied to a string
+	// value, or each string element of a sequence
+	Pattern, Replacement string
+}
+
+func patchCfgYaml(cfgYaml yaml.MapSlice, ops []CfgPatchOp) (yaml.MapSlice, error) {
+	patched := append(yaml.MapSlice(nil), cfgYaml...)
+	for _, op := range ops {
+		if len(op.Key) <= 0 {
+			return nil, errors.Errorf("no key for %s", op.Op)
+		}
+		if "mac" == op.Key {
+			return nil, errors.New("mac can not be patched")
+		}
+		ki := -1
+		for i, item := range patched {
+			if item.Key == op.Key {
+				ki = i
+				break
+			}
+		}
+
+		switch op.Op {
+		case "set":
+			var v interface{}
+			if err := yaml.Unmarshal([]byte(op.Value), &v); err != nil {
+				return nil, errors.Wrapf(err, "invalid value to set [%s]", op.Key)
+			}
+			if ki >= 0 {
+				patched[ki].Value = v
+			} else {
+				patched = append(patched, yaml.MapItem{Key: op.Key, Value: v})
+			}
+		case "unset":
+			if ki >= 0 {
+				patched = append(patched[:ki:ki], patched[ki+1:]...)
+			}
+		case "append":
+			var v interface{}
+			if err := yaml.Unmarshal([]byte(op.Value), &v); err != nil {
+				return nil, errors.Wrapf(err, "invalid value to append to [%s]", op.Key)
+			}
+			if ki < 0 {
+				patched = append(patched, yaml.MapItem{Key: op.Key, Value: []interface{}{v}})
+			} else if seq, ok := patched[ki].Value.([]interface{}); ok {
+				patched[ki].Value = append(append([]interface{}(nil), seq...), v)
+			} else {
+				return nil, errors.Errorf("[%s] is not a sequence to append to", op.Key)
+			}
+		case "replace":
+			re, err := regexp.Compile(op.Pattern)
+			if err != nil {
+				return nil, err
+			}
+			if ki < 0 {
+				continue
+			}
+			switch v := patched[ki].Value.(type) {
+			case string:
+				patched[ki].Value = re.ReplaceAllString(v, op.Replacement)
+			case []interface{}:
+				seq := make([]interface{}, len(v))
+				for i, elem := range v {
+					if s, ok := elem.(string); ok {
+						seq[i] = re.ReplaceAllString(s, op.Replacement)
+					} else {
+						seq[i] = elem
+					}
+				}
+				patched[ki].Value = seq
+			}
+		default:
+			return nil, errors.Errorf("unknown patch op [%s]", op.Op)
+		}
+	}
+	return patched, nil
+}
+
+// outcome of patching a compute node's config
+type CfgPatchPreview struct {
+	Mac, Host, IP string
+	// etag of the config the patch is based on
+	ETag string
+
+	// both empty if the patch changes nothing
+	RawDiff, InflatedDiff string
+	// patched raw yaml
+	After string
+
+	Err string
+}
+
+func inflatedYaml(cfg *ComputeNodeCfg) (string, error) {
+	cfgd, err := cfg.InflateE()
+	if err != nil {
+		return "", err
+	}
+	out, err := yaml.Marshal(cfgd)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+func previewCfgPatch(cfg *ComputeNodeCfg, ops []CfgPatchOp) CfgPatchPreview {
+	pv := CfgPatchPreview{Mac: cfg.Mac, ETag: cfg.ETag}
+	if cfgd, err := cfg.InflateE(); err == nil {
+		pv.Host, _ = cfgd["hostname"].(string)
+		pv.IP, _ = cfgd["ip"].(string)
+	}
+
+	patched, err := patchCfgYaml(cfg.CfgYaml, ops)
+	if err != nil {
+		pv.Err = err.Error()
+		return pv
+	}
+	rawYaml, err := yaml.Marshal(patched)
+	if err != nil {
+		pv.Err = err.Error()
+		return pv
+	}
+	if unpatched, err := yaml.Marshal(cfg.CfgYaml); err == nil && string(unpatched) == string(rawYaml) {
+		// nothing changed by the patch, keep the config file as is, with its
+		// comments and formatting
+		pv.After = cfg.RawYaml
+		return pv
+	}
+	newCfg, err := ParseComputeNodeCfg(rawYaml)
+	if err != nil {
+		pv.Err = err.Error()
+		return pv
+	}
+	pv.After = string(rawYaml)
+	pv.RawDiff = DiffLines(cfg.RawYaml, pv.After)
+
+	before, err := inflatedYaml(cfg)
+	if err != nil {
+		before = "# " + err.Error() + "\n"
+	}
+	after, err := inflatedYaml(newCfg)
+	if err != nil {
+		pv.Err = err.Error()
+		return pv
+	}
+	if _, err := inflatedIP(newCfg); err != nil {
+		pv.Err = err.Error()
+		return pv
+	}
+	pv.InflatedDiff = DiffLines(before, after)
+	return pv
+}
+
+// check patched configs for clashes with others as well as among themselves,
+// previews with conflicts get their Err set
+func _checkPatchConflicts(previews []CfgPatchPreview) error {
+	var changed []*ComputeNodeCfg
+	for _, pv := range previews {
+		if len(pv.Err) > 0 || len(pv.RawDiff) <= 0 {
+			continue
+		}
+		newCfg, err := ParseComputeNodeCfg([]byte(pv.After))
+		if err != nil {
+			return err
+		}
+		changed = append(changed, newCfg)
+	}
+	err := _checkCfgConflicts(changed...)
+	if cce, ok := err.(*CfgConflictError); ok {
+		for i := range previews {
+			for _, c := range cce.Conflicts {
+				if c.involves(previews[i].Mac) {
+					previews[i].Err = fmt.Sprintf("%s [%s] would clash among mac=%v", c.Kind, c.Value, c.Macs())
+					break
+				}
+			}
+		}
+	}
+	return err
+}
+
+// preview the outcome of patching selected compute nodes' configs
+func PreviewCfgPatch(sel NodeSelection, ops []CfgPatchOp) ([]CfgPatchPreview, error) {
+	lockComputeNodeCfgs()
+	defer mutexComputeNodeCfgs.Unlock()
+
+	cfgs, err := _selectComputeNodeCfgs(sel)
+	if err != nil {
+		return nil, err
+	}
+	previews := make([]CfgPatchPreview, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		previews = append(previews, previewCfgPatch(cfg, ops))
+	}
+	if err := _checkPatchConflicts(previews); err != nil {
+		if _, ok := err.(*CfgConflictError); !ok {
+			return nil, err
+		}
+	}
+	return previews, nil
+}
+
+// patch selected compute nodes' configs all at once, etags of the configs
+// previewed must be specified, and all of them have to be unchanged since
+func ApplyCfgPatch(sel NodeSelection, ops []CfgPatchOp, etags map[string]string) ([]CfgPatchPreview, error) {
+	lockComputeNodeCfgs()
+	defer mutexComputeNodeCfgs.Unlock()
+
+	cfgs, err := _selectComputeNodeCfgs(sel)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfgs) != len(etags) {
+		return nil, errors.Errorf("%d nodes selected now vs %d previewed", len(cfgs), len(etags))
+	}
+
+	st := getStore()
+	previews := make([]CfgPatchPreview, 0, len(cfgs))
+	rawYamls := make(map[string][]byte, len(cfgs))
+	for _, cfg := range cfgs {
+		// check against what's stored, it may have been modified by other means
+		curCfg, err := st.LoadCfg(cfg.Mac)
+		if err != nil {
+			return nil, err
+		}
+		if curCfg == nil || curCfg.ETag != etags[cfg.Mac] {
+			return nil, &CfgChangedError{Mac: cfg.Mac, Current: curCfg}
+		}
+		pv := previewCfgPatch(curCfg, ops)
+		if len(pv.Err) > 0 {
+			return nil, errors.Errorf("mac=[%s]: %s", cfg.Mac, pv.Err)
+		}
+		previews = append(previews, pv)
+		if len(pv.RawDiff) > 0 {
+			rawYamls[cfg.Mac] = []byte(pv.After)
+		}
+	}
+	if len(rawYamls) <= 0 {
+		return previews, nil
+	}
+	if err := _checkPatchConflicts(previews); err != nil {
+		return nil, err
+	}
+
+	savedCfgs, err := st.SaveCfgs(rawYamls)
+	if err != nil {
+		return nil, err
+	}
+	for _, cfg := range savedCfgs {
+		if oldCfg, ok := knownComputeNodeCfgs[cfg.Mac]; ok {
+			ForgetCfg(oldCfg)
+		}
+		knownComputeNodeCfgs[cfg.Mac] = cfg
+		ip, _ := inflatedIP(cfg)
+		CareIpAliveness(ip, false, cfg)
+		RecordHistory(cfg.Mac, ip, "saved", "bulk patch")
+	}
+	return previews, nil
+}
@@ -0,0 +1,114 @@
+package ccm
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+const patchBase = `mac: aa:bb:cc:dd:ee:01
+ip: 192.168.11.201
+group: rack1
+tags: [gpu, ib]
+`
+
+func patchBaseYaml(t *testing.T) yaml.MapSlice {
+	var ms yaml.MapSlice
+	if err := yaml.Unmarshal([]byte(patchBase), &ms); err != nil {
+		t.Fatal(err)
+	}
+	return ms
+}
+
+func TestPatchCfgYamlOps(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		ops  []CfgPatchOp
+		key  string
+		want interface{}
+		// whether the key is expected to be present after patching
+		present bool
+	}{
+		{"set existing", []CfgPatchOp{{Op: "set", Key: "group", Value: "rack2"}},
+			"group", "rack2", true},
+		{"set new", []CfgPatchOp{{Op: "set", Key: "faulty", Value: "psu"}},
+			"faulty", "psu", true},
+		{"unset", []CfgPatchOp{{Op: "unset", Key: "group"}},
+			"group", nil, false},
+		{"unset absent", []CfgPatchOp{{Op: "unset", Key: "nosuch"}},
+			"nosuch", nil, false},
+		{"append existing", []CfgPatchOp{{Op: "append", Key: "tags", Value: "nvme"}},
+			"tags", []interface{}{"gpu", "ib", "nvme"}, true},
+		{"append new", []CfgPatchOp{{Op: "append", Key: "extra", Value: "x"}},
+			"extra", []interface{}{"x"}, true},
+		{"replace string", []CfgPatchOp{{Op: "replace", Key: "group", Pattern: `^rack(\d+)$`, Replacement: "row$1"}},
+			"group", "row1", true},
+		{"replace sequence", []CfgPatchOp{{Op: "replace", Key: "tags", Pattern: "^ib$", Replacement: "roce"}},
+			"tags", []interface{}{"gpu", "roce"}, true},
+		{"ops in order", []CfgPatchOp{
+			{Op: "set", Key: "group", Value: "rack2"},
+			{Op: "replace", Key: "group", Pattern: "rack", Replacement: "row"},
+		}, "group", "row2", true},
+	} {
+		orig := patchBaseYaml(t)
+		patched, err := patchCfgYaml(orig, tc.ops)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		v, ok := mapSliceGet(patched, tc.key)
+		if ok != tc.present || !reflect.DeepEqual(v, tc.want) {
+			t.Errorf("%s: [%s] patched to %#v (present %v), want %#v (present %v)",
+				tc.name, tc.key, v, ok, tc.want, tc.present)
+		}
+		if !reflect.DeepEqual(orig, patchBaseYaml(t)) {
+			t.Errorf("%s: original config modified", tc.name)
+		}
+	}
+}
+
+func TestPatchCfgYamlErrors(t *testing.T) {
+	for _, tc := range []struct {
+		op      CfgPatchOp
+		wantErr string
+	}{
+		{CfgPatchOp{Op: "set", Value: "x"}, "no key"},
+		{CfgPatchOp{Op: "set", Key: "mac", Value: "aa:bb:cc:dd:ee:02"}, "mac can not be patched"},
+		{CfgPatchOp{Op: "append", Key: "group", Value: "x"}, "not a sequence"},
+		{CfgPatchOp{Op: "set", Key: "group", Value: "[x"}, "invalid value"},
+		{CfgPatchOp{Op: "replace", Key: "group", Pattern: "("}, "missing closing"},
+		{CfgPatchOp{Op: "rename", Key: "group"}, "unknown patch op"},
+	} {
+		_, err := patchCfgYaml(patchBaseYaml(t), []CfgPatchOp{tc.op})
+		if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%+v: got error %v, want containing %q", tc.op, err, tc.wantErr)
+		}
+	}
+}
+
+func TestPatchCfgYamlNoop(t *testing.T) {
+	orig := patchBaseYaml(t)
+	unpatched, err := yaml.Marshal(orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ops := range [][]CfgPatchOp{
+		{{Op: "set", Key: "group", Value: "rack1"}},
+		{{Op: "unset", Key: "nosuch"}},
+		{{Op: "replace", Key: "group", Pattern: "nomatch", Replacement: "x"}},
+	} {
+		patched, err := patchCfgYaml(orig, ops)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rawYaml, err := yaml.Marshal(patched)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(rawYaml) != string(unpatched) {
+			t.Errorf("%+v: no-op patch rendered differently:\n%s", ops, rawYaml)
+		}
+	}
+}
@@ -2,17 +2,19 @@ package ccm
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"io"
 	"io/ioutil"
-	"os"
-	"path/filepath"
+	"net"
+	"runtime"
 	"sort"
 	"strings"
 	"sync"
 	"text/template"
 	"time"
 
+	"github.com/complyue/different-hpc/pkg/audit"
 	"github.com/complyue/hbi/pkg/errors"
 	"github.com/golang/glog"
 	"gopkg.in/yaml.v2"
@@ -23,16 +25,168 @@ type ComputeNodeCfg struct {
 
 	GuiType, GuiHref string
 
+	// locator of the config in its store, a file path with yaml store
 	FileName string
 	FileTime time.Time
 
 	RawYaml string
 	CfgYaml yaml.MapSlice
+
+	// hash of RawYaml, for compare-and-swap on save
+	ETag string
+
+	// shared by copies, as a config is never modified once parsed
+	inflation *cfgInflation
+}
+
+// inflated result of a config, computed once
+type cfgInflation struct {
+	once sync.Once
+	ctx  map[string]interface{}
+	err  error
+}
+
+// hash of raw yaml of a compute node config
+func CfgETag(rawYaml []byte) string {
+	sum := sha256.Sum256(rawYaml)
+	return hex.EncodeToString(sum[:16])
+}
+
+// normalize a mac address to lower case, colon separated form,
+// error if it's not a valid mac address
+func NormalizeMac(mac string) (string, error) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return "", err
+	}
+	return hw.String(), nil
 }
 
+// the config to be saved is based on a stale version
+type CfgChangedError struct {
+	Mac string
+	// current config, nil if it has disappeared
+	Current *ComputeNodeCfg
+}
+
+func (e *CfgChangedError) Error() string {
+	if e.Current == nil {
+		return fmt.Sprintf("config of mac=[%s] has disappeared", e.Mac)
+	}
+	return fmt.Sprintf("config of mac=[%s] has changed", e.Mac)
+}
+
+// an error inflating a compute node config, with the offending key
+type InflateError struct {
+	Key string
+	Err error
+}
+
+func (e *InflateError) Error() string {
+	return fmt.Sprintf("bad template in [%s]: %v", e.Key, e.Err)
+}
+
+// inflate templates in config values, panic on failure
 func (cfg *ComputeNodeCfg) Inflate() map[string]interface{} {
+	ctx, err := cfg.InflateE()
+	if err != nil {
+		panic(err)
+	}
+	return ctx
+}
+
+// inflate templates in config values, an *InflateError is returned on failure.
+// the result is cached with the config, a copy is returned each time.
+func (cfg *ComputeNodeCfg) InflateE() (map[string]interface{}, error) {
+	if cfg.inflation == nil {
+		return cfg.inflate()
+	}
+	inf := cfg.inflation
+	inf.once.Do(func() {
+		inf.ctx, inf.err = cfg.inflate()
+	})
+	if inf.err != nil {
+		return nil, inf.err
+	}
+	ctx := make(map[string]interface{}, len(inf.ctx))
+	for k, v := range inf.ctx {
+		ctx[k] = v
+	}
+	return ctx, nil
+}
+
+const maxCompiledTmpls = 10000
+
+var (
+	// compiled templates by name and text, configs of nodes mostly share
+	// the same templates from cnode.yaml
+	compiledTmpls      = make(map[[2]string]*template.Template)
+	compiledTmplsMutex sync.Mutex
+)
+
+func compileTmpl(name, text string) (*template.Template, error) {
+	key := [2]string{name, text}
+
+	compiledTmplsMutex.Lock()
+	vt, ok := compiledTmpls[key]
+	compiledTmplsMutex.Unlock()
+	if ok {
+		return vt, nil
+	}
+
+	vt, err := template.New(name).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	compiledTmplsMutex.Lock()
+	defer compiledTmplsMutex.Unlock()
+
+	if len(compiledTmpls) >= maxCompiledTmpls {
+		// simply start over, stale ones are not worth tracking
+		compiledTmpls = make(map[[2]string]*template.Template)
+	}
+	compiledTmpls[key] = vt
+	return vt, nil
+}
+
+var (
+	cfgVars      = make(map[string]func(mac string) string)
+	cfgVarsMutex sync.Mutex
+)
+
+// register a variable available to templates in compute node configs, valued
+// per node by its mac, a config key of the same name takes precedence. should
+// be called before any config inflated, e.g. in init()
+func RegisterCfgVar(name string, valueOf func(mac string) string) {
+	cfgVarsMutex.Lock()
+	defer cfgVarsMutex.Unlock()
+
+	cfgVars[name] = valueOf
+}
+
+func (cfg *ComputeNodeCfg) inflate() (map[string]interface{}, error) {
 	ctx := make(map[string]interface{}, 20)
+	func() {
+		cfgVarsMutex.Lock()
+		defer cfgVarsMutex.Unlock()
+
+		for name, valueOf := range cfgVars {
+			ctx[name] = valueOf(cfg.Mac)
+		}
+	}()
 	buf := bytes.NewBuffer(nil)
+	expand := func(key, text string) (string, error) {
+		vt, err := compileTmpl("Value of "+key, text)
+		if err != nil {
+			return "", &InflateError{Key: key, Err: err}
+		}
+		buf.Reset()
+		if err := vt.Execute(buf, ctx); err != nil {
+			return "", &InflateError{Key: key, Err: err}
+		}
+		return buf.String(), nil
+	}
 	for _, cfgItem := range cfg.CfgYaml {
 		if cfgKey, ok := cfgItem.Key.(string); ok {
 			switch cfgVal := cfgItem.Value.(type) {
@@ -40,25 +194,22 @@ func (cfg *ComputeNodeCfg) Inflate() map[string]interface{} {
 				ctx[cfgKey] = cfgVal
 			case float64:
 				ctx[cfgKey] = cfgVal
+			case bool:
+				ctx[cfgKey] = cfgVal
 			case string:
-				vt := template.Must(template.New("Value of " + cfgKey).Parse(cfgVal))
-				buf.Reset()
-				if err := vt.Execute(buf, ctx); err != nil {
-					panic(err)
+				val, err := expand(cfgKey, cfgVal)
+				if err != nil {
+					return nil, err
 				}
-				val := buf.String()
 				ctx[cfgKey] = val
 			case []interface{}:
 				seqStrs := make([]string, 0, len(cfgVal))
 				for seqI, seqElem := range cfgVal {
 					if seqStr, ok := seqElem.(string); ok {
-						vt := template.Must(template.New(fmt.Sprintf(
-							"Value of %s:%v", cfgKey, seqI+1)).Parse(seqStr))
-						buf.Reset()
-						if err := vt.Execute(buf, ctx); err != nil {
-							panic(err)
+						val, err := expand(fmt.Sprintf("%s:%v", cfgKey, seqI+1), seqStr)
+						if err != nil {
+							return nil, err
 						}
-						val := buf.String()
 						seqStrs = append(seqStrs, val)
 					}
 				}
@@ -67,162 +218,396 @@ func (cfg *ComputeNodeCfg) Inflate() map[string]interface{} {
 
 		}
 	}
-	return ctx
+	return ctx, nil
 }
 
 const (
 	cnodesDir = "etc/cnodes"
+
+	cnodeTmplFile = "etc/cnode.yaml"
 )
 
-func LoadComputeNodeCfg(fileName string, mac string) (*ComputeNodeCfg, error) {
-	fi, err := os.Stat(fileName)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, nil
-		}
-		return nil, err
-	}
+// template for generating new compute node configs
+type cnodeTmpl struct {
+	ipnPrefix string
+	ipnRange  []int
+
+	cfgYaml yaml.MapSlice
+}
 
-	// file exists, either manually created or modified,
-	// do a fresh load
-	rawYaml, err := ioutil.ReadFile(fileName)
+var (
+	cachedCnodeTmpl *cnodeTmpl
+	cnodeTmplMutex  sync.Mutex
+)
+
+func loadCnodeTmpl() (*cnodeTmpl, error) {
+	tmplRawYaml, err := ioutil.ReadFile(cnodeTmplFile)
 	if err != nil {
 		return nil, err
 	}
-	var cfgYaml yaml.MapSlice
-	err = yaml.Unmarshal(rawYaml, &cfgYaml)
+	var tmplYaml yaml.MapSlice
+	err = yaml.Unmarshal(tmplRawYaml, &tmplYaml)
 	if err != nil {
 		return nil, err
 	}
-	var cfgMac, ip string
-	var guiType, guiHref string
-	for _, cfgItem := range cfgYaml {
-		if cfgKey, ok := cfgItem.Key.(string); ok {
-			if "mac" == cfgKey {
-				cfgMac = cfgItem.Value.(string)
-			} else if "ip" == cfgKey {
-				ip = cfgItem.Value.(string)
-			} else if "guiHref" == cfgKey {
-				guiHref = cfgItem.Value.(string)
-			} else if "guiType" == cfgKey {
-				guiType = cfgItem.Value.(string)
+
+	tmpl := &cnodeTmpl{}
+	for _, cfgItem := range tmplYaml {
+		if cfgKey, ok := cfgItem.Key.(string); ok && "autoip" == cfgKey {
+			autoip, ok := cfgItem.Value.(yaml.MapSlice)
+			if !ok {
+				return nil, errors.Errorf("invalid autoip in [%s]", cnodeTmplFile)
+			}
+			for _, ci1 := range autoip {
+				if "prefix" == ci1.Key {
+					tmpl.ipnPrefix, _ = ci1.Value.(string)
+				} else if "range" == ci1.Key {
+					ipnRange, _ := ci1.Value.([]interface{})
+					for _, ipn := range ipnRange {
+						n, ok := ipn.(int)
+						if !ok || n < 0 || n > 255 {
+							return nil, errors.Errorf("invalid autoip range element %#v in [%s]", ipn, cnodeTmplFile)
+						}
+						tmpl.ipnRange = append(tmpl.ipnRange, n)
+					}
+				}
 			}
+			continue
 		}
-	}
 
-	var problem error
-	if len(mac) > 0 && cfgMac != mac {
-		problem = errors.Errorf(
-			"invalid mac=[%s] vs [%s] in config file [%s]",
-			cfgMac, mac, fileName,
-		)
+		tmpl.cfgYaml = append(tmpl.cfgYaml, cfgItem)
 	}
-	if len(ip) <= 0 {
-		problem = errors.Errorf(
-			"no ip in config file [%s]",
-			fileName,
-		)
+	if len(tmpl.ipnPrefix) <= 0 {
+		return nil, errors.Errorf("no autoip prefix in [%s]", cnodeTmplFile)
 	}
-	if problem != nil {
-		glog.Warningf("Problem detected: %+v", problem)
-		d, f := filepath.Split(fileName)
-		bogonFileName := fmt.Sprintf("%s~%s.bogon-%s", d, f, time.Now().Format("20060102150405"))
-		glog.Infof("Renaming bogus config file from [%s] to [%s] ...",
-			fileName, bogonFileName)
-		if err = os.Rename(fileName, bogonFileName); err != nil {
+	if len(tmpl.ipnRange)%2 != 0 {
+		return nil, errors.Errorf("autoip range in [%s] should be start/end pairs", cnodeTmplFile)
+	}
+	for ipnRI := 0; ipnRI < len(tmpl.ipnRange); ipnRI += 2 {
+		if tmpl.ipnRange[ipnRI] > tmpl.ipnRange[ipnRI+1] {
+			return nil, errors.Errorf("invalid autoip range %v-%v in [%s]",
+				tmpl.ipnRange[ipnRI], tmpl.ipnRange[ipnRI+1], cnodeTmplFile)
+		}
+	}
+	return tmpl, nil
+}
+
+func getCnodeTmpl() (*cnodeTmpl, error) {
+	cnodeTmplMutex.Lock()
+	defer cnodeTmplMutex.Unlock()
+
+	if cachedCnodeTmpl == nil {
+		tmpl, err := loadCnodeTmpl()
+		if err != nil {
 			return nil, err
 		}
-		return nil, nil
+		cachedCnodeTmpl = tmpl
 	}
+	return cachedCnodeTmpl, nil
+}
 
-	cfg := &ComputeNodeCfg{
-		Mac:     cfgMac,
-		GuiType: guiType, GuiHref: guiHref,
-		FileName: fileName, FileTime: fi.ModTime(),
-		RawYaml: string(rawYaml), CfgYaml: cfgYaml,
+// reload the template for new compute node configs, the last good one is
+// kept on error
+func ReloadCnodeTmpl() error {
+	tmpl, err := loadCnodeTmpl()
+	if err != nil {
+		return err
 	}
-	return cfg, nil
+
+	cnodeTmplMutex.Lock()
+	defer cnodeTmplMutex.Unlock()
+
+	cachedCnodeTmpl = tmpl
+	return nil
+}
+
+// whether a file name under cnodesDir is for a compute node config
+func isComputeNodeCfgFile(fn string) bool {
+	if len(fn) < 1 {
+		return false
+	}
+	switch fn[0] {
+	case '.':
+		fallthrough
+	case '_':
+		fallthrough
+	case '~':
+		fallthrough
+	case '!':
+		return false
+	}
+	return strings.HasSuffix(fn, ".yaml")
 }
 
 var (
 	knownComputeNodeCfgs map[string]*ComputeNodeCfg
 	mutexComputeNodeCfgs sync.Mutex
+
+	// serializes initial loading, retried on next access if failed
+	loadingComputeNodeCfgs sync.Mutex
 )
 
-func ReloadComputeNodeCfg(fileName string) (*ComputeNodeCfg, error) {
-	cfg, err := LoadComputeNodeCfg(fileName, "")
-	if err != nil {
-		return cfg, err
+// lock mutexComputeNodeCfgs, with all configs loaded before that, the initial
+// loading happens without the lock held
+func lockComputeNodeCfgs() {
+	mutexComputeNodeCfgs.Lock()
+	loaded := knownComputeNodeCfgs != nil
+	mutexComputeNodeCfgs.Unlock()
+
+	if !loaded {
+		func() {
+			loadingComputeNodeCfgs.Lock()
+			defer loadingComputeNodeCfgs.Unlock()
+
+			mutexComputeNodeCfgs.Lock()
+			loaded = knownComputeNodeCfgs != nil
+			mutexComputeNodeCfgs.Unlock()
+			if !loaded {
+				loadComputeNodeCfgs()
+			}
+		}()
 	}
 
 	mutexComputeNodeCfgs.Lock()
+}
+
+// the known config of a compute node by its mac, nil if none
+func GetComputeNodeCfg(mac string) *ComputeNodeCfg {
+	lockComputeNodeCfgs()
 	defer mutexComputeNodeCfgs.Unlock()
 
-	knownComputeNodeCfgs[cfg.Mac] = cfg
+	return _getComputeNodeCfgs()[mac]
+}
+
+// the known config of a compute node by its inflated ip, nil if none, an
+// error if more than one node configured with the ip
+func GetComputeNodeCfgByIP(ip string) (*ComputeNodeCfg, error) {
+	lockComputeNodeCfgs()
+	defer mutexComputeNodeCfgs.Unlock()
+
+	var found *ComputeNodeCfg
+	for _, cfg := range _getComputeNodeCfgs() {
+		if cfgIP, err := inflatedIP(cfg); err != nil || cfgIP != ip {
+			continue
+		}
+		if found != nil {
+			return nil, errors.Errorf("ip [%s] configured for both mac=[%s] and mac=[%s]", ip, found.Mac, cfg.Mac)
+		}
+		found = cfg
+	}
+	return found, nil
+}
+
+// validate raw yaml then save it as the config of a compute node, the save
+// only happens if the config currently stored has the specified etag,
+// otherwise a *CfgChangedError is returned
+func SaveComputeNodeCfg(mac string, rawYaml []byte, etag string) (*ComputeNodeCfg, error) {
+	newCfg, err := ParseComputeNodeCfg(rawYaml)
+	if err != nil {
+		return nil, err
+	}
+	if newCfg.Mac != mac {
+		return nil, errors.Errorf("mac can not be changed from [%s] to [%s]", mac, newCfg.Mac)
+	}
+	ip, err := inflatedIP(newCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	lockComputeNodeCfgs()
+	defer mutexComputeNodeCfgs.Unlock()
+
+	st := getStore()
+	// check against what's stored, it may have been modified by other means
+	curCfg, err := st.LoadCfg(mac)
+	if err != nil {
+		return nil, err
+	}
+	if curCfg == nil || curCfg.ETag != etag {
+		return nil, &CfgChangedError{Mac: mac, Current: curCfg}
+	}
+	if err := _checkCfgConflicts(newCfg); err != nil {
+		return nil, err
+	}
+
+	cfg, err := st.SaveCfg(mac, rawYaml)
+	if err != nil {
+		return nil, err
+	}
+	if oldCfg, ok := knownComputeNodeCfgs[mac]; ok {
+		ForgetCfg(oldCfg)
+	}
+	knownComputeNodeCfgs[mac] = cfg
+	CareIpAliveness(ip, false, cfg)
+	RecordHistory(mac, ip, "saved", cfg.FileName)
 	return cfg, nil
 }
 
-func _getComputeNodeCfgs() map[string]*ComputeNodeCfg {
-	if nil == knownComputeNodeCfgs {
-		// do initial loading cfg for all known compute nodes
-		loadingCfgs := make(map[string]*ComputeNodeCfg, 255)
-		dirf, err := os.Open(cnodesDir)
-		if err != nil {
-			panic(errors.Errorf("Error reading dir: "+cnodesDir+"\n%+v", err))
+// the ip a config inflates to
+func inflatedIP(cfg *ComputeNodeCfg) (string, error) {
+	cfgd, err := cfg.InflateE()
+	if err != nil {
+		return "", err
+	}
+	ip, _ := cfgd["ip"].(string)
+	if len(ip) <= 0 {
+		return "", errors.Errorf("no ip inflated from config of mac=[%s]", cfg.Mac)
+	}
+	return ip, nil
+}
+
+// refresh a compute node config after its file changed on disk, only
+// meaningful with yaml store. unlike configs loaded otherwise, a bogus file is
+// not archived, the last good config is kept in effect and the problem returned
+func RefreshComputeNodeCfgFile(fileName string) error {
+	ys, ok := getStore().(*yamlDirStore)
+	if !ok {
+		return nil
+	}
+	cfg, problem, err := ys.readCfgFile(fileName)
+	if err != nil {
+		return err
+	}
+	if problem != nil {
+		return problem
+	}
+	var ip string
+	if cfg != nil {
+		// validate templates before it's put in effect
+		if ip, err = inflatedIP(cfg); err != nil {
+			return err
 		}
-		files, err := dirf.Readdir(500)
-		if err != nil && err != io.EOF {
-			panic(errors.Errorf("Error listing dir: "+cnodesDir+"\n%+v", err))
+	}
+
+	lockComputeNodeCfgs()
+	defer mutexComputeNodeCfgs.Unlock()
+
+	for si, c := range shadowedComputeNodeCfgs {
+		if c.FileName == fileName {
+			shadowedComputeNodeCfgs = append(shadowedComputeNodeCfgs[:si:si], shadowedComputeNodeCfgs[si+1:]...)
+			break
 		}
-		for _, fi := range files {
-			fn := fi.Name()
-			if fi.IsDir() {
-				continue
-			}
-			switch fn[0] {
-			case '.':
-				fallthrough
-			case '_':
-				fallthrough
-			case '~':
-				fallthrough
-			case '!':
-				continue
-			}
-			if !strings.HasSuffix(fn, ".yaml") {
-				continue
+	}
+	var oldCfg *ComputeNodeCfg
+	for _, c := range knownComputeNodeCfgs {
+		if c.FileName == fileName {
+			oldCfg = c
+			break
+		}
+	}
+	if oldCfg != nil {
+		if cfg != nil && oldCfg.RawYaml == cfg.RawYaml {
+			// content not changed
+			oldCfg.FileTime = cfg.FileTime
+			return nil
+		}
+		_forgetComputeNodeCfg(oldCfg)
+	}
+	if cfg == nil {
+		glog.Infof("Config file [%s] removed.", fileName)
+		return nil
+	}
+	if effCfg, ok := knownComputeNodeCfgs[cfg.Mac]; ok {
+		shadowedComputeNodeCfgs = append(shadowedComputeNodeCfgs, cfg)
+		return errors.Errorf("config [%s] shadowed by [%s] for the same mac=[%s]",
+			fileName, effCfg.FileName, cfg.Mac)
+	}
+
+	glog.Infof("Config file [%s] reloaded for mac=[%s].", fileName, cfg.Mac)
+	ys.noteCfgFile(cfg)
+	knownComputeNodeCfgs[cfg.Mac] = cfg
+	// assume alive for a newly appeared cfg file, the same as initial loading
+	CareIpAliveness(ip, oldCfg == nil, cfg)
+	if conflicts := _cfgConflictsOf(cfg.Mac); len(conflicts) > 0 {
+		return &CfgConflictError{Conflicts: conflicts}
+	}
+	return nil
+}
+
+// load all compute node configs from store initially
+func loadComputeNodeCfgs() {
+	// restore aliveness states persisted before
+	restored := restoreAliveness()
+
+	cfgs, err := getStore().LoadCfgs()
+	if err != nil {
+		panic(err)
+	}
+	glog.Infof("%d compute node configs loaded.", len(cfgs))
+
+	// inflate in parallel, results are cached with the configs
+	cfgIdxs := make(chan int)
+	var wg sync.WaitGroup
+	for w := runtime.NumCPU(); w > 0; w-- {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ci := range cfgIdxs {
+				cfgs[ci].InflateE()
 			}
+		}()
+	}
+	for ci := range cfgs {
+		cfgIdxs <- ci
+	}
+	close(cfgIdxs)
+	wg.Wait()
 
-			fileName := "etc/cnodes/" + fn
-			// if a single cfg file is to cause panic, ignore it with proper log, other things continue
-			func() {
-				defer func() {
-					if e := recover(); e != nil {
-						glog.Errorf("Error loading compute node cfg file [%s]\n%+v", fileName, e)
-					}
-				}()
-				if cfg, err := LoadComputeNodeCfg(fileName, ""); err != nil {
-					panic(err)
-				} else if cfg != nil {
-					loadingCfgs[cfg.Mac] = cfg
-					// assume alive since initial load, by sole existance of a node's cfg file
-					CareIpAliveness(cfg.Inflate()["ip"].(string), true, cfg)
-				}
-			}()
+	loadingCfgs := make(map[string]*ComputeNodeCfg, len(cfgs))
+	var shadowedCfgs []*ComputeNodeCfg
+	for _, cfg := range cfgs {
+		ip, err := inflatedIP(cfg)
+		if err != nil {
+			// a single bad cfg is ignored with proper log, other things continue
+			glog.Errorf("Error loading compute node cfg [%s]\n%+v", cfg.FileName, err)
+			continue
 		}
-		// only assign to global var after finished loading at all
-		knownComputeNodeCfgs = loadingCfgs
+		if effCfg, ok := loadingCfgs[cfg.Mac]; ok {
+			glog.Warningf("Config [%s] shadowed by [%s] for the same mac=[%s]",
+				cfg.FileName, effCfg.FileName, cfg.Mac)
+			shadowedCfgs = append(shadowedCfgs, cfg)
+			continue
+		}
+		loadingCfgs[cfg.Mac] = cfg
+		// assume alive since initial load, by sole existance of a node's cfg,
+		// unless its aliveness has been persisted
+		CareIpAliveness(ip, !restored[ip], cfg)
 	}
 
+	mutexComputeNodeCfgs.Lock()
+	defer mutexComputeNodeCfgs.Unlock()
+
+	// only assign to global var after finished loading at all
+	knownComputeNodeCfgs = loadingCfgs
+	shadowedComputeNodeCfgs = shadowedCfgs
+	for _, c := range conflictsAmong(_allComputeNodeCfgs()) {
+		glog.Warningf("Conflicting configs on %s [%s]: %v", c.Kind, c.Value, c.Holders)
+	}
+}
+
+// load compute node configs ahead of first access, failure is logged and the
+// loading retried on next access
+func PreloadComputeNodeCfgs() {
+	defer func() {
+		if e := recover(); e != nil {
+			glog.Errorf("Error loading compute node configs:\n%+v", e)
+		}
+	}()
+
+	lockComputeNodeCfgs()
+	mutexComputeNodeCfgs.Unlock()
+}
+
+// all known compute node configs, mutexComputeNodeCfgs must have been locked
+// via lockComputeNodeCfgs
+func _getComputeNodeCfgs() map[string]*ComputeNodeCfg {
 	return knownComputeNodeCfgs
 }
 
 func GetComputeNodeCfgs() []ComputeNodeCfg {
-	mutexComputeNodeCfgs.Lock()
+	lockComputeNodeCfgs()
 	defer mutexComputeNodeCfgs.Unlock()
 
-	_getComputeNodeCfgs()
-
 	cfgs := make([]ComputeNodeCfg, 0, len(knownComputeNodeCfgs))
 	for _, cfg := range knownComputeNodeCfgs {
 		cfgs = append(cfgs, *cfg)
@@ -231,168 +616,283 @@ func GetComputeNodeCfgs() []ComputeNodeCfg {
 }
 
 func PrepareComputeNodeCfg(mac string) (*ComputeNodeCfg, error) {
-	mutexComputeNodeCfgs.Lock()
+	lockComputeNodeCfgs()
 	defer mutexComputeNodeCfgs.Unlock()
 
-	_getComputeNodeCfgs()
-
-	if cfg, ok := knownComputeNodeCfgs[mac]; ok {
-		// already loaded
-		// check reload in case file modified after last load
-		if fi, err := os.Stat(cfg.FileName); err == nil {
-			if cfg.Mac != mac {
-				glog.Errorf("Config file [%s] contains invalid mac=[%s] vs [%s] ?!",
-					cfg.FileName, cfg.Mac, mac)
-				d, f := filepath.Split(cfg.FileName)
-				bogonFileName := fmt.Sprintf("%s~%s.bogon-%s", d, f, time.Now().Format("20060102150405"))
-				glog.Infof("Renaming bogus config file from [%s] to [%s] ...",
-					cfg.FileName, bogonFileName)
-				if err := os.Rename(cfg.FileName, bogonFileName); err != nil {
-					panic(err)
-				}
-				delete(knownComputeNodeCfgs, mac)
-				glog.Warningf("A new configuration will be generated for mac=[%s]", mac)
-			} else if fi.ModTime() == cfg.FileTime {
-				// file not modified since last load
-				return cfg, nil
-			} else {
-				// file changed, fallthrough to do a fresh load
-			}
-		} else {
-			glog.Warningf("Config file [%s] for mac=[%s] deleted ?", cfg.FileName, cfg.Mac)
-		}
-	}
+	st := getStore()
 
-	macKey := strings.Replace(mac, ":", "-", -1)
-	fileName := "etc/cnodes/" + macKey + ".yaml"
-	if cfg, err := LoadComputeNodeCfg(fileName, mac); err != nil {
+	// always load from store in case it's modified after last load
+	cfg, err := st.LoadCfg(mac)
+	if bce, ok := err.(*BogusCfgError); ok {
+		knownCfg, known := knownComputeNodeCfgs[mac]
+		if !known {
+			return nil, err
+		}
+		// keep the last good config, the bogus one is likely in the middle
+		// of a hand edit
+		glog.Warningf("Keeping last good config [%s] for mac=[%s], as stored one is bogus: %s",
+			knownCfg.FileName, mac, bce.Problem)
+		cfg = knownCfg
+	} else if err != nil {
 		panic(err)
-	} else if cfg != nil {
-		knownComputeNodeCfgs[mac] = cfg
-		CareIpAliveness(cfg.Inflate()["ip"].(string), true, cfg)
+	}
+	if cfg != nil {
+		if knownCfg, ok := knownComputeNodeCfgs[mac]; ok && knownCfg.RawYaml == cfg.RawYaml {
+			// not modified since last load
+			cfg = knownCfg
+		} else {
+			if ok {
+				ForgetCfg(knownCfg)
+			}
+			knownComputeNodeCfgs[mac] = cfg
+			CareIpAliveness(cfg.Inflate()["ip"].(string), true, cfg)
+		}
+		// never boot a node into an address clash
+		if conflicts := _cfgConflictsOf(mac); len(conflicts) > 0 {
+			return nil, &CfgConflictError{Conflicts: conflicts}
+		}
 		return cfg, nil
+	} else if knownCfg, ok := knownComputeNodeCfgs[mac]; ok {
+		glog.Warningf("Config [%s] for mac=[%s] deleted ?", knownCfg.FileName, mac)
+		ForgetCfg(knownCfg)
+		delete(knownComputeNodeCfgs, mac)
 	}
 
 	// no cfg yet, auto assign an IP and create the cfg
 	glog.Infof("Generating config for compute node with mac=[%s] ...", mac)
 
-	// todo: cache the template cfg, reload on mod time change
-	tmplFileName := "etc/cnode.yaml"
-	tmplRawYaml, err := ioutil.ReadFile(tmplFileName)
+	plan, err := planNewComputeNodeCfg(mac, CheckIpAlive)
 	if err != nil {
 		panic(err)
 	}
-	var tmplYaml yaml.MapSlice
-	err = yaml.Unmarshal(tmplRawYaml, &tmplYaml)
+	ip := plan.lease.IP
+	if len(plan.reclaimFrom) > 0 {
+		glog.Warningf("Reusing ip=[%s] from mac=%v, whose config is to be archived as corpse",
+			ip, plan.reclaimFrom)
+	}
+
+	// save config
+	cfg, err = st.AssignLease(plan.lease, plan.rawYaml, plan.reclaimFrom)
 	if err != nil {
 		panic(err)
 	}
-
-	var cfgYaml yaml.MapSlice
-	var (
-		ipnPrefix string
-		ipnRange  []interface{}
-	)
-	for _, cfgItem := range tmplYaml {
-		if cfgKey, ok := cfgItem.Key.(string); ok && "autoip" == cfgKey {
-			for _, ci1 := range cfgItem.Value.(yaml.MapSlice) {
-				if "prefix" == ci1.Key.(string) {
-					ipnPrefix = ci1.Value.(string)
-				} else if "range" == ci1.Key.(string) {
-					ipnRange = ci1.Value.([]interface{})
-				}
-			}
-			continue
+	glog.Infof("Configuration for compute node mac=[%s] written to [%s]", mac, cfg.FileName)
+	for _, deadMac := range plan.reclaimFrom {
+		var before string
+		if deadCfg, ok := knownComputeNodeCfgs[deadMac]; ok {
+			before = deadCfg.ETag
+			ForgetCfg(deadCfg)
+			delete(knownComputeNodeCfgs, deadMac)
 		}
+		RecordHistory(deadMac, ip, "reclaimed", "ip reused by mac="+mac)
+		audit.Record(audit.Entry{Actor: audit.SystemActor, Action: "ip-reuse", Mac: deadMac, IP: ip,
+			Detail: "config archived as corpse, ip reused by mac=" + mac, Before: before})
+	}
+	RecordHistory(mac, ip, "generated", cfg.FileName)
+	audit.Record(audit.Entry{Actor: audit.SystemActor, Action: "enroll", Mac: mac, IP: ip,
+		Detail: "config generated as " + cfg.FileName + " on first boot", After: cfg.ETag})
+
+	// record the cfg, mark it alive even before booted
+	knownComputeNodeCfgs[mac] = cfg
+	CareIpAliveness(ip, true, cfg)
+
+	return cfg, nil
+}
 
-		// inherit into compute node's config
-		cfgYaml = append(cfgYaml, cfgItem)
+// plan of generating config for a new compute node
+type newCfgPlan struct {
+	lease   Lease
+	rawYaml []byte
+	// nodes whose configs are to be archived as corpse for the ip reused
+	reclaimFrom []string
+}
+
+// plan config for a new compute node, with ip aliveness checked by the
+// specified func, nothing is changed by the planning itself
+func planNewComputeNodeCfg(mac string, checkAlive func(ip string) (bool, time.Time, []*ComputeNodeCfg)) (*newCfgPlan, error) {
+	tmpl, err := getCnodeTmpl()
+	if err != nil {
+		return nil, err
 	}
+	// inherit into compute node's config
+	cfgYaml := append(yaml.MapSlice(nil), tmpl.cfgYaml...)
+
+	ip, ipNum, reclaimFrom, err := pickIP(mac, tmpl, checkAlive, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// put assgined IP at top of generated YAML
+	now := time.Now()
+	cfgYaml = append(yaml.MapSlice{
+		yaml.MapItem{"generated", now.Format("2006-01-02T15:04:05Z07:00")},
+		yaml.MapItem{"mac", mac},
+		yaml.MapItem{"ip", ip},
+		yaml.MapItem{"ipnum", ipNum},
+	}, cfgYaml...)
+
+	rawYaml, err := yaml.Marshal(cfgYaml)
+	if err != nil {
+		return nil, err
+	}
+	return &newCfgPlan{
+		lease:       Lease{IP: ip, IPNum: ipNum, Mac: mac, Since: now},
+		rawYaml:     rawYaml,
+		reclaimFrom: reclaimFrom,
+	}, nil
+}
+
+// pick an ip from the configured range for a compute node, a never alive one
+// is preferred, or the one dead for longest, with nodes previously leasing it
+// to have their configs archived as corpse, if allowReclaim.
+// mutexComputeNodeCfgs must have been locked via lockComputeNodeCfgs
+func pickIP(mac string, tmpl *cnodeTmpl, checkAlive func(ip string) (bool, time.Time, []*ComputeNodeCfg),
+	allowReclaim bool) (ip string, ipNum int, reclaimFrom []string, err error) {
+	ipnPrefix, ipnRange := tmpl.ipnPrefix, tmpl.ipnRange
+
+	// ips leased to some node, maybe forgotten by the pulse checker, indexed
+	// from configs in memory as kept up to date by the file watcher, so the
+	// store is not touched by mere planning
+	leased := _leasedIPs()
 
 	// auto assign ip
 	type deadIP struct {
 		IP        string
 		IPNum     int
 		LastAlive time.Time
-		LastCfg   interface{}
+		LastMacs  []string
 	}
 	var deadIPs []deadIP
-	ipAssigned, ip, ipNum, aliveCnt := false, "", 0, 0
-	for ipnRI := 0; ipnRI < len(ipnRange); ipnRI += 2 {
-		ipnStart := int(ipnRange[ipnRI].(int))
-		ipnEnd := int(ipnRange[ipnRI+1].(int))
+	ipAssigned, aliveCnt := false, 0
+	for ipnRI := 0; ipnRI < len(ipnRange) && !ipAssigned; ipnRI += 2 {
+		ipnStart, ipnEnd := ipnRange[ipnRI], ipnRange[ipnRI+1]
 		for ipNum = ipnStart; ipNum <= ipnEnd; ipNum++ {
 			ip = fmt.Sprintf("%s%v", ipnPrefix, ipNum)
-			alive, lastAliveTime, aliveCfg := CheckIpAlive(ip)
+			alive, lastAliveTime, aliveCfgs := checkAlive(ip)
 			if alive {
 				aliveCnt++
-			} else {
-				if lastAliveTime.IsZero() {
-					// got a never alive ip, use it
-					glog.Infof("Assigned next available ip=[%s] for mac=[%s]", ip, mac)
-					ipAssigned = true
-					break
-				} else {
-					deadIPs = append(deadIPs, deadIP{ip, ipNum, lastAliveTime, aliveCfg})
-				}
+				continue
+			}
+			var lastMacs []string
+			for _, c := range aliveCfgs {
+				lastMacs = append(lastMacs, c.Mac)
+			}
+			if lease, ok := leased[ip]; ok && len(lastMacs) < 1 {
+				lastMacs = append(lastMacs, lease.Mac)
 			}
+			if lastAliveTime.IsZero() && len(lastMacs) < 1 {
+				// got a never alive ip, use it
+				glog.V(1).Infof("Next available ip=[%s] for mac=[%s]", ip, mac)
+				ipAssigned = true
+				break
+			}
+			deadIPs = append(deadIPs, deadIP{ip, ipNum, lastAliveTime, lastMacs})
 		}
 	}
-	if !ipAssigned && len(deadIPs) > 0 {
+	if !ipAssigned && len(deadIPs) > 0 && allowReclaim {
 		// sort to find the IP with earlest known alive time for reuse
 		sort.Slice(deadIPs, func(i, j int) bool {
 			return deadIPs[i].LastAlive.Before(deadIPs[j].LastAlive)
 		})
 		reuseIP := deadIPs[0]
-		switch deadCfg := reuseIP.LastCfg.(type) {
-		case *ComputeNodeCfg:
-			d, f := filepath.Split(deadCfg.FileName)
-			corpseFileName := fmt.Sprintf("%s~%s.corpse-%s", d, f, time.Now().Format("20060102150405"))
-			glog.Infof("To reuse ip=[%s], the old config file is to be renamed from [%s] to [%s] ...",
-				reuseIP.IP, deadCfg.FileName, corpseFileName)
-			if err := os.Rename(deadCfg.FileName, corpseFileName); err != nil {
-				panic(err)
-			}
-			delete(knownComputeNodeCfgs, deadCfg.Mac)
-			glog.Warningf("Reusing ip=[%s] from [%s], which has been renamed to [%s]",
-				reuseIP.IP, deadCfg.FileName, corpseFileName)
-		default:
-			glog.Warningf("ip=[%s] not bound to any known config ?! cfg type=%T", reuseIP.IP, deadCfg)
-			glog.Warningf("Reusing ip=[%s]", ip)
+		if len(reuseIP.LastMacs) > 0 {
+			reclaimFrom = reuseIP.LastMacs
+		} else {
+			glog.Warningf("ip=[%s] not bound to any known config ?!", reuseIP.IP)
 		}
 		ip, ipNum = reuseIP.IP, reuseIP.IPNum
 		ipAssigned = true
 	}
 	if !ipAssigned {
-		panic(errors.Errorf("No available IP in configured range, all %v occupied.", aliveCnt))
+		return "", 0, nil, errors.Errorf("No available IP in configured range, all %v occupied.", aliveCnt)
 	}
+	return
+}
 
-	// put assgined IP at top of generated YAML
-	cfgYaml = append(yaml.MapSlice{
-		yaml.MapItem{"generated", time.Now().Format("2006-01-02T15:04:05Z07:00")},
-		yaml.MapItem{"mac", mac},
-		yaml.MapItem{"ip", ip},
-		yaml.MapItem{"ipnum", ipNum},
-	}, cfgYaml...)
+// leases of all known configs by ip, an effective config wins over shadowed
+// ones, mutexComputeNodeCfgs must have been locked via lockComputeNodeCfgs
+func _leasedIPs() map[string]Lease {
+	cfgs := _allComputeNodeCfgs()
+	leased := make(map[string]Lease, len(cfgs))
+	for _, cfg := range cfgs {
+		lease := cfgLease(cfg)
+		if _, ok := leased[lease.IP]; !ok {
+			leased[lease.IP] = lease
+		}
+	}
+	return leased
+}
 
-	// save config file
-	rawYaml, err := yaml.Marshal(cfgYaml)
-	ioutil.WriteFile(fileName, rawYaml, 0644)
-	glog.Infof("Configuration for compute node mac=[%s] written to file [%s]", mac, fileName)
+// what config a compute node would boot with
+type BootCfgPreview struct {
+	Mac string
+	// config is to be generated for a new node
+	New bool
+	// nodes whose configs would be archived as corpse for the ip reused
+	ReclaimFrom []string
+
+	Cfg *ComputeNodeCfg
+	// the node would be refused to boot for these
+	Conflicts []CfgConflict
+}
 
-	// load file mod time
-	fi, err := os.Stat(fileName)
-	if err != nil {
-		panic(err)
+// preview the config a compute node would boot with, without side effects.
+// for a new node, ips not known by the pulse checker are pinged if probe is
+// true, or assumed available otherwise
+func PreviewBootCfg(mac string, probe bool) (*BootCfgPreview, error) {
+	// aliveness of ips pinged, done without configs locked as it takes a
+	// while, then planned again with the result
+	probed := make(map[string]bool)
+	for {
+		pv, toProbe, err := previewBootCfg(mac, probed)
+		if err != nil || !probe || len(toProbe) <= 0 {
+			return pv, err
+		}
+		alive, err := pingIP(toProbe)
+		if err != nil {
+			glog.Errorf("%+v", err)
+		}
+		probed[toProbe] = alive
 	}
+}
 
-	// record the cfg, mark it alive even before booted
-	cfg := &ComputeNodeCfg{
-		Mac: mac, FileName: fileName, FileTime: fi.ModTime(),
-		RawYaml: string(rawYaml), CfgYaml: cfgYaml,
+// preview the boot config with ips not cared by the pulse checker looked up in
+// probed, available if not there. the ip planned for a new node is returned if
+// it's neither cared nor probed yet.
+func previewBootCfg(mac string, probed map[string]bool) (*BootCfgPreview, string, error) {
+	lockComputeNodeCfgs()
+	defer mutexComputeNodeCfgs.Unlock()
+
+	if cfg, ok := _getComputeNodeCfgs()[mac]; ok {
+		return &BootCfgPreview{Mac: mac, Cfg: cfg, Conflicts: _cfgConflictsOf(mac)}, "", nil
 	}
-	knownComputeNodeCfgs[mac] = cfg
-	CareIpAliveness(ip, true, cfg)
 
-	return cfg, nil
+	unknown := make(map[string]bool)
+	plan, err := planNewComputeNodeCfg(mac, func(ip string) (bool, time.Time, []*ComputeNodeCfg) {
+		if alive, lastAlive, cfgs, caring := peekIpAlive(ip); caring {
+			return alive, lastAlive, cfgs
+		}
+		if probed[ip] {
+			return true, time.Now(), nil
+		}
+		if _, ok := probed[ip]; !ok {
+			unknown[ip] = true
+		}
+		return false, time.Time{}, nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	cfg, err := ParseComputeNodeCfg(plan.rawYaml)
+	if err != nil {
+		return nil, "", err
+	}
+	var toProbe string
+	if unknown[plan.lease.IP] {
+		toProbe = plan.lease.IP
+	}
+	return &BootCfgPreview{
+		Mac: mac, New: true, ReclaimFrom: plan.reclaimFrom,
+		Cfg: cfg,
+	}, toProbe, nil
 }
@@ -0,0 +1,281 @@
+package ccm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/complyue/hbi/pkg/errors"
+	"github.com/golang/glog"
+	"gopkg.in/yaml.v2"
+)
+
+// configs clashing on an address or name that must be unique
+type CfgConflict struct {
+	// ip/mac/hostname
+	Kind    string
+	Value   string
+	Holders []CfgHolder
+}
+
+// a config involved in a conflict
+type CfgHolder struct {
+	Mac, FileName string
+}
+
+func (c *CfgConflict) Macs() []string {
+	macs := make([]string, 0, len(c.Holders))
+	for _, h := range c.Holders {
+		macs = append(macs, h.Mac)
+	}
+	return macs
+}
+
+func (c *CfgConflict) involves(mac string) bool {
+	for _, h := range c.Holders {
+		if h.Mac == mac {
+			return true
+		}
+	}
+	return false
+}
+
+type CfgConflictError struct {
+	Conflicts []CfgConflict
+}
+
+func (e *CfgConflictError) Error() string {
+	var msgs []string
+	for _, c := range e.Conflicts {
+		msgs = append(msgs, fmt.Sprintf("%s [%s] used by mac=%v", c.Kind, c.Value, c.Macs()))
+	}
+	return "conflicting configs: " + strings.Join(msgs, "; ")
+}
+
+// configs of a mac already in effect by another file, only possible with yaml
+// store, guarded by mutexComputeNodeCfgs
+var shadowedComputeNodeCfgs []*ComputeNodeCfg
+
+// conflicts among the specified configs, sorted by kind then value
+func conflictsAmong(cfgs []*ComputeNodeCfg) []CfgConflict {
+	type conflictKey struct{ kind, value string }
+	holders := make(map[conflictKey][]*ComputeNodeCfg)
+	var keys []conflictKey
+	hold := func(k conflictKey, cfg *ComputeNodeCfg) {
+		if _, ok := holders[k]; !ok {
+			keys = append(keys, k)
+		}
+		holders[k] = append(holders[k], cfg)
+	}
+	for _, cfg := range cfgs {
+		hold(conflictKey{"mac", cfg.Mac}, cfg)
+		cfgd, err := cfg.InflateE()
+		if err != nil {
+			continue
+		}
+		if ip, ok := cfgd["ip"].(string); ok && len(ip) > 0 {
+			hold(conflictKey{"ip", ip}, cfg)
+		}
+		if host, ok := cfgd["hostname"].(string); ok && len(host) > 0 {
+			hold(conflictKey{"hostname", host}, cfg)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].kind != keys[j].kind {
+			return keys[i].kind < keys[j].kind
+		}
+		return keys[i].value < keys[j].value
+	})
+
+	var conflicts []CfgConflict
+	for _, k := range keys {
+		cfgs := holders[k]
+		if len(cfgs) < 2 {
+			continue
+		}
+		c := CfgConflict{Kind: k.kind, Value: k.value}
+		for _, cfg := range cfgs {
+			c.Holders = append(c.Holders, CfgHolder{cfg.Mac, cfg.FileName})
+		}
+		conflicts = append(conflicts, c)
+	}
+	return conflicts
+}
+
+func _allComputeNodeCfgs() []*ComputeNodeCfg {
+	cfgs := make([]*ComputeNodeCfg, 0, len(knownComputeNodeCfgs)+len(shadowedComputeNodeCfgs))
+	for _, cfg := range _getComputeNodeCfgs() {
+		cfgs = append(cfgs, cfg)
+	}
+	sort.Slice(cfgs, func(i, j int) bool {
+		return cfgs[i].Mac < cfgs[j].Mac
+	})
+	return append(cfgs, shadowedComputeNodeCfgs...)
+}
+
+// conflicts among all configs known
+func ListCfgConflicts() []CfgConflict {
+	lockComputeNodeCfgs()
+	defer mutexComputeNodeCfgs.Unlock()
+
+	return conflictsAmong(_allComputeNodeCfgs())
+}
+
+// conflicts a compute node is involved in
+func _cfgConflictsOf(mac string) []CfgConflict {
+	var conflicts []CfgConflict
+	for _, c := range conflictsAmong(_allComputeNodeCfgs()) {
+		if c.involves(mac) {
+			conflicts = append(conflicts, c)
+		}
+	}
+	return conflicts
+}
+
+// check configs to be put in effect for ip/hostname clashes with others, a
+// *CfgConflictError is returned if any
+func _checkCfgConflicts(changed ...*ComputeNodeCfg) error {
+	changedMacs := make(map[string]bool, len(changed))
+	for _, cfg := range changed {
+		changedMacs[cfg.Mac] = true
+	}
+	cfgs := append([]*ComputeNodeCfg(nil), changed...)
+	for _, cfg := range _allComputeNodeCfgs() {
+		if !changedMacs[cfg.Mac] {
+			cfgs = append(cfgs, cfg)
+		}
+	}
+	var conflicts []CfgConflict
+	for _, c := range conflictsAmong(cfgs) {
+		if "mac" == c.Kind {
+			continue // only ever from shadowed files, not caused by the change
+		}
+		for _, h := range c.Holders {
+			if changedMacs[h.Mac] {
+				conflicts = append(conflicts, c)
+				break
+			}
+		}
+	}
+	if len(conflicts) > 0 {
+		return &CfgConflictError{Conflicts: conflicts}
+	}
+	return nil
+}
+
+// take a config out of service, the shadowed one if fileName is of it,
+// with reason being conflict, as a resolution of conflicts
+func ArchiveConflictingCfg(mac, fileName string) error {
+	lockComputeNodeCfgs()
+	defer mutexComputeNodeCfgs.Unlock()
+
+	detail := "conflict resolution"
+	if conflicts := _cfgConflictsOf(mac); len(conflicts) > 0 {
+		detail = (&CfgConflictError{Conflicts: conflicts}).Error()
+	}
+
+	for si, cfg := range shadowedComputeNodeCfgs {
+		if cfg.Mac == mac && cfg.FileName == fileName {
+			ys, ok := getStore().(*yamlDirStore)
+			if !ok {
+				return errors.Errorf("shadowed config [%s] not from yaml store ?!", fileName)
+			}
+			if err := ys.archiveFile(fileName, mac, "conflict", detail); err != nil {
+				return err
+			}
+			shadowedComputeNodeCfgs = append(shadowedComputeNodeCfgs[:si:si], shadowedComputeNodeCfgs[si+1:]...)
+			// the file archived may have been noted for the mac
+			if knownCfg, ok := knownComputeNodeCfgs[mac]; ok {
+				ys.noteCfgFile(knownCfg)
+			}
+			RecordHistory(mac, "", "archived", detail)
+			return nil
+		}
+	}
+
+	cfg, ok := knownComputeNodeCfgs[mac]
+	if !ok || (len(fileName) > 0 && cfg.FileName != fileName) {
+		return errors.Errorf("no config [%s] of mac=[%s]", fileName, mac)
+	}
+	if err := getStore().ArchiveCfg(mac, "conflict", detail); err != nil {
+		return err
+	}
+	ip, _ := inflatedIP(cfg)
+	_forgetComputeNodeCfg(cfg)
+	RecordHistory(mac, ip, "archived", detail)
+	return nil
+}
+
+// stop tracking a known config, with a shadowed one of the same mac, if any,
+// put in effect instead
+func _forgetComputeNodeCfg(cfg *ComputeNodeCfg) {
+	ForgetCfg(cfg)
+	delete(knownComputeNodeCfgs, cfg.Mac)
+	for si, shadowed := range shadowedComputeNodeCfgs {
+		if shadowed.Mac != cfg.Mac {
+			continue
+		}
+		shadowedComputeNodeCfgs = append(shadowedComputeNodeCfgs[:si:si], shadowedComputeNodeCfgs[si+1:]...)
+		ip, err := inflatedIP(shadowed)
+		if err != nil {
+			glog.Errorf("Shadowed config [%s] not usable: %+v", shadowed.FileName, err)
+			break
+		}
+		glog.Infof("Config [%s] of mac=[%s] in effect now.", shadowed.FileName, shadowed.Mac)
+		if ys, ok := getStore().(*yamlDirStore); ok {
+			ys.noteCfgFile(shadowed)
+		}
+		knownComputeNodeCfgs[shadowed.Mac] = shadowed
+		CareIpAliveness(ip, false, shadowed)
+		break
+	}
+}
+
+// assign a compute node a free ip from the configured range, as a resolution
+// of ip conflicts, an ip once leased to others is never reclaimed for this
+func ReassignComputeNodeIP(mac string) (*ComputeNodeCfg, error) {
+	lockComputeNodeCfgs()
+	defer mutexComputeNodeCfgs.Unlock()
+
+	cfg, ok := _getComputeNodeCfgs()[mac]
+	if !ok {
+		return nil, errors.Errorf("no config of mac=[%s]", mac)
+	}
+	oldIP, _ := inflatedIP(cfg)
+	tmpl, err := getCnodeTmpl()
+	if err != nil {
+		return nil, err
+	}
+	ip, ipNum, _, err := pickIP(mac, tmpl, CheckIpAlive, false)
+	if err != nil {
+		return nil, err
+	}
+
+	patched, err := patchCfgYaml(cfg.CfgYaml, []CfgPatchOp{
+		{Op: "set", Key: "ip", Value: ip},
+		{Op: "set", Key: "ipnum", Value: fmt.Sprintf("%d", ipNum)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	rawYaml, err := yaml.Marshal(patched)
+	if err != nil {
+		return nil, err
+	}
+	newCfg, err := ParseComputeNodeCfg(rawYaml)
+	if err != nil {
+		return nil, err
+	}
+	if err := _checkCfgConflicts(newCfg); err != nil {
+		return nil, err
+	}
+
+	if newCfg, err = getStore().SaveCfg(mac, rawYaml); err != nil {
+		return nil, err
+	}
+	ForgetCfg(cfg)
+	knownComputeNodeCfgs[mac] = newCfg
+	CareIpAliveness(ip, false, newCfg)
+	RecordHistory(mac, ip, "reassigned", "ip was "+oldIP)
+	return newCfg, nil
+}
@@ -0,0 +1,60 @@
+package ccm
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func testCfg(t *testing.T, fileName, mac, ip, hostname string) *ComputeNodeCfg {
+	cfg, err := ParseComputeNodeCfg([]byte(fmt.Sprintf(
+		"mac: %s\nip: %s\nhostname: %s\n", mac, ip, hostname)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.FileName = fileName
+	return cfg
+}
+
+func TestConflictsAmong(t *testing.T) {
+	cfgs := []*ComputeNodeCfg{
+		testCfg(t, "a.yaml", "aa:bb:cc:dd:ee:01", "10.0.0.1", "n01"),
+		// ip clash with a.yaml
+		testCfg(t, "b.yaml", "aa:bb:cc:dd:ee:02", "10.0.0.1", "n02"),
+		// hostname clash with b.yaml
+		testCfg(t, "c.yaml", "aa:bb:cc:dd:ee:03", "10.0.0.3", "n02"),
+		// mac clash with c.yaml, as a shadowed file
+		testCfg(t, "c2.yaml", "aa:bb:cc:dd:ee:03", "10.0.0.4", "n04"),
+		// clashes with none
+		testCfg(t, "e.yaml", "aa:bb:cc:dd:ee:05", "10.0.0.5", "n05"),
+	}
+
+	want := []CfgConflict{
+		{Kind: "hostname", Value: "n02", Holders: []CfgHolder{
+			{"aa:bb:cc:dd:ee:02", "b.yaml"}, {"aa:bb:cc:dd:ee:03", "c.yaml"},
+		}},
+		{Kind: "ip", Value: "10.0.0.1", Holders: []CfgHolder{
+			{"aa:bb:cc:dd:ee:01", "a.yaml"}, {"aa:bb:cc:dd:ee:02", "b.yaml"},
+		}},
+		{Kind: "mac", Value: "aa:bb:cc:dd:ee:03", Holders: []CfgHolder{
+			{"aa:bb:cc:dd:ee:03", "c.yaml"}, {"aa:bb:cc:dd:ee:03", "c2.yaml"},
+		}},
+	}
+	got := conflictsAmong(cfgs)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("conflicts:\n%+v\nwant:\n%+v", got, want)
+	}
+
+	for _, c := range got {
+		if c.involves("aa:bb:cc:dd:ee:05") {
+			t.Errorf("unclashed node involved in %+v", c)
+		}
+	}
+	if !got[1].involves("aa:bb:cc:dd:ee:01") {
+		t.Errorf("ip clash not involving a.yaml: %+v", got[1])
+	}
+
+	if conflicts := conflictsAmong(cfgs[4:]); len(conflicts) > 0 {
+		t.Errorf("unexpected conflicts: %+v", conflicts)
+	}
+}
@@ -0,0 +1,86 @@
+package ccm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// lines of context around changes in a diff
+const diffContext = 3
+
+// line diff between two texts, in unified style without file headers,
+// empty if identical
+func DiffLines(a, b string) string {
+	if a == b {
+		return ""
+	}
+	al := strings.SplitAfter(a, "\n")
+	bl := strings.SplitAfter(b, "\n")
+
+	// longest common subsequence table
+	n, m := len(al), len(bl)
+	lcs := make([][]int, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if al[i] == bl[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	type diffLine struct {
+		op   byte
+		text string
+	}
+	var lines []diffLine
+	i, j := 0, 0
+	for i < n || j < m {
+		if i < n && j < m && al[i] == bl[j] {
+			lines = append(lines, diffLine{' ', al[i]})
+			i++
+			j++
+		} else if i < n && (j >= m || lcs[i+1][j] >= lcs[i][j+1]) {
+			lines = append(lines, diffLine{'-', al[i]})
+			i++
+		} else {
+			lines = append(lines, diffLine{'+', bl[j]})
+			j++
+		}
+	}
+
+	// only keep changed lines with some context
+	keep := make([]bool, len(lines))
+	for li, l := range lines {
+		if l.op != ' ' {
+			for k := li - diffContext; k <= li+diffContext; k++ {
+				if k >= 0 && k < len(keep) {
+					keep[k] = true
+				}
+			}
+		}
+	}
+	var out strings.Builder
+	for li, l := range lines {
+		if !keep[li] {
+			if li > 0 && keep[li-1] {
+				out.WriteString("...\n")
+			}
+			continue
+		}
+		text := l.text
+		if len(text) > 0 && !strings.HasSuffix(text, "\n") {
+			text += "\n"
+		} else if len(text) <= 0 {
+			continue
+		}
+		out.WriteString(fmt.Sprintf("%c%s", l.op, text))
+	}
+	return out.String()
+}
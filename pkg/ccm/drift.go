@@ -0,0 +1,248 @@
+package ccm
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/complyue/hbi/pkg/errors"
+	"github.com/golang/glog"
+)
+
+// what a compute node is to boot with, as responded to pixiecore
+type BootSpec struct {
+	Kernel  string
+	Initrd  []string
+	Cmdline string
+}
+
+// boot spec from the inflated config of a compute node
+func CfgBootSpec(cfg *ComputeNodeCfg) (*BootSpec, error) {
+	cfgData, err := cfg.InflateE()
+	if err != nil {
+		return nil, err
+	}
+	spec := &BootSpec{}
+	switch kernel := cfgData["kernel"].(type) {
+	case string:
+		spec.Kernel = kernel
+	default:
+		return nil, errors.Errorf("Invalid kernel of type %T - %#v", kernel, kernel)
+	}
+	switch initrd := cfgData["initrd"].(type) {
+	case []string:
+		spec.Initrd = initrd
+	case string:
+		spec.Initrd = []string{initrd}
+	default:
+		return nil, errors.Errorf("Invalid initrd of type %T - %#v", initrd, initrd)
+	}
+	switch cmdline := cfgData["cmdline"].(type) {
+	case []string:
+		spec.Cmdline = strings.Join(cmdline, " ")
+	case string:
+		spec.Cmdline = cmdline
+	default:
+		return nil, errors.Errorf("Invalid cmdline of type %T - %#v", cmdline, cmdline)
+	}
+	return spec, nil
+}
+
+// boot spec served to a compute node at its last boot
+type BootSnapshot struct {
+	Mac, IP string
+	Time    time.Time
+	// etag of the config served
+	ETag string
+
+	Boot BootSpec
+}
+
+var (
+	bootSnapshots      map[string]*BootSnapshot
+	bootSnapshotsMutex sync.Mutex
+)
+
+// lock boot snapshots, restored from store on first access
+func lockBootSnapshots() {
+	bootSnapshotsMutex.Lock()
+	if bootSnapshots != nil {
+		return
+	}
+	bootSnapshots = make(map[string]*BootSnapshot)
+	snaps, err := getStore().LoadBootSnapshots()
+	if err != nil {
+		glog.Errorf("Error restoring boot snapshots: %+v", err)
+		return
+	}
+	for i := range snaps {
+		bootSnapshots[snaps[i].Mac] = &snaps[i]
+	}
+}
+
+// record the boot spec just served to a compute node
+func RecordBootSnapshot(cfg *ComputeNodeCfg, spec *BootSpec) {
+	ip, _ := inflatedIP(cfg)
+	snap := BootSnapshot{
+		Mac: cfg.Mac, IP: ip, Time: time.Now(), ETag: cfg.ETag, Boot: *spec,
+	}
+	if err := getStore().SaveBootSnapshot(snap); err != nil {
+		glog.Errorf("Error saving boot snapshot of mac=[%s]: %+v", cfg.Mac, err)
+	}
+
+	lockBootSnapshots()
+	defer bootSnapshotsMutex.Unlock()
+
+	bootSnapshots[cfg.Mac] = &snap
+}
+
+func getBootSnapshot(mac string) *BootSnapshot {
+	lockBootSnapshots()
+	defer bootSnapshotsMutex.Unlock()
+
+	return bootSnapshots[mac]
+}
+
+// when a compute node last requested boot, zero if never seen
+func LastBootTime(mac string) time.Time {
+	if snap := getBootSnapshot(mac); snap != nil {
+		return snap.Time
+	}
+	return time.Time{}
+}
+
+// whether what a compute node runs is in line with its config
+type DriftState struct {
+	Mac, Host, IP string
+
+	// served at last boot, nil if not booted by this control center
+	LastBoot *BootSnapshot
+	// by the config now
+	Current *BootSpec
+	// as reported by the agent on the node since its last boot
+	RunningCmdline string
+
+	// the config changed since last boot in ways taking effect by reboot
+	PendingReboot bool
+	// the node runs other than served at its last boot, or other than its
+	// config if last boot unknown
+	Drifted bool
+
+	Reasons []string
+}
+
+// tokens removed (prefixed with -) and added (prefixed with +) from one
+// cmdline to another
+func cmdlineDiff(from, to string) []string {
+	fromArgs, toArgs := make(map[string]bool), make(map[string]bool)
+	for _, arg := range strings.Fields(from) {
+		fromArgs[arg] = true
+	}
+	for _, arg := range strings.Fields(to) {
+		toArgs[arg] = true
+	}
+	var diff []string
+	for _, arg := range strings.Fields(from) {
+		if !toArgs[arg] {
+			diff = append(diff, "-"+arg)
+		}
+	}
+	for _, arg := range strings.Fields(to) {
+		if !fromArgs[arg] {
+			diff = append(diff, "+"+arg)
+		}
+	}
+	return diff
+}
+
+func cfgDrift(cfg *ComputeNodeCfg) DriftState {
+	ds := DriftState{Mac: cfg.Mac}
+	if cfgd, err := cfg.InflateE(); err == nil {
+		ds.Host, _ = cfgd["hostname"].(string)
+		ds.IP, _ = cfgd["ip"].(string)
+	}
+	spec, err := CfgBootSpec(cfg)
+	if err != nil {
+		ds.Reasons = append(ds.Reasons, fmt.Sprintf("invalid boot config: %v", err))
+		return ds
+	}
+	ds.Current = spec
+
+	snap := getBootSnapshot(cfg.Mac)
+	if snap != nil {
+		snapCopy := *snap
+		ds.LastBoot = &snapCopy
+		if snap.Boot.Kernel != spec.Kernel {
+			ds.PendingReboot = true
+			ds.Reasons = append(ds.Reasons, fmt.Sprintf("kernel %s -> %s", snap.Boot.Kernel, spec.Kernel))
+		}
+		if !reflect.DeepEqual(snap.Boot.Initrd, spec.Initrd) {
+			ds.PendingReboot = true
+			ds.Reasons = append(ds.Reasons, fmt.Sprintf("initrd %v -> %v", snap.Boot.Initrd, spec.Initrd))
+		}
+		if snap.Boot.Cmdline != spec.Cmdline {
+			ds.PendingReboot = true
+			ds.Reasons = append(ds.Reasons, fmt.Sprintf("cmdline %s", strings.Join(cmdlineDiff(snap.Boot.Cmdline, spec.Cmdline), " ")))
+		}
+	}
+
+	if as := GetAgentState(cfg.Mac); as != nil && as.Inventory != nil &&
+		(snap == nil || as.Inventory.Time.After(snap.Time)) {
+		ds.RunningCmdline = as.Inventory.Cmdline
+		expected := spec.Cmdline
+		if snap != nil {
+			expected = snap.Boot.Cmdline
+		}
+		// the bootloader can add args of its own, e.g. initrd=
+		var missing []string
+		for _, arg := range cmdlineDiff(expected, ds.RunningCmdline) {
+			if strings.HasPrefix(arg, "-") {
+				missing = append(missing, arg[1:])
+			}
+		}
+		if len(missing) > 0 {
+			ds.Drifted = true
+			ds.Reasons = append(ds.Reasons, fmt.Sprintf("running without %s", strings.Join(missing, " ")))
+		}
+	}
+	return ds
+}
+
+// drift state of a compute node, nil if no config for it
+func GetDriftState(mac string) *DriftState {
+	cfg := GetComputeNodeCfg(mac)
+	if cfg == nil {
+		return nil
+	}
+	ds := cfgDrift(cfg)
+	return &ds
+}
+
+// drift states of compute nodes pending reboot or drifted, or all if all is
+// true, sorted by mac
+func ListDriftStates(all bool) []DriftState {
+	var cfgs []*ComputeNodeCfg
+	func() {
+		lockComputeNodeCfgs()
+		defer mutexComputeNodeCfgs.Unlock()
+
+		for _, cfg := range _getComputeNodeCfgs() {
+			cfgs = append(cfgs, cfg)
+		}
+	}()
+
+	states := make([]DriftState, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		ds := cfgDrift(cfg)
+		if all || ds.PendingReboot || ds.Drifted {
+			states = append(states, ds)
+		}
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Mac < states[j].Mac
+	})
+	return states
+}
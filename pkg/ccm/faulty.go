@@ -0,0 +1,56 @@
+package ccm
+
+import (
+	"github.com/complyue/different-hpc/pkg/audit"
+	"github.com/complyue/hbi/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// config key marking a compute node hardware faulty, with the reason as value
+const faultyKey = "faulty"
+
+// why a compute node is marked hardware faulty, empty if not
+func CfgFaulty(cfgd map[string]interface{}) string {
+	reason, _ := cfgd[faultyKey].(string)
+	return reason
+}
+
+// mark a compute node hardware faulty by setting the faulty key in its
+// config, remove the key to clear the mark once the hardware is fixed
+func MarkComputeNodeFaulty(mac, reason, actor string) (*ComputeNodeCfg, error) {
+	lockComputeNodeCfgs()
+	defer mutexComputeNodeCfgs.Unlock()
+
+	st := getStore()
+	curCfg, err := st.LoadCfg(mac)
+	if err != nil {
+		return nil, err
+	}
+	if curCfg == nil {
+		return nil, errors.Errorf("no config for mac=[%s]", mac)
+	}
+	patched, err := patchCfgYaml(curCfg.CfgYaml, []CfgPatchOp{{
+		Op: "set", Key: faultyKey, Value: yamlValueStr(reason, true),
+	}})
+	if err != nil {
+		return nil, err
+	}
+	rawYaml, err := yaml.Marshal(patched)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := st.SaveCfg(mac, rawYaml)
+	if err != nil {
+		return nil, err
+	}
+	if oldCfg, ok := knownComputeNodeCfgs[mac]; ok {
+		ForgetCfg(oldCfg)
+	}
+	knownComputeNodeCfgs[mac] = cfg
+	ip, _ := inflatedIP(cfg)
+	CareIpAliveness(ip, false, cfg)
+	RecordHistory(mac, ip, "faulty", reason)
+	audit.Record(audit.Entry{Actor: actor, Action: "faulty", Mac: mac, IP: ip, Detail: reason,
+		Before: curCfg.ETag, After: cfg.ETag})
+	return cfg, nil
+}
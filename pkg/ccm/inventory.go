@@ -0,0 +1,486 @@
+package ccm
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/complyue/different-hpc/pkg/agent"
+	"github.com/complyue/hbi/pkg/errors"
+	"github.com/golang/glog"
+)
+
+// history kinds of inventory changes and their acknowledgements
+const (
+	invChangeKind = "inventory-change"
+	invAckKind    = "inventory-ack"
+)
+
+// hardware changes detected from a new inventory of a compute node against
+// its previous one
+func diffInventory(old, inv *agent.Inventory) []string {
+	var changes []string
+	changed := func(what string, from, to interface{}) {
+		changes = append(changes, fmt.Sprintf("%s %v -> %v", what, from, to))
+	}
+	noted := func(format string, args ...interface{}) {
+		changes = append(changes, strings.TrimSpace(fmt.Sprintf(format, args...)))
+	}
+	if old.CPUModel != inv.CPUModel {
+		changed("cpu", old.CPUModel, inv.CPUModel)
+	}
+	if old.CPUCores != inv.CPUCores {
+		changed("cores", old.CPUCores, inv.CPUCores)
+	}
+	if old.MemTotal != inv.MemTotal {
+		changed("memory", old.MemStr(), inv.MemStr())
+	}
+
+	oldDisks := make(map[string]agent.Disk, len(old.Disks))
+	for _, d := range old.Disks {
+		oldDisks[d.Name] = d
+	}
+	for _, d := range inv.Disks {
+		od, ok := oldDisks[d.Name]
+		if !ok {
+			noted("disk %s appeared: %s %s", d.Name, d.SizeStr(), d.Model)
+			continue
+		}
+		delete(oldDisks, d.Name)
+		if od.Size != d.Size {
+			changed("disk "+d.Name+" size", od.SizeStr(), d.SizeStr())
+		}
+		if od.Model != d.Model {
+			changed("disk "+d.Name+" model", od.Model, d.Model)
+		}
+	}
+	for _, od := range old.Disks {
+		if _, gone := oldDisks[od.Name]; gone {
+			noted("disk %s disappeared: %s %s", od.Name, od.SizeStr(), od.Model)
+		}
+	}
+
+	oldNICs := make(map[string]agent.NIC, len(old.NICs))
+	for _, n := range old.NICs {
+		oldNICs[n.Name] = n
+	}
+	for _, n := range inv.NICs {
+		on, ok := oldNICs[n.Name]
+		if !ok {
+			noted("nic %s appeared: %s %s %s", n.Name, n.Mac, n.Driver, n.PciID)
+			continue
+		}
+		delete(oldNICs, n.Name)
+		if on.Mac != n.Mac {
+			changed("nic "+n.Name+" mac", on.Mac, n.Mac)
+		}
+		if on.Driver != n.Driver || on.PciID != n.PciID {
+			changed("nic "+n.Name+" model", on.Driver+" "+on.PciID, n.Driver+" "+n.PciID)
+		}
+		if on.Speed != n.Speed {
+			changed("nic "+n.Name+" speed", on.Speed, n.Speed)
+		}
+	}
+	for _, on := range old.NICs {
+		if _, gone := oldNICs[on.Name]; gone {
+			noted("nic %s disappeared: %s %s %s", on.Name, on.Mac, on.Driver, on.PciID)
+		}
+	}
+	return changes
+}
+
+// take a new inventory of a compute node, changes against the previous one
+// are raised as an alert
+func acceptInventory(mac, ip string, inv *agent.Inventory) ([]string, error) {
+	inv.Mac = mac
+	if inv.Time.IsZero() {
+		inv.Time = time.Now()
+	}
+	if err := getStore().SaveInventory(*inv); err != nil {
+		return nil, err
+	}
+
+	var old *agent.Inventory
+	func() {
+		lockAgentStates()
+		defer agentStatesMutex.Unlock()
+
+		as, ok := agentStates[mac]
+		if !ok {
+			as = &AgentState{Mac: mac}
+			agentStates[mac] = as
+		}
+		old, as.Inventory = as.Inventory, inv
+	}()
+	if old == nil {
+		return nil, nil
+	}
+
+	changes := diffInventory(old, inv)
+	if len(changes) > 0 {
+		glog.Warningf("Inventory of mac=[%s] changed: %v", mac, changes)
+		func() {
+			// alerts restored from history before this one recorded
+			lockInventoryAlerts()
+			defer inventoryAlertsMutex.Unlock()
+
+			inventoryAlerts = append(inventoryAlerts, InventoryAlert{
+				Time: time.Now(), Mac: mac, IP: ip, Changes: changes,
+			})
+			RecordHistory(mac, ip, invChangeKind, strings.Join(changes, "; "))
+		}()
+	}
+	return changes, nil
+}
+
+// put an inventory of a compute node, e.g. collected by other means than
+// the agent, changes detected are returned
+func PutInventory(macStr string, inv agent.Inventory) ([]string, error) {
+	mac, err := NormalizeMac(macStr)
+	if err != nil {
+		return nil, err
+	}
+	cfg := GetComputeNodeCfg(mac)
+	if cfg == nil {
+		return nil, errors.Errorf("no config for mac=[%s]", mac)
+	}
+	ip, err := inflatedIP(cfg)
+	if err != nil {
+		return nil, err
+	}
+	changes, err := acceptInventory(mac, ip, &inv)
+	if err != nil {
+		return nil, err
+	}
+	RecordHistory(mac, ip, "inventory", "posted")
+	return changes, nil
+}
+
+// hardware changes of a compute node detected between inventories
+type InventoryAlert struct {
+	Time    time.Time
+	Mac, IP string
+	Changes []string
+	Acked   bool
+}
+
+var (
+	inventoryAlerts      []InventoryAlert
+	inventoryAlertsMutex sync.Mutex
+	inventoryAlertsRead  bool
+)
+
+// lock inventory alerts, rebuilt from history on first access
+func lockInventoryAlerts() {
+	inventoryAlertsMutex.Lock()
+	if inventoryAlertsRead {
+		return
+	}
+	inventoryAlertsRead = true
+	evts, err := ListHistory("", 0)
+	if err != nil {
+		glog.Errorf("Error restoring inventory alerts: %+v", err)
+		return
+	}
+	for _, evt := range evts {
+		switch evt.Kind {
+		case invChangeKind:
+			inventoryAlerts = append(inventoryAlerts, InventoryAlert{
+				Time: evt.Time, Mac: evt.Mac, IP: evt.IP,
+				Changes: strings.Split(evt.Detail, "; "),
+			})
+		case invAckKind:
+			_ackInventoryAlerts(evt.Mac)
+		}
+	}
+}
+
+func _ackInventoryAlerts(mac string) int {
+	n := 0
+	for i := range inventoryAlerts {
+		if inventoryAlerts[i].Mac == mac && !inventoryAlerts[i].Acked {
+			inventoryAlerts[i].Acked = true
+			n++
+		}
+	}
+	return n
+}
+
+// inventory alerts, most recent first, acknowledged ones included if all
+func ListInventoryAlerts(all bool) []InventoryAlert {
+	lockInventoryAlerts()
+	defer inventoryAlertsMutex.Unlock()
+
+	alerts := make([]InventoryAlert, 0, len(inventoryAlerts))
+	for i := len(inventoryAlerts) - 1; i >= 0; i-- {
+		if all || !inventoryAlerts[i].Acked {
+			alerts = append(alerts, inventoryAlerts[i])
+		}
+	}
+	return alerts
+}
+
+// acknowledge all inventory alerts of a compute node, e.g. after the
+// hardware change is confirmed intended
+func AckInventoryAlerts(macStr, by string) (int, error) {
+	mac, err := NormalizeMac(macStr)
+	if err != nil {
+		return 0, err
+	}
+	n := func() int {
+		lockInventoryAlerts()
+		defer inventoryAlertsMutex.Unlock()
+
+		return _ackInventoryAlerts(mac)
+	}()
+	if n > 0 {
+		var ip string
+		if cfg := GetComputeNodeCfg(mac); cfg != nil {
+			ip, _ = inflatedIP(cfg)
+		}
+		RecordHistory(mac, ip, invAckKind, fmt.Sprintf("%d alerts acknowledged by %s", n, by))
+	}
+	return n, nil
+}
+
+// a compute node with its inventory, as searched
+type InventoryRecord struct {
+	Mac, Host, IP string
+	Groups        []string
+
+	Inventory agent.Inventory
+}
+
+// a term of inventory query, in form of <field><op><value>
+type invTerm struct {
+	field, op, value string
+	num              float64
+}
+
+// operators of inventory query terms, longer ones first
+var invOps = []string{"!~", "!=", ">=", "<=", "~", "=", ">", "<"}
+
+// numeric fields of inventory, with values in bytes accepting size units
+var invNumFields = map[string]func(r *InventoryRecord) float64{
+	"cores": func(r *InventoryRecord) float64 { return float64(r.Inventory.CPUCores) },
+	"mem":   func(r *InventoryRecord) float64 { return float64(r.Inventory.MemTotal) },
+	"disks": func(r *InventoryRecord) float64 { return float64(len(r.Inventory.Disks)) },
+	"disksize": func(r *InventoryRecord) float64 {
+		var total uint64
+		for _, d := range r.Inventory.Disks {
+			total += d.Size
+		}
+		return float64(total)
+	},
+	"nics": func(r *InventoryRecord) float64 { return float64(len(r.Inventory.NICs)) },
+}
+
+// text fields of inventory, a term matches if any of the values matches
+var invTextFields = map[string]func(r *InventoryRecord) []string{
+	"mac":     func(r *InventoryRecord) []string { return []string{r.Mac} },
+	"host":    func(r *InventoryRecord) []string { return []string{r.Host} },
+	"ip":      func(r *InventoryRecord) []string { return []string{r.IP} },
+	"group":   func(r *InventoryRecord) []string { return r.Groups },
+	"cpu":     func(r *InventoryRecord) []string { return []string{r.Inventory.CPUModel} },
+	"kernel":  func(r *InventoryRecord) []string { return []string{r.Inventory.Kernel} },
+	"cmdline": func(r *InventoryRecord) []string { return []string{r.Inventory.Cmdline} },
+	"disk": func(r *InventoryRecord) []string {
+		var vs []string
+		for _, d := range r.Inventory.Disks {
+			vs = append(vs, d.Name, d.Model)
+		}
+		return vs
+	},
+	"nic": func(r *InventoryRecord) []string {
+		var vs []string
+		for _, n := range r.Inventory.NICs {
+			vs = append(vs, n.Name, n.Mac, n.Driver, n.PciID)
+		}
+		return vs
+	},
+}
+
+// a number optionally with a size unit, e.g. 256G, 256GB or 256GiB, all
+// in binary units
+func parseInvNumber(s string) (float64, error) {
+	num := strings.TrimRightFunc(s, unicode.IsLetter)
+	unit := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(s[len(num):]), "B"), "I")
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0, errors.Errorf("invalid number [%s]", s)
+	}
+	if len(unit) > 0 {
+		exp := strings.Index("KMGTPE", unit)
+		if len(unit) != 1 || exp < 0 {
+			return 0, errors.Errorf("invalid size unit in [%s]", s)
+		}
+		for ; exp >= 0; exp-- {
+			n *= 1024
+		}
+	}
+	return n, nil
+}
+
+// split a query into terms by spaces, with double quoted values kept whole
+func splitInvQuery(q string) ([]string, error) {
+	var tokens []string
+	var tok strings.Builder
+	inQuote, hasTok := false, false
+	for _, c := range q {
+		switch {
+		case '"' == c:
+			inQuote, hasTok = !inQuote, true
+		case unicode.IsSpace(c) && !inQuote:
+			if hasTok {
+				tokens = append(tokens, tok.String())
+				tok.Reset()
+				hasTok = false
+			}
+		default:
+			tok.WriteRune(c)
+			hasTok = true
+		}
+	}
+	if inQuote {
+		return nil, errors.New("unbalanced quote in query")
+	}
+	if hasTok {
+		tokens = append(tokens, tok.String())
+	}
+	return tokens, nil
+}
+
+// parse an inventory query, terms separated by spaces all have to match, e.g.
+//
+//	mem>=256G cpu~EPYC
+//	group=gpu disk!~"Samsung SSD"
+//
+// where ~ is case insensitive containing, = and != are case insensitive
+// equality for text fields
+func parseInvQuery(q string) ([]invTerm, error) {
+	q = strings.NewReplacer("≥", ">=", "≤", "<=", "≠", "!=").Replace(q)
+	tokens, err := splitInvQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	terms := make([]invTerm, 0, len(tokens))
+	for _, tok := range tokens {
+		oi := strings.IndexAny(tok, "!~=<>")
+		if oi <= 0 {
+			return nil, errors.Errorf("invalid query term [%s]", tok)
+		}
+		term := invTerm{field: strings.ToLower(tok[:oi])}
+		for _, op := range invOps {
+			if strings.HasPrefix(tok[oi:], op) {
+				term.op = op
+				break
+			}
+		}
+		if len(term.op) <= 0 {
+			return nil, errors.Errorf("invalid operator in query term [%s]", tok)
+		}
+		term.value = tok[oi+len(term.op):]
+		if _, ok := invNumFields[term.field]; ok {
+			if "~" == term.op || "!~" == term.op {
+				return nil, errors.Errorf("%s not applicable to numeric field [%s]", term.op, term.field)
+			}
+			if term.num, err = parseInvNumber(term.value); err != nil {
+				return nil, err
+			}
+		} else if _, ok := invTextFields[term.field]; ok {
+			if strings.ContainsAny(term.op, "<>") {
+				return nil, errors.Errorf("%s not applicable to text field [%s]", term.op, term.field)
+			}
+			term.value = strings.ToLower(term.value)
+		} else {
+			return nil, errors.Errorf("unknown field [%s] in query", term.field)
+		}
+		terms = append(terms, term)
+	}
+	return terms, nil
+}
+
+func (term *invTerm) match(r *InventoryRecord) bool {
+	if numOf, ok := invNumFields[term.field]; ok {
+		v := numOf(r)
+		switch term.op {
+		case "=":
+			return v == term.num
+		case "!=":
+			return v != term.num
+		case ">=":
+			return v >= term.num
+		case "<=":
+			return v <= term.num
+		case ">":
+			return v > term.num
+		case "<":
+			return v < term.num
+		}
+		return false
+	}
+
+	anyMatch := false
+	for _, v := range invTextFields[term.field](r) {
+		v = strings.ToLower(v)
+		if ("~" == term.op || "!~" == term.op) && strings.Contains(v, term.value) ||
+			("=" == term.op || "!=" == term.op) && v == term.value {
+			anyMatch = true
+			break
+		}
+	}
+	if strings.HasPrefix(term.op, "!") {
+		return !anyMatch
+	}
+	return anyMatch
+}
+
+// compute nodes with inventory matching the query, all of them for an empty
+// query, sorted by mac
+func SearchInventory(q string) ([]InventoryRecord, error) {
+	terms, err := parseInvQuery(q)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []InventoryRecord
+	func() {
+		lockAgentStates()
+		defer agentStatesMutex.Unlock()
+
+		for mac, as := range agentStates {
+			if as.Inventory != nil {
+				records = append(records, InventoryRecord{Mac: mac, Inventory: *as.Inventory})
+			}
+		}
+	}()
+
+	matched := records[:0]
+	for _, r := range records {
+		if cfg := GetComputeNodeCfg(r.Mac); cfg != nil {
+			if cfgd, err := cfg.InflateE(); err == nil {
+				r.Host, _ = cfgd["hostname"].(string)
+				r.IP, _ = cfgd["ip"].(string)
+				r.Groups = CfgGroups(cfgd)
+			}
+		}
+		all := true
+		for i := range terms {
+			if !terms[i].match(&r) {
+				all = false
+				break
+			}
+		}
+		if all {
+			matched = append(matched, r)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].Mac < matched[j].Mac
+	})
+	return matched, nil
+}
@@ -0,0 +1,158 @@
+package ccm
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/complyue/hbi/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// a config key changed differently by concurrent edits
+type MergeConflict struct {
+	// dot separated path of the key
+	Key string
+	// yaml rendering of values, empty for absent
+	Base, Current, Mine string
+}
+
+func yamlValueStr(v interface{}, present bool) string {
+	if !present {
+		return ""
+	}
+	out, err := yaml.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%#v", v)
+	}
+	return strings.TrimSuffix(string(out), "\n")
+}
+
+func mapSliceGet(ms yaml.MapSlice, key interface{}) (interface{}, bool) {
+	for _, item := range ms {
+		if item.Key == key {
+			return item.Value, true
+		}
+	}
+	return nil, false
+}
+
+// check all keys of a yaml map are scalars, recursively, as keys are compared
+// and looked up by value when merging
+func checkScalarKeys(path string, ms yaml.MapSlice) error {
+	for _, item := range ms {
+		switch item.Key.(type) {
+		case yaml.MapSlice, []interface{}, map[interface{}]interface{}:
+			if len(path) <= 0 {
+				return errors.Errorf("non-scalar key [%v] not supported", item.Key)
+			}
+			return errors.Errorf("non-scalar key [%v] under [%s] not supported", item.Key, path)
+		}
+		keyPath := fmt.Sprintf("%v", item.Key)
+		if len(path) > 0 {
+			keyPath = path + "." + keyPath
+		}
+		if sub, ok := item.Value.(yaml.MapSlice); ok {
+			if err := checkScalarKeys(keyPath, sub); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func mergeMapSlices(path string, base, current, mine yaml.MapSlice) (yaml.MapSlice, []MergeConflict) {
+	// keys in order of mine, then those only appeared in current
+	var keys []interface{}
+	seen := make(map[interface{}]bool)
+	for _, ms := range []yaml.MapSlice{mine, current, base} {
+		for _, item := range ms {
+			if !seen[item.Key] {
+				seen[item.Key] = true
+				keys = append(keys, item.Key)
+			}
+		}
+	}
+
+	var merged yaml.MapSlice
+	var conflicts []MergeConflict
+	for _, key := range keys {
+		b, inB := mapSliceGet(base, key)
+		c, inC := mapSliceGet(current, key)
+		m, inM := mapSliceGet(mine, key)
+
+		v, inV := m, inM
+		if inC == inM && reflect.DeepEqual(c, m) {
+			// same on both sides
+		} else if inB == inC && reflect.DeepEqual(b, c) {
+			// only changed by mine
+		} else if inB == inM && reflect.DeepEqual(b, m) {
+			// only changed by current
+			v, inV = c, inC
+		} else {
+			keyPath := fmt.Sprintf("%v", key)
+			if len(path) > 0 {
+				keyPath = path + "." + keyPath
+			}
+			bm, bok := b.(yaml.MapSlice)
+			cm, cok := c.(yaml.MapSlice)
+			mm, mok := m.(yaml.MapSlice)
+			if inB && inC && inM && bok && cok && mok {
+				// merge nested maps
+				var subConflicts []MergeConflict
+				v, subConflicts = mergeMapSlices(keyPath, bm, cm, mm)
+				conflicts = append(conflicts, subConflicts...)
+			} else {
+				// changed by both sides, mine is kept in the merged draft
+				conflicts = append(conflicts, MergeConflict{
+					Key:     keyPath,
+					Base:    yamlValueStr(b, inB),
+					Current: yamlValueStr(c, inC),
+					Mine:    yamlValueStr(m, inM),
+				})
+			}
+		}
+		if inV {
+			merged = append(merged, yaml.MapItem{Key: key, Value: v})
+		}
+	}
+	return merged, conflicts
+}
+
+// three-way merge a config edited from base, with current being what's stored
+// now and mine being the edited one. the merged result is always returned,
+// with conflicting keys valued as mine in it. original text of mine or current
+// is returned if the merge result equals to either of them structurally, so
+// comments and formatting are kept as possible.
+func MergeCfgYaml(base, current, mine string) (string, []MergeConflict, error) {
+	var baseYaml, curYaml, mineYaml yaml.MapSlice
+	for _, p := range []struct {
+		name string
+		text string
+		ms   *yaml.MapSlice
+	}{
+		{"base", base, &baseYaml},
+		{"current", current, &curYaml},
+		{"mine", mine, &mineYaml},
+	} {
+		if err := yaml.Unmarshal([]byte(p.text), p.ms); err != nil {
+			return "", nil, errors.Wrapf(err, "invalid yaml as %s", p.name)
+		}
+		if err := checkScalarKeys("", *p.ms); err != nil {
+			return "", nil, errors.Wrapf(err, "can not merge %s", p.name)
+		}
+	}
+
+	merged, conflicts := mergeMapSlices("", baseYaml, curYaml, mineYaml)
+	if reflect.DeepEqual(merged, mineYaml) {
+		return mine, conflicts, nil
+	}
+	if reflect.DeepEqual(merged, curYaml) {
+		return current, conflicts, nil
+	}
+	out, err := yaml.Marshal(merged)
+	if err != nil {
+		return "", nil, err
+	}
+	return string(out), conflicts, nil
+}
@@ -0,0 +1,104 @@
+package ccm
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+const mergeBase = `mac: aa:bb:cc:dd:ee:01
+ip: 192.168.11.201
+hostname: n01
+boot:
+  kernel: vmlinuz
+  cmdline: quiet
+`
+
+func TestMergeCfgYamlDisjointEdits(t *testing.T) {
+	current := strings.Replace(mergeBase, "hostname: n01", "hostname: n01a", 1)
+	mine := strings.Replace(mergeBase, "cmdline: quiet", "cmdline: debug", 1)
+
+	merged, conflicts, err := MergeCfgYaml(mergeBase, current, mine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) > 0 {
+		t.Fatalf("unexpected conflicts: %+v", conflicts)
+	}
+	var ms yaml.MapSlice
+	if err := yaml.Unmarshal([]byte(merged), &ms); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := mapSliceGet(ms, "hostname"); v != "n01a" {
+		t.Errorf("hostname merged as %v, want n01a", v)
+	}
+	boot, _ := mapSliceGet(ms, "boot")
+	if v, _ := mapSliceGet(boot.(yaml.MapSlice), "cmdline"); v != "debug" {
+		t.Errorf("boot.cmdline merged as %v, want debug", v)
+	}
+	if v, _ := mapSliceGet(boot.(yaml.MapSlice), "kernel"); v != "vmlinuz" {
+		t.Errorf("boot.kernel merged as %v, want vmlinuz", v)
+	}
+}
+
+func TestMergeCfgYamlOneSided(t *testing.T) {
+	mine := mergeBase + "# my comment\n"
+	merged, conflicts, err := MergeCfgYaml(mergeBase, mergeBase, mine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) > 0 || merged != mine {
+		t.Errorf("text of mine not kept, got %q with conflicts %+v", merged, conflicts)
+	}
+}
+
+func TestMergeCfgYamlConflictingScalar(t *testing.T) {
+	current := strings.Replace(mergeBase, "cmdline: quiet", "cmdline: single", 1)
+	mine := strings.Replace(mergeBase, "cmdline: quiet", "cmdline: debug", 1)
+
+	merged, conflicts, err := MergeCfgYaml(mergeBase, current, mine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) != 1 {
+		t.Fatalf("got %d conflicts, want 1: %+v", len(conflicts), conflicts)
+	}
+	c := conflicts[0]
+	if c.Key != "boot.cmdline" || c.Base != "quiet" || c.Current != "single" || c.Mine != "debug" {
+		t.Errorf("unexpected conflict: %+v", c)
+	}
+	if !strings.Contains(merged, "cmdline: debug") {
+		t.Errorf("mine not kept for conflicting key in merged draft:\n%s", merged)
+	}
+}
+
+func TestCheckScalarKeys(t *testing.T) {
+	for _, tc := range []struct {
+		text    string
+		wantErr string
+	}{
+		{"a: 1\nb:\n  c: 2\n", ""},
+		{"? [p, q]\n: 1\n", "non-scalar key [[p q]] not supported"},
+		{"a:\n  ? {x: 1}\n  : 2\n", "under [a] not supported"},
+	} {
+		var ms yaml.MapSlice
+		if err := yaml.Unmarshal([]byte(tc.text), &ms); err != nil {
+			t.Fatalf("bad test yaml %q: %v", tc.text, err)
+		}
+		err := checkScalarKeys("", ms)
+		if len(tc.wantErr) <= 0 {
+			if err != nil {
+				t.Errorf("%q: unexpected error %v", tc.text, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%q: got error %v, want containing %q", tc.text, err, tc.wantErr)
+		}
+	}
+
+	if _, _, err := MergeCfgYaml("a: 1\n", "? [x]\n: 1\n", "a: 2\n"); err == nil {
+		t.Error("merge of non-scalar keys not rejected")
+	}
+}
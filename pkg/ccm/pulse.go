@@ -28,43 +28,153 @@ type PulseCfg struct {
 
 	// forget after this long
 	ForgetDead time.Duration `yaml:"forgetDead"`
+
+	// purge archived bogon/corpse configs after this long, 0 to keep forever
+	ArchiveRetention time.Duration `yaml:"archiveRetention"`
+
+	// interval for node agents to send heartbeats
+	AgentInterval time.Duration `yaml:"agentInterval"`
+
+	// only accept reports from the ip configured for the node
+	AgentCheckSource bool `yaml:"agentCheckSource"`
 }
 
-var pulseCfg *PulseCfg
+const pulseCfgFile = "etc/pulse.yaml"
+
+var (
+	pulseCfg      *PulseCfg
+	pulseCfgMutex sync.Mutex
+)
+
+func loadPulseCfg() (*PulseCfg, error) {
+	cfgRawYaml, err := ioutil.ReadFile(pulseCfgFile)
+	if err != nil {
+		return nil, err
+	}
+	var cfgYaml PulseCfg
+	if err = yaml.Unmarshal(cfgRawYaml, &cfgYaml); err != nil {
+		return nil, err
+	}
+	if cfgYaml.PingCount < 1 {
+		return nil, errors.Errorf("invalid pingCount=%v in [%s]", cfgYaml.PingCount, pulseCfgFile)
+	}
+	if cfgYaml.CheckInterval <= 0 {
+		return nil, errors.Errorf("invalid checkInterval=%v in [%s]", cfgYaml.CheckInterval, pulseCfgFile)
+	}
+	return &cfgYaml, nil
+}
 
 func GetPulseCfg() *PulseCfg {
-	// racing on this cfg loading is negligible to be prevented
+	pulseCfgMutex.Lock()
+	defer pulseCfgMutex.Unlock()
+
 	if nil == pulseCfg {
-		cfgRawYaml, err := ioutil.ReadFile("etc/pulse.yaml")
+		cfg, err := loadPulseCfg()
 		if err != nil {
 			panic(err)
 		}
-		var cfgYaml PulseCfg
-		if err = yaml.Unmarshal(cfgRawYaml, &cfgYaml); err != nil {
-			panic(err)
-		}
-		pulseCfg = &cfgYaml
-	} else {
-		// todo reload on cfg file modified
+		pulseCfg = cfg
 	}
 	return pulseCfg
 }
 
+// reload pulse cfg from file, the last good one is kept on error
+func ReloadPulseCfg() error {
+	cfg, err := loadPulseCfg()
+	if err != nil {
+		return err
+	}
+
+	pulseCfgMutex.Lock()
+	defer pulseCfgMutex.Unlock()
+
+	pulseCfg = cfg
+	return nil
+}
+
+var (
+	deathHandlers      []func(ip string, cfgs []*ComputeNodeCfg)
+	deathHandlersMutex sync.Mutex
+)
+
+// register a function to be called, in its own goroutine, once death of an
+// ip is confirmed by the pulse checker
+func RegisterDeathHandler(handler func(ip string, cfgs []*ComputeNodeCfg)) {
+	deathHandlersMutex.Lock()
+	defer deathHandlersMutex.Unlock()
+
+	deathHandlers = append(deathHandlers, handler)
+}
+
+func notifyDeath(ip string, cfgs []*ComputeNodeCfg) {
+	deathHandlersMutex.Lock()
+	defer deathHandlersMutex.Unlock()
+
+	glog.Warningf("Death of ip=[%s] confirmed.", ip)
+	for _, handler := range deathHandlers {
+		go handler(ip, cfgs)
+	}
+}
+
 type IpAliveness struct {
 	IP string
 
 	AssumeAlive, CheckedAlive bool
 	LastAlive, LastCheck      time.Time
 
-	Cfgs []*ComputeNodeCfg
+	Cfgs []*ComputeNodeCfg `json:"-"`
 }
 
 var (
 	aliveness       = make(map[string]IpAliveness)
 	alivenessMutext sync.Mutex
 	aliveCheckQueue = make(chan string, 500)
+	// not to persist states before the ones persisted earlier are restored
+	alivenessRestored bool
 )
 
+// restore aliveness states from store, return the set of restored IPs
+func restoreAliveness() map[string]bool {
+	states, err := getStore().LoadAliveness()
+	if err != nil {
+		glog.Errorf("Error restoring aliveness states: %+v", err)
+		return nil
+	}
+
+	alivenessMutext.Lock()
+	defer alivenessMutext.Unlock()
+
+	restored := make(map[string]bool, len(states))
+	for _, state := range states {
+		state.Cfgs = nil
+		aliveness[state.IP] = state
+		restored[state.IP] = true
+	}
+	alivenessRestored = true
+	return restored
+}
+
+// persist aliveness states to store, skipped until restored from it
+func persistAliveness() error {
+	var states []IpAliveness
+	func() {
+		alivenessMutext.Lock()
+		defer alivenessMutext.Unlock()
+
+		if !alivenessRestored {
+			return
+		}
+		states = make([]IpAliveness, 0, len(aliveness))
+		for _, state := range aliveness {
+			states = append(states, state)
+		}
+	}()
+	if states == nil {
+		return nil
+	}
+	return getStore().SaveAliveness(states)
+}
+
 func ForgetCfg(cfg *ComputeNodeCfg) {
 	cfgData := cfg.Inflate()
 	ip := cfgData["ip"].(string)
@@ -116,89 +226,230 @@ func CareIpAliveness(ip string, AssumeAlive bool, cfg *ComputeNodeCfg) {
 
 	aliveness[ip] = knownState
 
-	aliveCheckQueue <- ip
+	scheduleAliveCheck(ip)
+}
+
+// schedule an alive check for an ip, dropped if the queue is full, stale ips
+// are scheduled again by the periodic sweep anyway
+func scheduleAliveCheck(ip string) {
+	select {
+	case aliveCheckQueue <- ip:
+	default:
+	}
+}
+
+// schedule checks for all cared ips not checked within checkInterval
+func sweepStaleIPs() {
+	checkThres := time.Now().Add(-GetPulseCfg().CheckInterval)
+	var staleIPs []string
+	func() {
+		alivenessMutext.Lock()
+		defer alivenessMutext.Unlock()
+
+		for _, ca := range aliveness {
+			if !ca.LastCheck.After(checkThres) {
+				staleIPs = append(staleIPs, ca.IP)
+			}
+		}
+	}()
+	for _, ip := range staleIPs {
+		scheduleAliveCheck(ip)
+	}
+}
+
+const (
+	alivenessPersistInterval = time.Minute
+	staleSweepInterval       = time.Minute
+
+	// number of goroutines pinging concurrently
+	aliveCheckerCount = 32
+)
+
+var startPulseOnce sync.Once
+
+// start checking aliveness of cared ips, persisting their states and purging
+// expired archives periodically. to be called by the control center once its
+// store is in use and compute node configs loaded, other programs linking this
+// package do not check, persist or purge anything.
+func StartPulse() {
+	startPulseOnce.Do(startPulse)
 }
 
-func init() {
+func startPulse() {
 	go func() {
-		for {
-			var (
-				ip     = <-aliveCheckQueue
-				a2c    IpAliveness
-				caring bool
-			)
-			func() {
-				alivenessMutext.Lock()
-				defer alivenessMutext.Unlock()
-
-				a2c, caring = aliveness[ip]
-			}()
-			if !caring {
-				glog.Warningf("Not caring ip=[%s] anymore.", ip)
-				continue
+		for range time.Tick(alivenessPersistInterval) {
+			if err := persistAliveness(); err != nil {
+				glog.Errorf("Error persisting aliveness states: %+v", err)
 			}
+		}
+	}()
+
+	go func() {
+		for range time.Tick(staleSweepInterval) {
+			sweepStaleIPs()
+		}
+	}()
 
-			pulseCfg := GetPulseCfg()
-			now := time.Now()
-			if now.Before(a2c.LastCheck.Add(pulseCfg.CheckInterval)) {
-				// not repeating check within interval
-				if now.Sub(a2c.LastCheck) < time.Duration(pulseCfg.PingCount)*time.Second {
-					// very near to next check time
-					if len(aliveCheckQueue)*2 < cap(aliveCheckQueue) {
-						// and queue is not much crowded
-						aliveCheckQueue <- ip // schedule another check
-					}
+	for ci := 0; ci < aliveCheckerCount; ci++ {
+		go checkAliveness()
+	}
+
+	startArchivePurge()
+}
+
+// pick ips from the queue and check their aliveness, forever
+func checkAliveness() {
+	for {
+		var (
+			ip             = <-aliveCheckQueue
+			a2c            IpAliveness
+			caring         bool
+			deathConfirmed bool
+		)
+		func() {
+			alivenessMutext.Lock()
+			defer alivenessMutext.Unlock()
+
+			a2c, caring = aliveness[ip]
+		}()
+		if !caring {
+			glog.Warningf("Not caring ip=[%s] anymore.", ip)
+			continue
+		}
+
+		pulseCfg := GetPulseCfg()
+		now := time.Now()
+		if now.Before(a2c.LastCheck.Add(pulseCfg.CheckInterval)) {
+			// not repeating check within interval
+			if now.Sub(a2c.LastCheck) < time.Duration(pulseCfg.PingCount)*time.Second {
+				// very near to next check time
+				if len(aliveCheckQueue)*2 < cap(aliveCheckQueue) {
+					// and queue is not much crowded
+					scheduleAliveCheck(ip) // schedule another check
 				}
-				continue
 			}
+			continue
+		}
 
-			glog.V(1).Infof("Pinging ip=[%s] for alive check ...", ip)
-			pingCmd := exec.Command("ping", "-c", fmt.Sprintf("%d", pulseCfg.PingCount), ip)
-			pingCmd.Stdin, pingCmd.Stdout, pingCmd.Stderr = nil, nil, nil
-			if err := pingCmd.Run(); err == nil {
-				glog.V(1).Infof("IP [%s] is alive.", ip)
-				// start/continue caring its aliveness as got positive result at this instant
-				a2c.CheckedAlive, a2c.LastCheck = true, now
-				a2c.AssumeAlive, a2c.LastAlive = true, now
-			} else if ee, ok := err.(*exec.ExitError); ok {
-				glog.V(1).Infof("IP [%s] not alive, ping %+v", ip, ee)
-				a2c.CheckedAlive, a2c.LastCheck = false, now
-				if a2c.AssumeAlive { // check if death can be confirmed now
-					if now.After(a2c.LastAlive.Add(pulseCfg.DeathConfirm)) {
-						// confirm death after the configured duration
-						a2c.AssumeAlive = false
-					} else {
-						// not positive alive, but keep assumption for now
-					}
-				}
-				if !a2c.AssumeAlive && now.After(a2c.LastAlive.Add(pulseCfg.ForgetDead)) {
-					// forget about this IP
-					func() {
-						alivenessMutext.Lock()
-						defer alivenessMutext.Unlock()
-
-						delete(aliveness, ip)
-					}()
+		glog.V(1).Infof("Pinging ip=[%s] for alive check ...", ip)
+		pingCmd := exec.Command("ping", "-c", fmt.Sprintf("%d", pulseCfg.PingCount), ip)
+		pingCmd.Stdin, pingCmd.Stdout, pingCmd.Stderr = nil, nil, nil
+		if err := pingCmd.Run(); err == nil {
+			glog.V(1).Infof("IP [%s] is alive.", ip)
+			// start/continue caring its aliveness as got positive result at this instant
+			a2c.CheckedAlive, a2c.LastCheck = true, now
+			a2c.AssumeAlive, a2c.LastAlive = true, now
+		} else if ee, ok := err.(*exec.ExitError); ok {
+			glog.V(1).Infof("IP [%s] not alive, ping %+v", ip, ee)
+			a2c.CheckedAlive, a2c.LastCheck = false, now
+			if a2c.AssumeAlive { // check if death can be confirmed now
+				if now.After(a2c.LastAlive.Add(pulseCfg.DeathConfirm)) {
+					// confirm death after the configured duration
+					a2c.AssumeAlive = false
+					deathConfirmed = true
+				} else {
+					// not positive alive, but keep assumption for now
 				}
-			} else {
-				glog.Errorf("Unexpected error calling ping: %+v", err)
-				continue
 			}
+			if !a2c.AssumeAlive && now.After(a2c.LastAlive.Add(pulseCfg.ForgetDead)) {
+				// forget about this IP
+				func() {
+					alivenessMutext.Lock()
+					defer alivenessMutext.Unlock()
+
+					delete(aliveness, ip)
+				}()
+			}
+		} else {
+			glog.Errorf("Unexpected error calling ping: %+v", err)
+			continue
+		}
 
-			func() {
-				alivenessMutext.Lock()
-				defer alivenessMutext.Unlock()
+		func() {
+			alivenessMutext.Lock()
+			defer alivenessMutext.Unlock()
 
-				caringA2C, caring := aliveness[ip]
-				if caring {
-					// avoid overwriting with a stale cfg object
-					// a2c.Cfg may have been invalidated during checking without alivenessMutext locked
-					a2c.Cfgs = caringA2C.Cfgs
-				}
-				aliveness[ip] = a2c
-			}()
+			caringA2C, caring := aliveness[ip]
+			if caring {
+				// avoid overwriting with a stale cfg object
+				// a2c.Cfg may have been invalidated during checking without alivenessMutext locked
+				a2c.Cfgs = caringA2C.Cfgs
+			}
+			aliveness[ip] = a2c
+		}()
+		if deathConfirmed {
+			notifyDeath(ip, a2c.Cfgs)
 		}
-	}()
+	}
+}
+
+// ping an ip, with pingCount packets
+func pingIP(ip string) (bool, error) {
+	pulseCfg := GetPulseCfg()
+	pingCmd := exec.Command("ping", "-c", fmt.Sprintf("%d", pulseCfg.PingCount), ip)
+	pingCmd.Stdin, pingCmd.Stdout, pingCmd.Stderr = nil, nil, nil
+	if err := pingCmd.Run(); err == nil {
+		return true, nil
+	} else if ee, ok := err.(*exec.ExitError); ok {
+		glog.V(1).Infof("IP [%s] not alive, ping %+v", ip, ee)
+		return false, nil
+	} else {
+		return false, errors.Errorf("Unexpected error calling ping: %+v", err)
+	}
+}
+
+// ping an ip right now regardless of assumption, a positive result is
+// recorded if the ip is cared
+func ProbeIpAlive(ip string) (bool, error) {
+	alive, err := pingIP(ip)
+	if err != nil || !alive {
+		return alive, err
+	}
+
+	alivenessMutext.Lock()
+	defer alivenessMutext.Unlock()
+
+	if knownState, caring := aliveness[ip]; caring {
+		now := time.Now()
+		knownState.CheckedAlive, knownState.LastCheck = true, now
+		knownState.AssumeAlive, knownState.LastAlive = true, now
+		aliveness[ip] = knownState
+	}
+	return true, nil
+}
+
+// record an ip alive by a signal other than ping, e.g. an agent heartbeat,
+// so its death won't be confirmed even if ping is blocked
+func NoteIpAlive(ip string) {
+	alivenessMutext.Lock()
+	defer alivenessMutext.Unlock()
+
+	if knownState, caring := aliveness[ip]; caring {
+		knownState.AssumeAlive, knownState.LastAlive = true, time.Now()
+		aliveness[ip] = knownState
+	}
+}
+
+// when an ip was last seen alive, by ping or other signals, zero if its
+// aliveness not cared
+func LastAliveTime(ip string) time.Time {
+	alivenessMutext.Lock()
+	defer alivenessMutext.Unlock()
+
+	return aliveness[ip].LastAlive
+}
+
+// like CheckIpAlive but nothing recorded or scheduled, the last return is
+// false for an ip not cared, which is reported not alive
+func peekIpAlive(ip string) (bool, time.Time, []*ComputeNodeCfg, bool) {
+	alivenessMutext.Lock()
+	knownState, caring := aliveness[ip]
+	alivenessMutext.Unlock()
+
+	if caring {
+		return knownState.AssumeAlive, knownState.LastAlive, knownState.Cfgs, true
+	}
+	return false, time.Time{}, nil, false
 }
 
 func CheckIpAlive(ip string) (bool, time.Time, []*ComputeNodeCfg) {
@@ -208,7 +459,7 @@ func CheckIpAlive(ip string) (bool, time.Time, []*ComputeNodeCfg) {
 
 	if caring { // check should be carried out periodically
 		if !now.Before(knownState.LastAlive.Add(pulseCfg.CheckInterval)) {
-			aliveCheckQueue <- ip
+			scheduleAliveCheck(ip)
 		}
 	}
 
@@ -252,20 +503,14 @@ func CheckIpAlive(ip string) (bool, time.Time, []*ComputeNodeCfg) {
 }
 
 func ListCaredIPs() []IpAliveness {
-	pulseCfg := GetPulseCfg()
 	var caList []IpAliveness
 
 	func() { // sync load
-		caList = make([]IpAliveness, 0, len(aliveness))
 		alivenessMutext.Lock()
 		defer alivenessMutext.Unlock()
 
-		checkThres := time.Now().Add(-pulseCfg.CheckInterval)
+		caList = make([]IpAliveness, 0, len(aliveness))
 		for _, ca := range aliveness {
-			if !ca.LastCheck.After(checkThres) {
-				// schedule a new check for it
-				aliveCheckQueue <- ca.IP
-			}
 			caList = append(caList, ca)
 		}
 	}()
@@ -0,0 +1,248 @@
+package ccm
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/complyue/different-hpc/pkg/agent"
+	"github.com/complyue/hbi/pkg/errors"
+	"github.com/golang/glog"
+	"gopkg.in/yaml.v2"
+)
+
+// an IP address leased to a compute node
+type Lease struct {
+	IP    string
+	IPNum int
+	Mac   string
+	Since time.Time
+}
+
+// something happened to a compute node
+type HistoryEvent struct {
+	Time time.Time
+	Mac  string
+	IP   string
+	// generated/saved/archived/reclaimed/boot etc.
+	Kind   string
+	Detail string
+}
+
+// a compute node config moved out of service
+type ArchivedCfg struct {
+	// store specific identifier of the archived config
+	ID string
+	// empty if not known, e.g. a bogon without a valid mac
+	Mac string
+	// bogon/corpse
+	Reason string
+	// why it's archived, e.g. the problem with a bogon
+	Detail string
+	Time   time.Time
+	// only filled when loaded individually
+	RawYaml string `json:",omitempty"`
+}
+
+// a stored compute node config found bogus, e.g. in the middle of a hand edit
+type BogusCfgError struct {
+	Mac     string
+	Problem error
+}
+
+func (e *BogusCfgError) Error() string {
+	return fmt.Sprintf("bogus config of mac=[%s]: %s", e.Mac, e.Problem)
+}
+
+// persistent storage of compute node configs and states
+type Store interface {
+	// locator of this store, as can be passed to OpenStore
+	Spec() string
+
+	// all active compute node configs, bogus ones are archived as bogon,
+	// meant for the full load at startup only.
+	// a mac can appear more than once if the store allows, the first one is
+	// in effect
+	LoadCfgs() ([]*ComputeNodeCfg, error)
+	// active config of a compute node, nil without error if there's none,
+	// a bogus one is left as is and reported by a *BogusCfgError
+	LoadCfg(mac string) (*ComputeNodeCfg, error)
+	// write raw yaml as the active config of a compute node
+	SaveCfg(mac string, rawYaml []byte) (*ComputeNodeCfg, error)
+	// write configs of multiple compute nodes, all or none
+	SaveCfgs(rawYamls map[string][]byte) ([]*ComputeNodeCfg, error)
+	// move the active config of a compute node out of service, with reason
+	// being bogon or corpse
+	ArchiveCfg(mac string, reason, detail string) error
+
+	// archived configs, oldest first, without raw yaml
+	ListArchived() ([]ArchivedCfg, error)
+	// an archived config with its raw yaml, nil without error if not found
+	LoadArchived(id string) (*ArchivedCfg, error)
+	// put an archived config back into service, with rawYaml or the archived
+	// content if nil, the node must have no active config
+	RestoreArchived(id string, rawYaml []byte) (*ComputeNodeCfg, error)
+	// delete an archived config permanently
+	PurgeArchived(id string) error
+	// add an archived config, e.g. migrated from another store
+	PutArchived(ac ArchivedCfg) error
+
+	// assign an IP to a compute node with its config, the node previously
+	// leasing this IP (if reclaimFrom not empty) has its config archived as
+	// corpse at the same time
+	AssignLease(lease Lease, rawYaml []byte, reclaimFrom []string) (*ComputeNodeCfg, error)
+	ListLeases() ([]Lease, error)
+
+	SaveAliveness(states []IpAliveness) error
+	LoadAliveness() ([]IpAliveness, error)
+
+	AppendHistory(evt HistoryEvent) error
+	// most recent events of a compute node, of all nodes if mac is empty,
+	// limit <= 0 means all
+	ListHistory(mac string, limit int) ([]HistoryEvent, error)
+
+	// latest inventory reported by the agent on a compute node
+	SaveInventory(inv agent.Inventory) error
+	LoadInventories() ([]agent.Inventory, error)
+
+	// boot spec served to a compute node at its last boot
+	SaveBootSnapshot(snap BootSnapshot) error
+	LoadBootSnapshots() ([]BootSnapshot, error)
+
+	Close() error
+}
+
+// open a store by its locator, in form of:
+//
+//	yaml:<cfg dir>[,<state dir>[,sharded]]
+//	bolt:<db file>
+func OpenStore(spec string) (Store, error) {
+	kind, loc := spec, ""
+	if i := strings.IndexByte(spec, ':'); i >= 0 {
+		kind, loc = spec[:i], spec[i+1:]
+	}
+	switch kind {
+	case "yaml":
+		parts := strings.Split(loc, ",")
+		if len(parts) > 3 || (len(parts) == 3 && parts[2] != "sharded") {
+			return nil, errors.Errorf("invalid yaml store spec [%s]", spec)
+		}
+		dir, stateDir := parts[0], ""
+		if len(parts) > 1 {
+			stateDir = parts[1]
+		}
+		return openYamlDirStore(dir, stateDir, len(parts) == 3)
+	case "bolt":
+		return openBoltStore(loc)
+	}
+	return nil, errors.Errorf("unknown store kind [%s] in [%s]", kind, spec)
+}
+
+const defaultStoreSpec = "yaml:" + cnodesDir
+
+var (
+	store      Store
+	storeMutex sync.Mutex
+)
+
+// use the specified store for compute node configs and states, should be
+// called before anything loaded
+func UseStore(s Store) {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+
+	store = s
+}
+
+func getStore() Store {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+
+	if store == nil {
+		s, err := OpenStore(defaultStoreSpec)
+		if err != nil {
+			panic(err)
+		}
+		store = s
+	}
+	return store
+}
+
+// record an event of a compute node, failure is logged but otherwise ignored
+func RecordHistory(mac, ip, kind, detail string) {
+	if err := getStore().AppendHistory(HistoryEvent{
+		Time: time.Now(), Mac: mac, IP: ip, Kind: kind, Detail: detail,
+	}); err != nil {
+		glog.Errorf("Error recording %s event of mac=[%s]: %+v", kind, mac, err)
+	}
+}
+
+func ListHistory(mac string, limit int) ([]HistoryEvent, error) {
+	return getStore().ListHistory(mac, limit)
+}
+
+// parse raw yaml of a compute node config, an error is returned for content
+// not qualified as a compute node config
+func ParseComputeNodeCfg(rawYaml []byte) (*ComputeNodeCfg, error) {
+	var cfgYaml yaml.MapSlice
+	if err := yaml.Unmarshal(rawYaml, &cfgYaml); err != nil {
+		return nil, err
+	}
+	var cfgMac, ip string
+	var guiType, guiHref string
+	for _, cfgItem := range cfgYaml {
+		if cfgKey, ok := cfgItem.Key.(string); ok {
+			if "mac" == cfgKey {
+				cfgMac, _ = cfgItem.Value.(string)
+			} else if "ip" == cfgKey {
+				ip, _ = cfgItem.Value.(string)
+			} else if "guiHref" == cfgKey {
+				guiHref, _ = cfgItem.Value.(string)
+			} else if "guiType" == cfgKey {
+				guiType, _ = cfgItem.Value.(string)
+			}
+		}
+	}
+	if len(cfgMac) <= 0 {
+		return nil, errors.New("no mac in config")
+	}
+	if len(ip) <= 0 {
+		return nil, errors.New("no ip in config")
+	}
+
+	// mac written in other forms is accepted, but always normalized as key
+	normMac, err := NormalizeMac(cfgMac)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid mac [%s] in config", cfgMac)
+	}
+
+	return &ComputeNodeCfg{
+		Mac:     normMac,
+		GuiType: guiType, GuiHref: guiHref,
+		RawYaml: string(rawYaml), CfgYaml: cfgYaml,
+		ETag: CfgETag(rawYaml),
+
+		inflation: &cfgInflation{},
+	}, nil
+}
+
+// lease of the IP a compute node config carries
+func cfgLease(cfg *ComputeNodeCfg) Lease {
+	lease := Lease{Mac: cfg.Mac, Since: cfg.FileTime}
+	for _, cfgItem := range cfg.CfgYaml {
+		switch cfgItem.Key {
+		case "ip":
+			lease.IP, _ = cfgItem.Value.(string)
+		case "ipnum":
+			lease.IPNum, _ = cfgItem.Value.(int)
+		case "generated":
+			if s, ok := cfgItem.Value.(string); ok {
+				if t, err := time.Parse("2006-01-02T15:04:05Z07:00", s); err == nil {
+					lease.Since = t
+				}
+			}
+		}
+	}
+	return lease
+}
@@ -0,0 +1,559 @@
+package ccm
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/complyue/different-hpc/pkg/agent"
+	"github.com/complyue/hbi/pkg/errors"
+	"github.com/golang/glog"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltCfgsBucket      = []byte("cfgs")
+	boltArchiveBucket   = []byte("archive")
+	boltLeasesBucket    = []byte("leases")
+	boltAlivenessBucket = []byte("aliveness")
+	boltHistoryBucket   = []byte("history")
+	boltInventoryBucket = []byte("inventory")
+	boltBootsBucket     = []byte("boots")
+)
+
+// history of a compute node is capped to this many events, the oldest ones
+// are dropped
+const maxBoltHistoryEvents = 5000
+
+// compute node configs and states in an embedded transactional database
+type boltStore struct {
+	path string
+	db   *bolt.DB
+}
+
+// a compute node config as stored in bolt
+type boltCfgRec struct {
+	RawYaml string
+	Time    time.Time
+}
+
+// an archived compute node config as stored in bolt
+type boltArchivedRec struct {
+	Mac     string
+	Reason  string
+	Detail  string
+	Time    time.Time
+	RawYaml string
+}
+
+func openBoltStore(path string) (*boltStore, error) {
+	if len(path) <= 0 {
+		return nil, errors.New("no db file specified for bolt store")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 3 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	if err = db.Update(func(tx *bolt.Tx) error {
+		for _, bn := range [][]byte{
+			boltCfgsBucket, boltArchiveBucket, boltLeasesBucket,
+			boltAlivenessBucket, boltHistoryBucket, boltInventoryBucket,
+			boltBootsBucket,
+		} {
+			if _, err := tx.CreateBucketIfNotExists(bn); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{path: path, db: db}, nil
+}
+
+func (s *boltStore) Spec() string {
+	return "bolt:" + s.path
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *boltStore) decodeCfg(mac string, data []byte) (*ComputeNodeCfg, error) {
+	var rec boltCfgRec
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, err
+	}
+	cfg, err := ParseComputeNodeCfg([]byte(rec.RawYaml))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Mac != mac {
+		return nil, errors.Errorf("invalid mac=[%s] vs [%s] in stored config", cfg.Mac, mac)
+	}
+	cfg.FileName, cfg.FileTime = fmt.Sprintf("%s#%s", s.path, mac), rec.Time
+	return cfg, nil
+}
+
+func (s *boltStore) archiveCfg(tx *bolt.Tx, mac, reason, detail string) error {
+	cfgs := tx.Bucket(boltCfgsBucket)
+	data := cfgs.Get([]byte(mac))
+	if data == nil {
+		return nil
+	}
+	var rec boltCfgRec
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return err
+	}
+	arcKey, err := s.putArchived(tx, boltArchivedRec{
+		Mac: mac, Reason: reason, Detail: detail, Time: time.Now(), RawYaml: rec.RawYaml,
+	})
+	if err != nil {
+		return err
+	}
+	if cfg, err := ParseComputeNodeCfg([]byte(rec.RawYaml)); err == nil {
+		if err := s.dropLease(tx, cfgLease(cfg).IP, mac); err != nil {
+			return err
+		}
+	}
+	glog.Infof("Config of mac=[%s] archived as %s [%s].", mac, reason, arcKey)
+	return cfgs.Delete([]byte(mac))
+}
+
+func (s *boltStore) putArchived(tx *bolt.Tx, rec boltArchivedRec) (string, error) {
+	arcData, err := json.Marshal(rec)
+	if err != nil {
+		return "", err
+	}
+	arcKey := fmt.Sprintf("%s~%s-%s", rec.Mac, rec.Reason, rec.Time.Format("20060102150405.000000"))
+	if err := tx.Bucket(boltArchiveBucket).Put([]byte(arcKey), arcData); err != nil {
+		return "", err
+	}
+	return arcKey, nil
+}
+
+// remove an ip lease if it's held by the specified node
+func (s *boltStore) dropLease(tx *bolt.Tx, ip, mac string) error {
+	leases := tx.Bucket(boltLeasesBucket)
+	data := leases.Get([]byte(ip))
+	if data == nil {
+		return nil
+	}
+	var lease Lease
+	if err := json.Unmarshal(data, &lease); err != nil {
+		return err
+	}
+	if lease.Mac != mac {
+		return nil
+	}
+	return leases.Delete([]byte(ip))
+}
+
+func (s *boltStore) saveCfg(tx *bolt.Tx, mac string, rawYaml []byte) (*ComputeNodeCfg, error) {
+	cfg, err := ParseComputeNodeCfg(rawYaml)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Mac != mac {
+		return nil, errors.Errorf("invalid mac=[%s] vs [%s] in config to save", cfg.Mac, mac)
+	}
+
+	cfgs := tx.Bucket(boltCfgsBucket)
+	if oldData := cfgs.Get([]byte(mac)); oldData != nil {
+		if oldCfg, err := s.decodeCfg(mac, oldData); err == nil {
+			if err := s.dropLease(tx, cfgLease(oldCfg).IP, mac); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	now := time.Now()
+	data, err := json.Marshal(boltCfgRec{RawYaml: string(rawYaml), Time: now})
+	if err != nil {
+		return nil, err
+	}
+	if err := cfgs.Put([]byte(mac), data); err != nil {
+		return nil, err
+	}
+	cfg.FileName, cfg.FileTime = fmt.Sprintf("%s#%s", s.path, mac), now
+
+	lease := cfgLease(cfg)
+	leaseData, err := json.Marshal(lease)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Bucket(boltLeasesBucket).Put([]byte(lease.IP), leaseData); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (s *boltStore) LoadCfgs() ([]*ComputeNodeCfg, error) {
+	var cfgs []*ComputeNodeCfg
+	var bogons, problems []string
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltCfgsBucket).ForEach(func(k, v []byte) error {
+			cfg, err := s.decodeCfg(string(k), v)
+			if err != nil {
+				glog.Warningf("Problem detected with config of mac=[%s]: %+v", string(k), err)
+				bogons = append(bogons, string(k))
+				problems = append(problems, err.Error())
+				return nil
+			}
+			cfgs = append(cfgs, cfg)
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+	for i, mac := range bogons {
+		if err := s.ArchiveCfg(mac, "bogon", problems[i]); err != nil {
+			return nil, err
+		}
+	}
+	return cfgs, nil
+}
+
+func (s *boltStore) LoadCfg(mac string) (*ComputeNodeCfg, error) {
+	var cfg *ComputeNodeCfg
+	var problem error
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(boltCfgsBucket).Get([]byte(mac))
+		if data == nil {
+			return nil
+		}
+		cfg, problem = s.decodeCfg(mac, data)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if problem != nil {
+		glog.Warningf("Problem detected with config of mac=[%s]: %+v", mac, problem)
+		return nil, &BogusCfgError{Mac: mac, Problem: problem}
+	}
+	return cfg, nil
+}
+
+func (s *boltStore) SaveCfg(mac string, rawYaml []byte) (cfg *ComputeNodeCfg, err error) {
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		cfg, err = s.saveCfg(tx, mac, rawYaml)
+		return err
+	})
+	return
+}
+
+func (s *boltStore) SaveCfgs(rawYamls map[string][]byte) (cfgs []*ComputeNodeCfg, err error) {
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		cfgs = cfgs[:0]
+		for mac, rawYaml := range rawYamls {
+			cfg, err := s.saveCfg(tx, mac, rawYaml)
+			if err != nil {
+				return errors.Wrapf(err, "failed saving config of mac=[%s]", mac)
+			}
+			cfgs = append(cfgs, cfg)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (s *boltStore) ArchiveCfg(mac string, reason, detail string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return s.archiveCfg(tx, mac, reason, detail)
+	})
+}
+
+func decodeArchived(k, v []byte, withRaw bool) (*ArchivedCfg, error) {
+	var rec boltArchivedRec
+	if err := json.Unmarshal(v, &rec); err != nil {
+		return nil, err
+	}
+	ac := &ArchivedCfg{
+		ID: string(k), Mac: rec.Mac,
+		Reason: rec.Reason, Detail: rec.Detail, Time: rec.Time,
+	}
+	if withRaw {
+		ac.RawYaml = rec.RawYaml
+	}
+	return ac, nil
+}
+
+func (s *boltStore) ListArchived() ([]ArchivedCfg, error) {
+	var acs []ArchivedCfg
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltArchiveBucket).ForEach(func(k, v []byte) error {
+			ac, err := decodeArchived(k, v, false)
+			if err != nil {
+				return err
+			}
+			acs = append(acs, *ac)
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+	sort.Slice(acs, func(i, j int) bool {
+		return acs[i].Time.Before(acs[j].Time)
+	})
+	return acs, nil
+}
+
+func (s *boltStore) LoadArchived(id string) (ac *ArchivedCfg, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltArchiveBucket).Get([]byte(id))
+		if v == nil {
+			return nil
+		}
+		ac, err = decodeArchived([]byte(id), v, true)
+		return err
+	})
+	return
+}
+
+func (s *boltStore) RestoreArchived(id string, rawYaml []byte) (cfg *ComputeNodeCfg, err error) {
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		arcs := tx.Bucket(boltArchiveBucket)
+		v := arcs.Get([]byte(id))
+		if v == nil {
+			return errors.Errorf("no archived config [%s]", id)
+		}
+		if rawYaml == nil {
+			ac, err := decodeArchived([]byte(id), v, true)
+			if err != nil {
+				return err
+			}
+			rawYaml = []byte(ac.RawYaml)
+		}
+		parsed, err := ParseComputeNodeCfg(rawYaml)
+		if err != nil {
+			return err
+		}
+		if tx.Bucket(boltCfgsBucket).Get([]byte(parsed.Mac)) != nil {
+			return errors.Errorf("mac=[%s] has an active config", parsed.Mac)
+		}
+		if cfg, err = s.saveCfg(tx, parsed.Mac, rawYaml); err != nil {
+			return err
+		}
+		return arcs.Delete([]byte(id))
+	})
+	return
+}
+
+func (s *boltStore) PurgeArchived(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltArchiveBucket).Delete([]byte(id))
+	})
+}
+
+func (s *boltStore) PutArchived(ac ArchivedCfg) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		_, err := s.putArchived(tx, boltArchivedRec{
+			Mac: ac.Mac, Reason: ac.Reason, Detail: ac.Detail, Time: ac.Time, RawYaml: ac.RawYaml,
+		})
+		return err
+	})
+}
+
+func (s *boltStore) AssignLease(lease Lease, rawYaml []byte, reclaimFrom []string) (cfg *ComputeNodeCfg, err error) {
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		for _, deadMac := range reclaimFrom {
+			if err := s.archiveCfg(tx, deadMac, "corpse",
+				"ip "+lease.IP+" reused by mac="+lease.Mac); err != nil {
+				return err
+			}
+		}
+		cfg, err = s.saveCfg(tx, lease.Mac, rawYaml)
+		return err
+	})
+	return
+}
+
+func (s *boltStore) ListLeases() ([]Lease, error) {
+	var leases []Lease
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltLeasesBucket).ForEach(func(k, v []byte) error {
+			var lease Lease
+			if err := json.Unmarshal(v, &lease); err != nil {
+				return err
+			}
+			leases = append(leases, lease)
+			return nil
+		})
+	})
+	return leases, err
+}
+
+func (s *boltStore) SaveAliveness(states []IpAliveness) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(boltAlivenessBucket); err != nil {
+			return err
+		}
+		b, err := tx.CreateBucket(boltAlivenessBucket)
+		if err != nil {
+			return err
+		}
+		for _, state := range states {
+			data, err := json.Marshal(state)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(state.IP), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) LoadAliveness() ([]IpAliveness, error) {
+	var states []IpAliveness
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltAlivenessBucket).ForEach(func(k, v []byte) error {
+			var state IpAliveness
+			if err := json.Unmarshal(v, &state); err != nil {
+				return err
+			}
+			states = append(states, state)
+			return nil
+		})
+	})
+	return states, err
+}
+
+func (s *boltStore) AppendHistory(evt HistoryEvent) error {
+	data, err := json.Marshal(evt)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(boltHistoryBucket).CreateBucketIfNotExists([]byte(evt.Mac))
+		if err != nil {
+			return err
+		}
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		if err := b.Put(key, data); err != nil {
+			return err
+		}
+		// drop the oldest beyond the cap
+		if seq <= maxBoltHistoryEvents {
+			return nil
+		}
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) <= seq-maxBoltHistoryEvents; k, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) ListHistory(mac string, limit int) ([]HistoryEvent, error) {
+	var evts []HistoryEvent
+	collect := func(b *bolt.Bucket) error {
+		var macEvts []HistoryEvent
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			if limit > 0 && len(macEvts) >= limit {
+				break
+			}
+			var evt HistoryEvent
+			if err := json.Unmarshal(v, &evt); err != nil {
+				return err
+			}
+			macEvts = append(macEvts, evt)
+		}
+		evts = append(evts, macEvts...)
+		return nil
+	}
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		hb := tx.Bucket(boltHistoryBucket)
+		if len(mac) > 0 {
+			if b := hb.Bucket([]byte(mac)); b != nil {
+				return collect(b)
+			}
+			return nil
+		}
+		return hb.ForEach(func(k, v []byte) error {
+			if b := hb.Bucket(k); b != nil {
+				return collect(b)
+			}
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(evts, func(i, j int) bool {
+		return evts[i].Time.Before(evts[j].Time)
+	})
+	if limit > 0 && len(evts) > limit {
+		evts = evts[len(evts)-limit:]
+	}
+	return evts, nil
+}
+
+func (s *boltStore) SaveInventory(inv agent.Inventory) error {
+	data, err := json.Marshal(inv)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltInventoryBucket).Put([]byte(inv.Mac), data)
+	})
+}
+
+func (s *boltStore) LoadInventories() ([]agent.Inventory, error) {
+	var invs []agent.Inventory
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltInventoryBucket).ForEach(func(k, v []byte) error {
+			var inv agent.Inventory
+			if err := json.Unmarshal(v, &inv); err != nil {
+				return err
+			}
+			invs = append(invs, inv)
+			return nil
+		})
+	})
+	return invs, err
+}
+
+func (s *boltStore) SaveBootSnapshot(snap BootSnapshot) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBootsBucket).Put([]byte(snap.Mac), data)
+	})
+}
+
+func (s *boltStore) LoadBootSnapshots() ([]BootSnapshot, error) {
+	var snaps []BootSnapshot
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBootsBucket).ForEach(func(k, v []byte) error {
+			var snap BootSnapshot
+			if err := json.Unmarshal(v, &snap); err != nil {
+				return err
+			}
+			snaps = append(snaps, snap)
+			return nil
+		})
+	})
+	return snaps, err
+}
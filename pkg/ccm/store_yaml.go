@@ -0,0 +1,935 @@
+package ccm
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/complyue/different-hpc/pkg/agent"
+	"github.com/complyue/hbi/pkg/errors"
+	"github.com/golang/glog"
+)
+
+// compute node configs as yaml files in a directory, one file per node, with
+// states kept as json files in another directory. config files can be put in
+// subdirectories, and new ones are put in subdirectories named by the last
+// octet of mac if sharded.
+type yamlDirStore struct {
+	dir, stateDir string
+	sharded       bool
+
+	mutex sync.Mutex
+	// file name of each known node's config, a config file can be created
+	// by hand with a name other than the mac
+	files map[string]string
+	// configs parsed, reused until the file's size or mtime changes
+	parsed map[string]*ComputeNodeCfg
+}
+
+func openYamlDirStore(dir, stateDir string, sharded bool) (*yamlDirStore, error) {
+	if len(dir) <= 0 {
+		dir = cnodesDir
+	}
+	if len(stateDir) <= 0 {
+		stateDir = "var/cnodes"
+	}
+	for _, d := range []string{
+		dir, filepath.Join(stateDir, "history"), filepath.Join(stateDir, "archive"),
+		filepath.Join(stateDir, "inventory"), filepath.Join(stateDir, "boots"),
+	} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &yamlDirStore{
+		dir: filepath.Clean(dir), stateDir: filepath.Clean(stateDir), sharded: sharded,
+		files:  make(map[string]string),
+		parsed: make(map[string]*ComputeNodeCfg),
+	}, nil
+}
+
+func (s *yamlDirStore) Spec() string {
+	if s.sharded {
+		return "yaml:" + s.dir + "," + s.stateDir + ",sharded"
+	}
+	return "yaml:" + s.dir + "," + s.stateDir
+}
+
+func (s *yamlDirStore) Close() error {
+	return nil
+}
+
+func macFileKey(mac string) string {
+	return strings.Replace(mac, ":", "-", -1)
+}
+
+// resolve file name of a compute node's config, always inside the config dir
+func (s *yamlDirStore) cfgFileName(mac string) (string, error) {
+	normMac, err := NormalizeMac(mac)
+	if err != nil {
+		return "", err
+	}
+	if normMac != mac {
+		return "", errors.Errorf("mac [%s] not in normal form [%s]", mac, normMac)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if fileName, ok := s.files[mac]; ok {
+		return fileName, nil
+	}
+	if s.sharded {
+		return filepath.Join(s.dir, mac[len(mac)-2:], macFileKey(mac)+".yaml"), nil
+	}
+	return filepath.Join(s.dir, macFileKey(mac)+".yaml"), nil
+}
+
+// whether a dir under the config dir is to be looked into
+func isCfgSubDir(fn string) bool {
+	if len(fn) < 1 {
+		return false
+	}
+	switch fn[0] {
+	case '.', '_', '~', '!':
+		return false
+	}
+	return true
+}
+
+// walk the config dir and its subdirectories, for each regular file in name
+// order
+func (s *yamlDirStore) walkFiles(visit func(fileName string, fi os.FileInfo)) error {
+	return filepath.Walk(s.dir, func(fileName string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if fileName != s.dir && os.IsNotExist(err) {
+				return nil // removed meanwhile
+			}
+			return err
+		}
+		if fi.IsDir() {
+			if fileName != s.dir && !isCfgSubDir(fi.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fi.Mode().IsRegular() {
+			visit(fileName, fi)
+		}
+		return nil
+	})
+}
+
+// whether a file is under the config dir
+func (s *yamlDirStore) contains(fileName string) bool {
+	rel, err := filepath.Rel(s.dir, fileName)
+	return err == nil && rel != "." && !strings.HasPrefix(rel, "..")
+}
+
+// id of an archived config file, its path relative to the config dir
+func (s *yamlDirStore) archiveID(fileName string) string {
+	rel, err := filepath.Rel(s.dir, fileName)
+	if err != nil {
+		return filepath.Base(fileName)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// write a file atomically, by writing a temp file in the same dir, with
+// content synced to disk before renamed to the target file name
+func writeFileAtomic(fileName string, data []byte, perm os.FileMode) error {
+	d, f := filepath.Split(fileName)
+	tmpf, err := ioutil.TempFile(d, "."+f+".tmp-")
+	if err != nil {
+		return err
+	}
+	tmpFileName := tmpf.Name()
+	defer os.Remove(tmpFileName) // in case not renamed
+	if _, err := tmpf.Write(data); err != nil {
+		tmpf.Close()
+		return err
+	}
+	if err := tmpf.Sync(); err != nil {
+		tmpf.Close()
+		return err
+	}
+	if err := tmpf.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpFileName, perm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFileName, fileName); err != nil {
+		return err
+	}
+	// sync the dir so the rename is durable
+	if dirf, err := os.Open(filepath.Clean(d)); err == nil {
+		dirf.Sync()
+		dirf.Close()
+	}
+	return nil
+}
+
+// read a compute node config file, a problem is returned for a file not
+// qualified as a compute node config, nil for all if the file doesn't exist
+func (s *yamlDirStore) readCfgFile(fileName string) (cfg *ComputeNodeCfg, problem error, err error) {
+	fi, err := os.Stat(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			s.mutex.Lock()
+			delete(s.parsed, fileName)
+			s.mutex.Unlock()
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+
+	s.mutex.Lock()
+	cfg = s.parsed[fileName]
+	s.mutex.Unlock()
+	if cfg != nil && cfg.FileTime.Equal(fi.ModTime()) && int64(len(cfg.RawYaml)) == fi.Size() {
+		// not modified since parsed
+		return cfg, nil, nil
+	}
+
+	// file exists, either manually created or modified,
+	// do a fresh load
+	rawYaml, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg, problem = ParseComputeNodeCfg(rawYaml)
+	if problem != nil {
+		return nil, errors.Wrapf(problem, "bad config file [%s]", fileName), nil
+	}
+	cfg.FileName, cfg.FileTime = fileName, fi.ModTime()
+
+	s.mutex.Lock()
+	s.parsed[fileName] = cfg
+	s.mutex.Unlock()
+	return cfg, nil, nil
+}
+
+// archived config file name in form of ~<file>.<reason>-<timestamp>
+func archivedFileName(fileName, reason string, t time.Time) string {
+	d, f := filepath.Split(fileName)
+	return fmt.Sprintf("%s~%s.%s-%s", d, f, reason, t.Format(archiveTimeFormat))
+}
+
+const archiveTimeFormat = "20060102150405"
+
+// parse reason and time from an archived config file name
+func parseArchivedFileName(fn string) (reason string, t time.Time, ok bool) {
+	if !strings.HasPrefix(fn, "~") {
+		return
+	}
+	dot := strings.LastIndexByte(fn, '.')
+	if dot < 0 {
+		return
+	}
+	dash := strings.LastIndexByte(fn[dot:], '-')
+	if dash < 0 {
+		return
+	}
+	t, err := time.ParseInLocation(archiveTimeFormat, fn[dot+dash+1:], time.Local)
+	if err != nil {
+		return
+	}
+	return fn[dot+1 : dot+dash], t, true
+}
+
+// metadata of an archived config file, kept in the state dir
+func (s *yamlDirStore) archiveMetaFileName(id string) string {
+	return filepath.Join(s.stateDir, "archive", filepath.FromSlash(id)+".json")
+}
+
+func (s *yamlDirStore) writeArchiveMeta(ac ArchivedCfg) {
+	ac.RawYaml = ""
+	data, err := json.Marshal(ac)
+	if err == nil {
+		metaFileName := s.archiveMetaFileName(ac.ID)
+		if err = os.MkdirAll(filepath.Dir(metaFileName), 0755); err == nil {
+			err = writeFileAtomic(metaFileName, data, 0644)
+		}
+	}
+	if err != nil {
+		glog.Errorf("Failed recording metadata of archived config [%s]: %+v", ac.ID, err)
+	}
+}
+
+func (s *yamlDirStore) archiveFile(fileName, mac, reason, detail string) error {
+	now := time.Now()
+	archiveFileName := archivedFileName(fileName, reason, now)
+	glog.Infof("Renaming config file from [%s] to [%s] as %s ...",
+		fileName, archiveFileName, reason)
+	if err := os.Rename(fileName, archiveFileName); err != nil {
+		return err
+	}
+	s.writeArchiveMeta(ArchivedCfg{
+		ID: s.archiveID(archiveFileName), Mac: mac,
+		Reason: reason, Detail: detail, Time: now,
+	})
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.parsed, fileName)
+	for mac, fn := range s.files {
+		if fn == fileName {
+			delete(s.files, mac)
+		}
+	}
+	return nil
+}
+
+// resolve file name of an archived config, always inside the config dir
+func (s *yamlDirStore) archivedFileName(id string) (string, error) {
+	rel := filepath.Clean(filepath.FromSlash(id))
+	if _, _, ok := parseArchivedFileName(filepath.Base(rel)); !ok ||
+		filepath.IsAbs(rel) || strings.HasPrefix(rel, "..") {
+		return "", errors.Errorf("invalid archived config id [%s]", id)
+	}
+	return filepath.Join(s.dir, rel), nil
+}
+
+func (s *yamlDirStore) readArchived(id string, withRaw bool) (*ArchivedCfg, error) {
+	fileName, err := s.archivedFileName(id)
+	if err != nil {
+		return nil, err
+	}
+	rawYaml, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var ac ArchivedCfg
+	if data, err := ioutil.ReadFile(s.archiveMetaFileName(id)); err == nil {
+		if err := json.Unmarshal(data, &ac); err != nil {
+			glog.Warningf("Bad metadata of archived config [%s]: %+v", id, err)
+		}
+	}
+	ac.ID = id
+	if len(ac.Reason) <= 0 {
+		// archived before metadata recorded, or by hand
+		ac.Reason, ac.Time, _ = parseArchivedFileName(filepath.Base(fileName))
+	}
+	if len(ac.Mac) <= 0 {
+		if cfg, err := ParseComputeNodeCfg(rawYaml); err == nil {
+			ac.Mac = cfg.Mac
+		}
+	}
+	if withRaw {
+		ac.RawYaml = string(rawYaml)
+	}
+	return &ac, nil
+}
+
+func (s *yamlDirStore) ListArchived() ([]ArchivedCfg, error) {
+	var acs []ArchivedCfg
+	if err := s.walkFiles(func(fileName string, fi os.FileInfo) {
+		if _, _, ok := parseArchivedFileName(fi.Name()); !ok {
+			return
+		}
+		id := s.archiveID(fileName)
+		ac, err := s.readArchived(id, false)
+		if err != nil {
+			glog.Warningf("Error reading archived config [%s]: %+v", id, err)
+			return
+		}
+		if ac != nil {
+			acs = append(acs, *ac)
+		}
+	}); err != nil {
+		return nil, err
+	}
+	sort.Slice(acs, func(i, j int) bool {
+		return acs[i].Time.Before(acs[j].Time)
+	})
+	return acs, nil
+}
+
+func (s *yamlDirStore) LoadArchived(id string) (*ArchivedCfg, error) {
+	return s.readArchived(id, true)
+}
+
+func (s *yamlDirStore) RestoreArchived(id string, rawYaml []byte) (*ComputeNodeCfg, error) {
+	ac, err := s.readArchived(id, true)
+	if err != nil {
+		return nil, err
+	}
+	if ac == nil {
+		return nil, errors.Errorf("no archived config [%s]", id)
+	}
+	if rawYaml == nil {
+		rawYaml = []byte(ac.RawYaml)
+	}
+	cfg, err := ParseComputeNodeCfg(rawYaml)
+	if err != nil {
+		return nil, err
+	}
+	fileName, err := s.cfgFileName(cfg.Mac)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(fileName); err == nil {
+		return nil, errors.Errorf("mac=[%s] has an active config [%s]", cfg.Mac, fileName)
+	}
+	if cfg, err = s.SaveCfg(cfg.Mac, rawYaml); err != nil {
+		return nil, err
+	}
+	if err := s.PurgeArchived(id); err != nil {
+		glog.Errorf("Failed removing restored archive [%s]: %+v", id, err)
+	}
+	return cfg, nil
+}
+
+func (s *yamlDirStore) PurgeArchived(id string) error {
+	fileName, err := s.archivedFileName(id)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(s.archiveMetaFileName(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *yamlDirStore) PutArchived(ac ArchivedCfg) error {
+	fileKey := "unknown"
+	if len(ac.Mac) > 0 {
+		fileKey = macFileKey(ac.Mac)
+	}
+	fileName := archivedFileName(filepath.Join(s.dir, fileKey+".yaml"), ac.Reason, ac.Time)
+	if err := writeFileAtomic(fileName, []byte(ac.RawYaml), 0644); err != nil {
+		return err
+	}
+	ac.ID = s.archiveID(fileName)
+	s.writeArchiveMeta(ac)
+	return nil
+}
+
+func (s *yamlDirStore) noteCfgFile(cfg *ComputeNodeCfg) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.files[cfg.Mac] = cfg.FileName
+}
+
+func (s *yamlDirStore) LoadCfgs() ([]*ComputeNodeCfg, error) {
+	return s.loadCfgs(true)
+}
+
+// config files are read and parsed in parallel, unmodified ones are reused,
+// bogus ones are archived if asked, or skipped as is otherwise
+func (s *yamlDirStore) loadCfgs(archiveBogons bool) ([]*ComputeNodeCfg, error) {
+	var fileNames []string
+	if err := s.walkFiles(func(fileName string, fi os.FileInfo) {
+		if isComputeNodeCfgFile(fi.Name()) {
+			fileNames = append(fileNames, fileName)
+		}
+	}); err != nil {
+		return nil, errors.Errorf("Error listing dir: "+s.dir+"\n%+v", err)
+	}
+
+	loaded := make([]*ComputeNodeCfg, len(fileNames))
+	fileIdxs := make(chan int)
+	var wg sync.WaitGroup
+	for w := runtime.NumCPU(); w > 0; w-- {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for fi := range fileIdxs {
+				loaded[fi] = s.loadCfgFile(fileNames[fi], archiveBogons)
+			}
+		}()
+	}
+	for fi := range fileNames {
+		fileIdxs <- fi
+	}
+	close(fileIdxs)
+	wg.Wait()
+
+	// in name order, the first file wins if multiple ones carry the same mac
+	noted := make(map[string]bool, len(loaded))
+	cfgs := make([]*ComputeNodeCfg, 0, len(loaded))
+	for _, cfg := range loaded {
+		if cfg == nil {
+			continue
+		}
+		if !noted[cfg.Mac] {
+			s.noteCfgFile(cfg)
+			noted[cfg.Mac] = true
+		}
+		cfgs = append(cfgs, cfg)
+	}
+	return cfgs, nil
+}
+
+// load a config file during full loading, a bogus one is archived if asked,
+// nil is returned on any failure
+func (s *yamlDirStore) loadCfgFile(fileName string, archiveBogon bool) *ComputeNodeCfg {
+	// if a single cfg file is to cause panic, ignore it with proper log, other things continue
+	defer func() {
+		if e := recover(); e != nil {
+			glog.Errorf("Error loading compute node cfg file [%s]\n%+v", fileName, e)
+		}
+	}()
+	cfg, problem, err := s.readCfgFile(fileName)
+	if err != nil {
+		panic(err)
+	}
+	if problem != nil {
+		glog.Warningf("Problem detected: %+v", problem)
+		if !archiveBogon {
+			return nil
+		}
+		if err := s.archiveFile(fileName, "", "bogon", problem.Error()); err != nil {
+			panic(err)
+		}
+		return nil
+	}
+	return cfg
+}
+
+func (s *yamlDirStore) LoadCfg(mac string) (*ComputeNodeCfg, error) {
+	fileName, err := s.cfgFileName(mac)
+	if err != nil {
+		return nil, err
+	}
+	cfg, problem, err := s.readCfgFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if problem == nil && cfg != nil && cfg.Mac != mac {
+		problem = errors.Errorf(
+			"invalid mac=[%s] vs [%s] in config file [%s]",
+			cfg.Mac, mac, fileName,
+		)
+	}
+	if problem != nil {
+		glog.Warningf("Problem detected: %+v", problem)
+		return nil, &BogusCfgError{Mac: mac, Problem: problem}
+	}
+	if cfg != nil {
+		s.noteCfgFile(cfg)
+	}
+	return cfg, nil
+}
+
+func (s *yamlDirStore) SaveCfg(mac string, rawYaml []byte) (*ComputeNodeCfg, error) {
+	fileName, err := s.cfgFileName(mac)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(fileName, rawYaml, 0644); err != nil {
+		return nil, err
+	}
+	cfg, problem, err := s.readCfgFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if problem != nil {
+		return nil, problem
+	}
+	if cfg == nil {
+		return nil, errors.Errorf("config file [%s] disappeared after written", fileName)
+	}
+	s.noteCfgFile(cfg)
+	return cfg, nil
+}
+
+// all new contents are written to temp files first, then renamed into place,
+// files already renamed are restored with old contents if a later one fails
+func (s *yamlDirStore) SaveCfgs(rawYamls map[string][]byte) ([]*ComputeNodeCfg, error) {
+	type staged struct {
+		mac, fileName, tmpFileName string
+		oldData                    []byte
+	}
+	var stagedFiles []staged
+	defer func() {
+		for _, sf := range stagedFiles {
+			os.Remove(sf.tmpFileName) // in case not renamed
+		}
+	}()
+	for mac, rawYaml := range rawYamls {
+		fileName, err := s.cfgFileName(mac)
+		if err != nil {
+			return nil, err
+		}
+		oldData, err := ioutil.ReadFile(fileName)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		d, f := filepath.Split(fileName)
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return nil, err
+		}
+		tmpf, err := ioutil.TempFile(d, "."+f+".tmp-")
+		if err != nil {
+			return nil, err
+		}
+		stagedFiles = append(stagedFiles, staged{mac, fileName, tmpf.Name(), oldData})
+		_, err = tmpf.Write(rawYaml)
+		if err == nil {
+			err = tmpf.Sync()
+		}
+		if e := tmpf.Close(); err == nil {
+			err = e
+		}
+		if err == nil {
+			err = os.Chmod(tmpf.Name(), 0644)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed staging config file [%s]", fileName)
+		}
+	}
+
+	for si, sf := range stagedFiles {
+		if err := os.Rename(sf.tmpFileName, sf.fileName); err != nil {
+			for _, rf := range stagedFiles[:si] {
+				if rf.oldData == nil {
+					os.Remove(rf.fileName)
+				} else if e := writeFileAtomic(rf.fileName, rf.oldData, 0644); e != nil {
+					glog.Errorf("Failed restoring config file [%s]: %+v", rf.fileName, e)
+				}
+			}
+			return nil, errors.Wrapf(err, "failed saving config file [%s]", sf.fileName)
+		}
+	}
+	synced := make(map[string]bool)
+	for _, sf := range stagedFiles {
+		d := filepath.Dir(sf.fileName)
+		if synced[d] {
+			continue
+		}
+		if dirf, err := os.Open(d); err == nil {
+			dirf.Sync()
+			dirf.Close()
+		}
+		synced[d] = true
+	}
+
+	cfgs := make([]*ComputeNodeCfg, 0, len(stagedFiles))
+	for _, sf := range stagedFiles {
+		cfg, problem, err := s.readCfgFile(sf.fileName)
+		if err != nil {
+			return nil, err
+		}
+		if problem != nil {
+			return nil, problem
+		}
+		if cfg == nil {
+			return nil, errors.Errorf("config file [%s] disappeared after written", sf.fileName)
+		}
+		s.noteCfgFile(cfg)
+		cfgs = append(cfgs, cfg)
+	}
+	return cfgs, nil
+}
+
+func (s *yamlDirStore) ArchiveCfg(mac string, reason, detail string) error {
+	fileName, err := s.cfgFileName(mac)
+	if err != nil {
+		return err
+	}
+	if err := s.archiveFile(fileName, mac, reason, detail); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// not really atomic, but renaming of corpses is reverted in case the new
+// config fails to be written
+func (s *yamlDirStore) AssignLease(lease Lease, rawYaml []byte, reclaimFrom []string) (*ComputeNodeCfg, error) {
+	now := time.Now()
+	corpses := make(map[string]string, len(reclaimFrom))
+	corpseMacs := make(map[string]string, len(reclaimFrom))
+	revertCorpses := func() {
+		for corpseArchived, corpseFileName := range corpses {
+			if e := os.Rename(corpseArchived, corpseFileName); e != nil {
+				glog.Errorf("Failed reverting corpse config file [%s] to [%s]: %+v",
+					corpseArchived, corpseFileName, e)
+			}
+		}
+	}
+	for _, deadMac := range reclaimFrom {
+		corpseFileName, err := s.cfgFileName(deadMac)
+		if err != nil {
+			revertCorpses()
+			return nil, err
+		}
+		corpseArchived := archivedFileName(corpseFileName, "corpse", now)
+		glog.Infof("To reuse ip=[%s], the old config file is to be renamed from [%s] to [%s] ...",
+			lease.IP, corpseFileName, corpseArchived)
+		if err := os.Rename(corpseFileName, corpseArchived); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			revertCorpses()
+			return nil, err
+		}
+		corpses[corpseArchived] = corpseFileName
+		corpseMacs[corpseArchived] = deadMac
+	}
+
+	cfg, err := s.SaveCfg(lease.Mac, rawYaml)
+	if err != nil {
+		revertCorpses()
+		return nil, err
+	}
+
+	for corpseArchived, deadMac := range corpseMacs {
+		s.writeArchiveMeta(ArchivedCfg{
+			ID: s.archiveID(corpseArchived), Mac: deadMac,
+			Reason: "corpse", Detail: "ip " + lease.IP + " reused by mac=" + lease.Mac, Time: now,
+		})
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, deadMac := range reclaimFrom {
+		delete(s.files, deadMac)
+	}
+	return cfg, nil
+}
+
+func (s *yamlDirStore) ListLeases() ([]Lease, error) {
+	// a bogus file may be in the middle of a hand edit, leave it to the
+	// startup load to archive
+	cfgs, err := s.loadCfgs(false)
+	if err != nil {
+		return nil, err
+	}
+	leases := make([]Lease, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		leases = append(leases, cfgLease(cfg))
+	}
+	return leases, nil
+}
+
+func (s *yamlDirStore) alivenessFileName() string {
+	return filepath.Join(s.stateDir, "aliveness.json")
+}
+
+func (s *yamlDirStore) SaveAliveness(states []IpAliveness) error {
+	data, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.alivenessFileName(), data, 0644)
+}
+
+func (s *yamlDirStore) LoadAliveness() ([]IpAliveness, error) {
+	data, err := ioutil.ReadFile(s.alivenessFileName())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var states []IpAliveness
+	if err := json.Unmarshal(data, &states); err != nil {
+		return nil, err
+	}
+	return states, nil
+}
+
+func (s *yamlDirStore) historyFileName(mac string) (string, error) {
+	normMac, err := NormalizeMac(mac)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.stateDir, "history", macFileKey(normMac)+".jsonl"), nil
+}
+
+// a history file is rotated once grown over this size, with only one previous
+// generation kept, as <file>.1
+const maxHistoryFileSize = 512 << 10
+
+func (s *yamlDirStore) AppendHistory(evt HistoryEvent) error {
+	data, err := json.Marshal(evt)
+	if err != nil {
+		return err
+	}
+
+	fileName, err := s.historyFileName(evt.Mac)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	f, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	fi, err := f.Stat()
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if fi.Size() > maxHistoryFileSize {
+		if err := os.Rename(fileName, fileName+".1"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readHistoryFile(fileName string) ([]HistoryEvent, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var evts []HistoryEvent
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var evt HistoryEvent
+		if err := json.Unmarshal(scanner.Bytes(), &evt); err != nil {
+			glog.Warningf("Bad history record in [%s]: %+v", fileName, err)
+			continue
+		}
+		evts = append(evts, evt)
+	}
+	return evts, scanner.Err()
+}
+
+func (s *yamlDirStore) ListHistory(mac string, limit int) ([]HistoryEvent, error) {
+	var fileNames []string
+	if len(mac) > 0 {
+		fileName, err := s.historyFileName(mac)
+		if err != nil {
+			return nil, err
+		}
+		fileNames = []string{fileName}
+	} else {
+		// a rotated file may be there alone, till the next event appended
+		matches, err := filepath.Glob(filepath.Join(s.stateDir, "history", "*.jsonl*"))
+		if err != nil {
+			return nil, err
+		}
+		seen := make(map[string]bool, len(matches))
+		for _, fileName := range matches {
+			fileName = strings.TrimSuffix(fileName, ".1")
+			if strings.HasSuffix(fileName, ".jsonl") && !seen[fileName] {
+				seen[fileName] = true
+				fileNames = append(fileNames, fileName)
+			}
+		}
+	}
+
+	var evts []HistoryEvent
+	for _, fileName := range fileNames {
+		// the rotated generation first
+		for _, fn := range []string{fileName + ".1", fileName} {
+			fileEvts, err := readHistoryFile(fn)
+			if err != nil {
+				return nil, err
+			}
+			evts = append(evts, fileEvts...)
+		}
+	}
+	sort.SliceStable(evts, func(i, j int) bool {
+		return evts[i].Time.Before(evts[j].Time)
+	})
+	if limit > 0 && len(evts) > limit {
+		evts = evts[len(evts)-limit:]
+	}
+	return evts, nil
+}
+
+func (s *yamlDirStore) SaveInventory(inv agent.Inventory) error {
+	normMac, err := NormalizeMac(inv.Mac)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(inv, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(s.stateDir, "inventory", macFileKey(normMac)+".json"), data, 0644)
+}
+
+func (s *yamlDirStore) LoadInventories() ([]agent.Inventory, error) {
+	fileNames, err := filepath.Glob(filepath.Join(s.stateDir, "inventory", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	invs := make([]agent.Inventory, 0, len(fileNames))
+	for _, fileName := range fileNames {
+		data, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return nil, err
+		}
+		var inv agent.Inventory
+		if err := json.Unmarshal(data, &inv); err != nil {
+			glog.Warningf("Bad inventory record [%s]: %+v", fileName, err)
+			continue
+		}
+		invs = append(invs, inv)
+	}
+	return invs, nil
+}
+
+func (s *yamlDirStore) SaveBootSnapshot(snap BootSnapshot) error {
+	normMac, err := NormalizeMac(snap.Mac)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(s.stateDir, "boots", macFileKey(normMac)+".json"), data, 0644)
+}
+
+func (s *yamlDirStore) LoadBootSnapshots() ([]BootSnapshot, error) {
+	fileNames, err := filepath.Glob(filepath.Join(s.stateDir, "boots", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	snaps := make([]BootSnapshot, 0, len(fileNames))
+	for _, fileName := range fileNames {
+		data, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return nil, err
+		}
+		var snap BootSnapshot
+		if err := json.Unmarshal(data, &snap); err != nil {
+			glog.Warningf("Bad boot snapshot [%s]: %+v", fileName, err)
+			continue
+		}
+		snaps = append(snaps, snap)
+	}
+	return snaps, nil
+}
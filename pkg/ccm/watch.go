@@ -0,0 +1,184 @@
+package ccm
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/complyue/hbi/pkg/errors"
+	"github.com/fsnotify/fsnotify"
+	"github.com/golang/glog"
+)
+
+const (
+	etcDir = "etc"
+
+	// wait for a file to settle before reloading it, editors and config
+	// management tools tend to write a file in multiple steps
+	cfgSettleDelay = 500 * time.Millisecond
+)
+
+// a config file failed reloading, the last good config is still in effect
+type CfgReloadError struct {
+	FileName string
+	Time     time.Time
+	Err      string
+}
+
+var (
+	cfgReloaders = map[string]func() error{
+		pulseCfgFile:  ReloadPulseCfg,
+		cnodeTmplFile: ReloadCnodeTmpl,
+	}
+	cfgReloadErrors = make(map[string]CfgReloadError)
+	cfgReloadMutex  sync.Mutex
+)
+
+// register a function to reload a config file under etc/ once it's changed
+// on disk, the function should validate the new content and keep the last
+// good config in effect on error
+func RegisterCfgReloader(fileName string, reload func() error) {
+	cfgReloadMutex.Lock()
+	defer cfgReloadMutex.Unlock()
+
+	cfgReloaders[filepath.Clean(fileName)] = reload
+}
+
+// config files currently failing reload, sorted by file name
+func ListCfgReloadErrors() []CfgReloadError {
+	cfgReloadMutex.Lock()
+	defer cfgReloadMutex.Unlock()
+
+	errs := make([]CfgReloadError, 0, len(cfgReloadErrors))
+	for _, re := range cfgReloadErrors {
+		errs = append(errs, re)
+	}
+	sort.Slice(errs, func(i, j int) bool {
+		return errs[i].FileName < errs[j].FileName
+	})
+	return errs
+}
+
+func reloadCfgFile(fileName string) {
+	var reload func() error
+	if ys, ok := getStore().(*yamlDirStore); ok && ys.contains(fileName) {
+		if !isComputeNodeCfgFile(filepath.Base(fileName)) {
+			return
+		}
+		reload = func() error {
+			return RefreshComputeNodeCfgFile(fileName)
+		}
+	} else {
+		cfgReloadMutex.Lock()
+		reload = cfgReloaders[fileName]
+		cfgReloadMutex.Unlock()
+		if reload == nil {
+			return
+		}
+	}
+
+	var err error
+	func() {
+		defer func() {
+			if e := recover(); e != nil {
+				err = errors.Errorf("%+v", e)
+			}
+		}()
+		err = reload()
+	}()
+
+	cfgReloadMutex.Lock()
+	defer cfgReloadMutex.Unlock()
+
+	if err != nil {
+		glog.Errorf("Error reloading config file [%s], last good config kept:\n%+v", fileName, err)
+		cfgReloadErrors[fileName] = CfgReloadError{
+			FileName: fileName, Time: time.Now(), Err: err.Error(),
+		}
+	} else {
+		glog.V(1).Infof("Config file [%s] reloaded.", fileName)
+		delete(cfgReloadErrors, fileName)
+	}
+}
+
+// watch config files under etc/ for changes on disk, and reload them
+func WatchCfgFiles() error {
+	dirs := []string{etcDir}
+	ys, _ := getStore().(*yamlDirStore)
+	if ys != nil {
+		// compute node configs are watched only with yaml store
+		if err := filepath.Walk(ys.dir, func(fileName string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if fi.IsDir() {
+				if fileName != ys.dir && !isCfgSubDir(fi.Name()) {
+					return filepath.SkipDir
+				}
+				dirs = append(dirs, fileName)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return err
+		}
+	}
+
+	go func() {
+		defer watcher.Close()
+
+		settled := make(chan string, 100)
+		settling := make(map[string]*time.Timer)
+		for {
+			select {
+			case evt, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if evt.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Remove|fsnotify.Rename) == 0 {
+					continue
+				}
+				fileName := filepath.Clean(evt.Name)
+				if evt.Op&fsnotify.Create != 0 && ys != nil && ys.contains(fileName) {
+					if fi, err := os.Stat(fileName); err == nil && fi.IsDir() {
+						// a new shard subdirectory
+						if isCfgSubDir(fi.Name()) {
+							if err := watcher.Add(fileName); err != nil {
+								glog.Errorf("Error watching dir [%s]: %+v", fileName, err)
+							}
+						}
+						continue
+					}
+				}
+				if t, ok := settling[fileName]; ok {
+					t.Reset(cfgSettleDelay)
+				} else {
+					settling[fileName] = time.AfterFunc(cfgSettleDelay, func() {
+						settled <- fileName
+					})
+				}
+			case fileName := <-settled:
+				delete(settling, fileName)
+				reloadCfgFile(fileName)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				glog.Errorf("Error watching config files: %+v", err)
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,74 @@
+package cloudinit
+
+import (
+	"io/ioutil"
+	"sync"
+
+	"github.com/complyue/hbi/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+const CloudInitCfgFile = "etc/cloudinit.yaml"
+
+type CloudInitCfg struct {
+	// directory of data templates, with overrides for groups in its
+	// subdirectories named by group
+	TemplatesDir string `yaml:"templatesDir"`
+
+	// identify nodes by source ip of requests, besides tokens in url
+	BySourceIP bool `yaml:"bySourceIP"`
+
+	// key to derive per node tokens with, generated if not existing
+	TokenKeyFile string `yaml:"tokenKeyFile"`
+}
+
+var (
+	cloudInitCfg      *CloudInitCfg
+	cloudInitCfgMutex sync.Mutex
+)
+
+func loadCloudInitCfg() (*CloudInitCfg, error) {
+	cfgRawYaml, err := ioutil.ReadFile(CloudInitCfgFile)
+	if err != nil {
+		return nil, err
+	}
+	var cfgYaml CloudInitCfg
+	if err = yaml.Unmarshal(cfgRawYaml, &cfgYaml); err != nil {
+		return nil, err
+	}
+	if len(cfgYaml.TemplatesDir) <= 0 {
+		return nil, errors.Errorf("no templatesDir in [%s]", CloudInitCfgFile)
+	}
+	if len(cfgYaml.TokenKeyFile) <= 0 {
+		return nil, errors.Errorf("no tokenKeyFile in [%s]", CloudInitCfgFile)
+	}
+	return &cfgYaml, nil
+}
+
+func GetCloudInitCfg() *CloudInitCfg {
+	cloudInitCfgMutex.Lock()
+	defer cloudInitCfgMutex.Unlock()
+
+	if nil == cloudInitCfg {
+		cfg, err := loadCloudInitCfg()
+		if err != nil {
+			panic(err)
+		}
+		cloudInitCfg = cfg
+	}
+	return cloudInitCfg
+}
+
+// reload cloud-init cfg from file, the last good one is kept on error
+func ReloadCloudInitCfg() error {
+	cfg, err := loadCloudInitCfg()
+	if err != nil {
+		return err
+	}
+
+	cloudInitCfgMutex.Lock()
+	defer cloudInitCfgMutex.Unlock()
+
+	cloudInitCfg = cfg
+	return nil
+}
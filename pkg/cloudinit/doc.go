@@ -0,0 +1,2 @@
+// cloud-init NoCloud data source for compute nodes, served over http
+package cloudinit
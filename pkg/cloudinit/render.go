@@ -0,0 +1,117 @@
+package cloudinit
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/complyue/different-hpc/pkg/ccm"
+	"github.com/complyue/different-hpc/pkg/remote"
+	"github.com/complyue/hbi/pkg/errors"
+	"github.com/golang/glog"
+	"gopkg.in/yaml.v2"
+)
+
+// files of NoCloud data source, as fetched by cloud-init from the seed url
+var DataFiles = map[string]bool{
+	"meta-data": true, "user-data": true, "vendor-data": true, "network-config": true,
+}
+
+func yamlValue(v interface{}) (string, error) {
+	out, err := yaml.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
+
+var tmplFuncs = template.FuncMap{
+	// a string or sequence config value as a list
+	"list": func(v interface{}) []string {
+		switch v := v.(type) {
+		case string:
+			if len(v) <= 0 {
+				return nil
+			}
+			return []string{v}
+		case []string:
+			return v
+		}
+		return nil
+	},
+	// split a string by spaces
+	"split": strings.Fields,
+	// a value in yaml, e.g. quoted as necessary
+	"yaml": yamlValue,
+	// a sequence in yaml flow style
+	"flow": func(vs []string) (string, error) {
+		elems := make([]string, 0, len(vs))
+		for _, v := range vs {
+			elem, err := yamlValue(v)
+			if err != nil {
+				return "", err
+			}
+			elems = append(elems, elem)
+		}
+		return "[" + strings.Join(elems, ", ") + "]", nil
+	},
+}
+
+// template file of a data file for a compute node, the one for the first
+// group of the node having it, or the default one
+func tmplFileOf(cfgd map[string]interface{}, file string) (string, error) {
+	dir := GetCloudInitCfg().TemplatesDir
+	for _, group := range ccm.CfgGroups(cfgd) {
+		if strings.ContainsAny(group, `/\`) || strings.HasPrefix(group, ".") {
+			continue
+		}
+		fileName := filepath.Join(dir, group, file)
+		if _, err := os.Stat(fileName); err == nil {
+			return fileName, nil
+		}
+	}
+	fileName := filepath.Join(dir, file)
+	if _, err := os.Stat(fileName); err != nil {
+		return "", err
+	}
+	return fileName, nil
+}
+
+// render a NoCloud data file for a compute node, from its inflated config
+func Render(cfg *ccm.ComputeNodeCfg, file string) ([]byte, error) {
+	if !DataFiles[file] {
+		return nil, errors.Errorf("unknown data file [%s]", file)
+	}
+	cfgd, err := cfg.InflateE()
+	if err != nil {
+		return nil, err
+	}
+	fileName, err := tmplFileOf(cfgd, file)
+	if err != nil {
+		return nil, err
+	}
+	text, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New(fileName).Funcs(tmplFuncs).Parse(string(text))
+	if err != nil {
+		return nil, errors.Wrapf(err, "bad template [%s]", fileName)
+	}
+
+	cfgd["groups"] = ccm.CfgGroups(cfgd)
+	if pubKey, err := remote.PublicKey(); err != nil {
+		glog.Errorf("Error getting control center public key: %+v", err)
+	} else {
+		cfgd["cc_pubkey"] = strings.TrimSpace(pubKey)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := tmpl.Execute(buf, cfgd); err != nil {
+		return nil, errors.Wrapf(err, "failed rendering [%s] for mac=[%s]", fileName, cfg.Mac)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,124 @@
+package cloudinit
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/complyue/different-hpc/pkg/ccm"
+	"github.com/complyue/hbi/pkg/errors"
+	"github.com/golang/glog"
+)
+
+// variable in compute node configs for the token of the node, to be put in
+// its kernel cmdline like:
+//
+//	ds=nocloud;s=http://<dhpc-cc>/cloudinit/v1/t/{{.cloudinit_token}}/
+const TokenCfgVar = "cloudinit_token"
+
+var (
+	tokenKey      []byte
+	tokenKeyFile  string
+	tokenKeyMutex sync.Mutex
+)
+
+// the key tokens derived with, loaded from tokenKeyFile, generated if not
+// existing
+func getTokenKey() ([]byte, error) {
+	keyFile := GetCloudInitCfg().TokenKeyFile
+
+	tokenKeyMutex.Lock()
+	defer tokenKeyMutex.Unlock()
+
+	if tokenKey != nil && tokenKeyFile == keyFile {
+		return tokenKey, nil
+	}
+	keyHex, err := ioutil.ReadFile(keyFile)
+	if os.IsNotExist(err) {
+		key := make([]byte, 32)
+		if _, err = rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err = os.MkdirAll(filepath.Dir(keyFile), 0700); err != nil {
+			return nil, err
+		}
+		keyHex = []byte(hex.EncodeToString(key))
+		if err = ioutil.WriteFile(keyFile, keyHex, 0600); err != nil {
+			return nil, err
+		}
+		glog.Infof("Generated cloud-init token key [%s].", keyFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(keyHex)))
+	if err != nil || len(key) < 16 {
+		return nil, errors.Errorf("bad token key in [%s]", keyFile)
+	}
+	tokenKey, tokenKeyFile = key, keyFile
+	return tokenKey, nil
+}
+
+func tokenMAC(key []byte, mac string) string {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(mac))
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// token identifying a compute node to the metadata service, in form of
+// <mac with dashes>.<hmac of mac>
+func Token(mac string) (string, error) {
+	key, err := getTokenKey()
+	if err != nil {
+		return "", err
+	}
+	return strings.Replace(mac, ":", "-", -1) + "." + tokenMAC(key, mac), nil
+}
+
+// mac of the compute node a token is for, an error if the token is invalid
+func MacOfToken(token string) (string, error) {
+	dot := strings.IndexByte(token, '.')
+	if dot < 0 {
+		return "", errors.New("malformed token")
+	}
+	mac, err := ccm.NormalizeMac(token[:dot])
+	if err != nil {
+		return "", err
+	}
+	key, err := getTokenKey()
+	if err != nil {
+		return "", err
+	}
+	if !hmac.Equal([]byte(token[dot+1:]), []byte(tokenMAC(key, mac))) {
+		return "", errors.Errorf("invalid token for mac=[%s]", mac)
+	}
+	return mac, nil
+}
+
+func init() {
+	ccm.RegisterCfgVar(TokenCfgVar, func(mac string) (token string) {
+		// configs inflate regardless of cloud-init set up or not, no token
+		// key to be generated without it
+		if _, err := os.Stat(CloudInitCfgFile); os.IsNotExist(err) {
+			return ""
+		}
+		defer func() {
+			if e := recover(); e != nil {
+				glog.Errorf("Error deriving cloud-init token of mac=[%s]: %+v", mac, e)
+				token = ""
+			}
+		}()
+		token, err := Token(mac)
+		if err != nil {
+			glog.Errorf("Error deriving cloud-init token of mac=[%s]: %+v", mac, err)
+			return ""
+		}
+		return token
+	})
+}
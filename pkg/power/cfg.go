@@ -0,0 +1,132 @@
+package power
+
+import (
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/complyue/hbi/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+const PowerCfgFile = "etc/power.yaml"
+
+type WolCfg struct {
+	// host:port magic packets are sent to
+	Broadcast string `yaml:"broadcast"`
+
+	// send from this network interface
+	Interface string `yaml:"interface"`
+
+	// SecureOn password, 6 hex bytes
+	SecureOn string `yaml:"secureOn"`
+
+	// delay between packets to different nodes
+	Stagger time.Duration `yaml:"stagger"`
+
+	// wake failed if not alive after this long
+	WakeTimeout time.Duration `yaml:"wakeTimeout"`
+}
+
+type RemedyCfg struct {
+	// remedy nodes once their death confirmed
+	Enabled bool `yaml:"enabled"`
+
+	// bmc/wol, the first one applicable to a node is used
+	Methods []string `yaml:"methods"`
+
+	// give up after this many attempts
+	Attempts int `yaml:"attempts"`
+
+	// wait this long after the first failed attempt, doubled after each
+	Backoff time.Duration `yaml:"backoff"`
+
+	// an attempt failed if the node is not alive after this long
+	AliveTimeout time.Duration `yaml:"aliveTimeout"`
+
+	// shell command run on giving up, with the node in environment
+	NotifyCmd string `yaml:"notifyCmd"`
+
+	// url to POST json of the node on giving up
+	NotifyURL string `yaml:"notifyURL"`
+}
+
+type PowerCfg struct {
+	Wol    WolCfg    `yaml:"wol"`
+	Remedy RemedyCfg `yaml:"remedy"`
+}
+
+var (
+	powerCfg      *PowerCfg
+	powerCfgMutex sync.Mutex
+)
+
+func loadPowerCfg() (*PowerCfg, error) {
+	cfgRawYaml, err := ioutil.ReadFile(PowerCfgFile)
+	if err != nil {
+		return nil, err
+	}
+	var cfgYaml PowerCfg
+	if err = yaml.Unmarshal(cfgRawYaml, &cfgYaml); err != nil {
+		return nil, err
+	}
+	wol := &cfgYaml.Wol
+	if len(wol.Broadcast) <= 0 && len(wol.Interface) <= 0 {
+		return nil, errors.Errorf("neither wol.broadcast nor wol.interface specified in [%s]", PowerCfgFile)
+	}
+	if len(wol.Broadcast) > 0 {
+		if _, _, err = net.SplitHostPort(wol.Broadcast); err != nil {
+			return nil, errors.Wrapf(err, "invalid wol.broadcast [%s] in [%s]", wol.Broadcast, PowerCfgFile)
+		}
+	}
+	if _, err = parseSecureOn(wol.SecureOn); err != nil {
+		return nil, errors.Wrapf(err, "invalid wol.secureOn in [%s]", PowerCfgFile)
+	}
+	if wol.WakeTimeout <= 0 {
+		return nil, errors.Errorf("invalid wol.wakeTimeout=%v in [%s]", wol.WakeTimeout, PowerCfgFile)
+	}
+	remedy := &cfgYaml.Remedy
+	for _, method := range remedy.Methods {
+		if "bmc" != method && "wol" != method {
+			return nil, errors.Errorf("unknown remedy method [%s] in [%s]", method, PowerCfgFile)
+		}
+	}
+	if remedy.Enabled {
+		if remedy.Attempts < 1 {
+			return nil, errors.Errorf("invalid remedy.attempts=%v in [%s]", remedy.Attempts, PowerCfgFile)
+		}
+		if remedy.AliveTimeout <= 0 {
+			return nil, errors.Errorf("invalid remedy.aliveTimeout=%v in [%s]", remedy.AliveTimeout, PowerCfgFile)
+		}
+	}
+	return &cfgYaml, nil
+}
+
+func GetPowerCfg() *PowerCfg {
+	powerCfgMutex.Lock()
+	defer powerCfgMutex.Unlock()
+
+	if nil == powerCfg {
+		cfg, err := loadPowerCfg()
+		if err != nil {
+			panic(err)
+		}
+		powerCfg = cfg
+	}
+	return powerCfg
+}
+
+// reload power cfg from file, the last good one is kept on error
+func ReloadPowerCfg() error {
+	cfg, err := loadPowerCfg()
+	if err != nil {
+		return err
+	}
+
+	powerCfgMutex.Lock()
+	defer powerCfgMutex.Unlock()
+
+	powerCfg = cfg
+	return nil
+}
@@ -0,0 +1,2 @@
+// power management of compute nodes through their BMCs
+package power
@@ -0,0 +1,83 @@
+package power
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// a node held off remediation, while its power owned by power actions,
+// wakes or rollouts
+type nodeHold struct {
+	// number of holders
+	count int
+	// why held by the latest holder
+	reason string
+}
+
+var (
+	holds     = make(map[string]*nodeHold)
+	holdMutex sync.Mutex
+)
+
+// hold a node off remediation till the returned func called
+func holdNode(mac, reason string) (release func()) {
+	holdMutex.Lock()
+	defer holdMutex.Unlock()
+
+	h := holds[mac]
+	if h == nil {
+		h = &nodeHold{}
+		holds[mac] = h
+	}
+	h.count++
+	h.reason = reason
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			holdMutex.Lock()
+			defer holdMutex.Unlock()
+
+			if h.count--; h.count <= 0 && holds[mac] == h {
+				delete(holds, mac)
+			}
+		})
+	}
+}
+
+// why a node is held off remediation, empty if not held
+func heldReason(mac string) string {
+	holdMutex.Lock()
+	defer holdMutex.Unlock()
+
+	if h := holds[mac]; h != nil {
+		return h.reason
+	}
+	return ""
+}
+
+// hold a node off remediation for a power action to be done to it. with the
+// action done, the hold lasts till the node is alive again, after booting if
+// reset or powered off, or the alive timeout of remediation passed. the
+// returned func is to be called with whether the action is done.
+func HoldForPower(mac, ip, action string) (done func(ok bool)) {
+	release := holdNode(mac, "power "+action)
+	return func(ok bool) {
+		if !ok || len(ip) <= 0 {
+			release()
+			return
+		}
+		// a node being reset or shut down may still respond for a while, it's
+		// only alive again after booting
+		requireBoot := Reset == action || Off == action || Shutdown == action
+		timeout := GetPowerCfg().Remedy.AliveTimeout
+		go func() {
+			defer release()
+			if _, aliveAt := awaitAlive(mac, ip, time.Now(), timeout, requireBoot, nil); aliveAt.IsZero() {
+				glog.V(1).Infof("Hold of mac=[%s] after power %s expired.", mac, action)
+			}
+		}()
+	}
+}
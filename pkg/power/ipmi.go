@@ -0,0 +1,90 @@
+package power
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/complyue/hbi/pkg/errors"
+)
+
+const ipmiTimeout = 30 * time.Second
+
+// power control through ipmitool over IPMI v2.0 lanplus
+type ipmi struct {
+	bmc *BMC
+}
+
+func newIpmi(bmc *BMC) *ipmi {
+	return &ipmi{bmc: bmc}
+}
+
+func (im *ipmi) run(args ...string) (string, error) {
+	host, port, err := net.SplitHostPort(im.bmc.Addr)
+	if err != nil {
+		// no port, maybe a bare ipv6 address
+		host, port = im.bmc.Addr, ""
+	}
+	cmdArgs := []string{"-I", "lanplus", "-H", host}
+	if len(port) > 0 {
+		cmdArgs = append(cmdArgs, "-p", port)
+	}
+	if len(im.bmc.User) > 0 {
+		cmdArgs = append(cmdArgs, "-U", im.bmc.User)
+	}
+	// password through env, not to be seen in process list
+	cmdArgs = append(cmdArgs, "-E")
+
+	ctx, cancel := context.WithTimeout(context.Background(), ipmiTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "ipmitool", append(cmdArgs, args...)...)
+	cmd.Env = append(os.Environ(), "IPMI_PASSWORD="+im.bmc.Password)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return "", errors.Errorf("ipmitool %s: %v %s", strings.Join(args, " "), err,
+			strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+func (im *ipmi) Status() (string, error) {
+	out, err := im.run("power", "status")
+	if err != nil {
+		return "", err
+	}
+	// Chassis Power is on
+	switch {
+	case strings.HasSuffix(out, " on"):
+		return "On", nil
+	case strings.HasSuffix(out, " off"):
+		return "Off", nil
+	}
+	return out, nil
+}
+
+func (im *ipmi) Do(action string) error {
+	if err := checkAction(action); err != nil {
+		return err
+	}
+	var args []string
+	switch action {
+	case On:
+		args = []string{"power", "on"}
+	case Off:
+		args = []string{"power", "off"}
+	case Shutdown:
+		args = []string{"power", "soft"}
+	case Reset:
+		args = []string{"power", "reset"}
+	case PxeOnce:
+		// without options=persistent, it only applies to next boot
+		args = []string{"chassis", "bootdev", "pxe"}
+	}
+	_, err := im.run(args...)
+	return err
+}
@@ -0,0 +1,50 @@
+package power
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const notifyTimeout = 30 * time.Second
+
+// notify that a node is marked faulty, by the configured command and/or url
+func notifyFaulty(mac, ip, host, reason string) {
+	rc := GetPowerCfg().Remedy
+
+	if len(rc.NotifyCmd) > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, "sh", "-c", rc.NotifyCmd)
+		cmd.Env = append(os.Environ(),
+			"DHPC_MAC="+mac, "DHPC_IP="+ip, "DHPC_HOST="+host, "DHPC_REASON="+reason)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			glog.Errorf("Error running notify command for mac=[%s]: %v\n%s", mac, err, out)
+		}
+	}
+
+	if len(rc.NotifyURL) > 0 {
+		body, err := json.Marshal(map[string]string{
+			"mac": mac, "ip": ip, "host": host, "reason": reason,
+		})
+		if err != nil {
+			panic(err)
+		}
+		client := &http.Client{Timeout: notifyTimeout}
+		resp, err := client.Post(rc.NotifyURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			glog.Errorf("Error notifying [%s] for mac=[%s]: %v", rc.NotifyURL, mac, err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			glog.Errorf("Error notifying [%s] for mac=[%s]: %s", rc.NotifyURL, mac, resp.Status)
+		}
+	}
+}
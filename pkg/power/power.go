@@ -0,0 +1,121 @@
+package power
+
+import (
+	"strings"
+
+	"github.com/complyue/different-hpc/pkg/ccm"
+	"github.com/complyue/hbi/pkg/errors"
+	"github.com/golang/glog"
+)
+
+// power actions
+const (
+	On       = "on"
+	Off      = "off"
+	Shutdown = "shutdown"
+	Reset    = "reset"
+	// set the node to boot from network once, on next boot
+	PxeOnce = "pxe-once"
+)
+
+// address and credentials of a node's BMC
+type BMC struct {
+	// redfish/ipmi
+	Type string
+	// host[:port] of the BMC, or base url with redfish
+	Addr           string
+	User, Password string
+	// skip TLS verification, BMCs mostly come with self signed certs
+	Insecure bool
+}
+
+// controls power of a node through its BMC
+type Controller interface {
+	// power state as reported by the BMC, On/Off etc.
+	Status() (string, error)
+	// perform one of the power actions
+	Do(action string) error
+}
+
+// BMC of a node from its inflated config, with credentials from the BMC
+// secrets file, nil if no bmc_addr configured
+func BMCOf(mac string, cfgd map[string]interface{}) *BMC {
+	str := func(key string) string {
+		v, _ := cfgd[key].(string)
+		return v
+	}
+	bmc := &BMC{Type: str("bmc_type"), Addr: str("bmc_addr")}
+	if len(bmc.Addr) <= 0 {
+		return nil
+	}
+	if _, ok := cfgd["bmc_password"]; ok {
+		glog.Warningf("bmc_password in config of mac=[%s] ignored, move it to [%s].", mac, BMCSecretsFile)
+	}
+	if cred := bmcCredentialOf(mac, ccm.CfgGroups(cfgd), bmc.Addr); cred != nil {
+		bmc.User, bmc.Password = cred.User, cred.Password
+	}
+	switch insecure := cfgd["bmc_insecure"].(type) {
+	case bool:
+		bmc.Insecure = insecure
+	case string:
+		bmc.Insecure = "true" == strings.ToLower(insecure)
+	}
+	if len(bmc.Type) <= 0 {
+		bmc.Type = "redfish"
+	}
+	return bmc
+}
+
+// controller for a BMC by its type
+func NewController(bmc *BMC) (Controller, error) {
+	switch bmc.Type {
+	case "redfish":
+		return newRedfish(bmc), nil
+	case "ipmi":
+		return newIpmi(bmc), nil
+	}
+	return nil, errors.Errorf("unsupported bmc_type [%s]", bmc.Type)
+}
+
+func checkAction(action string) error {
+	switch action {
+	case On, Off, Shutdown, Reset, PxeOnce:
+		return nil
+	}
+	return errors.Errorf("unknown power action [%s]", action)
+}
+
+// controller for a compute node by its config
+func NodeController(cfg *ccm.ComputeNodeCfg) (Controller, error) {
+	cfgd, err := cfg.InflateE()
+	if err != nil {
+		return nil, err
+	}
+	bmc := BMCOf(cfg.Mac, cfgd)
+	if bmc == nil {
+		return nil, errors.Errorf("no bmc_addr configured for mac=[%s]", cfg.Mac)
+	}
+	return NewController(bmc)
+}
+
+// reset a node through its BMC, or power it on if off, optionally to boot
+// from network once
+func rebootByBMC(bmc *BMC, pxe bool) error {
+	ctrl, err := NewController(bmc)
+	if err != nil {
+		return err
+	}
+	if pxe {
+		if err := ctrl.Do(PxeOnce); err != nil {
+			return err
+		}
+	}
+	state, err := ctrl.Status()
+	if err != nil {
+		return err
+	}
+	if "Off" == state {
+		return ctrl.Do(On)
+	}
+	return ctrl.Do(Reset)
+}
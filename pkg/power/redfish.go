@@ -0,0 +1,135 @@
+package power
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/complyue/hbi/pkg/errors"
+)
+
+const redfishTimeout = 30 * time.Second
+
+// power control through the DMTF Redfish API of a BMC
+type redfish struct {
+	bmc     *BMC
+	baseURL string
+	client  *http.Client
+}
+
+func newRedfish(bmc *BMC) *redfish {
+	baseURL := strings.TrimSuffix(bmc.Addr, "/")
+	if !strings.Contains(baseURL, "://") {
+		baseURL = "https://" + baseURL
+	}
+	transport := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: bmc.Insecure},
+	}
+	return &redfish{
+		bmc: bmc, baseURL: baseURL,
+		client: &http.Client{Transport: transport, Timeout: redfishTimeout},
+	}
+}
+
+// do a request, decode json response into result if not nil
+func (rf *redfish) request(method, path string, body interface{}, result interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, rf.baseURL+path, reqBody)
+	if err != nil {
+		return err
+	}
+	if len(rf.bmc.User) > 0 {
+		req.SetBasicAuth(rf.bmc.User, rf.bmc.Password)
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := rf.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("redfish %s %s: %s %s", method, path, resp.Status, strings.TrimSpace(string(respBody)))
+	}
+	if result != nil && len(respBody) > 0 {
+		if err := json.Unmarshal(respBody, result); err != nil {
+			return errors.Wrapf(err, "bad redfish response to %s %s", method, path)
+		}
+	}
+	return nil
+}
+
+// path of the first computer system managed by the BMC
+func (rf *redfish) systemPath() (string, error) {
+	var systems struct {
+		Members []struct {
+			ID string `json:"@odata.id"`
+		}
+	}
+	if err := rf.request("GET", "/redfish/v1/Systems", nil, &systems); err != nil {
+		return "", err
+	}
+	if len(systems.Members) < 1 {
+		return "", errors.New("no system managed by the bmc")
+	}
+	return systems.Members[0].ID, nil
+}
+
+func (rf *redfish) Status() (string, error) {
+	sysPath, err := rf.systemPath()
+	if err != nil {
+		return "", err
+	}
+	var system struct {
+		PowerState string
+	}
+	if err := rf.request("GET", sysPath, nil, &system); err != nil {
+		return "", err
+	}
+	return system.PowerState, nil
+}
+
+func (rf *redfish) Do(action string) error {
+	if err := checkAction(action); err != nil {
+		return err
+	}
+	sysPath, err := rf.systemPath()
+	if err != nil {
+		return err
+	}
+	if PxeOnce == action {
+		return rf.request("PATCH", sysPath, map[string]interface{}{
+			"Boot": map[string]string{
+				"BootSourceOverrideEnabled": "Once",
+				"BootSourceOverrideTarget":  "Pxe",
+			},
+		}, nil)
+	}
+	resetType := map[string]string{
+		On:       "On",
+		Off:      "ForceOff",
+		Shutdown: "GracefulShutdown",
+		Reset:    "ForceRestart",
+	}[action]
+	return rf.request("POST", sysPath+"/Actions/ComputerSystem.Reset",
+		map[string]string{"ResetType": resetType}, nil)
+}
@@ -0,0 +1,238 @@
+package power
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/complyue/different-hpc/pkg/audit"
+	"github.com/complyue/different-hpc/pkg/ccm"
+	"github.com/complyue/hbi/pkg/errors"
+	"github.com/golang/glog"
+)
+
+// number of finished remediations kept for status query
+const maxFinishedRemedies = 100
+
+// remediation of a node after its death confirmed
+type Remedy struct {
+	Mac, IP, Host string
+
+	Started, Updated time.Time
+	Attempt          int
+
+	// attempting/waiting/backoff/recovered/faulty/cancelled
+	State  string
+	Detail string
+	Done   bool
+}
+
+var (
+	remedies    = make(map[string]*Remedy)
+	remedyMutex sync.Mutex
+)
+
+func init() {
+	ccm.RegisterDeathHandler(remedyDeath)
+}
+
+func (r *Remedy) update(state, detail string) {
+	remedyMutex.Lock()
+	defer remedyMutex.Unlock()
+
+	r.State, r.Detail, r.Updated = state, detail, time.Now()
+}
+
+func (r *Remedy) finish(state, detail string) {
+	remedyMutex.Lock()
+	defer remedyMutex.Unlock()
+
+	r.State, r.Detail, r.Updated = state, detail, time.Now()
+	r.Done = true
+}
+
+// register a remediation to start, false if one is in progress for the node
+func startRemedy(r *Remedy) bool {
+	remedyMutex.Lock()
+	defer remedyMutex.Unlock()
+
+	if existing, ok := remedies[r.Mac]; ok && !existing.Done {
+		return false
+	}
+	remedies[r.Mac] = r
+
+	var finished []*Remedy
+	for _, fr := range remedies {
+		if fr.Done {
+			finished = append(finished, fr)
+		}
+	}
+	if len(finished) > maxFinishedRemedies {
+		sort.Slice(finished, func(i, j int) bool {
+			return finished[i].Updated.Before(finished[j].Updated)
+		})
+		for _, fr := range finished[:len(finished)-maxFinishedRemedies] {
+			delete(remedies, fr.Mac)
+		}
+	}
+	return true
+}
+
+// remediations in progress and recently finished, most recent first
+func ListRemedies() []Remedy {
+	remedyMutex.Lock()
+	defer remedyMutex.Unlock()
+
+	list := make([]Remedy, 0, len(remedies))
+	for _, r := range remedies {
+		list = append(list, *r)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Started.After(list[j].Started)
+	})
+	return list
+}
+
+func remedyDeath(ip string, cfgs []*ccm.ComputeNodeCfg) {
+	defer func() {
+		if e := recover(); e != nil {
+			glog.Errorf("Error remedying death of ip=[%s]: %+v", ip, errors.RichError(e))
+		}
+	}()
+
+	if !GetPowerCfg().Remedy.Enabled {
+		return
+	}
+	for _, cfg := range cfgs {
+		go remedyNode(cfg, ip)
+	}
+}
+
+// try power cycling or waking a dead node, till it's alive again or attempts
+// exhausted, then mark it faulty and notify
+func remedyNode(cfg *ccm.ComputeNodeCfg, ip string) {
+	defer func() {
+		if e := recover(); e != nil {
+			glog.Errorf("Error remedying mac=[%s]: %+v", cfg.Mac, errors.RichError(e))
+		}
+	}()
+
+	cfgd, err := cfg.InflateE()
+	if err != nil {
+		glog.Errorf("Not remedying mac=[%s] with bad config: %+v", cfg.Mac, err)
+		return
+	}
+	if faulty := ccm.CfgFaulty(cfgd); len(faulty) > 0 {
+		glog.V(1).Infof("Not remedying mac=[%s] marked faulty: %s", cfg.Mac, faulty)
+		return
+	}
+	if held := heldReason(cfg.Mac); len(held) > 0 {
+		glog.V(1).Infof("Not remedying mac=[%s] held by %s.", cfg.Mac, held)
+		return
+	}
+	r := &Remedy{Mac: cfg.Mac, IP: ip, Started: time.Now(), State: "attempting"}
+	r.Host, _ = cfgd["hostname"].(string)
+	r.Updated = r.Started
+	if !startRemedy(r) {
+		return
+	}
+
+	rc := GetPowerCfg().Remedy
+	backoff := rc.Backoff
+	attempt := 0
+	for attempt < rc.Attempts {
+		attempt++
+		func() {
+			remedyMutex.Lock()
+			defer remedyMutex.Unlock()
+
+			r.Attempt = attempt
+		}()
+		if held := heldReason(cfg.Mac); len(held) > 0 {
+			ccm.RecordHistory(cfg.Mac, ip, "remedy", "cancelled as held by "+held)
+			r.finish("cancelled", "held by "+held)
+			return
+		}
+		r.update("attempting", "")
+
+		since := time.Now()
+		method, err := powerCycle(cfg.Mac, cfgd, rc.Methods)
+		if len(method) <= 0 {
+			// nothing tried, so no ground to mark it faulty
+			ccm.RecordHistory(cfg.Mac, ip, "remedy", err.Error())
+			r.finish("cancelled", err.Error())
+			return
+		}
+		auditRemedy(cfg.Mac, ip, attempt, method, err)
+		if err != nil {
+			ccm.RecordHistory(cfg.Mac, ip, "remedy",
+				fmt.Sprintf("attempt %d by %s failed: %v", attempt, method, err))
+		} else {
+			ccm.RecordHistory(cfg.Mac, ip, "remedy", fmt.Sprintf("attempt %d by %s", attempt, method))
+			r.update("waiting", "by "+method)
+			if _, aliveAt := awaitAlive(cfg.Mac, ip, since, rc.AliveTimeout, false, nil); !aliveAt.IsZero() {
+				detail := fmt.Sprintf("recovered by attempt %d", attempt)
+				ccm.RecordHistory(cfg.Mac, ip, "remedy", detail)
+				r.finish("recovered", detail)
+				return
+			}
+			ccm.RecordHistory(cfg.Mac, ip, "remedy",
+				fmt.Sprintf("attempt %d: not alive in %v", attempt, rc.AliveTimeout))
+		}
+
+		if attempt >= rc.Attempts {
+			break
+		}
+		r.update("backoff", "next attempt at "+time.Now().Add(backoff).Format("15:04:05"))
+		time.Sleep(backoff)
+		backoff *= 2
+		// follow the latest config, remediation may have been disabled meanwhile
+		if rc = GetPowerCfg().Remedy; !rc.Enabled {
+			ccm.RecordHistory(cfg.Mac, ip, "remedy", "cancelled as disabled")
+			r.finish("cancelled", "remediation disabled")
+			return
+		}
+	}
+
+	reason := fmt.Sprintf("not recovered by %d remediation attempts since %s",
+		attempt, r.Started.Format("2006-01-02 15:04"))
+	if _, err := ccm.MarkComputeNodeFaulty(cfg.Mac, reason, audit.RemedyActor); err != nil {
+		glog.Errorf("Error marking mac=[%s] faulty: %+v", cfg.Mac, err)
+	}
+	notifyFaulty(cfg.Mac, ip, r.Host, reason)
+	r.finish("faulty", reason)
+}
+
+// record a remediation attempt in the audit log, as a power action or a wake
+// by the method
+func auditRemedy(mac, ip string, attempt int, method string, err error) {
+	e := audit.Entry{Actor: audit.RemedyActor, Action: "power", Mac: mac, IP: ip,
+		Detail: fmt.Sprintf("reset by remedy attempt %d", attempt)}
+	if "wol" == method {
+		e.Action, e.Detail = "wake", fmt.Sprintf("remedy attempt %d", attempt)
+	}
+	if err != nil {
+		e.Detail += fmt.Sprintf(" failed: %v", err)
+	}
+	audit.Record(e)
+}
+
+// power cycle a node by the first applicable method, the method used is
+// returned, empty if none applicable
+func powerCycle(mac string, cfgd map[string]interface{}, methods []string) (string, error) {
+	for _, method := range methods {
+		switch method {
+		case "bmc":
+			bmc := BMCOf(mac, cfgd)
+			if bmc == nil {
+				continue
+			}
+			return method, rebootByBMC(bmc, false)
+		case "wol":
+			secureOn, _ := cfgd["wol_secureon"].(string)
+			return method, SendWol(mac, secureOn)
+		}
+	}
+	return "", errors.Errorf("none of remedy methods %v applicable", methods)
+}
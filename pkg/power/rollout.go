@@ -0,0 +1,347 @@
+package power
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/complyue/different-hpc/pkg/audit"
+	"github.com/complyue/different-hpc/pkg/ccm"
+	"github.com/complyue/hbi/pkg/errors"
+	"github.com/golang/glog"
+)
+
+// number of finished rollouts kept for status query
+const maxFinishedRollouts = 10
+
+// how to reboot a selection of nodes in waves
+type RolloutSpec struct {
+	Selection ccm.NodeSelection
+
+	// nodes rebooted at the same time in a wave
+	Concurrency int
+
+	// set nodes to boot from network once before reboot, to reimage them
+	Pxe bool
+
+	// a node failed if not healthy this long after its reboot, like "10m"
+	HealthTimeout string
+
+	// pause, or abort with AbortOnFailure, after this many nodes failed,
+	// 0 to carry on regardless
+	MaxFailures    int
+	AbortOnFailure bool
+}
+
+// progress of a node in a rollout
+type RolloutNode struct {
+	Mac, IP, Host string
+	Wave          int
+
+	// pending/rebooting/booted/healthy/failed
+	State string
+	Err   string
+
+	RebootAt, BootedAt, HealthyAt time.Time
+}
+
+// a rolling reboot in progress or finished
+type Rollout struct {
+	ID      int
+	Spec    RolloutSpec
+	Started time.Time
+
+	// running/paused/aborted/done
+	State string
+	// why paused or aborted
+	Reason string
+
+	Wave, Waves int
+	Failures    int
+
+	Nodes []RolloutNode
+
+	healthTimeout time.Duration
+	// failures tolerated by resuming
+	ackedFailures int
+}
+
+var (
+	rollouts      []*Rollout
+	nextRolloutID = 1
+	rolloutMutex  sync.Mutex
+	rolloutCond   = sync.NewCond(&rolloutMutex)
+)
+
+func (ro *Rollout) snapshot() Rollout {
+	snap := *ro
+	snap.Nodes = append([]RolloutNode(nil), ro.Nodes...)
+	return snap
+}
+
+func (ro *Rollout) update(ni int, f func(node *RolloutNode)) {
+	rolloutMutex.Lock()
+	defer rolloutMutex.Unlock()
+
+	f(&ro.Nodes[ni])
+}
+
+// start rebooting selected nodes in waves, only one rollout can be running
+// or paused at a time
+func StartRollout(spec RolloutSpec) (Rollout, error) {
+	if spec.Concurrency < 1 {
+		return Rollout{}, errors.Errorf("invalid concurrency %d", spec.Concurrency)
+	}
+	healthTimeout, err := time.ParseDuration(spec.HealthTimeout)
+	if err != nil {
+		return Rollout{}, errors.Wrapf(err, "invalid health timeout")
+	}
+	if healthTimeout <= 0 {
+		return Rollout{}, errors.Errorf("invalid health timeout %v", healthTimeout)
+	}
+	cfgs, err := ccm.SelectComputeNodeCfgs(spec.Selection)
+	if err != nil {
+		return Rollout{}, err
+	}
+	if len(cfgs) <= 0 {
+		return Rollout{}, errors.New("no node selected")
+	}
+
+	ro := &Rollout{
+		Spec: spec, Started: time.Now(), State: "running",
+		Waves:         (len(cfgs) + spec.Concurrency - 1) / spec.Concurrency,
+		healthTimeout: healthTimeout,
+	}
+	for ci, cfg := range cfgs {
+		node := RolloutNode{Mac: cfg.Mac, Wave: 1 + ci/spec.Concurrency, State: "pending"}
+		cfgd, err := cfg.InflateE()
+		if err != nil {
+			return Rollout{}, errors.Wrapf(err, "bad config of mac=[%s]", cfg.Mac)
+		}
+		if BMCOf(cfg.Mac, cfgd) == nil {
+			return Rollout{}, errors.Errorf("no bmc_addr configured for mac=[%s]", cfg.Mac)
+		}
+		node.IP, _ = cfgd["ip"].(string)
+		node.Host, _ = cfgd["hostname"].(string)
+		ro.Nodes = append(ro.Nodes, node)
+	}
+
+	rolloutMutex.Lock()
+	defer rolloutMutex.Unlock()
+
+	for _, other := range rollouts {
+		if "running" == other.State || "paused" == other.State {
+			return Rollout{}, errors.Errorf("rollout #%d is %s", other.ID, other.State)
+		}
+	}
+	ro.ID = nextRolloutID
+	nextRolloutID++
+	rollouts = append(rollouts, ro)
+	if len(rollouts) > maxFinishedRollouts+1 {
+		rollouts = rollouts[len(rollouts)-maxFinishedRollouts-1:]
+	}
+
+	go ro.run()
+	return ro.snapshot(), nil
+}
+
+// block while paused, false if aborted
+func (ro *Rollout) checkpoint() bool {
+	rolloutMutex.Lock()
+	defer rolloutMutex.Unlock()
+
+	for "paused" == ro.State {
+		rolloutCond.Wait()
+	}
+	return "aborted" != ro.State
+}
+
+func (ro *Rollout) run() {
+	defer func() {
+		if e := recover(); e != nil {
+			err := errors.RichError(e)
+			glog.Errorf("Error with rollout #%d: %+v", ro.ID, err)
+
+			rolloutMutex.Lock()
+			defer rolloutMutex.Unlock()
+
+			ro.State, ro.Reason = "aborted", fmt.Sprintf("unexpected error: %v", err)
+		}
+	}()
+
+	for wave := 1; wave <= ro.Waves; wave++ {
+		if !ro.checkpoint() {
+			return
+		}
+		func() {
+			rolloutMutex.Lock()
+			defer rolloutMutex.Unlock()
+
+			ro.Wave = wave
+		}()
+
+		var nodes sync.WaitGroup
+		for ni := range ro.Nodes {
+			if ro.Nodes[ni].Wave != wave {
+				continue
+			}
+			nodes.Add(1)
+			go func(ni int) {
+				defer nodes.Done()
+				ro.rebootNode(ni)
+			}(ni)
+		}
+		nodes.Wait()
+
+		func() {
+			rolloutMutex.Lock()
+			defer rolloutMutex.Unlock()
+
+			ro.Failures = 0
+			for _, node := range ro.Nodes {
+				if "failed" == node.State {
+					ro.Failures++
+				}
+			}
+			if "running" != ro.State || ro.Spec.MaxFailures <= 0 ||
+				ro.Failures-ro.ackedFailures < ro.Spec.MaxFailures {
+				return
+			}
+			reason := fmt.Sprintf("%d nodes failed by wave %d", ro.Failures, wave)
+			if ro.Spec.AbortOnFailure {
+				ro.State, ro.Reason = "aborted", reason
+			} else {
+				ro.State, ro.Reason = "paused", reason
+			}
+			glog.Warningf("Rollout #%d %s as %s.", ro.ID, ro.State, reason)
+		}()
+	}
+
+	rolloutMutex.Lock()
+	defer rolloutMutex.Unlock()
+
+	if "aborted" != ro.State {
+		ro.State, ro.Reason = "done", ""
+		if ro.Failures > 0 {
+			ro.Reason = fmt.Sprintf("%d nodes failed", ro.Failures)
+		}
+	}
+}
+
+// reboot a node and wait for it to request boot and turn alive
+func (ro *Rollout) rebootNode(ni int) {
+	node := ro.Nodes[ni] // identity fields never change
+	fail := func(err error) {
+		ro.update(ni, func(n *RolloutNode) {
+			n.State, n.Err = "failed", err.Error()
+		})
+		ccm.RecordHistory(node.Mac, node.IP, "rollout", fmt.Sprintf("#%d failed: %v", ro.ID, err))
+	}
+
+	cfg := ccm.GetComputeNodeCfg(node.Mac)
+	if cfg == nil {
+		fail(errors.New("config disappeared"))
+		return
+	}
+	cfgd, err := cfg.InflateE()
+	if err != nil {
+		fail(err)
+		return
+	}
+	bmc := BMCOf(node.Mac, cfgd)
+	if bmc == nil {
+		fail(errors.New("no bmc_addr configured"))
+		return
+	}
+
+	defer holdNode(node.Mac, fmt.Sprintf("rollout #%d", ro.ID))()
+
+	rebootAt := time.Now()
+	ro.update(ni, func(n *RolloutNode) {
+		n.State, n.RebootAt = "rebooting", rebootAt
+	})
+	err = rebootByBMC(bmc, ro.Spec.Pxe)
+	detail := fmt.Sprintf("reset by rollout #%d", ro.ID)
+	if ro.Spec.Pxe {
+		detail += ", pxe once"
+	}
+	if err != nil {
+		detail += fmt.Sprintf(" failed: %v", err)
+	}
+	audit.Record(audit.Entry{Actor: audit.RolloutActor, Action: "power", Mac: node.Mac, IP: node.IP,
+		Detail: detail})
+	if err != nil {
+		fail(err)
+		return
+	}
+	ccm.RecordHistory(node.Mac, node.IP, "rollout", fmt.Sprintf("#%d rebooted", ro.ID))
+
+	_, healthyAt := awaitAlive(node.Mac, node.IP, rebootAt, ro.healthTimeout, true, func(bootedAt time.Time) {
+		ro.update(ni, func(n *RolloutNode) {
+			n.State, n.BootedAt = "booted", bootedAt
+		})
+	})
+	if healthyAt.IsZero() {
+		fail(errors.Errorf("not booted and alive in %v", ro.healthTimeout))
+		return
+	}
+	ro.update(ni, func(n *RolloutNode) {
+		n.State, n.HealthyAt = "healthy", healthyAt
+	})
+	ccm.RecordHistory(node.Mac, node.IP, "rollout",
+		fmt.Sprintf("#%d healthy in %v", ro.ID, healthyAt.Sub(rebootAt).Round(time.Second)))
+}
+
+// pause/resume/abort a rollout. pausing or aborting takes effect before
+// the next wave, nodes of the current wave are still followed
+func ControlRollout(id int, act string) (Rollout, error) {
+	rolloutMutex.Lock()
+	defer rolloutMutex.Unlock()
+
+	var ro *Rollout
+	for _, r := range rollouts {
+		if r.ID == id {
+			ro = r
+			break
+		}
+	}
+	if ro == nil {
+		return Rollout{}, errors.Errorf("no rollout #%d", id)
+	}
+	switch act {
+	case "pause":
+		if "running" != ro.State {
+			return Rollout{}, errors.Errorf("rollout #%d is %s", id, ro.State)
+		}
+		ro.State, ro.Reason = "paused", "paused by request"
+	case "resume":
+		if "paused" != ro.State {
+			return Rollout{}, errors.Errorf("rollout #%d is %s", id, ro.State)
+		}
+		ro.State, ro.Reason = "running", ""
+		ro.ackedFailures = ro.Failures
+		rolloutCond.Broadcast()
+	case "abort":
+		if "running" != ro.State && "paused" != ro.State {
+			return Rollout{}, errors.Errorf("rollout #%d is %s", id, ro.State)
+		}
+		ro.State, ro.Reason = "aborted", "aborted by request"
+		rolloutCond.Broadcast()
+	default:
+		return Rollout{}, errors.Errorf("unknown rollout control [%s]", act)
+	}
+	glog.Infof("Rollout #%d %s.", id, ro.State)
+	return ro.snapshot(), nil
+}
+
+// recent rollouts, most recent first
+func ListRollouts() []Rollout {
+	rolloutMutex.Lock()
+	defer rolloutMutex.Unlock()
+
+	list := make([]Rollout, 0, len(rollouts))
+	for ri := len(rollouts) - 1; ri >= 0; ri-- {
+		list = append(list, rollouts[ri].snapshot())
+	}
+	return list
+}
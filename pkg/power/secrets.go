@@ -0,0 +1,158 @@
+package power
+
+import (
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/complyue/different-hpc/pkg/ccm"
+	"github.com/complyue/hbi/pkg/errors"
+	"github.com/golang/glog"
+	"gopkg.in/yaml.v2"
+)
+
+// BMC credentials are kept in this file, apart from node configs which are
+// visible to all web users, so it should be readable by dhpc-cc only
+const BMCSecretsFile = "etc/bmc-secrets.yaml"
+
+type BMCCredential struct {
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+}
+
+type BMCSecrets struct {
+	// by mac of the node
+	Nodes map[string]*BMCCredential `yaml:"nodes"`
+	// by group of the node, the first group of a node found here is used
+	Groups map[string]*BMCCredential `yaml:"groups"`
+	// for nodes not found above
+	Default *BMCCredential `yaml:"default"`
+	// CIDRs of BMC networks, credentials of groups or the default are only
+	// sent to a bmc_addr inside them, nodes with BMCs elsewhere need their own
+	Networks []string `yaml:"networks"`
+
+	nets []*net.IPNet
+}
+
+var (
+	bmcSecrets      *BMCSecrets
+	bmcSecretsMutex sync.Mutex
+)
+
+// read BMC secrets from file, none if the file doesn't exist
+func loadBMCSecrets() (*BMCSecrets, error) {
+	rawYaml, err := ioutil.ReadFile(BMCSecretsFile)
+	if os.IsNotExist(err) {
+		return &BMCSecrets{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var secrets BMCSecrets
+	if err = yaml.Unmarshal(rawYaml, &secrets); err != nil {
+		return nil, errors.Wrapf(err, "invalid bmc secrets file [%s]", BMCSecretsFile)
+	}
+	nodes := make(map[string]*BMCCredential, len(secrets.Nodes))
+	for mac, cred := range secrets.Nodes {
+		normMac, err := ccm.NormalizeMac(mac)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid mac [%s] in [%s]", mac, BMCSecretsFile)
+		}
+		nodes[normMac] = cred
+	}
+	secrets.Nodes = nodes
+	for _, cidr := range secrets.Networks {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid network [%s] in [%s]", cidr, BMCSecretsFile)
+		}
+		secrets.nets = append(secrets.nets, ipNet)
+	}
+	if fi, err := os.Stat(BMCSecretsFile); err == nil && fi.Mode().Perm()&0077 != 0 {
+		glog.Warningf("BMC secrets file [%s] is accessible by others, mode %v.",
+			BMCSecretsFile, fi.Mode().Perm())
+	}
+	return &secrets, nil
+}
+
+func getBMCSecrets() *BMCSecrets {
+	bmcSecretsMutex.Lock()
+	defer bmcSecretsMutex.Unlock()
+
+	if nil == bmcSecrets {
+		secrets, err := loadBMCSecrets()
+		if err != nil {
+			panic(err)
+		}
+		bmcSecrets = secrets
+	}
+	return bmcSecrets
+}
+
+// reload BMC secrets from file, the last good ones are kept on error
+func ReloadBMCSecrets() error {
+	secrets, err := loadBMCSecrets()
+	if err != nil {
+		return err
+	}
+
+	bmcSecretsMutex.Lock()
+	defer bmcSecretsMutex.Unlock()
+
+	bmcSecrets = secrets
+	return nil
+}
+
+// whether a bmc_addr, as host[:port] or a base url, is an ip inside the BMC
+// networks, a host name is never, as it may resolve anywhere
+func (secrets *BMCSecrets) inNetworks(addr string) bool {
+	host := addr
+	if strings.Contains(addr, "://") {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return false
+		}
+		host = u.Hostname()
+	} else if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range secrets.nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// BMC credential of a node by its mac, then its groups, then the default,
+// nil if none configured. credentials shared by groups or the default are
+// only for a BMC inside the BMC networks, lest they be sent to whatever
+// bmc_addr put in a node config
+func bmcCredentialOf(mac string, groups []string, addr string) *BMCCredential {
+	secrets := getBMCSecrets()
+	if cred := secrets.Nodes[mac]; cred != nil {
+		return cred
+	}
+	var cred *BMCCredential
+	for _, g := range groups {
+		if cred = secrets.Groups[g]; cred != nil {
+			break
+		}
+	}
+	if cred == nil {
+		cred = secrets.Default
+	}
+	if cred != nil && !secrets.inNetworks(addr) {
+		glog.Warningf("Shared BMC credential not sent to bmc_addr [%s] of mac=[%s] outside BMC networks %v.",
+			addr, mac, secrets.Networks)
+		return nil
+	}
+	return cred
+}
@@ -0,0 +1,217 @@
+package power
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/complyue/different-hpc/pkg/ccm"
+	"github.com/golang/glog"
+)
+
+const (
+	// how often a woken node is checked for boot request and aliveness
+	wakePollInterval = 5 * time.Second
+
+	// number of recent wake jobs kept for status query
+	maxWakeJobs = 20
+)
+
+// wake progress of a node
+type WakeNode struct {
+	Mac, IP, Host string
+
+	// pending/sent/booted/alive/timeout/failed
+	State string
+	Err   string
+
+	SentAt, BootedAt, AliveAt time.Time
+}
+
+// Wake-on-LAN of a selection of nodes
+type WakeJob struct {
+	ID      int
+	Started time.Time
+	Done    bool
+
+	Nodes []WakeNode
+}
+
+var (
+	wakeJobs   []*WakeJob
+	nextWakeID = 1
+	wakeMutex  sync.Mutex
+)
+
+func (job *WakeJob) snapshot() WakeJob {
+	snap := *job
+	snap.Nodes = append([]WakeNode(nil), job.Nodes...)
+	return snap
+}
+
+func (job *WakeJob) update(ni int, f func(node *WakeNode)) {
+	wakeMutex.Lock()
+	defer wakeMutex.Unlock()
+
+	f(&job.Nodes[ni])
+}
+
+// send magic packets to selected nodes, staggered, then watch each of them
+// for its boot request and liveness in background
+func StartWake(sel ccm.NodeSelection) (WakeJob, error) {
+	cfgs, err := ccm.SelectComputeNodeCfgs(sel)
+	if err != nil {
+		return WakeJob{}, err
+	}
+	job := &WakeJob{Started: time.Now()}
+	secureOns := make([]string, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		node := WakeNode{Mac: cfg.Mac, State: "pending"}
+		secureOn := ""
+		if cfgd, err := cfg.InflateE(); err != nil {
+			node.State, node.Err = "failed", err.Error()
+		} else {
+			node.IP, _ = cfgd["ip"].(string)
+			node.Host, _ = cfgd["hostname"].(string)
+			secureOn, _ = cfgd["wol_secureon"].(string)
+		}
+		job.Nodes = append(job.Nodes, node)
+		secureOns = append(secureOns, secureOn)
+	}
+
+	wakeMutex.Lock()
+	job.ID = nextWakeID
+	nextWakeID++
+	wakeJobs = append(wakeJobs, job)
+	if len(wakeJobs) > maxWakeJobs {
+		wakeJobs = wakeJobs[len(wakeJobs)-maxWakeJobs:]
+	}
+	snap := job.snapshot()
+	wakeMutex.Unlock()
+
+	go job.run(secureOns)
+	return snap, nil
+}
+
+func (job *WakeJob) run(secureOns []string) {
+	var watchers sync.WaitGroup
+	stagger := GetPowerCfg().Wol.Stagger
+	for ni := range job.Nodes {
+		node := job.Nodes[ni] // a pending node is only changed here
+		if "pending" != node.State {
+			continue
+		}
+		if ni > 0 && stagger > 0 {
+			time.Sleep(stagger)
+		}
+		release := holdNode(node.Mac, fmt.Sprintf("wake job #%d", job.ID))
+		err := SendWol(node.Mac, secureOns[ni])
+		now := time.Now()
+		job.update(ni, func(n *WakeNode) {
+			if err != nil {
+				n.State, n.Err = "failed", err.Error()
+			} else {
+				n.State, n.SentAt = "sent", now
+			}
+		})
+		if err != nil {
+			glog.Errorf("Error sending wol to mac=[%s]: %+v", node.Mac, err)
+			ccm.RecordHistory(node.Mac, node.IP, "wol", "failed sending: "+err.Error())
+			release()
+			continue
+		}
+		ccm.RecordHistory(node.Mac, node.IP, "wol", "magic packet sent")
+		watchers.Add(1)
+		go func(ni int, node WakeNode) {
+			defer watchers.Done()
+			defer release()
+			job.watch(ni, node.Mac, node.IP, now)
+		}(ni, node)
+	}
+	watchers.Wait()
+
+	wakeMutex.Lock()
+	job.Done = true
+	wakeMutex.Unlock()
+}
+
+// watch a node after its magic packet sent, till alive or timeout
+func (job *WakeJob) watch(ni int, mac, ip string, sentAt time.Time) {
+	timeout := GetPowerCfg().Wol.WakeTimeout
+	booted, aliveAt := awaitAlive(mac, ip, sentAt, timeout, false, func(bootedAt time.Time) {
+		job.update(ni, func(n *WakeNode) {
+			n.State, n.BootedAt = "booted", bootedAt
+		})
+	})
+	if !aliveAt.IsZero() {
+		job.update(ni, func(n *WakeNode) {
+			n.State, n.AliveAt = "alive", aliveAt
+		})
+		ccm.RecordHistory(mac, ip, "wol", "woke up in "+aliveAt.Sub(sentAt).Round(time.Second).String())
+		return
+	}
+	job.update(ni, func(n *WakeNode) {
+		n.State = "timeout"
+	})
+	detail := "not alive in " + timeout.String()
+	if booted {
+		detail += ", though boot requested"
+	}
+	ccm.RecordHistory(mac, ip, "wol", detail)
+}
+
+// wait for a node to request boot and turn alive, after since and within
+// timeout. with requireBoot, aliveness is only checked after its boot request
+// seen, as a node being rebooted may still respond for a while. onBoot is
+// called once its boot request seen, aliveAt is zero on timeout.
+// boot requests and aliveness are watched in memory, the ip is probed only
+// if not seen alive otherwise.
+func awaitAlive(mac, ip string, since time.Time, timeout time.Duration, requireBoot bool,
+	onBoot func(bootedAt time.Time)) (booted bool, aliveAt time.Time) {
+	deadline := since.Add(timeout)
+	var bootedAt time.Time
+	for {
+		time.Sleep(wakePollInterval)
+
+		if !booted {
+			if t := ccm.LastBootTime(mac); t.After(since) {
+				booted, bootedAt = true, t
+				if onBoot != nil {
+					onBoot(t)
+				}
+			}
+		}
+
+		if len(ip) > 0 && (booted || !requireBoot) {
+			aliveSince := since
+			if booted {
+				aliveSince = bootedAt
+			}
+			if t := ccm.LastAliveTime(ip); t.After(aliveSince) {
+				return booted, t
+			}
+			alive, err := ccm.ProbeIpAlive(ip)
+			if err != nil {
+				glog.Errorf("Error probing ip=[%s]: %+v", ip, err)
+			} else if alive {
+				return booted, time.Now()
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return booted, time.Time{}
+		}
+	}
+}
+
+// recent wake jobs, most recent first
+func ListWakeJobs() []WakeJob {
+	wakeMutex.Lock()
+	defer wakeMutex.Unlock()
+
+	jobs := make([]WakeJob, 0, len(wakeJobs))
+	for ji := len(wakeJobs) - 1; ji >= 0; ji-- {
+		jobs = append(jobs, wakeJobs[ji].snapshot())
+	}
+	return jobs
+}
@@ -0,0 +1,103 @@
+package power
+
+import (
+	"bytes"
+	"net"
+
+	"github.com/complyue/hbi/pkg/errors"
+)
+
+// SecureOn password from its text form, nil for empty
+func parseSecureOn(s string) ([]byte, error) {
+	if len(s) <= 0 {
+		return nil, nil
+	}
+	pw, err := net.ParseMAC(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(pw) != 6 {
+		return nil, errors.Errorf("SecureOn password should be 6 bytes, not %d", len(pw))
+	}
+	return pw, nil
+}
+
+// 6 bytes of 0xff followed by the mac repeated 16 times, then the optional
+// SecureOn password
+func magicPacket(mac net.HardwareAddr, secureOn []byte) []byte {
+	pkt := bytes.Repeat([]byte{0xff}, 6)
+	for i := 0; i < 16; i++ {
+		pkt = append(pkt, mac...)
+	}
+	return append(pkt, secureOn...)
+}
+
+// local and remote addresses to send magic packets between
+func wolAddrs(wc *WolCfg) (laddr, raddr *net.UDPAddr, err error) {
+	var ifBroadcast net.IP
+	if len(wc.Interface) > 0 {
+		iface, err := net.InterfaceByName(wc.Interface)
+		if err != nil {
+			return nil, nil, err
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip4 := ipNet.IP.To4()
+			if ip4 == nil {
+				continue
+			}
+			laddr = &net.UDPAddr{IP: ip4}
+			ifBroadcast = make(net.IP, 4)
+			for i := range ip4 {
+				ifBroadcast[i] = ip4[i] | ^ipNet.Mask[len(ipNet.Mask)-4+i]
+			}
+			break
+		}
+		if laddr == nil {
+			return nil, nil, errors.Errorf("no ipv4 address on interface [%s]", wc.Interface)
+		}
+	}
+	if len(wc.Broadcast) > 0 {
+		if raddr, err = net.ResolveUDPAddr("udp4", wc.Broadcast); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		raddr = &net.UDPAddr{IP: ifBroadcast, Port: 9}
+	}
+	return laddr, raddr, nil
+}
+
+// send a Wake-on-LAN magic packet to a mac, with the node specific SecureOn
+// password if not empty, or the configured one
+func SendWol(mac string, secureOn string) error {
+	hwAddr, err := net.ParseMAC(mac)
+	if err != nil {
+		return err
+	}
+	wc := &GetPowerCfg().Wol
+	if len(secureOn) <= 0 {
+		secureOn = wc.SecureOn
+	}
+	pw, err := parseSecureOn(secureOn)
+	if err != nil {
+		return err
+	}
+	laddr, raddr, err := wolAddrs(wc)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp4", laddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.WriteToUDP(magicPacket(hwAddr, pw), raddr)
+	return err
+}
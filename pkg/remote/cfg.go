@@ -0,0 +1,116 @@
+package remote
+
+import (
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/complyue/hbi/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+const RemoteCfgFile = "etc/remote.yaml"
+
+type RemoteCfg struct {
+	// private key to log into nodes with
+	KeyFile string `yaml:"keyFile"`
+
+	// user to log into nodes as
+	User string `yaml:"user"`
+
+	// ssh port of nodes
+	Port int `yaml:"port"`
+
+	// known_hosts file to verify host keys of nodes against
+	KnownHosts string `yaml:"knownHosts"`
+
+	// where host keys generated for nodes are kept, none generated if empty
+	HostKeysDir string `yaml:"hostKeysDir"`
+	// how long a node can take to fetch its host key after booting
+	HostKeyTokenTTL time.Duration `yaml:"hostKeyTokenTTL"`
+
+	// forward the ssh agent dhpc-cc runs with into terminal sessions
+	ForwardAgent bool `yaml:"forwardAgent"`
+
+	// log into terminal sessions as the web user instead
+	TermAsWebUser bool `yaml:"termAsWebUser"`
+
+	// max nodes to run a command on at the same time
+	Fanout int `yaml:"fanout"`
+
+	ConnectTimeout time.Duration `yaml:"connectTimeout"`
+	CommandTimeout time.Duration `yaml:"commandTimeout"`
+
+	// records of command runs
+	RunsDir  string `yaml:"runsDir"`
+	KeepRuns int    `yaml:"keepRuns"`
+}
+
+var (
+	remoteCfg      *RemoteCfg
+	remoteCfgMutex sync.Mutex
+)
+
+func loadRemoteCfg() (*RemoteCfg, error) {
+	cfgRawYaml, err := ioutil.ReadFile(RemoteCfgFile)
+	if err != nil {
+		return nil, err
+	}
+	var cfgYaml RemoteCfg
+	if err = yaml.Unmarshal(cfgRawYaml, &cfgYaml); err != nil {
+		return nil, err
+	}
+	if len(cfgYaml.KeyFile) <= 0 {
+		return nil, errors.Errorf("no keyFile in [%s]", RemoteCfgFile)
+	}
+	if cfgYaml.Port <= 0 {
+		return nil, errors.Errorf("invalid port=%v in [%s]", cfgYaml.Port, RemoteCfgFile)
+	}
+	if len(cfgYaml.HostKeysDir) > 0 && cfgYaml.HostKeyTokenTTL <= 0 {
+		return nil, errors.Errorf("invalid hostKeyTokenTTL=%v in [%s]", cfgYaml.HostKeyTokenTTL, RemoteCfgFile)
+	}
+	if cfgYaml.Fanout < 1 {
+		return nil, errors.Errorf("invalid fanout=%v in [%s]", cfgYaml.Fanout, RemoteCfgFile)
+	}
+	if cfgYaml.ConnectTimeout <= 0 {
+		return nil, errors.Errorf("invalid connectTimeout=%v in [%s]", cfgYaml.ConnectTimeout, RemoteCfgFile)
+	}
+	if cfgYaml.CommandTimeout <= 0 {
+		return nil, errors.Errorf("invalid commandTimeout=%v in [%s]", cfgYaml.CommandTimeout, RemoteCfgFile)
+	}
+	if len(cfgYaml.RunsDir) <= 0 {
+		return nil, errors.Errorf("no runsDir in [%s]", RemoteCfgFile)
+	}
+	if cfgYaml.KeepRuns < 1 {
+		return nil, errors.Errorf("invalid keepRuns=%v in [%s]", cfgYaml.KeepRuns, RemoteCfgFile)
+	}
+	return &cfgYaml, nil
+}
+
+func GetRemoteCfg() *RemoteCfg {
+	remoteCfgMutex.Lock()
+	defer remoteCfgMutex.Unlock()
+
+	if nil == remoteCfg {
+		cfg, err := loadRemoteCfg()
+		if err != nil {
+			panic(err)
+		}
+		remoteCfg = cfg
+	}
+	return remoteCfg
+}
+
+// reload remote cfg from file, the last good one is kept on error
+func ReloadRemoteCfg() error {
+	cfg, err := loadRemoteCfg()
+	if err != nil {
+		return err
+	}
+
+	remoteCfgMutex.Lock()
+	defer remoteCfgMutex.Unlock()
+
+	remoteCfg = cfg
+	return nil
+}
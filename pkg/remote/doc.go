@@ -0,0 +1,2 @@
+// remote access to compute nodes over SSH
+package remote
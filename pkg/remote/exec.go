@@ -0,0 +1,530 @@
+package remote
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/complyue/different-hpc/pkg/ccm"
+	"github.com/complyue/hbi/pkg/errors"
+	"github.com/golang/glog"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// output kept per stream of a node, the rest discarded
+	maxNodeOutput = 1 << 20
+
+	// how long a query for events waits for new ones
+	eventsWait = 20 * time.Second
+
+	// number of recent runs kept in memory with their events
+	maxRunsInMemory = 10
+)
+
+// outcome of a command on a node
+type ExecNode struct {
+	Mac, IP, Host string
+
+	// pending/running/done/failed/timeout
+	State string
+	// exit status, -1 if unknown
+	Exit int
+	Err  string
+
+	Stdout, Stderr string
+	Truncated      bool
+
+	Started, Finished time.Time
+}
+
+// a piece of output from a node, or its termination with Kind "end"
+type ExecEvent struct {
+	Seq  int
+	Mac  string
+	Host string
+	// stdout/stderr/end
+	Kind string
+	Data string
+}
+
+// a command run on a selection of nodes
+type ExecRun struct {
+	ID        int
+	Command   string
+	Timeout   string
+	Selection ccm.NodeSelection
+
+	Started, Finished time.Time
+	Done              bool
+
+	Nodes []ExecNode
+
+	events []ExecEvent
+}
+
+type ExecRunSummary struct {
+	ID                int
+	Command           string
+	Started, Finished time.Time
+	Done              bool
+	Nodes, Failed     int
+	// of the nodes run on
+	Macs []string
+}
+
+var (
+	// recent runs kept in memory, by id
+	execRuns = make(map[int]*ExecRun)
+	// summaries of all runs recorded, in order of id
+	execSummaries   []ExecRunSummary
+	summariesLoaded bool
+	nextExecID      = 1
+	execMutex       sync.Mutex
+	execCond        = sync.NewCond(&execMutex)
+)
+
+func (run *ExecRun) summary() ExecRunSummary {
+	s := ExecRunSummary{
+		ID: run.ID, Command: run.Command,
+		Started: run.Started, Finished: run.Finished, Done: run.Done,
+		Nodes: len(run.Nodes),
+	}
+	for _, node := range run.Nodes {
+		if "done" != node.State || node.Exit != 0 {
+			s.Failed++
+		}
+		s.Macs = append(s.Macs, node.Mac)
+	}
+	return s
+}
+
+func (run *ExecRun) snapshot() ExecRun {
+	snap := *run
+	snap.Nodes = append([]ExecNode(nil), run.Nodes...)
+	snap.events = nil
+	return snap
+}
+
+func runFileName(runsDir string, id int) string {
+	return filepath.Join(runsDir, fmt.Sprintf("%d.json", id))
+}
+
+// load summaries of recorded runs on first use, with execMutex locked
+func _loadExecSummaries() error {
+	if summariesLoaded {
+		return nil
+	}
+	runsDir := GetRemoteCfg().RunsDir
+	fis, err := ioutil.ReadDir(runsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, fi := range fis {
+		id, err := strconv.Atoi(strings.TrimSuffix(fi.Name(), ".json"))
+		if err != nil || !strings.HasSuffix(fi.Name(), ".json") {
+			continue
+		}
+		run, err := readRunFile(runFileName(runsDir, id))
+		if err != nil {
+			glog.Errorf("Error loading command run record: %+v", err)
+			continue
+		}
+		execSummaries = append(execSummaries, run.summary())
+		if id >= nextExecID {
+			nextExecID = id + 1
+		}
+	}
+	sort.Slice(execSummaries, func(i, j int) bool {
+		return execSummaries[i].ID < execSummaries[j].ID
+	})
+	summariesLoaded = true
+	_pruneExecRuns()
+	return nil
+}
+
+// forget runs beyond keepRuns, with execMutex locked
+func _pruneExecRuns() {
+	rc := GetRemoteCfg()
+	for len(execSummaries) > rc.KeepRuns {
+		id := execSummaries[0].ID
+		execSummaries = execSummaries[1:]
+		delete(execRuns, id)
+		if err := os.Remove(runFileName(rc.RunsDir, id)); err != nil && !os.IsNotExist(err) {
+			glog.Errorf("Error removing command run record: %+v", err)
+		}
+	}
+	var inMemory []int
+	for id, run := range execRuns {
+		if run.Done {
+			inMemory = append(inMemory, id)
+		}
+	}
+	if len(inMemory) > maxRunsInMemory {
+		sort.Ints(inMemory)
+		for _, id := range inMemory[:len(inMemory)-maxRunsInMemory] {
+			delete(execRuns, id)
+		}
+	}
+}
+
+func readRunFile(fileName string) (*ExecRun, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var run ExecRun
+	if err := json.Unmarshal(data, &run); err != nil {
+		return nil, errors.Wrapf(err, "bad command run record [%s]", fileName)
+	}
+	return &run, nil
+}
+
+func writeRunFile(run *ExecRun) error {
+	runsDir := GetRemoteCfg().RunsDir
+	if err := os.MkdirAll(runsDir, 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+	fileName := runFileName(runsDir, run.ID)
+	if err := ioutil.WriteFile(fileName+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(fileName+".tmp", fileName)
+}
+
+// start running a shell command on selected nodes, timeout like "30s",
+// commandTimeout configured if empty
+func StartExec(sel ccm.NodeSelection, command, timeout string) (ExecRun, error) {
+	if len(strings.TrimSpace(command)) <= 0 {
+		return ExecRun{}, errors.New("no command")
+	}
+	rc := GetRemoteCfg()
+	cmdTimeout := rc.CommandTimeout
+	if len(timeout) > 0 {
+		var err error
+		if cmdTimeout, err = time.ParseDuration(timeout); err != nil {
+			return ExecRun{}, errors.Wrapf(err, "invalid timeout")
+		}
+		if cmdTimeout <= 0 {
+			return ExecRun{}, errors.Errorf("invalid timeout %v", cmdTimeout)
+		}
+	}
+	cfgs, err := ccm.SelectComputeNodeCfgs(sel)
+	if err != nil {
+		return ExecRun{}, err
+	}
+	if len(cfgs) <= 0 {
+		return ExecRun{}, errors.New("no node selected")
+	}
+
+	run := &ExecRun{
+		Command: command, Timeout: cmdTimeout.String(), Selection: sel,
+		Started: time.Now(),
+	}
+	for _, cfg := range cfgs {
+		node := ExecNode{Mac: cfg.Mac, State: "pending", Exit: -1}
+		if cfgd, err := cfg.InflateE(); err == nil {
+			node.IP, _ = cfgd["ip"].(string)
+			node.Host, _ = cfgd["hostname"].(string)
+		}
+		run.Nodes = append(run.Nodes, node)
+	}
+
+	execMutex.Lock()
+	defer execMutex.Unlock()
+
+	if err := _loadExecSummaries(); err != nil {
+		return ExecRun{}, err
+	}
+	run.ID = nextExecID
+	nextExecID++
+	execRuns[run.ID] = run
+
+	go run.run(cfgs, cmdTimeout, rc.Fanout)
+	return run.snapshot(), nil
+}
+
+func (run *ExecRun) run(cfgs []*ccm.ComputeNodeCfg, timeout time.Duration, fanout int) {
+	sem := make(chan struct{}, fanout)
+	var nodes sync.WaitGroup
+	for ni, cfg := range cfgs {
+		sem <- struct{}{}
+		nodes.Add(1)
+		go func(ni int, cfg *ccm.ComputeNodeCfg) {
+			defer func() {
+				<-sem
+				nodes.Done()
+			}()
+			defer func() {
+				if e := recover(); e != nil {
+					run.end(ni, "failed", -1, fmt.Sprintf("unexpected error: %v", e))
+				}
+			}()
+			run.runOn(ni, cfg, timeout)
+		}(ni, cfg)
+	}
+	nodes.Wait()
+
+	execMutex.Lock()
+	defer execMutex.Unlock()
+
+	run.Done, run.Finished = true, time.Now()
+	if err := writeRunFile(run); err != nil {
+		glog.Errorf("Error recording command run #%d: %+v", run.ID, err)
+	}
+	execSummaries = append(execSummaries, run.summary())
+	_pruneExecRuns()
+	execCond.Broadcast()
+}
+
+func (run *ExecRun) output(ni int, kind, data string) {
+	execMutex.Lock()
+	defer execMutex.Unlock()
+
+	node := &run.Nodes[ni]
+	out := &node.Stdout
+	if "stderr" == kind {
+		out = &node.Stderr
+	}
+	if room := maxNodeOutput - len(*out); room < len(data) {
+		data = data[:room]
+		node.Truncated = true
+	}
+	if len(data) <= 0 {
+		return
+	}
+	*out += data
+	run.events = append(run.events, ExecEvent{
+		Seq: len(run.events), Mac: node.Mac, Host: node.Host, Kind: kind, Data: data,
+	})
+	execCond.Broadcast()
+}
+
+func (run *ExecRun) end(ni int, state string, exit int, errMsg string) {
+	var node ExecNode
+	func() {
+		execMutex.Lock()
+		defer execMutex.Unlock()
+
+		n := &run.Nodes[ni]
+		n.State, n.Exit, n.Err, n.Finished = state, exit, errMsg, time.Now()
+		data := fmt.Sprintf("%s, exit %d", state, exit)
+		if len(errMsg) > 0 {
+			data += ": " + errMsg
+		}
+		run.events = append(run.events, ExecEvent{
+			Seq: len(run.events), Mac: n.Mac, Host: n.Host, Kind: "end", Data: data,
+		})
+		execCond.Broadcast()
+		node = *n
+	}()
+
+	cmd := run.Command
+	if len(cmd) > 60 {
+		cmd = cmd[:60] + "..."
+	}
+	ccm.RecordHistory(node.Mac, node.IP, "exec", fmt.Sprintf("#%d %s exit %d: %s", run.ID, state, exit, cmd))
+}
+
+func (run *ExecRun) runOn(ni int, cfg *ccm.ComputeNodeCfg, timeout time.Duration) {
+	func() {
+		execMutex.Lock()
+		defer execMutex.Unlock()
+
+		run.Nodes[ni].State, run.Nodes[ni].Started = "running", time.Now()
+	}()
+
+	client, err := Dial(cfg)
+	if err != nil {
+		run.end(ni, "failed", -1, err.Error())
+		return
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		run.end(ni, "failed", -1, err.Error())
+		return
+	}
+	defer session.Close()
+
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		run.end(ni, "failed", -1, err.Error())
+		return
+	}
+	stderr, err := session.StderrPipe()
+	if err != nil {
+		run.end(ni, "failed", -1, err.Error())
+		return
+	}
+	if err := session.Start(run.Command); err != nil {
+		run.end(ni, "failed", -1, err.Error())
+		return
+	}
+
+	timedOut := make(chan struct{})
+	killer := time.AfterFunc(timeout, func() {
+		close(timedOut)
+		session.Signal(ssh.SIGKILL)
+		client.Close()
+	})
+	defer killer.Stop()
+
+	var readers sync.WaitGroup
+	for kind, r := range map[string]io.Reader{"stdout": stdout, "stderr": stderr} {
+		readers.Add(1)
+		go func(kind string, r io.Reader) {
+			defer readers.Done()
+			buf := make([]byte, 4096)
+			for {
+				n, err := r.Read(buf)
+				if n > 0 {
+					run.output(ni, kind, string(buf[:n]))
+				}
+				if err != nil {
+					return
+				}
+			}
+		}(kind, r)
+	}
+	readers.Wait()
+	err = session.Wait()
+
+	select {
+	case <-timedOut:
+		run.end(ni, "timeout", -1, "killed after "+timeout.String())
+		return
+	default:
+	}
+	switch e := err.(type) {
+	case nil:
+		run.end(ni, "done", 0, "")
+	case *ssh.ExitError:
+		run.end(ni, "done", e.ExitStatus(), "")
+	default:
+		run.end(ni, "failed", -1, err.Error())
+	}
+}
+
+// summaries of recorded runs, most recent first
+func ListExecRuns() ([]ExecRunSummary, error) {
+	execMutex.Lock()
+	defer execMutex.Unlock()
+
+	if err := _loadExecSummaries(); err != nil {
+		return nil, err
+	}
+	list := make([]ExecRunSummary, 0, len(execSummaries)+len(execRuns))
+	for _, run := range execRuns {
+		if !run.Done {
+			list = append(list, run.summary())
+		}
+	}
+	for si := len(execSummaries) - 1; si >= 0; si-- {
+		list = append(list, execSummaries[si])
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].ID > list[j].ID
+	})
+	return list, nil
+}
+
+// a run in progress or recorded
+func GetExecRun(id int) (*ExecRun, error) {
+	execMutex.Lock()
+	if run, ok := execRuns[id]; ok {
+		snap := run.snapshot()
+		execMutex.Unlock()
+		return &snap, nil
+	}
+	execMutex.Unlock()
+
+	run, err := readRunFile(runFileName(GetRemoteCfg().RunsDir, id))
+	if os.IsNotExist(err) {
+		return nil, errors.Errorf("no command run #%d", id)
+	}
+	return run, err
+}
+
+// events of a run since a sequence number, waiting a while for new ones if
+// none yet. done is true once the run finished and all its events returned,
+// or its events are no longer in memory
+func ExecEvents(id int, since int) (events []ExecEvent, done bool) {
+	execMutex.Lock()
+	defer execMutex.Unlock()
+
+	run, ok := execRuns[id]
+	if !ok {
+		return nil, true
+	}
+	deadline := time.Now().Add(eventsWait)
+	waker := time.AfterFunc(eventsWait, func() {
+		execMutex.Lock()
+		defer execMutex.Unlock()
+
+		execCond.Broadcast()
+	})
+	defer waker.Stop()
+	for len(run.events) <= since && !run.Done && time.Now().Before(deadline) {
+		execCond.Wait()
+	}
+	if since < len(run.events) {
+		events = append([]ExecEvent(nil), run.events[since:]...)
+	}
+	return events, run.Done
+}
+
+// nodes with identical outcome
+type OutputGroup struct {
+	Hosts []string
+
+	State  string
+	Exit   int
+	Err    string
+	Stdout string
+	Stderr string
+}
+
+// group nodes by identical output and exit status, like dshbak -c, larger
+// groups first
+func GroupOutputs(nodes []ExecNode) []OutputGroup {
+	var groups []*OutputGroup
+	byKey := make(map[string]*OutputGroup)
+	for _, node := range nodes {
+		key := fmt.Sprintf("%s\x00%d\x00%s\x00%s\x00%s", node.State, node.Exit, node.Err, node.Stdout, node.Stderr)
+		g, ok := byKey[key]
+		if !ok {
+			g = &OutputGroup{
+				State: node.State, Exit: node.Exit, Err: node.Err,
+				Stdout: node.Stdout, Stderr: node.Stderr,
+			}
+			byKey[key] = g
+			groups = append(groups, g)
+		}
+		host := node.Host
+		if len(host) <= 0 {
+			host = node.Mac
+		}
+		g.Hosts = append(g.Hosts, host)
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		return len(groups[i].Hosts) > len(groups[j].Hosts)
+	})
+	result := make([]OutputGroup, len(groups))
+	for gi, g := range groups {
+		result[gi] = *g
+	}
+	return result
+}
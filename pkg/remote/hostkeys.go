@@ -0,0 +1,219 @@
+package remote
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/complyue/different-hpc/pkg/ccm"
+	"github.com/complyue/hbi/pkg/errors"
+	"github.com/golang/glog"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// host key of a node, as fetched by it at boot
+type HostKey struct {
+	// openssh format private key
+	PrivateKey string
+	// authorized_keys format public key
+	PublicKey string
+}
+
+type hostKeyToken struct {
+	token   string
+	expires time.Time
+}
+
+var (
+	// one-time tokens for nodes to fetch their host keys, by mac
+	hostKeyTokens      = make(map[string]hostKeyToken)
+	hostKeyTokensMutex sync.Mutex
+
+	// serializes generation of host keys
+	hostKeyGenMutex sync.Mutex
+)
+
+// file of the host key of a node, empty if host keys disabled
+func hostKeyFile(mac string) string {
+	dir := GetRemoteCfg().HostKeysDir
+	if len(dir) <= 0 {
+		return ""
+	}
+	return filepath.Join(dir, strings.Replace(mac, ":", "-", -1))
+}
+
+// host key of a node, generated if not existing yet
+func ensureHostKey(mac string) (string, error) {
+	keyFile := hostKeyFile(mac)
+	if len(keyFile) <= 0 {
+		return "", errors.New("host keys disabled")
+	}
+
+	hostKeyGenMutex.Lock()
+	defer hostKeyGenMutex.Unlock()
+
+	if _, err := os.Stat(keyFile); err == nil {
+		return keyFile, nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	if err := writeKeyPair(keyFile, "dhpc host key of "+mac); err != nil {
+		return "", err
+	}
+	glog.Infof("Generated ssh host key [%s] for mac=[%s].", keyFile, mac)
+	return keyFile, nil
+}
+
+// public host key generated for a node, nil if none
+func HostPublicKey(mac string) (ssh.PublicKey, error) {
+	keyFile := hostKeyFile(mac)
+	if len(keyFile) <= 0 {
+		return nil, nil
+	}
+	pubData, err := ioutil.ReadFile(keyFile + ".pub")
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(pubData)
+	if err != nil {
+		return nil, errors.Wrapf(err, "bad host key [%s.pub]", keyFile)
+	}
+	return pub, nil
+}
+
+// issue a one-time token for a node to fetch its host key with, the host key
+// is generated if not existing yet. empty token without error if host keys
+// disabled. a token issued earlier for the node is invalidated.
+func IssueHostKeyToken(mac string) (string, error) {
+	rc := GetRemoteCfg()
+	if len(rc.HostKeysDir) <= 0 {
+		return "", nil
+	}
+	if _, err := ensureHostKey(mac); err != nil {
+		return "", err
+	}
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+
+	hostKeyTokensMutex.Lock()
+	defer hostKeyTokensMutex.Unlock()
+
+	now := time.Now()
+	for m, t := range hostKeyTokens {
+		if now.After(t.expires) {
+			delete(hostKeyTokens, m)
+		}
+	}
+	hostKeyTokens[mac] = hostKeyToken{token: token, expires: now.Add(rc.HostKeyTokenTTL)}
+	return token, nil
+}
+
+// host key of a node, requested from the source ip, which must be the ip of
+// the node if it has one configured. the token is consumed only when it
+// matches, so a wrong guess doesn't stop the node from fetching its key
+func TakeHostKey(mac, token, sourceIP string) (*HostKey, error) {
+	if cfg := ccm.GetComputeNodeCfg(mac); cfg != nil {
+		if ip, _ := cfg.Inflate()["ip"].(string); len(ip) > 0 && ip != sourceIP {
+			return nil, errors.Errorf("host key of mac=[%s] requested from [%s] other than its ip [%s]",
+				mac, sourceIP, ip)
+		}
+	}
+
+	if err := func() error {
+		hostKeyTokensMutex.Lock()
+		defer hostKeyTokensMutex.Unlock()
+
+		t, ok := hostKeyTokens[mac]
+		if !ok || time.Now().After(t.expires) {
+			delete(hostKeyTokens, mac)
+			return errors.Errorf("no valid host key token for mac=[%s], reboot it to get one", mac)
+		}
+		if len(token) <= 0 || subtle.ConstantTimeCompare([]byte(token), []byte(t.token)) != 1 {
+			return errors.Errorf("wrong host key token for mac=[%s]", mac)
+		}
+		delete(hostKeyTokens, mac)
+		return nil
+	}(); err != nil {
+		return nil, err
+	}
+
+	keyFile := hostKeyFile(mac)
+	if len(keyFile) <= 0 {
+		return nil, errors.New("host keys disabled")
+	}
+	privData, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	pubData, err := ioutil.ReadFile(keyFile + ".pub")
+	if err != nil {
+		return nil, err
+	}
+	return &HostKey{PrivateKey: string(privData), PublicKey: string(pubData)}, nil
+}
+
+// known_hosts lines of all nodes with host keys generated, by hostname and ip
+func KnownHosts() ([]byte, error) {
+	cfgs := ccm.GetComputeNodeCfgs()
+	sort.Slice(cfgs, func(i, j int) bool {
+		return cfgs[i].Mac < cfgs[j].Mac
+	})
+	var out []byte
+	for i := range cfgs {
+		cfg := &cfgs[i]
+		pub, err := HostPublicKey(cfg.Mac)
+		if err != nil {
+			glog.Warningf("Error reading host key of mac=[%s]: %v", cfg.Mac, err)
+			continue
+		}
+		if pub == nil {
+			continue
+		}
+		cfgd, err := cfg.InflateE()
+		if err != nil {
+			continue
+		}
+		var names []string
+		if host, _ := cfgd["hostname"].(string); len(host) > 0 {
+			names = append(names, host)
+		}
+		if ip, _ := cfgd["ip"].(string); len(ip) > 0 {
+			names = append(names, ip)
+		}
+		if addr, err := sshAddr(cfgd); err == nil {
+			// as ssh looks it up, [host]:port with a non-standard port
+			if name := knownhosts.Normalize(addr); !containsStr(names, name) {
+				names = append(names, name)
+			}
+		}
+		if len(names) <= 0 {
+			continue
+		}
+		out = append(out, knownhosts.Line(names, pub)...)
+		out = append(out, '\n')
+	}
+	return out, nil
+}
+
+func containsStr(strs []string, s string) bool {
+	for _, e := range strs {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
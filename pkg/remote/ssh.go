@@ -0,0 +1,203 @@
+package remote
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/complyue/different-hpc/pkg/ccm"
+	"github.com/complyue/hbi/pkg/errors"
+	"github.com/golang/glog"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var (
+	signer        ssh.Signer
+	signerKeyFile string
+	signerMutex   sync.Mutex
+)
+
+// generate an ed25519 key pair into keyFile and keyFile.pub
+func writeKeyPair(keyFile, comment string) error {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	block, err := ssh.MarshalPrivateKey(priv, comment)
+	if err != nil {
+		return err
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(keyFile), 0700); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(block), 0600); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(keyFile+".pub", ssh.MarshalAuthorizedKey(sshPub), 0644); err != nil {
+		return err
+	}
+	return nil
+}
+
+// generate an ed25519 key pair as the control center key
+func generateKey(keyFile string) error {
+	if err := writeKeyPair(keyFile, "dhpc control center"); err != nil {
+		return err
+	}
+	glog.Infof("Generated control center ssh key [%s], authorize [%s.pub] on nodes.", keyFile, keyFile)
+	return nil
+}
+
+// the control center key, loaded from keyFile, generated if not existing
+func getSigner() (ssh.Signer, error) {
+	keyFile := GetRemoteCfg().KeyFile
+
+	signerMutex.Lock()
+	defer signerMutex.Unlock()
+
+	if signer != nil && signerKeyFile == keyFile {
+		return signer, nil
+	}
+	keyPem, err := ioutil.ReadFile(keyFile)
+	if os.IsNotExist(err) {
+		if err = generateKey(keyFile); err != nil {
+			return nil, err
+		}
+		keyPem, err = ioutil.ReadFile(keyFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s, err := ssh.ParsePrivateKey(keyPem)
+	if err != nil {
+		return nil, errors.Wrapf(err, "bad ssh key [%s]", keyFile)
+	}
+	signer, signerKeyFile = s, keyFile
+	return signer, nil
+}
+
+// public key of the control center in authorized_keys format
+func PublicKey() (string, error) {
+	s, err := getSigner()
+	if err != nil {
+		return "", err
+	}
+	return string(ssh.MarshalAuthorizedKey(s.PublicKey())), nil
+}
+
+// verify host key of a node against the knownHosts file if configured, or
+// the host key generated for it, any host key is trusted otherwise
+func hostKeyCallback(mac string) (ssh.HostKeyCallback, error) {
+	knownHosts := GetRemoteCfg().KnownHosts
+	if len(knownHosts) > 0 {
+		return knownhosts.New(knownHosts)
+	}
+	hostKey, err := HostPublicKey(mac)
+	if err != nil {
+		return nil, err
+	}
+	if hostKey == nil {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+	return ssh.FixedHostKey(hostKey), nil
+}
+
+// address to ssh into a node, ssh_addr in its config, or its ip
+func sshAddr(cfgd map[string]interface{}) (string, error) {
+	if addr, ok := cfgd["ssh_addr"].(string); ok && len(addr) > 0 {
+		return addr, nil
+	}
+	ip, _ := cfgd["ip"].(string)
+	if len(ip) <= 0 {
+		return "", errors.New("no ip to ssh into")
+	}
+	return net.JoinHostPort(ip, strconv.Itoa(GetRemoteCfg().Port)), nil
+}
+
+// keys of the ssh agent the control center runs with, nil if none
+func agentClient() agent.ExtendedAgent {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if len(sock) <= 0 {
+		return nil
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		glog.Warningf("Error connecting ssh agent [%s]: %v", sock, err)
+		return nil
+	}
+	return agent.NewClient(conn)
+}
+
+// log into a node with the control center key
+func Dial(cfg *ccm.ComputeNodeCfg) (*ssh.Client, error) {
+	return DialAs(cfg, "", nil)
+}
+
+// log into a node as the specified user, or the configured one if empty,
+// with the control center key, and keys of the agent if not nil
+func DialAs(cfg *ccm.ComputeNodeCfg, user string, ag agent.Agent) (*ssh.Client, error) {
+	cfgd, err := cfg.InflateE()
+	if err != nil {
+		return nil, err
+	}
+	addr, err := sshAddr(cfgd)
+	if err != nil {
+		return nil, err
+	}
+	s, err := getSigner()
+	if err != nil {
+		return nil, err
+	}
+	hkcb, err := hostKeyCallback(cfg.Mac)
+	if err != nil {
+		return nil, err
+	}
+	rc := GetRemoteCfg()
+	if len(user) <= 0 {
+		user = rc.User
+	}
+	if len(user) <= 0 {
+		user = ccm.GetPulseCfg().SshUser
+	}
+	auths := []ssh.AuthMethod{ssh.PublicKeys(s)}
+	if ag != nil {
+		auths = append(auths, ssh.PublicKeysCallback(ag.Signers))
+	}
+	conn, err := net.DialTimeout("tcp", addr, rc.ConnectTimeout)
+	if err != nil {
+		return nil, err
+	}
+	// ssh.ClientConfig.Timeout only covers the tcp connect, the handshake
+	// could stall forever with a hung sshd
+	if err := conn.SetDeadline(time.Now().Add(rc.ConnectTimeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, &ssh.ClientConfig{
+		User:            user,
+		Auth:            auths,
+		HostKeyCallback: hkcb,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
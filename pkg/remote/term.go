@@ -0,0 +1,89 @@
+package remote
+
+import (
+	"io"
+
+	"github.com/complyue/different-hpc/pkg/ccm"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// an interactive shell on a node, with a pty
+type TermSession struct {
+	client  *ssh.Client
+	session *ssh.Session
+
+	stdin  io.WriteCloser
+	stdout io.Reader
+}
+
+// open a login shell on a node, as the specified user or the configured one
+// if empty
+func OpenTerm(cfg *ccm.ComputeNodeCfg, user string, cols, rows int) (*TermSession, error) {
+	var ag agent.ExtendedAgent
+	forwardAgent := GetRemoteCfg().ForwardAgent
+	if forwardAgent {
+		ag = agentClient()
+	}
+	client, err := DialAs(cfg, user, ag)
+	if err != nil {
+		return nil, err
+	}
+	ok := false
+	defer func() {
+		if !ok {
+			client.Close()
+		}
+	}()
+
+	if ag != nil {
+		if err := agent.ForwardToAgent(client, ag); err != nil {
+			return nil, err
+		}
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	if ag != nil {
+		if err := agent.RequestAgentForwarding(session); err != nil {
+			return nil, err
+		}
+	}
+	if err := session.RequestPty("xterm-256color", rows, cols, ssh.TerminalModes{
+		ssh.ECHO: 1,
+	}); err != nil {
+		return nil, err
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	// with a pty, stderr is merged into stdout by the remote side
+	if err := session.Shell(); err != nil {
+		return nil, err
+	}
+	ok = true
+	return &TermSession{client: client, session: session, stdin: stdin, stdout: stdout}, nil
+}
+
+func (t *TermSession) Read(p []byte) (int, error) {
+	return t.stdout.Read(p)
+}
+
+func (t *TermSession) Write(p []byte) (int, error) {
+	return t.stdin.Write(p)
+}
+
+func (t *TermSession) Resize(cols, rows int) error {
+	return t.session.WindowChange(rows, cols)
+}
+
+func (t *TermSession) Close() error {
+	t.session.Close()
+	return t.client.Close()
+}
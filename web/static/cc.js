@@ -39,6 +39,27 @@ function stopEditTextArea(ta) {
   tast.left = "";
 }
 
+// csrf token of the login session, to be presented with mutating requests
+const csrfMeta = document.querySelector('meta[name="csrf-token"]');
+const csrfToken = csrfMeta ? csrfMeta.content : "";
+
+// post a json request body, resolve to the json result
+async function postJson(url, body) {
+  const resp = await fetch(url, {
+    method: "POST",
+    body: JSON.stringify(body),
+    headers: {
+      "Content-Type": "application/json",
+      "X-CSRF-Token": csrfToken
+    }
+  });
+  if (!resp.ok) {
+    console.error("Request failure:", url, resp);
+    throw new Error("HTTP " + resp.status);
+  }
+  return await resp.json();
+}
+
 const cnodeTable = document.getElementById("cnode_tbl");
 
 // double click on textareas
@@ -52,8 +73,8 @@ cnodeTable.addEventListener("dblclick", function(evt) {
     return;
   }
 
-  if (ta.dataset.filename) {
-    // only start edit if has a filename with it
+  if (ta.dataset.mac) {
+    // only start edit if has a mac with it
 
     ta.dataset.preEdit = ta.value;
     ta.readOnly = false;
@@ -72,44 +93,228 @@ cnodeTable.addEventListener("dblclick", function(evt) {
   evt.stopImmediatePropagation();
 });
 
+// leave editing mode of a config textarea, with saved content if not canceled
+function finishEdit(cfe, ta, saved) {
+  if (saved) {
+    ta.dataset.etag = saved.etag;
+    ta.value = saved.rawYaml;
+  } else {
+    ta.value = ta.dataset.preEdit;
+  }
+  ta.readOnly = true;
+  stopEditTextArea(ta);
+  for (let btn of cfe.querySelectorAll("button")) {
+    btn.disabled = true;
+  }
+}
+
+const mergeDialog = document.getElementById("merge_dlg");
+
+// present conflicting concurrent edits side by side for manual resolution
+function resolveConflict(cfe, ta, conflict) {
+  const tbody = mergeDialog.querySelector("table.MergeConflicts > tbody");
+  tbody.innerHTML = "";
+  for (let c of conflict.keys) {
+    const tr = document.createElement("tr");
+    for (let v of [c.Key, c.Base, c.Current, c.Mine]) {
+      const td = document.createElement("td");
+      td.textContent = v;
+      tr.appendChild(td);
+    }
+    tbody.appendChild(tr);
+  }
+  mergeDialog.querySelector("textarea[data-pane=current]").value =
+    conflict.current;
+  mergeDialog.querySelector("textarea[data-pane=mine]").value = conflict.mine;
+  mergeDialog.querySelector("textarea[data-pane=merged]").value =
+    conflict.merged;
+
+  mergeDialog.onclick = async function(evt) {
+    const btn = evt.target;
+    if ("BUTTON" != btn.tagName) {
+      return;
+    }
+    switch (btn.dataset.act) {
+      case "save-merged":
+        try {
+          const result = await postJson("/cnode/v1/save", {
+            Mac: ta.dataset.mac,
+            AfterEdit: mergeDialog.querySelector("textarea[data-pane=merged]")
+              .value,
+            PreEdit: conflict.current,
+            ETag: conflict.etag
+          });
+          if (result.conflict) {
+            // changed yet again
+            resolveConflict(cfe, ta, result.conflict);
+            return;
+          }
+          if (result.err) {
+            console.error("Failed saving merged config:", result);
+            alert(result.err);
+            return;
+          }
+          mergeDialog.close();
+          finishEdit(cfe, ta, result);
+        } catch (err) {
+          console.error("Error saving merged config:", err);
+          alert("Failed saving merged config: " + err);
+        }
+        break;
+      case "discard-mine":
+        mergeDialog.close();
+        finishEdit(cfe, ta, { etag: conflict.etag, rawYaml: conflict.current });
+        break;
+      case "close":
+        mergeDialog.close();
+        break;
+    }
+  };
+  mergeDialog.showModal();
+}
+
+const bootPreviewDialog = document.getElementById("boot_preview_dlg");
+bootPreviewDialog.addEventListener("click", function(evt) {
+  if ("close" === evt.target.dataset.act) {
+    bootPreviewDialog.close();
+  }
+});
+
+// show what a node would be responded to boot with, nothing changed
+async function showBootPreview(mac, probe) {
+  let result;
+  try {
+    const resp = await fetch(
+      "/pixie/v1/preview/" + encodeURIComponent(mac) + (probe ? "?probe=1" : "")
+    );
+    if (!resp.ok) {
+      throw new Error("HTTP " + resp.status);
+    }
+    result = await resp.json();
+  } catch (err) {
+    console.error("Error previewing boot:", err);
+    alert("Failed previewing boot: " + err);
+    return;
+  }
+  const field = name =>
+    bootPreviewDialog.querySelector("[data-field=" + name + "]");
+  field("mac").textContent = result.mac || mac;
+  let summary = "";
+  if (result.ip) {
+    summary = result.new
+      ? "New node, would be assigned ip " + result.ip
+      : "Known node with ip " + result.ip;
+    if (result.reclaimFrom && result.reclaimFrom.length > 0) {
+      summary +=
+        ", reclaimed from " +
+        result.reclaimFrom.join(", ") +
+        " whose config would be archived";
+    }
+  }
+  field("summary").textContent = summary;
+  field("err").textContent = result.err || "";
+  field("boot").textContent = result.boot
+    ? JSON.stringify(result.boot, null, 2)
+    : "";
+  field("rawYaml").textContent = result.rawYaml || "";
+  bootPreviewDialog.showModal();
+}
+
+const bootPreview = document.getElementById("boot_preview");
+bootPreview.addEventListener("click", function(evt) {
+  if ("boot-preview" !== evt.target.dataset.act) {
+    return;
+  }
+  const mac = bootPreview.querySelector("input[name=mac]").value.trim();
+  if (!mac) {
+    alert("MAC is required.");
+    return;
+  }
+  showBootPreview(mac, bootPreview.querySelector("input[name=probe]").checked);
+});
+
+// query power status through the node's BMC with an empty action,
+// or perform the action
+async function powerControl(btn) {
+  const ctl = btn.closest("span.PowerCtl");
+  const mac = ctl.dataset.mac;
+  const action = btn.dataset.action;
+  const statusBtn = ctl.querySelector("button[data-action='']");
+  if (
+    ("off" === action || "reset" === action) &&
+    !confirm("Power " + action + " node " + mac + " forcibly?")
+  ) {
+    return;
+  }
+  let result;
+  try {
+    if (action) {
+      result = await postJson(
+        "/cnode/v1/power/" + encodeURIComponent(mac),
+        { Action: action }
+      );
+    } else {
+      const resp = await fetch("/cnode/v1/power/" + encodeURIComponent(mac));
+      if (!resp.ok) {
+        throw new Error("HTTP " + resp.status);
+      }
+      result = await resp.json();
+    }
+  } catch (err) {
+    console.error("Error with power control:", err);
+    alert("Failed power control: " + err);
+    return;
+  }
+  if (result.err) {
+    alert(result.err);
+    return;
+  }
+  if (result.power) {
+    statusBtn.textContent = "Power: " + result.power;
+  } else {
+    statusBtn.textContent = "Power?";
+  }
+}
+
 // button click
 cnodeTable.addEventListener("click", async function(evt) {
   const btn = evt.target;
   if ("BUTTON" != btn.tagName) {
     return;
   }
+  if ("boot-preview" === btn.dataset.act) {
+    showBootPreview(btn.dataset.mac, false);
+    return;
+  }
+  if ("power" === btn.dataset.act) {
+    powerControl(btn);
+    return;
+  }
   const cfe = btn.closest("div.ConfigFileEdit");
   switch (btn.dataset.act) {
     case "save":
       for (let ta of cfe.querySelectorAll("textarea")) {
         try {
-          const resp = await fetch("/cnode/v1/save", {
-            method: "POST",
-            body: JSON.stringify({
-              FileName: ta.dataset.filename,
-              AfterEdit: ta.value,
-              PreEdit: ta.dataset.preEdit
-            }),
-            headers: {
-              "Content-Type": "application/json"
-            }
+          const result = await postJson("/cnode/v1/save", {
+            Mac: ta.dataset.mac,
+            AfterEdit: ta.value,
+            PreEdit: ta.dataset.preEdit,
+            ETag: ta.dataset.etag
           });
-          if (!resp.ok) {
-            console.error("Config save failure:", resp);
-            alert("Failed saving config: " + resp.status);
+          if (result.conflict) {
+            console.warn("Conflicting edits:", result);
+            resolveConflict(cfe, ta, result.conflict);
             return;
           }
-          const result = await resp.json();
           if (result.err) {
             console.error("Failed saving config:", result);
             alert(result.err);
             return;
           }
-          ta.readOnly = true;
-          stopEditTextArea(ta);
-          for (let btn of cfe.querySelectorAll("button")) {
-            btn.disabled = true;
+          if (result.merged) {
+            alert("Config had been changed by others, edits merged.");
           }
+          finishEdit(cfe, ta, result);
         } catch (err) {
           console.error("Error saving config:", err);
           alert("Failed saving config: " + err);
@@ -118,15 +323,988 @@ cnodeTable.addEventListener("click", async function(evt) {
       break;
     case "cancel":
       for (let ta of cfe.querySelectorAll("textarea")) {
-        ta.readOnly = true;
-        ta.value = ta.dataset.preEdit;
-        stopEditTextArea(ta);
-      }
-      for (let btn of cfe.querySelectorAll("button")) {
-        btn.disabled = true;
+        finishEdit(cfe, ta, null);
       }
       break;
     default:
       console.warn("Unknown button action:", btn.dataset.act, btn);
   }
 });
+
+// check/uncheck all nodes
+cnodeTable.addEventListener("change", function(evt) {
+  const cb = evt.target;
+  if ("check-all" !== cb.dataset.act) {
+    return;
+  }
+  for (let nc of cnodeTable.querySelectorAll("input.NodeCheck")) {
+    nc.checked = cb.checked;
+  }
+});
+
+const bulkEdit = document.getElementById("bulk_edit");
+const bulkOps = [];
+let bulkPreviewed = null;
+
+function bulkSelection() {
+  const macs = [];
+  for (let nc of cnodeTable.querySelectorAll("input.NodeCheck:checked")) {
+    macs.push(nc.value);
+  }
+  return {
+    Macs: macs,
+    Filter: bulkEdit.querySelector("input[name=filter]").value,
+    Group: bulkEdit.querySelector("input[name=group]").value,
+    Stale: bulkEdit.querySelector("input[name=stale]").checked
+  };
+}
+
+// time of day from a json time, empty for zero time
+function fmtTime(t) {
+  return t && !t.startsWith("0001-") ? new Date(t).toLocaleTimeString() : "";
+}
+
+// a table with header and rows of text cells
+function textTable(headers, rows) {
+  const tbl = document.createElement("table");
+  const thead = document.createElement("thead");
+  const htr = document.createElement("tr");
+  for (let h of headers) {
+    const th = document.createElement("th");
+    th.textContent = h;
+    htr.appendChild(th);
+  }
+  thead.appendChild(htr);
+  tbl.appendChild(thead);
+  const tbody = document.createElement("tbody");
+  for (let row of rows) {
+    const tr = document.createElement("tr");
+    for (let text of row) {
+      const td = document.createElement("td");
+      td.textContent = text;
+      tr.appendChild(td);
+    }
+    tbody.appendChild(tr);
+  }
+  tbl.appendChild(tbody);
+  return tbl;
+}
+
+const wakeNodes = document.getElementById("wake_nodes");
+let wakePolling = null;
+
+function renderWakeJobs(jobs) {
+  const div = wakeNodes.querySelector("div.WakeJobs");
+  div.innerHTML = "";
+  for (let job of jobs) {
+    const h = document.createElement("h6");
+    h.textContent =
+      "#" +
+      job.ID +
+      " started " +
+      new Date(job.Started).toLocaleString() +
+      (job.Done ? ", done" : ", watching ...");
+    div.appendChild(h);
+    div.appendChild(
+      textTable(
+        ["Host", "IP/MAC", "State", "Sent", "Booted", "Alive"],
+        job.Nodes.map(node => [
+          node.Host,
+          node.IP + " " + node.Mac,
+          node.Err ? node.State + ": " + node.Err : node.State,
+          fmtTime(node.SentAt),
+          fmtTime(node.BootedAt),
+          fmtTime(node.AliveAt)
+        ])
+      )
+    );
+  }
+}
+
+// refresh wake jobs, and keep polling while any of them is in progress
+async function pollWakeJobs() {
+  wakePolling = null;
+  let result;
+  try {
+    const resp = await fetch("/cnode/v1/wake");
+    if (!resp.ok) {
+      throw new Error("HTTP " + resp.status);
+    }
+    result = await resp.json();
+  } catch (err) {
+    console.error("Error listing wake jobs:", err);
+    return;
+  }
+  const jobs = result.jobs || [];
+  renderWakeJobs(jobs);
+  if (jobs.some(job => !job.Done)) {
+    wakePolling = setTimeout(pollWakeJobs, 5000);
+  }
+}
+
+wakeNodes.addEventListener("click", async function(evt) {
+  if ("wake" !== evt.target.dataset.act) {
+    return;
+  }
+  try {
+    const result = await postJson("/cnode/v1/wake", {
+      Selection: bulkSelection()
+    });
+    if (result.err) {
+      alert(result.err);
+      return;
+    }
+  } catch (err) {
+    console.error("Error waking nodes:", err);
+    alert("Failed waking nodes: " + err);
+    return;
+  }
+  if (wakePolling) {
+    clearTimeout(wakePolling);
+  }
+  pollWakeJobs();
+});
+
+pollWakeJobs();
+
+const drift = document.getElementById("drift");
+let driftMacs = [];
+
+async function loadDrift() {
+  let result;
+  try {
+    result = await getJson("/cnode/v1/drift");
+  } catch (err) {
+    console.error("Error listing drifted nodes:", err);
+    return;
+  }
+  const nodes = result.nodes || [];
+  driftMacs = nodes.map(node => node.Mac);
+  const div = drift.querySelector("div.DriftNodes");
+  div.innerHTML = "";
+  div.appendChild(
+    textTable(
+      ["Host", "IP/MAC", "State", "Last Boot", "Reasons"],
+      nodes.map(node => [
+        node.Host,
+        node.IP + " " + node.Mac,
+        [
+          node.PendingReboot ? "pending reboot" : "",
+          node.Drifted ? "drifted" : ""
+        ]
+          .filter(s => s)
+          .join(", "),
+        node.LastBoot ? new Date(node.LastBoot.Time).toLocaleString() : "",
+        (node.Reasons || []).join("; ")
+      ])
+    )
+  );
+}
+
+drift.addEventListener("click", function(evt) {
+  if ("select" !== evt.target.dataset.act) {
+    return;
+  }
+  for (let nc of cnodeTable.querySelectorAll("input.NodeCheck")) {
+    nc.checked = driftMacs.includes(nc.value);
+  }
+  invalidateBulkPreview();
+});
+
+loadDrift();
+
+const rollout = document.getElementById("rollout");
+let rolloutPolling = null;
+
+function renderRollouts(rollouts) {
+  const div = rollout.querySelector("div.Rollouts");
+  div.innerHTML = "";
+  for (let ro of rollouts) {
+    const h = document.createElement("h6");
+    h.textContent =
+      "#" +
+      ro.ID +
+      " started " +
+      new Date(ro.Started).toLocaleString() +
+      ", wave " +
+      ro.Wave +
+      "/" +
+      ro.Waves +
+      ", " +
+      ro.State +
+      (ro.Reason ? ": " + ro.Reason : "");
+    div.appendChild(h);
+    const acts = [];
+    if ("running" === ro.State) {
+      acts.push("pause", "abort");
+    } else if ("paused" === ro.State) {
+      acts.push("resume", "abort");
+    }
+    for (let act of acts) {
+      const btn = document.createElement("button");
+      btn.textContent = act;
+      btn.dataset.act = "control";
+      btn.dataset.control = act;
+      btn.dataset.id = ro.ID;
+      div.appendChild(btn);
+    }
+    div.appendChild(
+      textTable(
+        ["Wave", "Host", "IP/MAC", "State", "Rebooted", "Booted", "Healthy"],
+        ro.Nodes.map(node => [
+          node.Wave,
+          node.Host,
+          node.IP + " " + node.Mac,
+          node.Err ? node.State + ": " + node.Err : node.State,
+          fmtTime(node.RebootAt),
+          fmtTime(node.BootedAt),
+          fmtTime(node.HealthyAt)
+        ])
+      )
+    );
+  }
+}
+
+// refresh rollouts, and keep polling while any of them is in progress
+async function pollRollouts() {
+  if (rolloutPolling) {
+    clearTimeout(rolloutPolling);
+  }
+  rolloutPolling = null;
+  let result;
+  try {
+    const resp = await fetch("/cnode/v1/rollout");
+    if (!resp.ok) {
+      throw new Error("HTTP " + resp.status);
+    }
+    result = await resp.json();
+  } catch (err) {
+    console.error("Error listing rollouts:", err);
+    return;
+  }
+  const rollouts = result.rollouts || [];
+  renderRollouts(rollouts);
+  if (rollouts.some(ro => "running" === ro.State || "paused" === ro.State)) {
+    rolloutPolling = setTimeout(pollRollouts, 5000);
+  }
+}
+
+rollout.addEventListener("click", async function(evt) {
+  const btn = evt.target;
+  let result;
+  try {
+    switch (btn.dataset.act) {
+      case "start": {
+        const input = name => rollout.querySelector("input[name=" + name + "]");
+        if (!confirm("Reboot selected nodes in waves?")) {
+          return;
+        }
+        result = await postJson("/cnode/v1/rollout", {
+          Selection: bulkSelection(),
+          Concurrency: parseInt(input("concurrency").value),
+          HealthTimeout: input("healthTimeout").value,
+          MaxFailures: parseInt(input("maxFailures").value) || 0,
+          AbortOnFailure: input("abortOnFailure").checked,
+          Pxe: input("pxe").checked
+        });
+        break;
+      }
+      case "control":
+        result = await postJson("/cnode/v1/rollout/control", {
+          ID: parseInt(btn.dataset.id),
+          Act: btn.dataset.control
+        });
+        break;
+      default:
+        return;
+    }
+  } catch (err) {
+    console.error("Error with rollout:", err);
+    alert("Failed with rollout: " + err);
+    return;
+  }
+  if (result.err) {
+    alert(result.err);
+  }
+  pollRollouts();
+});
+
+pollRollouts();
+
+const remoteExec = document.getElementById("remote_exec");
+
+async function getJson(url) {
+  const resp = await fetch(url);
+  if (!resp.ok) {
+    throw new Error("HTTP " + resp.status);
+  }
+  return await resp.json();
+}
+
+async function loadExecRuns() {
+  let result;
+  try {
+    result = await getJson("/cnode/v1/exec");
+  } catch (err) {
+    console.error("Error listing command runs:", err);
+    return;
+  }
+  remoteExec.querySelector("pre.PubKey").textContent =
+    result.pubKey || result.err || "";
+  const ul = remoteExec.querySelector("ul.ExecRuns");
+  ul.innerHTML = "";
+  for (let run of result.runs || []) {
+    const li = document.createElement("li");
+    const a = document.createElement("a");
+    a.href = "#";
+    a.dataset.act = "view";
+    a.dataset.id = run.ID;
+    a.textContent = "#" + run.ID + " " + run.Command;
+    li.appendChild(a);
+    li.appendChild(
+      document.createTextNode(
+        " " +
+          new Date(run.Started).toLocaleString() +
+          ", " +
+          run.Nodes +
+          " nodes" +
+          (run.Done ? ", " + run.Failed + " failed" : ", running")
+      )
+    );
+    ul.appendChild(li);
+  }
+}
+
+// show outputs of a run grouped by identical ones, dshbak style
+async function showExecRun(id) {
+  let result;
+  try {
+    result = await getJson("/cnode/v1/exec/" + id);
+  } catch (err) {
+    console.error("Error viewing command run:", err);
+    alert("Failed viewing command run: " + err);
+    return;
+  }
+  const pre = remoteExec.querySelector("pre.ExecGroups");
+  if (result.err) {
+    pre.textContent = result.err;
+    return;
+  }
+  let text = "#" + result.run.ID + " $ " + result.run.Command + "\n";
+  for (let g of result.groups || []) {
+    const head =
+      g.Hosts.join(",") +
+      " (" +
+      g.State +
+      ", exit " +
+      g.Exit +
+      (g.Err ? ": " + g.Err : "") +
+      ")";
+    const rule = "-".repeat(Math.min(head.length, 78));
+    text += rule + "\n" + head + "\n" + rule + "\n" + g.Stdout;
+    if (g.Stderr) {
+      text += "[stderr]\n" + g.Stderr;
+    }
+  }
+  pre.textContent = text;
+}
+
+// follow output of a run as it comes, lines prefixed by host like pdsh
+async function watchExecRun(id) {
+  const pre = remoteExec.querySelector("pre.ExecLive");
+  pre.textContent = "";
+  remoteExec.querySelector("pre.ExecGroups").textContent = "";
+  const partial = {};
+  let since = 0;
+  for (;;) {
+    let result;
+    try {
+      result = await getJson(
+        "/cnode/v1/exec/" + id + "/events?since=" + since
+      );
+    } catch (err) {
+      console.error("Error watching command run:", err);
+      break;
+    }
+    for (let ev of result.events || []) {
+      since = ev.Seq + 1;
+      const host = ev.Host || ev.Mac;
+      const key = ev.Mac + ev.Kind;
+      if ("end" === ev.Kind) {
+        for (let kind of ["stdout", "stderr"]) {
+          if (partial[ev.Mac + kind]) {
+            pre.textContent += host + ": " + partial[ev.Mac + kind] + "\n";
+            delete partial[ev.Mac + kind];
+          }
+        }
+        pre.textContent += host + ": [" + ev.Data + "]\n";
+        continue;
+      }
+      const lines = ((partial[key] || "") + ev.Data).split("\n");
+      partial[key] = lines.pop();
+      for (let line of lines) {
+        pre.textContent += host + ": " + line + "\n";
+      }
+    }
+    if (result.next) {
+      since = result.next;
+    }
+    pre.scrollTop = pre.scrollHeight;
+    if (result.done || result.err) {
+      break;
+    }
+  }
+  await showExecRun(id);
+  loadExecRuns();
+}
+
+remoteExec.addEventListener("click", async function(evt) {
+  const btn = evt.target;
+  switch (btn.dataset.act) {
+    case "run": {
+      const input = name =>
+        remoteExec.querySelector("input[name=" + name + "]");
+      let result;
+      try {
+        result = await postJson("/cnode/v1/exec", {
+          Selection: bulkSelection(),
+          Command: input("command").value,
+          Timeout: input("timeout").value
+        });
+      } catch (err) {
+        console.error("Error running command:", err);
+        alert("Failed running command: " + err);
+        return;
+      }
+      if (result.err) {
+        alert(result.err);
+        return;
+      }
+      loadExecRuns();
+      watchExecRun(result.run.ID);
+      break;
+    }
+    case "view":
+      evt.preventDefault();
+      remoteExec.querySelector("pre.ExecLive").textContent = "";
+      showExecRun(btn.dataset.id);
+      break;
+  }
+});
+
+loadExecRuns();
+
+const inventory = document.getElementById("inventory");
+
+function fmtBytes(n) {
+  const units = ["B", "KiB", "MiB", "GiB", "TiB", "PiB"];
+  let i = 0;
+  for (; n >= 1024 && i < units.length - 1; i++) {
+    n /= 1024;
+  }
+  return (i > 0 ? n.toFixed(1) : n) + units[i];
+}
+
+async function searchInventory() {
+  const q = inventory.querySelector("input[name=q]").value;
+  const div = inventory.querySelector("div.InventoryResults");
+  let result;
+  try {
+    result = await getJson("/cnode/v1/inventory?q=" + encodeURIComponent(q));
+  } catch (err) {
+    console.error("Error searching inventory:", err);
+    alert("Failed searching inventory: " + err);
+    return;
+  }
+  div.innerHTML = "";
+  if (result.err) {
+    div.textContent = result.err;
+    return;
+  }
+  const nodes = result.nodes || [];
+  const h = document.createElement("h6");
+  h.textContent = nodes.length + " nodes";
+  div.appendChild(h);
+  div.appendChild(
+    textTable(
+      ["Host", "IP/MAC", "CPU", "Memory", "Disks", "NICs", "Kernel"],
+      nodes.map(node => {
+        const inv = node.Inventory;
+        return [
+          node.Host,
+          node.IP + " " + node.Mac,
+          inv.CPUModel + " x " + inv.CPUCores,
+          fmtBytes(inv.MemTotal),
+          (inv.Disks || [])
+            .map(d => d.Name + " " + fmtBytes(d.Size) + " " + d.Model)
+            .join(", "),
+          (inv.NICs || [])
+            .map(
+              n =>
+                n.Name + " " + n.Driver + (n.Speed ? " " + n.Speed + "Mbps" : "")
+            )
+            .join(", "),
+          inv.Kernel
+        ];
+      })
+    )
+  );
+}
+
+async function loadInventoryAlerts() {
+  let result;
+  try {
+    result = await getJson("/cnode/v1/inventory/alerts");
+  } catch (err) {
+    console.error("Error listing inventory alerts:", err);
+    return;
+  }
+  const ul = inventory.querySelector("ul.InventoryAlerts");
+  ul.innerHTML = "";
+  for (let a of result.alerts || []) {
+    const li = document.createElement("li");
+    li.textContent =
+      new Date(a.Time).toLocaleString() +
+      " " +
+      a.IP +
+      " " +
+      a.Mac +
+      ": " +
+      a.Changes.join("; ") +
+      " ";
+    const btn = document.createElement("button");
+    btn.dataset.act = "ack";
+    btn.dataset.mac = a.Mac;
+    btn.textContent = "Ack";
+    li.appendChild(btn);
+    ul.appendChild(li);
+  }
+}
+
+inventory.addEventListener("click", async function(evt) {
+  const btn = evt.target;
+  switch (btn.dataset.act) {
+    case "search":
+      searchInventory();
+      break;
+    case "ack": {
+      let result;
+      try {
+        result = await postJson("/cnode/v1/inventory/alerts/ack", {
+          Mac: btn.dataset.mac
+        });
+      } catch (err) {
+        console.error("Error acknowledging inventory alerts:", err);
+        alert("Failed acknowledging inventory alerts: " + err);
+        return;
+      }
+      if (result.err) {
+        alert(result.err);
+      }
+      loadInventoryAlerts();
+      break;
+    }
+  }
+});
+
+inventory.addEventListener("keydown", function(evt) {
+  if ("Enter" === evt.key && "q" === evt.target.name) {
+    searchInventory();
+  }
+});
+
+loadInventoryAlerts();
+
+function renderBulkOps() {
+  const ol = bulkEdit.querySelector("ol.BulkOps");
+  ol.innerHTML = "";
+  bulkOps.forEach((op, i) => {
+    const li = document.createElement("li");
+    let desc = op.Op + " " + op.Key;
+    if ("set" === op.Op || "append" === op.Op) {
+      desc += " " + op.Value;
+    } else if ("replace" === op.Op) {
+      desc += " s/" + op.Pattern + "/" + op.Replacement + "/";
+    }
+    li.textContent = desc;
+    const btn = document.createElement("button");
+    btn.dataset.act = "remove-op";
+    btn.dataset.idx = i;
+    btn.innerHTML = "&#x2718;";
+    li.appendChild(btn);
+    ol.appendChild(li);
+  });
+}
+
+// any change to selection or ops invalidates the preview
+function invalidateBulkPreview() {
+  bulkPreviewed = null;
+  bulkEdit.querySelector("button[data-act=apply]").disabled = true;
+}
+bulkEdit.addEventListener("input", invalidateBulkPreview);
+cnodeTable.addEventListener("change", invalidateBulkPreview);
+
+function renderBulkPreview(previews) {
+  const div = bulkEdit.querySelector("div.BulkPreview");
+  div.innerHTML = "";
+  for (let pv of previews) {
+    const h = document.createElement("h6");
+    h.textContent = pv.Host + " " + pv.IP + " " + pv.Mac;
+    div.appendChild(h);
+    if (pv.Err) {
+      const p = document.createElement("p");
+      p.className = "err";
+      p.textContent = pv.Err;
+      div.appendChild(p);
+      continue;
+    }
+    if (!pv.RawDiff) {
+      const p = document.createElement("p");
+      p.textContent = "(no change)";
+      div.appendChild(p);
+      continue;
+    }
+    for (let [title, diff] of [
+      ["raw", pv.RawDiff],
+      ["inflated", pv.InflatedDiff]
+    ]) {
+      const pre = document.createElement("pre");
+      pre.className = "Diff";
+      pre.dataset.title = title;
+      pre.textContent = diff || "(no change)";
+      div.appendChild(pre);
+    }
+  }
+}
+
+bulkEdit.addEventListener("click", async function(evt) {
+  const btn = evt.target;
+  if ("BUTTON" != btn.tagName) {
+    return;
+  }
+  switch (btn.dataset.act) {
+    case "add-op":
+      const op = {};
+      for (let f of ["op", "key", "value", "pattern", "replacement"]) {
+        op[f.charAt(0).toUpperCase() + f.slice(1)] = bulkEdit.querySelector(
+          "[name=" + f + "]"
+        ).value;
+      }
+      if (!op.Key) {
+        alert("Key is required.");
+        return;
+      }
+      bulkOps.push(op);
+      renderBulkOps();
+      invalidateBulkPreview();
+      break;
+    case "remove-op":
+      bulkOps.splice(parseInt(btn.dataset.idx), 1);
+      renderBulkOps();
+      invalidateBulkPreview();
+      break;
+    case "preview":
+      try {
+        const req = { Selection: bulkSelection(), Ops: bulkOps };
+        const result = await postJson("/cnode/v1/bulk/preview", req);
+        if (result.err) {
+          alert(result.err);
+          return;
+        }
+        renderBulkPreview(result.previews);
+        const etags = {};
+        let hasErr = false;
+        for (let pv of result.previews) {
+          etags[pv.Mac] = pv.ETag;
+          hasErr = hasErr || !!pv.Err;
+        }
+        req.ETags = etags;
+        bulkPreviewed = req;
+        bulkEdit.querySelector("button[data-act=apply]").disabled =
+          hasErr || result.previews.length < 1;
+      } catch (err) {
+        console.error("Error previewing bulk edit:", err);
+        alert("Failed previewing: " + err);
+      }
+      break;
+    case "apply":
+      if (!bulkPreviewed) {
+        return;
+      }
+      if (
+        !confirm(
+          "Apply to " + Object.keys(bulkPreviewed.ETags).length + " nodes?"
+        )
+      ) {
+        return;
+      }
+      try {
+        const result = await postJson("/cnode/v1/bulk/apply", bulkPreviewed);
+        if (result.err) {
+          alert(result.err);
+          return;
+        }
+        location.reload();
+      } catch (err) {
+        console.error("Error applying bulk edit:", err);
+        alert("Failed applying: " + err);
+      }
+      break;
+  }
+});
+
+const archivedCfgs = document.getElementById("archived_cfgs");
+const archivedDialog = document.getElementById("archived_dlg");
+
+async function purgeArchived(ids) {
+  if (!confirm("Purge " + ids.length + " archived configs permanently?")) {
+    return false;
+  }
+  try {
+    const result = await postJson("/cnode/v1/archived/purge", { IDs: ids });
+    if (result.err) {
+      alert(result.err);
+    }
+  } catch (err) {
+    console.error("Error purging archived configs:", err);
+    alert("Failed purging: " + err);
+  }
+  return true;
+}
+
+// show an archived config with its diff against the active one
+async function viewArchived(id) {
+  let result;
+  try {
+    const resp = await fetch(
+      "/cnode/v1/archived/view?id=" + encodeURIComponent(id)
+    );
+    if (!resp.ok) {
+      throw new Error("HTTP " + resp.status);
+    }
+    result = await resp.json();
+  } catch (err) {
+    console.error("Error viewing archived config:", err);
+    alert("Failed viewing archived config: " + err);
+    return;
+  }
+  const field = name =>
+    archivedDialog.querySelector("[data-field=" + name + "]");
+  const ac = result.archived || {};
+  field("id").textContent = id;
+  field("summary").textContent = ac.Reason
+    ? ac.Reason + " of " + (ac.Mac || "unknown mac") + " at " + ac.Time
+    : "";
+  field("err").textContent = result.err || ac.Detail || "";
+  const diff = field("diff");
+  diff.dataset.title = result.against
+    ? "diff from active " + result.against
+    : "no active config";
+  diff.textContent = result.diff || "";
+  field("rawYaml").value = ac.RawYaml || "";
+
+  archivedDialog.onclick = async function(evt) {
+    const btn = evt.target;
+    if ("BUTTON" != btn.tagName) {
+      return;
+    }
+    switch (btn.dataset.act) {
+      case "restore":
+        try {
+          const result = await postJson("/cnode/v1/archived/restore", {
+            ID: id,
+            RawYaml: field("rawYaml").value
+          });
+          if (result.err) {
+            alert(result.err);
+            return;
+          }
+          location.reload();
+        } catch (err) {
+          console.error("Error restoring archived config:", err);
+          alert("Failed restoring: " + err);
+        }
+        break;
+      case "purge":
+        if (await purgeArchived([id])) {
+          location.reload();
+        }
+        break;
+      case "close":
+        archivedDialog.close();
+        break;
+    }
+  };
+  archivedDialog.showModal();
+}
+
+if (archivedCfgs) {
+  archivedCfgs.addEventListener("change", function(evt) {
+    if ("check-all" !== evt.target.dataset.act) {
+      return;
+    }
+    for (let cb of archivedCfgs.querySelectorAll("input.ArchivedCheck")) {
+      cb.checked = evt.target.checked;
+    }
+  });
+  archivedCfgs.addEventListener("click", async function(evt) {
+    const btn = evt.target;
+    if ("BUTTON" != btn.tagName) {
+      return;
+    }
+    switch (btn.dataset.act) {
+      case "view":
+        viewArchived(btn.dataset.id);
+        break;
+      case "purge":
+        const ids = [];
+        for (let cb of archivedCfgs.querySelectorAll(
+          "input.ArchivedCheck:checked"
+        )) {
+          ids.push(cb.value);
+        }
+        if (ids.length < 1) {
+          alert("No archived config checked.");
+          return;
+        }
+        if (await purgeArchived(ids)) {
+          location.reload();
+        }
+        break;
+    }
+  });
+}
+
+const cfgConflicts = document.getElementById("cfg_conflicts");
+if (cfgConflicts) {
+  cfgConflicts.addEventListener("click", async function(evt) {
+    const btn = evt.target;
+    if ("BUTTON" != btn.tagName) {
+      return;
+    }
+    let url, body;
+    switch (btn.dataset.act) {
+      case "archive":
+        if (!confirm("Archive config " + btn.dataset.file + " ?")) {
+          return;
+        }
+        url = "/cnode/v1/conflicts/archive";
+        body = { Mac: btn.dataset.mac, FileName: btn.dataset.file };
+        break;
+      case "reassign-ip":
+        if (!confirm("Assign a free IP to " + btn.dataset.mac + " ?")) {
+          return;
+        }
+        url = "/cnode/v1/conflicts/reassign-ip";
+        body = { Mac: btn.dataset.mac };
+        break;
+      default:
+        return;
+    }
+    try {
+      const result = await postJson(url, body);
+      if (result.err) {
+        alert(result.err);
+        return;
+      }
+      location.reload();
+    } catch (err) {
+      console.error("Error resolving conflict:", err);
+      alert("Failed resolving conflict: " + err);
+    }
+  });
+}
+
+const auditLog = document.getElementById("audit_log");
+if (auditLog) {
+  const auditQuery = function() {
+    const params = new URLSearchParams();
+    for (let input of auditLog.querySelectorAll("div.AuditFilter input")) {
+      if (input.value) {
+        params.set(input.name, input.value.trim());
+      }
+    }
+    return params.toString();
+  };
+
+  const queryAudit = async function() {
+    const div = auditLog.querySelector("div.AuditEntries");
+    let result;
+    try {
+      result = await getJson("/audit/v1/entries?" + auditQuery());
+    } catch (err) {
+      console.error("Error querying audit log:", err);
+      alert("Failed querying audit log: " + err);
+      return;
+    }
+    div.innerHTML = "";
+    if (result.err) {
+      div.textContent = result.err;
+      return;
+    }
+    div.appendChild(
+      textTable(
+        ["#", "Time", "Actor", "Source", "Action", "Node", "Detail", "Config"],
+        (result.entries || []).map(e => [
+          "" + e.Seq,
+          new Date(e.Time).toLocaleString(),
+          e.Actor,
+          e.Source || "",
+          e.Action,
+          ((e.IP || "") + " " + (e.Mac || "")).trim(),
+          e.Detail || "",
+          e.Before || e.After
+            ? (e.Before || "-") + " > " + (e.After || "-")
+            : ""
+        ])
+      )
+    );
+  };
+
+  auditLog.addEventListener("click", async function(evt) {
+    const btn = evt.target;
+    switch (btn.dataset.act) {
+      case "query":
+        queryAudit();
+        break;
+      case "export":
+        location.href = "/audit/v1/export?" + auditQuery();
+        break;
+      case "verify": {
+        const p = auditLog.querySelector("p.AuditVerification");
+        let result;
+        try {
+          result = await getJson("/audit/v1/verify");
+        } catch (err) {
+          console.error("Error verifying audit log:", err);
+          alert("Failed verifying audit log: " + err);
+          return;
+        }
+        if (result.err) {
+          p.textContent = result.err;
+          return;
+        }
+        const v = result.verification;
+        p.className = "AuditVerification" + (v.OK ? "" : " err");
+        p.textContent = v.OK
+          ? v.Entries + " entries verified, head #" + v.HeadSeq + " " + v.Head
+          : "Broken at line " +
+            v.BrokenLine +
+            ": " +
+            v.Problem +
+            ", " +
+            v.Entries +
+            " entries good before it";
+        break;
+      }
+    }
+  });
+
+  auditLog.addEventListener("keydown", function(evt) {
+    if ("Enter" === evt.key && "INPUT" === evt.target.tagName) {
+      queryAudit();
+    }
+  });
+
+  queryAudit();
+}
@@ -0,0 +1,53 @@
+// browser terminal to a node, over a websocket to an ssh session in dhpc-cc
+
+const termDiv = document.getElementById("term");
+const statusSpan = document.querySelector("span.TermStatus");
+
+if (termDiv) {
+  const term = new Terminal({ cursorBlink: true });
+  const fitAddon = new FitAddon.FitAddon();
+  term.loadAddon(fitAddon);
+  term.open(termDiv);
+  fitAddon.fit();
+
+  const wsUrl =
+    (location.protocol === "https:" ? "wss://" : "ws://") +
+    location.host +
+    "/term/v1/ws/" +
+    encodeURIComponent(termDiv.dataset.mac) +
+    "?cols=" +
+    term.cols +
+    "&rows=" +
+    term.rows;
+  const ws = new WebSocket(wsUrl);
+  ws.binaryType = "arraybuffer";
+
+  ws.onopen = function() {
+    statusSpan.textContent = "connected";
+    term.focus();
+  };
+  ws.onmessage = function(evt) {
+    term.write(new Uint8Array(evt.data));
+  };
+  ws.onclose = function(evt) {
+    statusSpan.textContent =
+      "disconnected" + (evt.reason ? ": " + evt.reason : "");
+  };
+
+  const encoder = new TextEncoder();
+  term.onData(function(data) {
+    if (ws.readyState === WebSocket.OPEN) {
+      ws.send(encoder.encode(data));
+    }
+  });
+  term.onResize(function(size) {
+    if (ws.readyState === WebSocket.OPEN) {
+      ws.send(
+        JSON.stringify({ Type: "resize", Cols: size.cols, Rows: size.rows })
+      );
+    }
+  });
+  window.addEventListener("resize", function() {
+    fitAddon.fit();
+  });
+}
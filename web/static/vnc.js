@@ -0,0 +1,43 @@
+// noVNC to a node's VNC server, over a websocket bridged to it by dhpc-cc
+
+import RFB from "https://cdn.jsdelivr.net/gh/novnc/noVNC@v1.4.0/core/rfb.js";
+
+const vncDiv = document.getElementById("vnc");
+const statusSpan = document.querySelector("span.VncStatus");
+const cadBtn = document.querySelector("button.VncCad");
+
+if (vncDiv) {
+  const wsUrl =
+    (location.protocol === "https:" ? "wss://" : "ws://") +
+    location.host +
+    "/gui/v1/vnc/" +
+    encodeURIComponent(vncDiv.dataset.mac);
+  const rfb = new RFB(vncDiv, wsUrl);
+  rfb.scaleViewport = true;
+
+  rfb.addEventListener("connect", function() {
+    statusSpan.textContent = "connected";
+    rfb.focus();
+  });
+  rfb.addEventListener("disconnect", function(evt) {
+    statusSpan.textContent = evt.detail.clean
+      ? "disconnected"
+      : "connection lost";
+  });
+  rfb.addEventListener("credentialsrequired", function() {
+    const password = prompt("VNC password:");
+    if (password === null) {
+      rfb.disconnect();
+      return;
+    }
+    rfb.sendCredentials({ password: password });
+  });
+  rfb.addEventListener("desktopname", function(evt) {
+    document.title = evt.detail.name;
+  });
+
+  cadBtn.onclick = function() {
+    rfb.sendCtrlAltDel();
+    rfb.focus();
+  };
+}